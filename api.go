@@ -22,7 +22,7 @@ func (handler APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     // Handle origin stuff, otherwise cross-domain frontend requests will fail
     if origin := r.Header.Get("Origin"); origin != "" {
         w.Header().Set("Access-Control-Allow-Origin", origin)
-        w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+        w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
         w.Header().Set("Access-Control-Allow-Headers",
             "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Session-Token")
     }
@@ -36,18 +36,49 @@ func (handler APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     }
 }
 
-func setupAPIHandlers() *mux.Router {
+// Handler given the user a wrapper (like limitRate) already authenticated the
+// request as, and whether it was
+type UserHandler func(w http.ResponseWriter, r *http.Request, user User, authenticated bool) int
+
+// API has everything the handlers need, so they don't rely on globals for it.
+type API struct {
+    store   Store
+}
+
+func newAPI(store Store) *API {
+    return &API{
+        store:  store,
+    }
+}
+
+func setupAPIHandlers(api *API) *mux.Router {
     router := mux.NewRouter().StrictSlash(true)
 
-    router.Handle("/friends", APIHandler(friendsHandler))
-    router.Handle("/friends/{friendId:[0-9]+}", APIHandler(friendHandler))
-    router.Handle("/friends/{friendId:[0-9]+}/messages", APIHandler(messagesHandler))
-    router.Handle("/users", APIHandler(usersHandler))
-    router.Handle("/me", APIHandler(meHandler))
-    router.Handle("/friendrequests", APIHandler(myFriendRequestsHandler))
-    router.Handle("/friendrequests/{requestorId:[0-9]+}", APIHandler(myFriendRequestHandler))
-    router.Handle("/users/{userId:[0-9]+}/friendrequests", APIHandler(othersFriendRequestHandler))
-    router.Handle("/nextMessage", APIHandler(nextMessageHandler))
+    router.Handle("/friends", APIHandler(api.friendsHandler))
+    router.Handle("/friends/{friendId:[0-9]+}", APIHandler(api.friendHandler))
+    router.Handle("/friends/{friendId:[0-9]+}/messages", api.limitRate(RateLimitMessages, "POST", api.messagesHandler))
+    router.Handle("/friends/{friendId:[0-9]+}/messages/read", APIHandler(api.readMessagesHandler))
+    router.Handle("/friends/{friendId:[0-9]+}/messages/{messageId:[0-9]+}", APIHandler(api.messageHandler))
+    router.Handle("/users", APIHandler(api.usersHandler))
+    router.Handle("/me", APIHandler(api.meHandler))
+    router.Handle("/me/sessions", APIHandler(api.mySessionsHandler))
+    router.Handle("/me/sessions/{sessionId:[0-9]+}", APIHandler(api.mySessionHandler))
+    router.Handle("/sessions", api.limitRate(RateLimitSessions, "POST", api.sessionsHandler))
+    router.Handle("/sessions/current", APIHandler(api.currentSessionHandler))
+    router.Handle("/bots", APIHandler(api.botsHandler))
+    router.Handle("/bots/{botId:[0-9]+}", APIHandler(api.botHandler))
+    router.Handle("/bots/{botId:[0-9]+}/keys", APIHandler(api.botKeysHandler))
+    router.Handle("/bots/{botId:[0-9]+}/keys/{keyId:[0-9]+}", APIHandler(api.botKeyHandler))
+    router.Handle("/friendrequests", APIHandler(api.myFriendRequestsHandler))
+    router.Handle("/friendrequests/{requestorId:[0-9]+}", APIHandler(api.myFriendRequestHandler))
+    router.Handle("/users/{userId:[0-9]+}/friendrequests", api.limitRate(RateLimitFriendRequests, "POST", api.othersFriendRequestHandler))
+    router.Handle("/groups", APIHandler(api.groupsHandler))
+    router.Handle("/groups/{groupId:[0-9]+}", APIHandler(api.groupHandler))
+    router.Handle("/groups/{groupId:[0-9]+}/members/{userId:[0-9]+}", APIHandler(api.groupMemberHandler))
+    router.Handle("/groups/{groupId:[0-9]+}/messages", api.limitRate(RateLimitMessages, "POST", api.groupMessagesHandler))
+    router.Handle("/nextMessage", APIHandler(api.nextMessageHandler))
+    router.Handle("/ws", APIHandler(api.webSocketHandler))
+    router.Handle("/events", APIHandler(api.eventStreamHandler))
  
     return router
 }
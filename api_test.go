@@ -0,0 +1,237 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/rsa"
+    "encoding/json"
+    "fmt"
+    "io"
+    "testing"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "time"
+)
+
+// A server running the whole API, which accepts tokens signed with its dev key
+type testAPIServer struct {
+    *httptest.Server
+    key             *rsa.PrivateKey
+    t               *testing.T
+    oldProviders    []identityProvider
+}
+
+// Starts a test API server. Callers must close it when they're done, which
+// also puts back the identity providers it replaced.
+func newTestAPIServer(t *testing.T) *testAPIServer {
+    // a small key, so tests don't spend ages generating it
+    key, err := rsa.GenerateKey(rand.Reader, 1024)
+    if err != nil {
+        t.Fatalf("Generating dev key failed: %v", err)
+    }
+    provider, err := newDevProvider(key, time.Minute)
+    if err != nil {
+        t.Fatalf("Creating dev provider failed: %v", err)
+    }
+
+    oldProviders := identityProviders
+    identityProviders = []identityProvider{provider}
+
+    return &testAPIServer{
+        Server:         httptest.NewServer(setupAPIHandlers(testAPI)),
+        key:            key,
+        t:              t,
+        oldProviders:   oldProviders,
+    }
+}
+
+func (server *testAPIServer) Close() {
+    server.Server.Close()
+    identityProviders = server.oldProviders
+}
+
+// Makes a request, decoding the JSON response into resp if it's not nil.
+// Returns the status code.
+func (server *testAPIServer) request(method string, path string, token string, body interface{}, resp interface{}) int {
+    header := http.Header{}
+    if token != "" {
+        header.Set("X-Session-Token", token)
+    }
+    return server.requestWithHeader(method, path, header, body, resp)
+}
+
+// Like request, but authenticating with an API key
+func (server *testAPIServer) botRequest(method string, path string, key string, body interface{}, resp interface{}) int {
+    header := http.Header{}
+    header.Set("Authorization", "Bearer "+key)
+    return server.requestWithHeader(method, path, header, body, resp)
+}
+
+func (server *testAPIServer) requestWithHeader(method string, path string, header http.Header, body interface{}, resp interface{}) int {
+    var reqBody io.Reader
+    if body != nil {
+        b, _ := json.Marshal(body)
+        reqBody = bytes.NewReader(b)
+    }
+    req, _ := http.NewRequest(method, server.URL+path, reqBody)
+    req.Header = header
+
+    res, err := http.DefaultClient.Do(req)
+    if err != nil {
+        server.t.Fatalf("%v %v failed: %v", method, path, err)
+    }
+    defer res.Body.Close()
+
+    if resp != nil && res.StatusCode == http.StatusOK {
+        if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+            server.t.Errorf("Decoding response to %v %v failed: %v", method, path, err)
+        }
+    }
+    return res.StatusCode
+}
+
+// Signs in as the user through POST /sessions
+func (server *testAPIServer) signIn(info IdentityInfo) CreateSessionResponse {
+    idToken, err := mintDevToken(server.key, info, time.Hour)
+    if err != nil {
+        server.t.Fatalf("Minting token failed: %v", err)
+    }
+
+    var resp CreateSessionResponse
+    if status := server.request("POST", "/sessions", "", CreateSessionRequest{IdToken: idToken}, &resp); status != http.StatusOK {
+        server.t.Fatalf("Signing in failed: %v", status)
+    }
+    if !resp.Success {
+        server.t.Fatalf("Signing in failed: %v", resp.Error)
+    }
+    return resp
+}
+
+func TestAPIEndToEnd(t *testing.T) {
+    defer resetTables()
+
+    server := newTestAPIServer(t)
+    defer server.Close()
+
+    info1 := IdentityInfo{
+        ID:             "1000",
+        DisplayName:    "Tony Abbott",
+        FirstName:      "Tony",
+        LastName:       "Abbott",
+        Email:          "xXx_0n10n_fan_xXx@hotmail.com",
+        Picture:        "tone.jpg",
+    }
+    info2 := IdentityInfo{
+        ID:             "1001",
+        DisplayName:    "Malcolm Turnbull",
+        FirstName:      "Malcolm",
+        LastName:       "Turnbull",
+        Email:          "pm@gmail.com",
+        Picture:        "hehe",
+    }
+
+    log.Println("** Testing requests without a token are rejected")
+    if status := server.request("GET", "/me", "", nil, nil); status != http.StatusUnauthorized {
+        t.Errorf("Expected %v, got %v", http.StatusUnauthorized, status)
+    }
+
+    log.Println("** Testing signing in with a bad token is rejected")
+    if status := server.request("POST", "/sessions", "", CreateSessionRequest{IdToken: "bogus"}, nil); status != http.StatusUnauthorized {
+        t.Errorf("Expected %v, got %v", http.StatusUnauthorized, status)
+    }
+
+    log.Println("** Testing signing in")
+    session1 := server.signIn(info1)
+    session2 := server.signIn(info2)
+    if session1.User.Uid != "dev:1000" {
+        t.Errorf("Uid was not correct: expected %v, got %v", "dev:1000", session1.User.Uid)
+    }
+
+    var me GetMeResponse
+    server.request("GET", "/me", session1.Token, nil, &me)
+    if me.User != session1.User {
+        t.Errorf("Wrong user from /me: expected %v, got %v", session1.User, me.User)
+    }
+
+    log.Println("** Testing becoming friends")
+    var addResp AddOthersFriendRequestResponse
+    server.request("POST", fmt.Sprintf("/users/%d/friendrequests", session2.User.Id), session1.Token, nil, &addResp)
+    if !addResp.Success {
+        t.Fatalf("Sending friend request failed: %v", addResp.Error)
+    }
+
+    var acceptResp ModifyMyFriendRequestResponse
+    server.request("PUT", fmt.Sprintf("/friendrequests/%d", session1.User.Id), session2.Token, nil, &acceptResp)
+    if !acceptResp.Success {
+        t.Fatalf("Accepting friend request failed: %v", acceptResp.Error)
+    }
+
+    var friends ListFriendsResponse
+    server.request("GET", "/friends", session1.Token, nil, &friends)
+    if len(friends.Friends) != 1 || friends.Friends[0].Id != session2.User.Id {
+        t.Errorf("Expected user2 as only friend, got %v", friends.Friends)
+    }
+
+    log.Println("** Testing sending and receiving a message")
+    var sendResp SendMessageResponse
+    req := SendMessageRequest{
+        Content:        "malcom pls",
+        ContentType:    ContentTypeText,
+    }
+    server.request("POST", fmt.Sprintf("/friends/%d/messages", session2.User.Id), session1.Token, req, &sendResp)
+    if !sendResp.Success {
+        t.Fatalf("Sending message failed: %v", sendResp.Error)
+    }
+
+    var listResp ListMessagesResponse
+    server.request("GET", fmt.Sprintf("/friends/%d/messages", session1.User.Id), session2.Token, nil, &listResp)
+    if len(listResp.Messages) != 1 || listResp.Messages[0].Id != sendResp.Id || listResp.Messages[0].Content != req.Content {
+        t.Errorf("Expected the sent message, got %v", listResp.Messages)
+    }
+
+    log.Println("** Testing editing a message to nothing is a bad request")
+    path := fmt.Sprintf("/friends/%d/messages/%d", session2.User.Id, sendResp.Id)
+    if status := server.request("PATCH", path, session1.Token, EditMessageRequest{}, nil); status != http.StatusBadRequest {
+        t.Errorf("Expected %v, got %v", http.StatusBadRequest, status)
+    }
+
+    log.Println("** Testing an ID token still works directly")
+    idToken, _ := mintDevToken(server.key, info1, time.Hour)
+    server.request("GET", "/me", idToken, nil, &me)
+    if me.User.Id != session1.User.Id {
+        t.Errorf("Wrong user from /me: expected %v, got %v", session1.User.Id, me.User.Id)
+    }
+
+    log.Println("** Testing logging out")
+    var sessions ListMySessionsResponse
+    server.request("GET", "/me/sessions", session1.Token, nil, &sessions)
+    if len(sessions.Sessions) != 1 || !sessions.Sessions[0].Current {
+        t.Errorf("Expected just the current session, got %v", sessions.Sessions)
+    }
+
+    var logoutResp LogoutResponse
+    server.request("DELETE", "/sessions/current", session1.Token, nil, &logoutResp)
+    if !logoutResp.Success {
+        t.Errorf("Logging out failed: %v", logoutResp.Error)
+    }
+    if status := server.request("GET", "/me", session1.Token, nil, nil); status != http.StatusUnauthorized {
+        t.Errorf("Expected %v after logging out, got %v", http.StatusUnauthorized, status)
+    }
+
+    log.Println("** Testing logging out everywhere revokes ID tokens")
+    oldIdToken, _ := mintDevToken(server.key, info2, time.Hour)
+    server.request("DELETE", "/sessions", session2.Token, nil, &logoutResp)
+    if !logoutResp.Success {
+        t.Errorf("Logging out everywhere failed: %v", logoutResp.Error)
+    }
+    if status := server.request("GET", "/me", oldIdToken, nil, nil); status != http.StatusUnauthorized {
+        t.Errorf("Expected %v for an ID token issued before logging out, got %v", http.StatusUnauthorized, status)
+    }
+
+    log.Println("** Testing expired ID tokens are rejected")
+    expired, _ := mintDevToken(server.key, info1, -time.Hour)
+    if status := server.request("POST", "/sessions", "", CreateSessionRequest{IdToken: expired}, nil); status != http.StatusUnauthorized {
+        t.Errorf("Expected %v, got %v", http.StatusUnauthorized, status)
+    }
+}
@@ -1,24 +1,55 @@
 package main
 
 import (
+    "log"
     "net/http"
+    "strings"
 )
 
 /*
  * Helper functions
  */
 
-// Gets GoogleInfo (and whether the user is authenticated)
-func getAuthInfo(r *http.Request) (info GoogleInfo, authenticated bool) {
+// Gets IdentityInfo (and whether the user is authenticated)
+func (api *API) getAuthInfo(r *http.Request) (info IdentityInfo, authenticated bool) {
     c := newContext(r)
 
     // Get token from header
     if tokens, ok := r.Header["X-Session-Token"]; ok {
         info, err := verifyIDToken(c, tokens[0])
         if err == nil {
+            if api.isIDTokenRevoked(tokens[0], info) {
+                log.Println("Rejected ID token: revoked")
+                return info, false
+            }
             return info, true
         }
+        if tokenErr, ok := err.(*IDTokenError); ok {
+            log.Printf("Rejected ID token (%v): %v\n", tokenErr.Reason, tokenErr.Message)
+        } else {
+            log.Printf("Couldn't verify ID token: %v\n", err)
+        }
     }
 
     return info, false
 }
+
+// Copies the token query parameter into the X-Session-Token header, if the
+// header isn't already set.
+// Only for streaming endpoints whose browser APIs (WebSocket, EventSource)
+// can't set headers, since tokens in URLs end up in logs.
+func useSessionTokenParam(r *http.Request) {
+    if token := r.FormValue("token"); token != "" && r.Header.Get("X-Session-Token") == "" {
+        r.Header.Set("X-Session-Token", token)
+    }
+}
+
+// Gets the token from an "Authorization: Bearer <token>" header, if there is
+// one.
+func getBearerToken(r *http.Request) string {
+    auth := r.Header.Get("Authorization")
+    if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+        return strings.TrimSpace(auth[7:])
+    }
+    return ""
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Bot uids are this, a colon, and something random, so they can't collide
+// with anyone signing in through an identity provider
+const BotUidPrefix = "bot"
+
+// API keys start with this, so they're easy to spot if they leak
+const APIKeyPrefix = "wob_"
+
+// Number of random bytes in an API key
+const APIKeySize = 32
+
+// API key scopes
+const (
+    // send messages to friends who've added the bot
+    ScopeMessagesSend = "messages:send"
+    // read messages from friends, and list friends
+    ScopeMessagesRead = "messages:read"
+)
+
+var validScopes = []string{ScopeMessagesSend, ScopeMessagesRead}
+
+// What each scope lets a bot do.
+// Bots can't do anything that isn't listed here.
+var scopeRoutes = []struct {
+    scope   string
+    method  string
+    path    *regexp.Regexp
+}{
+    // any key can see who it's for
+    {"", "GET", regexp.MustCompile(`^/me/?$`)},
+    {ScopeMessagesSend, "POST", regexp.MustCompile(`^/friends/[0-9]+/messages/?$`)},
+    {ScopeMessagesRead, "GET", regexp.MustCompile(`^/friends/?$`)},
+    {ScopeMessagesRead, "GET", regexp.MustCompile(`^/friends/[0-9]+/messages/?$`)},
+    {ScopeMessagesRead, "GET", regexp.MustCompile(`^/nextMessage/?$`)},
+}
+
+/*
+ * Data types
+ */
+
+// A key a bot uses to authenticate, with "Authorization: Bearer <key>".
+// Like sessions, only a hash of the key is stored.
+type APIKey struct {
+    Id          int
+    BotId       int         `sql:"not null;index"`
+    KeyHash     string      `sql:"not null;unique"`
+    // the start of the key, so owners can tell their keys apart
+    Prefix      string      `sql:"not null"`
+    // space separated
+    Scopes      string      `sql:"not null"`
+    Timestamp   time.Time   `sql:"not null"`
+    LastUsedAt  time.Time   `sql:"not null"`
+}
+
+type PublicAPIKey struct {
+    Id          int         `json:"id"`
+    BotId       int         `json:"botId"`
+    Prefix      string      `json:"prefix"`
+    Scopes      []string    `json:"scopes"`
+    Timestamp   time.Time   `json:"timestamp"`
+    LastUsedAt  time.Time   `json:"lastUsedAt"`
+}
+
+/*
+ * Helper functions
+ */
+
+func (key *APIKey) toPublic() PublicAPIKey {
+    return PublicAPIKey{
+        Id:         key.Id,
+        BotId:      key.BotId,
+        Prefix:     key.Prefix,
+        Scopes:     strings.Fields(key.Scopes),
+        Timestamp:  key.Timestamp,
+        LastUsedAt: key.LastUsedAt,
+    }
+}
+
+func (key *APIKey) hasScope(scope string) bool {
+    return scope == "" || containsString(strings.Fields(key.Scopes), scope)
+}
+
+// Gets whether the key lets a bot make the request.
+func (key *APIKey) allows(r *http.Request) bool {
+    for _, route := range scopeRoutes {
+        if r.Method == route.method && route.path.MatchString(r.URL.Path) && key.hasScope(route.scope) {
+            return true
+        }
+    }
+    return false
+}
+
+func newAPIKeySecret() (string, error) {
+    b := make([]byte, APIKeySize)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func checkScopes(scopes []string) error {
+    if len(scopes) == 0 {
+        return errors.New("At least one scope is required")
+    }
+    for _, scope := range scopes {
+        if !containsString(validScopes, scope) {
+            return errors.New("Unknown scope " + scope)
+        }
+    }
+    return nil
+}
+
+// Gets the bot an API key belongs to, if the key is valid and lets the bot
+// make the request.
+func (api *API) getAPIKeyUser(r *http.Request, secret string) (user User, ok bool) {
+    key, err := api.store.getAPIKeyByHash(hashSessionToken(secret))
+    if err != nil {
+        return user, false
+    }
+    if user, err = api.store.getUser(key.BotId); err != nil || !user.IsBot {
+        return user, false
+    }
+    if !key.allows(r) {
+        log.Printf("API key %v isn't allowed to %v %v\n", key.Id, r.Method, r.URL.Path)
+        return user, false
+    }
+
+    if time.Since(key.LastUsedAt) > SessionLastUsedResolution {
+        key.LastUsedAt = time.Now()
+        api.store.saveAPIKey(&key)
+    }
+    return user, true
+}
+
+// Creates a bot owned by the user.
+func (api *API) createBot(user User, name string) (bot User, err error) {
+    if user.IsBot {
+        return bot, errors.New("Bots can't create bots")
+    }
+    if strings.TrimSpace(name) == "" {
+        return bot, errors.New("Name is required")
+    }
+
+    b := make([]byte, 16)
+    if _, err = rand.Read(b); err != nil {
+        return bot, err
+    }
+
+    bot = User{
+        Uid:        BotUidPrefix + ":" + hex.EncodeToString(b),
+        Name:       name,
+        FirstName:  name,
+        IsBot:      true,
+        OwnerId:    user.Id,
+    }
+    err = api.store.createUser(&bot)
+    return bot, err
+}
+
+// Gets one of the user's bots
+func (api *API) getBot(user User, botId int) (bot User, err error) {
+    if bot, err = api.store.getUser(botId); err != nil || !bot.IsBot || bot.OwnerId != user.Id {
+        return bot, errors.New("Bot not found")
+    }
+    return bot, nil
+}
+
+// Gets one of the bot's API keys
+func (api *API) getAPIKey(bot User, keyId int) (key APIKey, err error) {
+    if key, err = api.store.getAPIKey(bot, keyId); err != nil {
+        return key, errors.New("API key not found")
+    }
+    return key, nil
+}
+
+// Creates an API key for the bot, returning the key itself, which isn't
+// stored anywhere.
+func (api *API) createAPIKey(bot User, scopes []string) (secret string, key APIKey, err error) {
+    if err = checkScopes(scopes); err != nil {
+        return secret, key, err
+    }
+    if secret, err = newAPIKeySecret(); err != nil {
+        return secret, key, err
+    }
+
+    now := time.Now()
+    key = APIKey{
+        BotId:      bot.Id,
+        KeyHash:    hashSessionToken(secret),
+        Prefix:     secret[:len(APIKeyPrefix)+6],
+        Scopes:     strings.Join(scopes, " "),
+        Timestamp:  now,
+        LastUsedAt: now,
+    }
+    if err = api.store.createAPIKey(&key); err != nil {
+        return "", key, err
+    }
+    return secret, key, nil
+}
+
+// Replaces the key's secret, keeping its scopes. The old secret stops
+// working straight away.
+func (api *API) rotateAPIKey(key *APIKey) (secret string, err error) {
+    if secret, err = newAPIKeySecret(); err != nil {
+        return secret, err
+    }
+
+    key.KeyHash = hashSessionToken(secret)
+    key.Prefix = secret[:len(APIKeyPrefix)+6]
+    key.Timestamp = time.Now()
+    if err = api.store.saveAPIKey(key); err != nil {
+        return "", err
+    }
+    return secret, nil
+}
+
+// Gets a bot or key ID from the URL
+func getIdVar(r *http.Request, name string) (int, bool) {
+    id, err := strconv.Atoi(mux.Vars(r)[name])
+    if err != nil || id <= 0 {
+        log.Printf("%v not positive integer\n", name)
+        return 0, false
+    }
+    return id, true
+}
+
+/*
+ * API endpoints
+ */
+
+/*
+ * /bots endpoint
+ */
+
+func (api *API) botsHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /bots")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "GET":
+        resp = api.listBotsEndpoint(user)
+    case "POST":
+        decoder := json.NewDecoder(r.Body)
+        var req CreateBotRequest
+        err := decoder.Decode(&req)
+        if err != nil {
+            log.Println("JSON decoding failed")
+            return http.StatusBadRequest
+        }
+        resp = api.createBotEndpoint(user, req)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * GET /bots
+ * Gets the bots the current user owns.
+ */
+type ListBotsResponse struct {
+    Success     bool            `json:"success"`
+    Error       string          `json:"error"`
+    Bots        []PublicUser    `json:"bots"`
+}
+
+func (api *API) listBotsEndpoint(user User) ListBotsResponse {
+    bots := api.store.getBots(user)
+    resp := ListBotsResponse{
+        Success:    true,
+        Bots:       []PublicUser{},
+    }
+    for _, bot := range bots {
+        resp.Bots = append(resp.Bots, bot.toPublic())
+    }
+    return resp
+}
+
+/*
+ * POST /bots
+ * Creates a bot owned by the current user.
+ * Users add the bot as a friend (which it accepts straight away) before it
+ * can message them.
+ */
+type CreateBotRequest struct {
+    Name        string      `json:"name"`
+}
+
+type CreateBotResponse struct {
+    Success     bool        `json:"success"`
+    Error       string      `json:"error"`
+    Bot         PublicUser  `json:"bot"`
+}
+
+func (api *API) createBotEndpoint(user User, req CreateBotRequest) CreateBotResponse {
+    bot, err := api.createBot(user, req.Name)
+    if err != nil {
+        return CreateBotResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+    return CreateBotResponse{
+        Success:    true,
+        Bot:        bot.toPublic(),
+    }
+}
+
+/*
+ * /bots/{botId} endpoint
+ */
+
+func (api *API) botHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /bots/{botId}")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    botId, ok := getIdVar(r, "botId")
+    if !ok {
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "DELETE":
+        resp = api.deleteBotEndpoint(user, botId)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * DELETE /bots/{botId}
+ * Deletes one of the current user's bots, along with its API keys,
+ * friendships and group memberships.
+ */
+type DeleteBotResponse struct {
+    Success     bool        `json:"success"`
+    Error       string      `json:"error"`
+}
+
+func (api *API) deleteBotEndpoint(user User, botId int) DeleteBotResponse {
+    bot, err := api.getBot(user, botId)
+    if err == nil {
+        err = api.store.deleteUser(bot)
+    }
+    if err != nil {
+        return DeleteBotResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+    return DeleteBotResponse{
+        Success:    true,
+    }
+}
+
+/*
+ * /bots/{botId}/keys endpoint
+ */
+
+func (api *API) botKeysHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /bots/{botId}/keys")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    botId, ok := getIdVar(r, "botId")
+    if !ok {
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "GET":
+        resp = api.listAPIKeysEndpoint(user, botId)
+    case "POST":
+        decoder := json.NewDecoder(r.Body)
+        var req CreateAPIKeyRequest
+        err := decoder.Decode(&req)
+        if err != nil {
+            log.Println("JSON decoding failed")
+            return http.StatusBadRequest
+        }
+        resp = api.createAPIKeyEndpoint(user, botId, req)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * GET /bots/{botId}/keys
+ * Gets the API keys of one of the current user's bots. The keys themselves
+ * aren't included, just enough to tell them apart.
+ */
+type ListAPIKeysResponse struct {
+    Success     bool            `json:"success"`
+    Error       string          `json:"error"`
+    Keys        []PublicAPIKey  `json:"keys"`
+}
+
+func (api *API) listAPIKeysEndpoint(user User, botId int) ListAPIKeysResponse {
+    bot, err := api.getBot(user, botId)
+    if err != nil {
+        return ListAPIKeysResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    resp := ListAPIKeysResponse{
+        Success:    true,
+        Keys:       []PublicAPIKey{},
+    }
+    for _, key := range api.store.getAPIKeys(bot) {
+        resp.Keys = append(resp.Keys, key.toPublic())
+    }
+    return resp
+}
+
+/*
+ * POST /bots/{botId}/keys
+ * Creates an API key for one of the current user's bots, limited to the
+ * given scopes.
+ * The key is only ever returned here, so it has to be saved straight away.
+ */
+type CreateAPIKeyRequest struct {
+    Scopes      []string    `json:"scopes"`
+}
+
+type APIKeyResponse struct {
+    Success     bool            `json:"success"`
+    Error       string          `json:"error"`
+    Key         string          `json:"key"`
+    APIKey      PublicAPIKey    `json:"apiKey"`
+}
+
+func (api *API) createAPIKeyEndpoint(user User, botId int, req CreateAPIKeyRequest) APIKeyResponse {
+    bot, err := api.getBot(user, botId)
+    if err != nil {
+        return APIKeyResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    secret, key, err := api.createAPIKey(bot, req.Scopes)
+    if err != nil {
+        return APIKeyResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+    return APIKeyResponse{
+        Success:    true,
+        Key:        secret,
+        APIKey:     key.toPublic(),
+    }
+}
+
+/*
+ * /bots/{botId}/keys/{keyId} endpoint
+ */
+
+func (api *API) botKeyHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /bots/{botId}/keys/{keyId}")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    botId, ok := getIdVar(r, "botId")
+    if !ok {
+        return http.StatusBadRequest
+    }
+    keyId, ok := getIdVar(r, "keyId")
+    if !ok {
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "PUT":
+        resp = api.rotateAPIKeyEndpoint(user, botId, keyId)
+    case "DELETE":
+        resp = api.deleteAPIKeyEndpoint(user, botId, keyId)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * PUT /bots/{botId}/keys/{keyId}
+ * Rotates an API key: it gets a new key with the same scopes, and the old
+ * one stops working.
+ */
+func (api *API) rotateAPIKeyEndpoint(user User, botId int, keyId int) APIKeyResponse {
+    bot, err := api.getBot(user, botId)
+    if err != nil {
+        return APIKeyResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+    key, err := api.getAPIKey(bot, keyId)
+    if err != nil {
+        return APIKeyResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    secret, err := api.rotateAPIKey(&key)
+    if err != nil {
+        return APIKeyResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+    return APIKeyResponse{
+        Success:    true,
+        Key:        secret,
+        APIKey:     key.toPublic(),
+    }
+}
+
+/*
+ * DELETE /bots/{botId}/keys/{keyId}
+ * Revokes an API key.
+ */
+type DeleteAPIKeyResponse struct {
+    Success     bool        `json:"success"`
+    Error       string      `json:"error"`
+}
+
+func (api *API) deleteAPIKeyEndpoint(user User, botId int, keyId int) DeleteAPIKeyResponse {
+    bot, err := api.getBot(user, botId)
+    if err != nil {
+        return DeleteAPIKeyResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+    key, err := api.getAPIKey(bot, keyId)
+    if err == nil {
+        err = api.store.deleteAPIKey(key)
+    }
+    if err != nil {
+        return DeleteAPIKeyResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+    return DeleteAPIKeyResponse{
+        Success:    true,
+    }
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "testing"
+)
+
+func TestBots(t *testing.T) {
+    defer resetTables()
+
+    server := newTestAPIServer(t)
+    defer server.Close()
+
+    owner := server.signIn(IdentityInfo{ID: "2000", DisplayName: "Bill Shorten"})
+    other := server.signIn(IdentityInfo{ID: "2001", DisplayName: "Julie Bishop"})
+
+    log.Println("** Testing creating a bot")
+    var botResp CreateBotResponse
+    server.request("POST", "/bots", owner.Token, CreateBotRequest{Name: "Zinger Bot"}, &botResp)
+    if !botResp.Success {
+        t.Fatalf("Creating bot failed: %v", botResp.Error)
+    }
+    bot := botResp.Bot
+    if !bot.IsBot {
+        t.Errorf("Bot wasn't flagged as a bot")
+    }
+
+    var bots ListBotsResponse
+    server.request("GET", "/bots", owner.Token, nil, &bots)
+    if len(bots.Bots) != 1 || bots.Bots[0].Id != bot.Id {
+        t.Errorf("Expected just the bot, got %v", bots.Bots)
+    }
+    server.request("GET", "/bots", other.Token, nil, &bots)
+    if len(bots.Bots) != 0 {
+        t.Errorf("Expected no bots for another user, got %v", bots.Bots)
+    }
+
+    log.Println("** Testing issuing API keys")
+    var keyResp APIKeyResponse
+    keysPath := fmt.Sprintf("/bots/%d/keys", bot.Id)
+    server.request("POST", keysPath, owner.Token, CreateAPIKeyRequest{Scopes: []string{"everything"}}, &keyResp)
+    if keyResp.Success {
+        t.Errorf("Creating a key with an unknown scope should fail")
+    }
+    server.request("POST", keysPath, other.Token, CreateAPIKeyRequest{Scopes: []string{ScopeMessagesSend}}, &keyResp)
+    if keyResp.Success {
+        t.Errorf("Creating a key for someone else's bot should fail")
+    }
+
+    server.request("POST", keysPath, owner.Token, CreateAPIKeyRequest{Scopes: []string{ScopeMessagesSend}}, &keyResp)
+    if !keyResp.Success {
+        t.Fatalf("Creating key failed: %v", keyResp.Error)
+    }
+    sendKey := keyResp.Key
+    sendKeyId := keyResp.APIKey.Id
+
+    server.request("POST", keysPath, owner.Token, CreateAPIKeyRequest{Scopes: []string{ScopeMessagesRead}}, &keyResp)
+    if !keyResp.Success {
+        t.Fatalf("Creating key failed: %v", keyResp.Error)
+    }
+    readKey := keyResp.Key
+
+    var keys ListAPIKeysResponse
+    server.request("GET", keysPath, owner.Token, nil, &keys)
+    if len(keys.Keys) != 2 {
+        t.Errorf("Expected 2 keys, got %v", keys.Keys)
+    }
+
+    log.Println("** Testing API keys authenticate the bot")
+    var me GetMeResponse
+    if status := server.botRequest("GET", "/me", readKey, nil, &me); status != http.StatusOK {
+        t.Errorf("GET /me with an API key: expected %v, got %v", http.StatusOK, status)
+    }
+    if me.User.Id != bot.Id {
+        t.Errorf("Wrong user from /me: expected %v, got %v", bot.Id, me.User.Id)
+    }
+    if status := server.botRequest("GET", "/me", "wob_bogus", nil, nil); status != http.StatusUnauthorized {
+        t.Errorf("Expected %v for a bad key, got %v", http.StatusUnauthorized, status)
+    }
+
+    log.Println("** Testing adding a bot makes it a friend straight away")
+    var addResp AddOthersFriendRequestResponse
+    server.request("POST", fmt.Sprintf("/users/%d/friendrequests", bot.Id), other.Token, nil, &addResp)
+    if !addResp.Success {
+        t.Fatalf("Adding bot failed: %v", addResp.Error)
+    }
+
+    log.Println("** Testing scopes limit what bots can do")
+    msg := SendMessageRequest{Content: "i'm a bot", ContentType: ContentTypeText}
+    messagesPath := fmt.Sprintf("/friends/%d/messages", other.User.Id)
+    if status := server.botRequest("POST", messagesPath, sendKey, msg, nil); status != http.StatusOK {
+        t.Errorf("Sending with the send key: expected %v, got %v", http.StatusOK, status)
+    }
+    if status := server.botRequest("POST", messagesPath, readKey, msg, nil); status != http.StatusUnauthorized {
+        t.Errorf("Sending with the read key: expected %v, got %v", http.StatusUnauthorized, status)
+    }
+    if status := server.botRequest("GET", messagesPath, readKey, nil, nil); status != http.StatusOK {
+        t.Errorf("Reading with the read key: expected %v, got %v", http.StatusOK, status)
+    }
+    if status := server.botRequest("GET", messagesPath, sendKey, nil, nil); status != http.StatusUnauthorized {
+        t.Errorf("Reading with the send key: expected %v, got %v", http.StatusUnauthorized, status)
+    }
+    if status := server.botRequest("POST", fmt.Sprintf("/users/%d/friendrequests", owner.User.Id), sendKey, nil, nil); status != http.StatusUnauthorized {
+        t.Errorf("Sending a friend request as a bot: expected %v, got %v", http.StatusUnauthorized, status)
+    }
+    if status := server.botRequest("GET", "/bots", sendKey, nil, nil); status != http.StatusUnauthorized {
+        t.Errorf("Managing bots as a bot: expected %v, got %v", http.StatusUnauthorized, status)
+    }
+
+    var sendResp SendMessageResponse
+    server.request("POST", fmt.Sprintf("/friends/%d/messages", bot.Id), owner.Token, msg, &sendResp)
+    if sendResp.Success {
+        t.Errorf("Bot could be messaged by someone who hasn't added it")
+    }
+
+    log.Println("** Testing rotating a key")
+    server.request("PUT", fmt.Sprintf("%v/%d", keysPath, sendKeyId), owner.Token, nil, &keyResp)
+    if !keyResp.Success {
+        t.Fatalf("Rotating key failed: %v", keyResp.Error)
+    }
+    if keyResp.Key == sendKey {
+        t.Errorf("Rotating didn't change the key")
+    }
+    if status := server.botRequest("POST", messagesPath, sendKey, msg, nil); status != http.StatusUnauthorized {
+        t.Errorf("Using the old key: expected %v, got %v", http.StatusUnauthorized, status)
+    }
+    sendKey = keyResp.Key
+    if status := server.botRequest("POST", messagesPath, sendKey, msg, nil); status != http.StatusOK {
+        t.Errorf("Using the new key: expected %v, got %v", http.StatusOK, status)
+    }
+
+    log.Println("** Testing revoking a key")
+    var deleteKeyResp DeleteAPIKeyResponse
+    server.request("DELETE", fmt.Sprintf("%v/%d", keysPath, sendKeyId), owner.Token, nil, &deleteKeyResp)
+    if !deleteKeyResp.Success {
+        t.Errorf("Revoking key failed: %v", deleteKeyResp.Error)
+    }
+    if status := server.botRequest("POST", messagesPath, sendKey, msg, nil); status != http.StatusUnauthorized {
+        t.Errorf("Using a revoked key: expected %v, got %v", http.StatusUnauthorized, status)
+    }
+
+    log.Println("** Testing deleting a bot")
+    var deleteBotResp DeleteBotResponse
+    server.request("DELETE", fmt.Sprintf("/bots/%d", bot.Id), other.Token, nil, &deleteBotResp)
+    if deleteBotResp.Success {
+        t.Errorf("Deleting someone else's bot should fail")
+    }
+    server.request("DELETE", fmt.Sprintf("/bots/%d", bot.Id), owner.Token, nil, &deleteBotResp)
+    if !deleteBotResp.Success {
+        t.Errorf("Deleting bot failed: %v", deleteBotResp.Error)
+    }
+    if status := server.botRequest("GET", "/me", readKey, nil, nil); status != http.StatusUnauthorized {
+        t.Errorf("Using a deleted bot's key: expected %v, got %v", http.StatusUnauthorized, status)
+    }
+}
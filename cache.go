@@ -15,10 +15,10 @@
 package main
 
 import (
-	"encoding/binary"
+	"container/list"
 	"errors"
 	"fmt"
-	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -32,12 +32,35 @@ var (
 
 	// TODO: rename this to errNotFound and move to errors.go
 	errCacheMiss = errors.New("cache: miss")
+
+	// errCacheTooLarge is returned when an item won't fit in the cache.
+	errCacheTooLarge = errors.New("cache: item too large")
+)
+
+// Cache types for Config.Cache.Type
+const (
+	CacheMemory = "memory"
+	CacheRedis  = "redis"
 )
 
+// newCache creates the cache named in the config.
+func newCache(cfg Config) (cacheInterface, error) {
+	switch cfg.Cache.Type {
+	case "", CacheMemory:
+		sweepInterval := time.Duration(cfg.Cache.SweepInterval) * time.Second
+		return newMemoryCache(cfg.Cache.MaxItems, cfg.Cache.MaxBytes, sweepInterval), nil
+	case CacheRedis:
+		return newRedisCache(cfg.Cache.Address, cfg.Cache.Password, cfg.Cache.Database, cfg.Cache.Prefix)
+	default:
+		return nil, fmt.Errorf("newCache: unknown cache type %q", cfg.Cache.Type)
+	}
+}
+
 // cacheIterface unifies different types of caches,
 // e.g. memoryCache and appengine/memcache.
 type cacheInterface interface {
 	// set puts data bytes into the cache under key for the duration of the exp.
+	// An exp of zero means the item doesn't expire.
 	set(c context.Context, key string, data []byte, exp time.Duration) error
 	// inc atomically increments the decimal value in the given key by delta
 	// and returns the new value. The value must fit in a uint64. Overflow wraps around,
@@ -46,82 +69,221 @@ type cacheInterface interface {
 	// get gets data from the cache put under key.
 	// it returns errCacheMiss if item is not in the cache or expired.
 	get(c context.Context, key string) ([]byte, error)
+	// touch changes the expiry of an existing item, like set would.
+	// it returns errCacheMiss if item is not in the cache or expired.
+	touch(c context.Context, key string, exp time.Duration) error
 	// deleteMulti removes keys from mecache.
 	deleleMulti(c context.Context, keys []string) error
 	// flush flushes all items from memcache.
 	flush(c context.Context) error
 }
 
-// memoryCache is a very simple in-memory cache.
+// memoryCache is an in-memory LRU cache. When it's over its limits, the least
+// recently used items are evicted; a janitor sweeps out expired items
+// in the background so they don't sit there until they're evicted.
 type memoryCache struct {
 	sync.Mutex
-	items map[string]*cacheItem
+	items map[string]*list.Element
+	// most recently used at the front
+	lru *list.List
+	// 0 means no limit
+	maxItems int
+	maxBytes int
+	bytes    int
+	stats    memoryCacheStats
+	stop     chan struct{}
+}
+
+// memoryCacheStats counts what a memoryCache has been up to.
+type memoryCacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Items       int
+	Bytes       int
 }
 
-// newMemoryCache creates a new memoryCache instance.
-func newMemoryCache() cacheInterface {
-	return &memoryCache{items: make(map[string]*cacheItem)}
+// newMemoryCache creates a new memoryCache instance holding at most maxItems
+// items and maxBytes bytes (0 for no limit), which sweeps out expired items
+// every sweepInterval (0 for never).
+func newMemoryCache(maxItems, maxBytes int, sweepInterval time.Duration) *memoryCache {
+	mc := &memoryCache{
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		stop:     make(chan struct{}),
+	}
+	if sweepInterval > 0 {
+		go mc.janitor(sweepInterval)
+	}
+	return mc
 }
 
 // cacheItem is a single item of the memoryCache.
 type cacheItem struct {
+	key  string
 	data []byte
-	exp  time.Time
+	// zero if the item doesn't expire
+	exp time.Time
 }
 
-func (mc *memoryCache) set(c context.Context, key string, data []byte, exp time.Duration) error {
+func (item *cacheItem) size() int {
+	return len(item.key) + len(item.data)
+}
+
+func (item *cacheItem) expired(now time.Time) bool {
+	return !item.exp.IsZero() && now.After(item.exp)
+}
+
+// janitor sweeps expired items every interval until close is called.
+func (mc *memoryCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mc.sweep()
+		case <-mc.stop:
+			return
+		}
+	}
+}
+
+// sweep removes all expired items.
+func (mc *memoryCache) sweep() {
 	mc.Lock()
 	defer mc.Unlock()
-	mc.items[key] = &cacheItem{data, time.Now().Add(exp)}
-	return nil
+	now := time.Now()
+	for _, e := range mc.items {
+		if e.Value.(*cacheItem).expired(now) {
+			mc.remove(e)
+			mc.stats.Expirations++
+		}
+	}
 }
 
-func (mc *memoryCache) inc(c context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+// close stops the janitor.
+func (mc *memoryCache) close() {
+	close(mc.stop)
+}
+
+// getStats returns the cache's counters.
+func (mc *memoryCache) getStats() memoryCacheStats {
 	mc.Lock()
 	defer mc.Unlock()
-	item, ok := mc.items[key]
+	stats := mc.stats
+	stats.Items = len(mc.items)
+	stats.Bytes = mc.bytes
+	return stats
+}
+
+// remove deletes an item. mc must be locked.
+func (mc *memoryCache) remove(e *list.Element) {
+	item := mc.lru.Remove(e).(*cacheItem)
+	delete(mc.items, item.key)
+	mc.bytes -= item.size()
+}
+
+// lookup gets a live item and marks it as used, removing it if it's expired.
+// mc must be locked.
+func (mc *memoryCache) lookup(key string) *cacheItem {
+	e, ok := mc.items[key]
 	if !ok {
-		var z time.Time
-		b := make([]byte, binary.Size(initialValue))
-		binary.PutUvarint(b, initialValue)
-		item = &cacheItem{b, z}
-		mc.items[key] = item
+		return nil
 	}
-	v, n := binary.Uvarint(item.data)
-	if n <= 0 {
-		return 0, fmt.Errorf("inc: binary.Uvarint error: %d", n)
+	item := e.Value.(*cacheItem)
+	if item.expired(time.Now()) {
+		mc.remove(e)
+		mc.stats.Expirations++
+		return nil
 	}
-	switch {
-	case delta < 0 && v < uint64(delta):
-		v = 0
-	case delta < 0:
-		v -= uint64(delta)
-	case delta > 0:
-		v += uint64(delta)
+	mc.lru.MoveToFront(e)
+	return item
+}
+
+// store puts an item in the cache, evicting the least recently used items
+// to make room for it. mc must be locked.
+func (mc *memoryCache) store(item *cacheItem) error {
+	if mc.maxBytes > 0 && item.size() > mc.maxBytes {
+		return errCacheTooLarge
+	}
+	if e, ok := mc.items[item.key]; ok {
+		mc.remove(e)
+	}
+	mc.items[item.key] = mc.lru.PushFront(item)
+	mc.bytes += item.size()
+
+	for (mc.maxItems > 0 && len(mc.items) > mc.maxItems) || (mc.maxBytes > 0 && mc.bytes > mc.maxBytes) {
+		mc.remove(mc.lru.Back())
+		mc.stats.Evictions++
+	}
+	return nil
+}
+
+func (mc *memoryCache) set(c context.Context, key string, data []byte, exp time.Duration) error {
+	mc.Lock()
+	defer mc.Unlock()
+	item := &cacheItem{key: key, data: data}
+	if exp > 0 {
+		item.exp = time.Now().Add(exp)
+	}
+	return mc.store(item)
+}
+
+func (mc *memoryCache) inc(c context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	mc.Lock()
+	defer mc.Unlock()
+	v := initialValue
+	var exp time.Time
+	if item := mc.lookup(key); item != nil {
+		var err error
+		if v, err = strconv.ParseUint(string(item.data), 10, 64); err != nil {
+			return 0, fmt.Errorf("inc: %q isn't a number", key)
+		}
+		// keep the expiry, if the item has one
+		exp = item.exp
+	}
+	v = incValue(v, delta)
+	if err := mc.store(&cacheItem{key: key, data: []byte(strconv.FormatUint(v, 10)), exp: exp}); err != nil {
+		return 0, err
 	}
-	binary.PutUvarint(item.data, v)
 	return v, nil
 }
 
 func (mc *memoryCache) get(c context.Context, key string) ([]byte, error) {
 	mc.Lock()
 	defer mc.Unlock()
-	item, ok := mc.items[key]
-	if !ok || time.Now().After(item.exp) {
-		delete(mc.items, key)
+	item := mc.lookup(key)
+	if item == nil {
+		mc.stats.Misses++
 		return nil, errCacheMiss
 	}
+	mc.stats.Hits++
 	return item.data, nil
 }
 
+func (mc *memoryCache) touch(c context.Context, key string, exp time.Duration) error {
+	mc.Lock()
+	defer mc.Unlock()
+	item := mc.lookup(key)
+	if item == nil {
+		return errCacheMiss
+	}
+	item.exp = time.Time{}
+	if exp > 0 {
+		item.exp = time.Now().Add(exp)
+	}
+	return nil
+}
+
 func (mc *memoryCache) deleleMulti(c context.Context, keys []string) error {
-	sort.Strings(keys)
 	mc.Lock()
 	defer mc.Unlock()
-	for k := range mc.items {
-		i := sort.SearchStrings(keys, k)
-		if i < len(keys) && keys[i] == k {
-			delete(mc.items, k)
+	for _, k := range keys {
+		if e, ok := mc.items[k]; ok {
+			mc.remove(e)
 		}
 	}
 	return nil
@@ -130,6 +292,21 @@ func (mc *memoryCache) deleleMulti(c context.Context, keys []string) error {
 func (mc *memoryCache) flush(c context.Context) error {
 	mc.Lock()
 	defer mc.Unlock()
-	mc.items = make(map[string]*cacheItem)
+	mc.items = make(map[string]*list.Element)
+	mc.lru.Init()
+	mc.bytes = 0
 	return nil
 }
+
+// incValue adds delta to v the way cacheInterface.inc does:
+// overflow wraps around, and underflow is capped to zero.
+func incValue(v uint64, delta int64) uint64 {
+	switch {
+	case delta < 0 && v < uint64(-delta):
+		return 0
+	case delta < 0:
+		return v - uint64(-delta)
+	default:
+		return v + uint64(delta)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "log"
+    "testing"
+    "time"
+
+    "golang.org/x/net/context"
+)
+
+func TestMemoryCache(t *testing.T) {
+    c := context.Background()
+
+    log.Println("Testing the least recently used items are evicted")
+    mc := newMemoryCache(3, 0, 0)
+    mc.set(c, "a", []byte("a"), time.Minute)
+    mc.set(c, "b", []byte("b"), time.Minute)
+    mc.set(c, "c", []byte("c"), time.Minute)
+    mc.get(c, "a")
+    mc.set(c, "d", []byte("d"), time.Minute)
+    if _, err := mc.get(c, "b"); err != errCacheMiss {
+        t.Errorf("Expected b to be evicted, got %v", err)
+    }
+    for _, key := range []string{"a", "c", "d"} {
+        if _, err := mc.get(c, key); err != nil {
+            t.Errorf("Expected %v to be kept, got %v", key, err)
+        }
+    }
+    if stats := mc.getStats(); stats.Evictions != 1 || stats.Items != 3 || stats.Hits != 4 || stats.Misses != 1 {
+        t.Errorf("Wrong stats: %+v", stats)
+    }
+
+    log.Println("Testing evicting to stay under the byte limit")
+    mc = newMemoryCache(0, 10, 0)
+    mc.set(c, "a", []byte("12345"), time.Minute)
+    mc.set(c, "b", []byte("12345"), time.Minute)
+    if _, err := mc.get(c, "a"); err != errCacheMiss {
+        t.Errorf("Expected a to be evicted, got %v", err)
+    }
+    if stats := mc.getStats(); stats.Bytes != 6 {
+        t.Errorf("Expected 6 bytes, got %v", stats.Bytes)
+    }
+    if err := mc.set(c, "big", []byte("12345678901"), time.Minute); err != errCacheTooLarge {
+        t.Errorf("Expected %v, got %v", errCacheTooLarge, err)
+    }
+
+    log.Println("Testing expiry")
+    mc = newMemoryCache(0, 0, 0)
+    mc.set(c, "short", []byte("x"), 10*time.Millisecond)
+    mc.set(c, "forever", []byte("x"), 0)
+    time.Sleep(20 * time.Millisecond)
+    if _, err := mc.get(c, "short"); err != errCacheMiss {
+        t.Errorf("Expected short to expire, got %v", err)
+    }
+    if _, err := mc.get(c, "forever"); err != nil {
+        t.Errorf("Expected an item without expiry to be kept, got %v", err)
+    }
+
+    log.Println("Testing touch")
+    if err := mc.touch(c, "missing", time.Minute); err != errCacheMiss {
+        t.Errorf("Expected touching a missing item to miss, got %v", err)
+    }
+    mc.touch(c, "forever", 10*time.Millisecond)
+    time.Sleep(20 * time.Millisecond)
+    if _, err := mc.get(c, "forever"); err != errCacheMiss {
+        t.Errorf("Expected touch to set the expiry, got %v", err)
+    }
+
+    log.Println("Testing inc")
+    if v, err := mc.inc(c, "n", 5, 10); err != nil || v != 15 {
+        t.Errorf("Expected 15, got %v (%v)", v, err)
+    }
+    if v, err := mc.inc(c, "n", -3, 10); err != nil || v != 12 {
+        t.Errorf("Expected 12, got %v (%v)", v, err)
+    }
+    if v, err := mc.inc(c, "n", -100, 10); err != nil || v != 0 {
+        t.Errorf("Expected underflow to cap at 0, got %v (%v)", v, err)
+    }
+    if data, err := mc.get(c, "n"); err != nil || string(data) != "0" {
+        t.Errorf("Expected inc's item to be kept, got %q (%v)", data, err)
+    }
+    mc.set(c, "limited", []byte("1"), 10*time.Millisecond)
+    mc.inc(c, "limited", 1, 0)
+    time.Sleep(20 * time.Millisecond)
+    if _, err := mc.get(c, "limited"); err != errCacheMiss {
+        t.Errorf("inc lost the item's expiry: %v", err)
+    }
+
+    log.Println("Testing the janitor sweeps expired items")
+    mc = newMemoryCache(0, 0, 10*time.Millisecond)
+    defer mc.close()
+    mc.set(c, "a", []byte("a"), 5*time.Millisecond)
+    mc.set(c, "b", []byte("b"), time.Minute)
+    time.Sleep(50 * time.Millisecond)
+    if stats := mc.getStats(); stats.Items != 1 || stats.Expirations != 1 {
+        t.Errorf("Expected a to be swept, got %+v", stats)
+    }
+
+    log.Println("Testing deleleMulti and flush")
+    mc.deleleMulti(c, []string{"b", "missing"})
+    if stats := mc.getStats(); stats.Items != 0 || stats.Bytes != 0 {
+        t.Errorf("Expected nothing left, got %+v", stats)
+    }
+    mc.set(c, "a", []byte("a"), time.Minute)
+    mc.flush(c)
+    if stats := mc.getStats(); stats.Items != 0 || stats.Bytes != 0 {
+        t.Errorf("Expected nothing left after flush, got %+v", stats)
+    }
+}
@@ -10,15 +10,101 @@ import (
 const DefaultConfigFile = "/etc/wobchat-backend.conf"
 const DefaultPort = 8000
 
+// Seconds of difference allowed between our clock and an ID token issuer's
+const DefaultClockSkew = 60
+
+// Where the dev signing key goes if [auth] doesn't say
+const DefaultDevKeyFile = "wobchat-backend-dev.pem"
+
+// Memory cache limits if [cache] doesn't say
+const DefaultCacheMaxItems = 10000
+const DefaultCacheMaxBytes = 64 << 20
+const DefaultCacheSweepInterval = 60
+
+// Issuers of Google ID tokens
+var DefaultIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
 type Config struct {
     Server struct {
-        HTTPPort    int
+        HTTPPort            int
+        // whether the server is behind a proxy that sets X-Forwarded-For;
+        // otherwise clients could claim to be anyone with it
+        TrustForwardedFor   bool
     }
     Database struct {
+        // "postgres", "sqlite3" (with the file name as the connection
+        // string), or "memory" to keep everything in memory until the
+        // server stops
         Type                    string
         ConnectionString        string
         TestConnectionString    string
     }
+    Events struct {
+        // "local" (default) or "postgres"
+        Bus                     string
+    }
+    Cache struct {
+        // "memory" (default) or "redis"; use redis to share the cache
+        // between instances
+        Type                    string
+        // host:port of the Redis server
+        Address                 string
+        Password                string
+        Database                int
+        // prepended to every key, so the database can be shared
+        Prefix                  string
+        // limits of the memory cache; the least recently used items are
+        // evicted to stay under them
+        MaxItems                int
+        MaxBytes                int
+        // how often, in seconds, the memory cache sweeps out expired items
+        SweepInterval           int
+    }
+    Auth struct {
+        // OAuth client IDs ID tokens can be issued for (aud/azp); one line each
+        ClientId                []string
+        // accepted ID token issuers (iss); defaults to Google's
+        Issuer                  []string
+        // in seconds; applies to every provider
+        ClockSkew               int
+        // accept tokens signed with a local key, made by the mint-token
+        // command; never turn this on in production
+        DevMode                 bool
+        // where the dev signing key is kept; created if it doesn't exist
+        DevKeyFile              string
+    }
+    // other OpenID Connect identity providers, as [provider "name"]
+    Provider map[string]*ProviderConfig
+    // limits on how often users can do things, as [ratelimit "name"]
+    RateLimit map[string]*RateLimitConfig
+}
+
+// Settings for a rate limit
+type RateLimitConfig struct {
+    // requests allowed per window; 0 for no limit
+    Requests                int
+    // in seconds
+    Window                  int
+    // count the last window's requests too, as the window slides along,
+    // instead of starting afresh each window
+    Sliding                 bool
+}
+
+// Settings for an OpenID Connect identity provider
+type ProviderConfig struct {
+    // accepted ID token issuers (iss)
+    Issuer                  []string
+    // URL of the provider's signing keys (JWKS)
+    KeysURL                 string
+    // our OAuth client IDs with the provider
+    ClientId                []string
+    // claims holding user info, if they aren't the standard ones
+    IdClaim                 string
+    NameClaim               string
+    FirstNameClaim          string
+    LastNameClaim           string
+    EmailClaim              string
+    PictureClaim            string
 }
 
 func setupConfig() (cfg Config) {
@@ -37,5 +123,28 @@ func setupConfig() (cfg Config) {
         cfg.Server.HTTPPort = DefaultPort
     }
 
+    if cfg.Cache.MaxItems == 0 {
+        cfg.Cache.MaxItems = DefaultCacheMaxItems
+    }
+    if cfg.Cache.MaxBytes == 0 {
+        cfg.Cache.MaxBytes = DefaultCacheMaxBytes
+    }
+    if cfg.Cache.SweepInterval == 0 {
+        cfg.Cache.SweepInterval = DefaultCacheSweepInterval
+    }
+
+    if len(cfg.Auth.Issuer) == 0 {
+        cfg.Auth.Issuer = DefaultIssuers
+    }
+    if cfg.Auth.ClockSkew == 0 {
+        cfg.Auth.ClockSkew = DefaultClockSkew
+    }
+    if cfg.Auth.DevMode && cfg.Auth.DevKeyFile == "" {
+        cfg.Auth.DevKeyFile = DefaultDevKeyFile
+    }
+    if len(cfg.Auth.ClientId) == 0 {
+        log.Println("No client IDs set in [auth]; every ID token will be rejected")
+    }
+
     return cfg
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "time"
+
+    jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Dev mode lets anyone holding the dev key sign in as anyone, so it's only
+// for development and tests, where there's no Google to get tokens from.
+const (
+    IdentityProviderDev = "dev"
+    DevIssuer           = "wobchat-dev"
+    DevClientId         = "wobchat-dev"
+    DevKeyId            = "dev"
+    DevKeySize          = 2048
+)
+
+// Creates the identity provider for tokens signed with the dev key.
+func newDevProvider(key *rsa.PrivateKey, clockSkew time.Duration) (identityProvider, error) {
+    der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+    if err != nil {
+        return nil, err
+    }
+    publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+    return &oidcProvider{
+        providerName:   IdentityProviderDev,
+        issuerList:     []string{DevIssuer},
+        staticKeys:     map[string][]byte{DevKeyId: publicKey},
+        clientIds:      []string{DevClientId},
+        clockSkew:      clockSkew,
+        claims:         defaultClaimMapping,
+    }, nil
+}
+
+// Loads the dev signing key from path, creating it if it doesn't exist yet.
+func loadDevKey(path string) (*rsa.PrivateKey, error) {
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        log.Printf("Creating dev signing key %v\n", path)
+        key, err := rsa.GenerateKey(rand.Reader, DevKeySize)
+        if err != nil {
+            return nil, err
+        }
+        data = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+        if err := ioutil.WriteFile(path, data, 0600); err != nil {
+            return nil, err
+        }
+        return key, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    block, _ := pem.Decode(data)
+    if block == nil || block.Type != "RSA PRIVATE KEY" {
+        return nil, fmt.Errorf("loadDevKey: %v isn't a PEM RSA private key", path)
+    }
+    return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// Creates an ID token for the user, signed with the dev key, that's valid
+// for lifetime.
+func mintDevToken(key *rsa.PrivateKey, info IdentityInfo, lifetime time.Duration) (string, error) {
+    if info.ID == "" {
+        return "", errors.New("An ID is required")
+    }
+
+    now := time.Now()
+    token := jwt.New(jwt.SigningMethodRS256)
+    token.Header["kid"] = DevKeyId
+    token.Claims["iss"] = DevIssuer
+    token.Claims["aud"] = DevClientId
+    token.Claims["sub"] = info.ID
+    token.Claims["name"] = info.DisplayName
+    token.Claims["given_name"] = info.FirstName
+    token.Claims["family_name"] = info.LastName
+    token.Claims["picture"] = info.Picture
+    if info.Email != "" {
+        token.Claims["email"] = info.Email
+        token.Claims["email_verified"] = true
+    }
+    token.Claims["iat"] = now.Unix()
+    token.Claims["exp"] = now.Add(lifetime).Unix()
+
+    return token.SignedString(key)
+}
+
+// mint-token subcommand: prints a dev token for a test user, to use with
+// POST /sessions.
+func mintTokenCommand(cfg Config, args []string) error {
+    if !cfg.Auth.DevMode {
+        return errors.New("Dev mode isn't enabled in the config")
+    }
+
+    var info IdentityInfo
+    var lifetime time.Duration
+
+    flags := flag.NewFlagSet("mint-token", flag.ContinueOnError)
+    flags.StringVar(&info.ID, "id", "", "User's id (required)")
+    flags.StringVar(&info.DisplayName, "name", "", "Display name")
+    flags.StringVar(&info.FirstName, "first", "", "First name")
+    flags.StringVar(&info.LastName, "last", "", "Last name")
+    flags.StringVar(&info.Email, "email", "", "Email address")
+    flags.StringVar(&info.Picture, "picture", "", "Picture URL")
+    flags.DurationVar(&lifetime, "lifetime", time.Hour, "How long the token is valid for")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+
+    key, err := loadDevKey(cfg.Auth.DevKeyFile)
+    if err != nil {
+        return err
+    }
+
+    token, err := mintDevToken(key, info, lifetime)
+    if err != nil {
+        return err
+    }
+    fmt.Println(token)
+    return nil
+}
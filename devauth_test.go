@@ -0,0 +1,50 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "log"
+    "time"
+)
+
+func TestDevKey(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wobchat-dev-key")
+    if err != nil {
+        t.Fatalf("Creating temp dir failed: %v", err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "dev.pem")
+
+    log.Println("Testing the dev key is created if it doesn't exist")
+    key, err := loadDevKey(path)
+    if err != nil {
+        t.Fatalf("Creating dev key failed: %v", err)
+    }
+    if stat, err := os.Stat(path); err != nil {
+        t.Errorf("Dev key wasn't saved: %v", err)
+    } else if stat.Mode().Perm() != 0600 {
+        t.Errorf("Dev key is readable by others: %v", stat.Mode())
+    }
+
+    log.Println("Testing the saved dev key is loaded")
+    loaded, err := loadDevKey(path)
+    if err != nil {
+        t.Fatalf("Loading dev key failed: %v", err)
+    }
+    if loaded.N.Cmp(key.N) != 0 {
+        t.Error("Loaded a different dev key")
+    }
+
+    log.Println("Testing loading something that isn't a key")
+    ioutil.WriteFile(path, []byte("nope"), 0600)
+    if _, err := loadDevKey(path); err == nil {
+        t.Error("Loaded a dev key from garbage")
+    }
+
+    log.Println("Testing minting a token without an ID")
+    if _, err := mintDevToken(key, IdentityInfo{DisplayName: "Nobody"}, time.Hour); err == nil {
+        t.Error("Minted a token without an ID")
+    }
+}
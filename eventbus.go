@@ -0,0 +1,206 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+const (
+    EventBusLocal = "local"
+    EventBusPostgres = "postgres"
+)
+
+// Postgres channel events are published on
+const PostgresEventChannel = "wobchat_events"
+
+// Postgres sequence event ids come from, so they're unique and increasing
+// across every instance
+const PostgresEventIdSequence = "wobchat_event_ids"
+
+// NOTIFY payloads have to be shorter than this
+const PostgresMaxNotifyPayload = 8000
+
+// eventBus is the instance used by the program, initialized by main().
+// Defaults to only delivering events within this instance.
+var eventBus eventBusInterface = newLocalEventBus()
+
+// eventBusInterface gets events to subscribers, wherever they're connected.
+// Implementations hand events to deliverEvent on every instance that might
+// have subscribers for the user.
+type eventBusInterface interface {
+    // publish sends an event to every instance.
+    publish(userId int, event Event) error
+    // close stops receiving events from other instances.
+    close() error
+}
+
+// localEventBus delivers events within this instance only, which is all you
+// need when running a single instance.
+type localEventBus struct{}
+
+func newLocalEventBus() eventBusInterface {
+    return &localEventBus{}
+}
+
+func (bus *localEventBus) publish(userId int, event Event) error {
+    deliverEvent(userId, event)
+    return nil
+}
+
+func (bus *localEventBus) close() error {
+    return nil
+}
+
+// postgresEventBus delivers events between instances sharing a database,
+// using Postgres's LISTEN/NOTIFY.
+// Events published by this instance come back to it through the listener
+// too, so every instance delivers events the same way.
+// Events are given ids from a database sequence as they're published, since
+// each instance's own ids would collide.
+type postgresEventBus struct {
+    listener    *pq.Listener
+    // for publishing, since the listener's connection can only listen
+    db          *sql.DB
+    // for fetching the messages of events too large to send
+    store       Store
+    done        chan bool
+}
+
+// The JSON sent as a NOTIFY payload
+type postgresEventNotification struct {
+    UserId      int     `json:"userId"`
+    Event       Event   `json:"event"`
+    // set instead of the event's payload when the event is about a message
+    // and too large for NOTIFY; receivers fetch the message themselves
+    MessageId   int     `json:"messageId,omitempty"`
+}
+
+// newPostgresEventBus starts listening for events published by any instance.
+func newPostgresEventBus(connectionString string, store Store) (eventBusInterface, error) {
+    listener := pq.NewListener(connectionString, 10*time.Second, time.Minute,
+        func(ev pq.ListenerEventType, err error) {
+            if err != nil {
+                log.Printf("Event listener error: %v\n", err)
+            }
+        })
+
+    if err := listener.Listen(PostgresEventChannel); err != nil {
+        listener.Close()
+        return nil, err
+    }
+
+    db, err := sql.Open("postgres", connectionString)
+    if err != nil {
+        listener.Close()
+        return nil, err
+    }
+
+    if _, err := db.Exec("CREATE SEQUENCE IF NOT EXISTS " + PostgresEventIdSequence); err != nil {
+        db.Close()
+        listener.Close()
+        return nil, err
+    }
+
+    bus := &postgresEventBus{
+        listener:   listener,
+        db:         db,
+        store:      store,
+        done:       make(chan bool),
+    }
+    go bus.listen()
+
+    return bus, nil
+}
+
+func (bus *postgresEventBus) listen() {
+    for {
+        select {
+        case <-bus.done:
+            return
+        case notification, ok := <-bus.listener.Notify:
+            if !ok {
+                return
+            }
+            if notification == nil {
+                // the connection was re-established, so anything published
+                // in the meantime is gone
+                log.Println("Event listener reconnected; flagging subscribers as lagged")
+                markAllSubscribersLagged()
+                continue
+            }
+
+            var n postgresEventNotification
+            if err := json.Unmarshal([]byte(notification.Extra), &n); err != nil {
+                log.Printf("Failed to decode event notification: %v\n", err)
+                continue
+            }
+            if n.MessageId != 0 {
+                message, err := bus.store.getMessage(n.MessageId)
+                if err != nil {
+                    log.Printf("Failed to get message %v of event %v: %v\n", n.MessageId, n.Event.Id, err)
+                    markAllSubscribersLagged()
+                    continue
+                }
+                n.Event.Payload = message
+            }
+            deliverEvent(n.UserId, n.Event)
+        case <-time.After(90 * time.Second):
+            // make sure the connection is still alive
+            go bus.listener.Ping()
+        }
+    }
+}
+
+func (bus *postgresEventBus) publish(userId int, event Event) error {
+    if err := bus.db.QueryRow("SELECT nextval($1)", PostgresEventIdSequence).Scan(&event.Id); err != nil {
+        return err
+    }
+
+    n := postgresEventNotification{UserId: userId, Event: event}
+    b, err := json.Marshal(n)
+    if err != nil {
+        return err
+    }
+
+    if len(b) >= PostgresMaxNotifyPayload {
+        // send the message's id instead, if there is one
+        message, ok := event.Payload.(Message)
+        if !ok || message.Id == 0 {
+            return fmt.Errorf("publish: event too large for NOTIFY (%d bytes)", len(b))
+        }
+        n.Event.Payload = nil
+        n.MessageId = message.Id
+        if b, err = json.Marshal(n); err != nil {
+            return err
+        }
+    }
+
+    _, err = bus.db.Exec("SELECT pg_notify($1, $2)", PostgresEventChannel, string(b))
+    return err
+}
+
+func (bus *postgresEventBus) close() error {
+    close(bus.done)
+    bus.db.Close()
+    return bus.listener.Close()
+}
+
+// newEventBus creates the event bus named in the config.
+func newEventBus(cfg Config, store Store) (eventBusInterface, error) {
+    switch cfg.Events.Bus {
+    case "", EventBusLocal:
+        return newLocalEventBus(), nil
+    case EventBusPostgres:
+        if cfg.Database.Type != DialectPostgres {
+            return nil, fmt.Errorf("newEventBus: %q event bus needs a postgres database", cfg.Events.Bus)
+        }
+        return newPostgresEventBus(cfg.Database.ConnectionString, store)
+    default:
+        return nil, fmt.Errorf("newEventBus: unknown event bus %q", cfg.Events.Bus)
+    }
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "log"
+    "time"
+)
+
+func TestEventJSON(t *testing.T) {
+    log.Println("Round-tripping a message event")
+    message := Message{Id: 3, Content: "hi", ContentType: ContentTypeText, SenderId: 1, RecipientId: 2, RecipientType: RecipientTypeUser}
+    b, _ := json.Marshal(newMessageEvent(message))
+
+    var event Event
+    if err := json.Unmarshal(b, &event); err != nil {
+        t.Fatalf("Unmarshal failed: %v", err)
+    }
+    if decoded, ok := event.getMessage(); !ok || decoded.Id != message.Id || decoded.Content != message.Content {
+        t.Errorf("Message event decoded wrong: %v", event)
+    }
+
+    log.Println("Round-tripping a friend event")
+    user := User{Id: 4, Uid: "4", Name: "Peppa Pig"}
+    b, _ = json.Marshal(newEvent(EventTypeFriendRemoved, user.toPublic()))
+
+    if err := json.Unmarshal(b, &event); err != nil {
+        t.Fatalf("Unmarshal failed: %v", err)
+    }
+    if decoded, ok := event.Payload.(PublicUser); !ok || decoded != user.toPublic() {
+        t.Errorf("Friend event decoded wrong: %v", event)
+    }
+
+    log.Println("Decoding an unknown event type")
+    if err := json.Unmarshal([]byte(`{"type":"bogus","payload":{}}`), &event); err == nil {
+        t.Error("Decoding an unknown event type should fail")
+    }
+}
+
+func TestPostgresEventBus(t *testing.T) {
+    if cfg.Database.Type != "postgres" {
+        t.Skip("Postgres event bus needs a postgres test database")
+    }
+
+    defer resetTables()
+
+    // one bus publishes, the other stands in for a second instance
+    publisher, err := newPostgresEventBus(cfg.Database.TestConnectionString, testStore)
+    if err != nil {
+        t.Fatalf("Creating event bus failed: %v", err)
+    }
+    defer publisher.close()
+
+    other, err := newPostgresEventBus(cfg.Database.TestConnectionString, testStore)
+    if err != nil {
+        t.Fatalf("Creating event bus failed: %v", err)
+    }
+    defer other.close()
+
+    sub := subscribeEvents(3000)
+    defer sub.unsubscribe()
+
+    // both buses deliver to this process's subscribers, so we should get
+    // each event twice
+    receive := func(expected Message) Event {
+        var received Event
+        for i := 0; i < 2; i++ {
+            select {
+            case event := <-sub.Events:
+                if message, ok := event.getMessage(); !ok || message.Id != expected.Id || message.Content != expected.Content {
+                    t.Errorf("Received the wrong event: %v", event)
+                }
+                if i > 0 && event.Id != received.Id {
+                    t.Errorf("Instances received different ids for the same event: %v, %v", received.Id, event.Id)
+                }
+                received = event
+            case <-time.After(time.Second):
+                t.Errorf("Event %v wasn't delivered in time", i)
+            }
+        }
+        return received
+    }
+
+    log.Println("Publishing an event")
+    message := Message{Id: 5, Content: "across the wire", RecipientId: 3000, RecipientType: RecipientTypeUser}
+    if err := publisher.publish(3000, newMessageEvent(message)); err != nil {
+        t.Fatalf("Publishing failed: %v", err)
+    }
+    first := receive(message)
+
+    log.Println("Publishing an event from the other instance")
+    if err := other.publish(3000, newMessageEvent(message)); err != nil {
+        t.Fatalf("Publishing failed: %v", err)
+    }
+    if second := receive(message); second.Id <= first.Id {
+        t.Errorf("Event ids should increase across instances: %v, then %v", first.Id, second.Id)
+    }
+
+    log.Println("Publishing an event too large for NOTIFY")
+    user1 := User{Uid: "3001", Name: "Sam Dastyari"}
+    user2 := User{Uid: "3002", Name: "Bob Katter"}
+    testStore.createUser(&user1)
+    testStore.createUser(&user2)
+    stored := Message{Content: "fetched", ContentType: ContentTypeText, SenderId: user1.Id, RecipientId: user2.Id, RecipientType: RecipientTypeUser, Timestamp: time.Now()}
+    if err := testStore.addMessage(&stored); err != nil {
+        t.Fatalf("Adding message failed: %v", err)
+    }
+    large := stored
+    large.Content = strings.Repeat("a", PostgresMaxNotifyPayload)
+    if err := publisher.publish(3000, newMessageEvent(large)); err != nil {
+        t.Fatalf("Publishing failed: %v", err)
+    }
+    // the payload comes from the store instead
+    receive(stored)
+}
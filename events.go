@@ -1,122 +1,324 @@
 package main
 
 import (
+    "encoding/json"
+    "fmt"
     "log"
     "net/http"
     "strconv"
     "sync"
+    "sync/atomic"
     "time"
 )
 
 const MessageEventTimeout = 10
 
-type MessageEventListener struct {
-    Lock        sync.Mutex
-    Cond        *sync.Cond
-    Message     Message
+// How many events can be queued for a subscriber before we start dropping
+// them and flag it as lagged
+const EventQueueSize = 64
+
+// Event types
+const (
+    EventTypeMessage                = "message"
+    EventTypeMessageEdited          = "messageEdited"
+    EventTypeMessageDeleted         = "messageDeleted"
+    EventTypeMessagesRead           = "messagesRead"
+    EventTypeFriendRequestReceived  = "friendRequestReceived"
+    EventTypeFriendRequestAccepted  = "friendRequestAccepted"
+    EventTypeFriendRequestDeclined  = "friendRequestDeclined"
+    EventTypeFriendRemoved          = "friendRemoved"
+    EventTypeProfileUpdated         = "profileUpdated"
+)
 
-    TimeoutChan *chan bool
+// Envelope for everything delivered through the event system.
+// Payload depends on Type: a Message for the message types, a ReadMarker
+// for messagesRead, or the PublicUser the event is about for the friend and
+// profile types.
+type Event struct {
+    Id          int64       `json:"id"`
+    Type        string      `json:"type"`
+    Payload     interface{} `json:"payload"`
+    Timestamp   time.Time   `json:"timestamp"`
 }
 
-var listenersLock   sync.Mutex
-var listeners       map[int]*MessageEventListener
+// last Event.Id handed out; only unique within this process, so the Postgres
+// event bus replaces them as they're published
+var lastEventId int64
 
-func getListener(userId int) *MessageEventListener {
-    listenersLock.Lock()
+func newEvent(eventType string, payload interface{}) Event {
+    return Event{
+        Id:         atomic.AddInt64(&lastEventId, 1),
+        Type:       eventType,
+        Payload:    payload,
+        Timestamp:  time.Now(),
+    }
+}
+
+func newMessageEvent(message Message) Event {
+    event := newEvent(EventTypeMessage, message)
+    event.Timestamp = message.Timestamp
+    return event
+}
 
-    if listeners == nil {
-        listeners = make(map[int]*MessageEventListener)
+// Decodes an Event, giving Payload the right type for the event's Type.
+func (event *Event) UnmarshalJSON(b []byte) error {
+    var raw struct {
+        Id          int64           `json:"id"`
+        Type        string          `json:"type"`
+        Payload     json.RawMessage `json:"payload"`
+        Timestamp   time.Time       `json:"timestamp"`
     }
+    if err := json.Unmarshal(b, &raw); err != nil {
+        return err
+    }
+
+    event.Id = raw.Id
+    event.Type = raw.Type
+    event.Timestamp = raw.Timestamp
 
-    listener := listeners[userId]
-    if listener == nil {
-        listener = new(MessageEventListener)
-        listener.Cond = sync.NewCond(&listener.Lock)
-        listeners[userId] = listener
+    switch raw.Type {
+    case EventTypeMessage, EventTypeMessageEdited, EventTypeMessageDeleted:
+        var message Message
+        if err := json.Unmarshal(raw.Payload, &message); err != nil {
+            return err
+        }
+        event.Payload = message
+    case EventTypeMessagesRead:
+        var marker ReadMarker
+        if err := json.Unmarshal(raw.Payload, &marker); err != nil {
+            return err
+        }
+        event.Payload = marker
+    case EventTypeFriendRequestReceived, EventTypeFriendRequestAccepted,
+        EventTypeFriendRequestDeclined, EventTypeFriendRemoved, EventTypeProfileUpdated:
+        var user PublicUser
+        if err := json.Unmarshal(raw.Payload, &user); err != nil {
+            return err
+        }
+        event.Payload = user
+    default:
+        return fmt.Errorf("Unknown event type %q", raw.Type)
+    }
+    return nil
+}
+
+// Gets the message a message event is about.
+func (event *Event) getMessage() (message Message, ok bool) {
+    if event.Type != EventTypeMessage {
+        return message, false
     }
+    message, ok = event.Payload.(Message)
+    return message, ok
+}
 
-    listenersLock.Unlock()
+// A single waiting connection (long-poll, websocket, etc.) for a user.
+// Each connection gets its own queue, so every device a user has receives
+// every event.
+type EventSubscriber struct {
+    UserId      int
+    Events      chan Event
 
-    return listener
+    // set when an event couldn't be queued because Events was full;
+    // protected by subscribersLock
+    lagged      bool
 }
 
-// Sends an event to the given user.
-func sendMessageEvent(userId int, message Message) {
-    listener := getListener(userId)
+var subscribersLock sync.Mutex
+var subscribers     map[int]map[*EventSubscriber]bool
+
+// Starts queueing events for the given user.
+// Callers must unsubscribe when they're done.
+func subscribeEvents(userId int) *EventSubscriber {
+    sub := &EventSubscriber{
+        UserId:     userId,
+        Events:     make(chan Event, EventQueueSize),
+    }
+
+    subscribersLock.Lock()
+    defer subscribersLock.Unlock()
+
+    if subscribers == nil {
+        subscribers = make(map[int]map[*EventSubscriber]bool)
+    }
+    if subscribers[userId] == nil {
+        subscribers[userId] = make(map[*EventSubscriber]bool)
+    }
+    subscribers[userId][sub] = true
+
+    return sub
+}
+
+func (sub *EventSubscriber) unsubscribe() {
+    subscribersLock.Lock()
+    defer subscribersLock.Unlock()
+
+    delete(subscribers[sub.UserId], sub)
+    if len(subscribers[sub.UserId]) == 0 {
+        delete(subscribers, sub.UserId)
+    }
+}
+
+// Gets whether any events were dropped since the last call.
+// If so, the subscriber should catch up from the database.
+func (sub *EventSubscriber) checkLagged() bool {
+    subscribersLock.Lock()
+    defer subscribersLock.Unlock()
+
+    lagged := sub.lagged
+    sub.lagged = false
+    return lagged
+}
+
+// Flags every subscriber on this instance as lagged, for when events may
+// have been lost on their way here.
+func markAllSubscribersLagged() {
+    subscribersLock.Lock()
+    defer subscribersLock.Unlock()
 
-    listener.Lock.Lock()
-    listener.Cond.Broadcast()
+    for _, userSubscribers := range subscribers {
+        for sub := range userSubscribers {
+            sub.lagged = true
+        }
+    }
+}
 
-    listener.Message = message
-    listener.TimeoutChan = nil
+// Waits until an event is queued for the subscriber (or timeout).
+// Unless allEvents is set, anything other than a message event is skipped.
+func (sub *EventSubscriber) wait(allEvents bool) (event Event, timedOut bool) {
+    timeout := time.After(time.Second * MessageEventTimeout)
+    for {
+        select {
+        case event = <-sub.Events:
+            if allEvents || event.Type == EventTypeMessage {
+                return event, false
+            }
+        case <-timeout:
+            return Event{}, true
+        }
+    }
+}
 
-    listener.Lock.Unlock()
+// Sends an event to every subscriber of the given user, on every instance.
+func sendEvent(userId int, event Event) {
+    if err := eventBus.publish(userId, event); err != nil {
+        log.Printf("Failed to publish %v event %v: %v\n", event.Type, event.Id, err)
+    }
 }
 
-// Waits until an event is received (or timeout).
+// Sends an event to every subscriber of the given user on this instance.
+// Never blocks; if a subscriber's queue is full, it's flagged as lagged instead.
+func deliverEvent(userId int, event Event) {
+    subscribersLock.Lock()
+    defer subscribersLock.Unlock()
+
+    for sub := range subscribers[userId] {
+        select {
+        case sub.Events <- event:
+        default:
+            log.Printf("Event queue full for user %v, dropping %v event %v\n", userId, event.Type, event.Id)
+            sub.lagged = true
+        }
+    }
+}
+
+// Sends a message event to the given user.
+func sendMessageEvent(userId int, message Message) {
+    sendEvent(userId, newMessageEvent(message))
+}
+
+// Waits until a message event is received (or timeout).
+// Anything sent before this is called isn't received; use subscribeEvents
+// directly to avoid missing events.
 func waitForMessageEvent(userId int) (message Message, timedOut bool) {
-    listener := getListener(userId)
+    sub := subscribeEvents(userId)
+    defer sub.unsubscribe()
 
-    // spin off goroutine for wait loop
-    done := make(chan bool)
-    go func() {
-        for {
-            listener.Lock.Lock()
-            listener.Cond.Wait()
+    event, timedOut := sub.wait(false)
+    message, _ = event.getMessage()
+    return message, timedOut
+}
 
-            if listener.TimeoutChan == nil {
-                // legit signal!
-                message = listener.Message
+// Calls send for every message the user receives after afterId, then for
+// every new event as it arrives, until closed is closed or a call fails.
+// keepAlive is called every keepAlivePeriod so the connection isn't dropped
+// while idle.
+// If afterId is 0, only new events are sent.
+func (api *API) streamEvents(user User, afterId int, keepAlivePeriod time.Duration, closed <-chan bool, send func(Event) error, keepAlive func() error) {
+    // subscribe before catching up, so nothing sent in between is missed
+    sub := subscribeEvents(user.Id)
+    defer sub.unsubscribe()
 
-                listener.Lock.Unlock()
-                done <- true
+    ticker := time.NewTicker(keepAlivePeriod)
+    defer ticker.Stop()
 
-                break
-            } else if listener.TimeoutChan == &done {
-                // timeout was for us :(
-                
-                listener.Lock.Unlock()
-                done <- false
+    lastId := afterId
 
-                break
+    // messages sent while catching up, so they aren't sent again when their
+    // events come through
+    caughtUp := make(map[int]bool)
+
+    // only messages are stored, so other events can't be caught up on
+    catchUp := func() error {
+        for {
+            message, ok := api.store.getNextMessageAfterId(user, lastId)
+            if !ok {
+                return nil
             }
+            if !caughtUp[message.Id] {
+                if err := send(newMessageEvent(message)); err != nil {
+                    return err
+                }
+                caughtUp[message.Id] = true
+            }
+            lastId = message.Id
+        }
+    }
 
-            listener.Lock.Unlock()
+    if lastId > 0 {
+        if err := catchUp(); err != nil {
+            log.Printf("Sending event failed: %v\n", err)
+            return
         }
-    }()
+    }
 
-    select {
-    case <-done:
-        //log.Println("Received message while waiting")
+    for {
+        select {
+        case <-closed:
+            log.Println("Event stream closed by client")
+            return
+        case <-ticker.C:
+            if err := keepAlive(); err != nil {
+                log.Printf("Sending keepalive failed: %v\n", err)
+                return
+            }
+        case event := <-sub.Events:
+            message, isMessage := event.getMessage()
+            if isMessage && caughtUp[message.Id] {
+                delete(caughtUp, message.Id)
+                continue
+            }
+            if err := send(event); err != nil {
+                log.Printf("Sending event failed: %v\n", err)
+                return
+            }
+            if isMessage && message.Id > lastId {
+                lastId = message.Id
+            }
 
-        return message, false
-    case <-time.After(time.Second * MessageEventTimeout):
-        //log.Println("Timed out while waiting")
-        //log.Println("Broadcasting timeout signal")
-
-        listener.Lock.Lock()
-
-        listener.TimeoutChan = &done
-
-        listener.Cond.Broadcast()
-        listener.Lock.Unlock()
-
-        //log.Println("Waiting for response from listener")
-        // this will either mean we successfully timed out or we
-        // were receiving something while timing out
-        if <-done {
-            //log.Println("Surprise! Received data")
-            return message, false
-        } else {
-            //log.Println("Timeout successful")
-            return Message{}, true
+            // some events were dropped, so get what we can from the database
+            if sub.checkLagged() && lastId > 0 {
+                if err := catchUp(); err != nil {
+                    log.Printf("Sending event failed: %v\n", err)
+                    return
+                }
+            }
         }
     }
 }
 
-func nextMessageHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) nextMessageHandler(w http.ResponseWriter, r *http.Request) int {
     log.Println("Handling /nextMessage")
-    user, ok := getCurrentUser(r)
+    user, ok := api.getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -138,8 +340,10 @@ func nextMessageHandler(w http.ResponseWriter, r *http.Request) int {
             }
         }
 
+        allEvents := r.FormValue("events") == "all"
+
         log.Printf("After ID: %v\n", afterId)
-        resp = getNextMessageEndpoint(user, afterId)
+        resp = api.getNextEventEndpoint(user, afterId, allEvents)
     default:
         return http.StatusMethodNotAllowed
     }
@@ -148,29 +352,47 @@ func nextMessageHandler(w http.ResponseWriter, r *http.Request) int {
     return http.StatusOK
 }
 
+/*
+ * GET /nextMessage
+ * Gets the next message received after afterId, waiting for one if there
+ * isn't one already.
+ * If allEvents is set, any other event received while waiting is returned
+ * too.
+ */
 type GetNextMessageResponse struct {
     Success     bool        `json:"success"`
     Error       string      `json:"error"`
     Message     Message     `json:"message"`
+    Event       *Event      `json:"event,omitempty"`
+}
+
+func (api *API) getNextMessageEndpoint(user User, afterId int) GetNextMessageResponse {
+    return api.getNextEventEndpoint(user, afterId, false)
 }
 
-func getNextMessageEndpoint(user User, afterId int) GetNextMessageResponse {
+func (api *API) getNextEventEndpoint(user User, afterId int, allEvents bool) GetNextMessageResponse {
+    // subscribe first, so a message sent while we're checking isn't missed
+    sub := subscribeEvents(user.Id)
+    defer sub.unsubscribe()
+
     // is there already a new message?
     if afterId > 0 {
-        message, ok := user.getNextMessageAfterId(afterId)
+        message, ok := api.store.getNextMessageAfterId(user, afterId)
         if ok {
             log.Printf("Found existing message: %v\n", message.Id)
+            event := newMessageEvent(message)
             return GetNextMessageResponse{
                 Success:    true,
                 Message:    message,
+                Event:      &event,
             }
         }
     }
 
     // no new messages: long-poll and wait
-    log.Println("Waiting for message")
+    log.Println("Waiting for event")
 
-    message, timedOut := waitForMessageEvent(user.Id)
+    event, timedOut := sub.wait(allEvents)
 
     if timedOut {
         return GetNextMessageResponse{
@@ -178,9 +400,12 @@ func getNextMessageEndpoint(user User, afterId int) GetNextMessageResponse {
             Error:      "Timed out",
         }
     } else {
+        // only set for message events
+        message, _ := event.getMessage()
         return GetNextMessageResponse{
             Success:    true,
             Message:    message,
+            Event:      &event,
         }
     }
 }
@@ -18,7 +18,7 @@ func TestEvents(t *testing.T) {
         Email:      "xXx_0n10n_fan_xXx@hotmail.com",
         Picture:    "tone.jpg",
     }
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:         1001,
@@ -29,19 +29,19 @@ func TestEvents(t *testing.T) {
         Email:      "pm@gmail.com",
         Picture:    "hehe",
     }
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
-    user1.addFriend(user2)
+    testStore.addFriend(user1, user2)
     
-    msg1A, _ := user2.addMessageToUser(user1, "soz", ContentTypeText)
-    msg1B, _ := user1.addMessageToUser(user2, "malcom pls", ContentTypeText)
-    msg2A, _ := user2.addMessageToUser(user1, "lel", ContentTypeText)
-    msg2B, _ := user1.addMessageToUser(user2, "not lel", ContentTypeText)
-    msg3A, _ := user2.addMessageToUser(user1, "idc", ContentTypeText)
-    msg3B, _ := user1.addMessageToUser(user2, "i h8 u", ContentTypeText)
+    msg1A, _ := testAPI.addMessageToUser(user2, user1, "soz", ContentTypeText)
+    msg1B, _ := testAPI.addMessageToUser(user1, user2, "malcom pls", ContentTypeText)
+    msg2A, _ := testAPI.addMessageToUser(user2, user1, "lel", ContentTypeText)
+    msg2B, _ := testAPI.addMessageToUser(user1, user2, "not lel", ContentTypeText)
+    msg3A, _ := testAPI.addMessageToUser(user2, user1, "idc", ContentTypeText)
+    msg3B, _ := testAPI.addMessageToUser(user1, user2, "i h8 u", ContentTypeText)
 
-    msg4, _ := user2.addMessageToUser(user1, "top kek", ContentTypeText)
-    msg5, _ := user2.addMessageToUser(user1, "bye", ContentTypeText)
+    msg4, _ := testAPI.addMessageToUser(user2, user1, "top kek", ContentTypeText)
+    msg5, _ := testAPI.addMessageToUser(user2, user1, "bye", ContentTypeText)
 
     timeout := 100 * time.Millisecond
     sendWait := 100 * time.Millisecond
@@ -264,7 +264,7 @@ func TestEvents(t *testing.T) {
 
     log.Println("Testing afterId = 0")
     go func() {
-        resp := getNextMessageEndpoint(user1, 0)
+        resp := testAPI.getNextMessageEndpoint(user1, 0)
         log.Printf("[1] D1: success %v, error %v, msg %v\n", resp.Success, resp.Error, resp.Message.Id)
         done1 <- (resp.Success && resp.Message.Id == msg4.Id)
     }()
@@ -297,7 +297,7 @@ func TestEvents(t *testing.T) {
 
     log.Printf("Testing afterId = msg4.Id (%v)\n", msg4.Id)
     go func() {
-        resp := getNextMessageEndpoint(user1, msg4.Id)
+        resp := testAPI.getNextMessageEndpoint(user1, msg4.Id)
         log.Printf("[1] D2: success %v, error %v, msg %v\n", resp.Success, resp.Error, resp.Message.Id)
         done1 <- (resp.Success && resp.Message.Id == msg5.Id)
     }()
@@ -318,11 +318,11 @@ func TestEvents(t *testing.T) {
     done1 = make(chan bool)
 
     log.Println("Adding msg6")
-    msg6, _ := user2.addMessageToUser(user1, "glhf", ContentTypeText)
+    msg6, _ := testAPI.addMessageToUser(user2, user1, "glhf", ContentTypeText)
 
     log.Printf("Testing afterId = msg5.Id (%v)\n", msg5.Id)
     go func() {
-        resp := getNextMessageEndpoint(user1, msg5.Id)
+        resp := testAPI.getNextMessageEndpoint(user1, msg5.Id)
         log.Printf("[1] D3: success %v, error %v, msg %v\n", resp.Success, resp.Error, resp.Message.Id)
         done1 <- (resp.Success && resp.Message.Id == msg6.Id)
     }()
@@ -346,14 +346,14 @@ func TestEvents(t *testing.T) {
 
     log.Printf("Testing afterId = msg6.Id (%v)\n", msg6.Id)
     go func() {
-        resp := getNextMessageEndpoint(user1, msg6.Id)
+        resp := testAPI.getNextMessageEndpoint(user1, msg6.Id)
         log.Printf("[1] D4: success %v, error %v, msg %v\n", resp.Success, resp.Error, resp.Message.Id)
         done1 <- (resp.Success && resp.Message.Id == nextId)
     }()
 
     time.Sleep(sendWait)
     log.Println("Adding msg7")
-    msg7, _ := user2.addMessageToUser(user1, "gg", ContentTypeText)
+    msg7, _ := testAPI.addMessageToUser(user2, user1, "gg", ContentTypeText)
     if msg7.Id != nextId {
         t.Errorf("msg7.Id wasn't what we expected: expected %v, got %v; correct assumption!", nextId, msg7.Id)
     }
@@ -395,7 +395,7 @@ func TestEvents(t *testing.T) {
 
     log.Println("Testing afterId = 0")
     go func() {
-        resp := getNextMessageEndpoint(user1, 0)
+        resp := testAPI.getNextMessageEndpoint(user1, 0)
         log.Printf("[1] E: success %v, error %v, msg %v\n", resp.Success, resp.Error, resp.Message.Id)
         done1 <- (resp.Success && resp.Message.Id == nextId)
     }()
@@ -409,7 +409,7 @@ func TestEvents(t *testing.T) {
     }
 
     time.Sleep(sendWait)
-    resp := sendMessageEndpoint(user2, user1.Id, req)
+    resp := testAPI.sendMessageEndpoint(user2, user1.Id, req)
     if !resp.Success {
         t.Errorf("Send message failed: %v", resp.Error)
     }
@@ -433,3 +433,140 @@ func TestEvents(t *testing.T) {
 
     log.Println("** Event tests should be done now")
 }
+
+func TestEventQueues(t *testing.T) {
+    timeout := 100 * time.Millisecond
+
+    log.Println("** Testing queued events aren't lost")
+
+    sub := subscribeEvents(2000)
+
+    sendMessageEvent(2000, Message{Id: 1})
+    sendMessageEvent(2000, Message{Id: 2})
+
+    for _, id := range []int{1, 2} {
+        select {
+        case event := <-sub.Events:
+            if msg, _ := event.getMessage(); msg.Id != id {
+                t.Errorf("Expected message %v, got %v", id, event)
+            }
+        case <-time.After(timeout):
+            t.Errorf("Message %v wasn't queued", id)
+        }
+    }
+
+    log.Println("** Testing every device receives every event")
+
+    sub2 := subscribeEvents(2000)
+
+    sendMessageEvent(2000, Message{Id: 3})
+    sendMessageEvent(2000, Message{Id: 4})
+
+    for i, s := range []*EventSubscriber{sub, sub2} {
+        for _, id := range []int{3, 4} {
+            select {
+            case event := <-s.Events:
+                if msg, _ := event.getMessage(); msg.Id != id {
+                    t.Errorf("Expected message %v for subscriber %v, got %v", id, i, event)
+                }
+            case <-time.After(timeout):
+                t.Errorf("Message %v wasn't queued for subscriber %v", id, i)
+            }
+        }
+    }
+
+    log.Println("** Testing unsubscribed queues don't receive events")
+
+    sub2.unsubscribe()
+    sendMessageEvent(2000, Message{Id: 5})
+
+    select {
+    case event := <-sub2.Events:
+        t.Errorf("Unsubscribed queue received %v", event)
+    case <-time.After(timeout):
+    }
+
+    log.Println("** Testing full queues are flagged as lagged")
+
+    if sub.checkLagged() {
+        t.Errorf("Subscriber shouldn't be lagged yet")
+    }
+    for i := 0; i < EventQueueSize; i++ {
+        sendMessageEvent(2000, Message{Id: 6 + i})
+    }
+    if !sub.checkLagged() {
+        t.Errorf("Subscriber should be lagged after its queue filled up")
+    }
+    if sub.checkLagged() {
+        t.Errorf("checkLagged should reset the flag")
+    }
+
+    sub.unsubscribe()
+}
+
+func TestTypedEvents(t *testing.T) {
+    timeout := 100 * time.Millisecond
+    sendWait := 100 * time.Millisecond
+
+    user := User{Id: 2001}
+    friend := User{Id: 2002, Name: "Malcolm Turnbull"}
+
+    log.Println("** Testing message-only waits skip other events")
+
+    done := make(chan GetNextMessageResponse)
+    go func() {
+        done <- testAPI.getNextEventEndpoint(user, 0, false)
+    }()
+
+    time.Sleep(sendWait)
+    sendEvent(user.Id, newEvent(EventTypeFriendRequestReceived, friend.toPublic()))
+
+    select {
+    case resp := <-done:
+        t.Errorf("Shouldn't have received a non-message event, got %v", resp.Event)
+    case <-time.After(timeout):
+        log.Println("Timed out successfully")
+    }
+
+    sendMessageEvent(user.Id, Message{Id: 7, Content: "hi"})
+
+    select {
+    case resp := <-done:
+        if !resp.Success || resp.Message.Id != 7 || resp.Event == nil || resp.Event.Type != EventTypeMessage {
+            t.Errorf("Expected message event for message 7, got %v", resp)
+        }
+    case <-time.After(timeout):
+        t.Errorf("Message event wasn't received in time")
+    }
+
+    log.Println("** Testing waits for all events receive other events")
+
+    go func() {
+        done <- testAPI.getNextEventEndpoint(user, 0, true)
+    }()
+
+    time.Sleep(sendWait)
+    sendEvent(user.Id, newEvent(EventTypeFriendRequestReceived, friend.toPublic()))
+
+    select {
+    case resp := <-done:
+        if !resp.Success || resp.Event == nil || resp.Event.Type != EventTypeFriendRequestReceived {
+            t.Errorf("Expected friend request event, got %v", resp)
+        } else if requestor, ok := resp.Event.Payload.(PublicUser); !ok || requestor.Id != friend.Id {
+            t.Errorf("Friend request event had the wrong payload: %v", resp.Event.Payload)
+        }
+        if resp.Message.Id != 0 {
+            t.Errorf("Non-message events shouldn't set message, got %v", resp.Message.Id)
+        }
+    case <-time.After(timeout):
+        t.Errorf("Friend request event wasn't received in time")
+    }
+
+    log.Println("** Testing event ids increase")
+
+    event1 := newEvent(EventTypeProfileUpdated, friend.toPublic())
+    event2 := newEvent(EventTypeProfileUpdated, friend.toPublic())
+    if event2.Id <= event1.Id {
+        t.Errorf("Event ids should increase: %v then %v", event1.Id, event2.Id)
+    }
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// how often we send a comment line so proxies don't drop idle connections
+const EventStreamKeepAlivePeriod = 30 * time.Second
+
+/*
+ * /events endpoint
+ */
+
+func (api *API) eventStreamHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /events")
+
+    // EventSource can't set headers either
+    useSessionTokenParam(r)
+
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    if r.Method != "GET" {
+        return http.StatusMethodNotAllowed
+    }
+
+    // default to ID of 0
+    afterId := 0
+
+    // EventSource sends Last-Event-ID by itself when it reconnects; after is
+    // for the first connection
+    afterIdStr := r.Header.Get("Last-Event-ID")
+    if afterIdStr == "" {
+        afterIdStr = r.FormValue("after")
+    }
+    if afterIdStr != "" {
+        var err error
+        afterId, err = strconv.Atoi(afterIdStr)
+        if err != nil || afterId <= 0 {
+            log.Println("After ID not positive integer")
+            return http.StatusBadRequest
+        }
+    }
+
+    return api.serveEventStream(w, user, afterId)
+}
+
+// Streams events to the user as Server-Sent Events until the client goes
+// away.
+// If afterId is given, any messages received after it are sent first.
+func (api *API) serveEventStream(w http.ResponseWriter, user User, afterId int) int {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        log.Println("Streaming not supported")
+        return http.StatusInternalServerError
+    }
+
+    var closed <-chan bool
+    if closeNotifier, ok := w.(http.CloseNotifier); ok {
+        closed = closeNotifier.CloseNotify()
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    // stop nginx from buffering the whole response
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    api.streamEvents(user, afterId, EventStreamKeepAlivePeriod, closed,
+        func(event Event) error {
+            return writeEventStreamEvent(w, flusher, event)
+        },
+        func() error {
+            if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+                return err
+            }
+            flusher.Flush()
+            return nil
+        })
+
+    return http.StatusOK
+}
+
+// Writes an event in the text/event-stream format.
+// Only message events get an id, since they're the only ones that can be
+// replayed with Last-Event-ID.
+func writeEventStreamEvent(w io.Writer, flusher http.Flusher, event Event) error {
+    b, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    if message, ok := event.getMessage(); ok {
+        if _, err := fmt.Fprintf(w, "id: %d\n", message.Id); err != nil {
+            return err
+        }
+    }
+    if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, b); err != nil {
+        return err
+    }
+    flusher.Flush()
+    return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "testing"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type testServerSentEvent struct {
+    Id      int
+    Event   string
+    Data    testMessageEvent
+}
+
+// Reads server-sent events from the reader in the background, skipping comments
+func readServerSentEvents(reader *bufio.Reader) chan testServerSentEvent {
+    events := make(chan testServerSentEvent, 10)
+    go func() {
+        defer close(events)
+        var event testServerSentEvent
+        for {
+            line, err := reader.ReadString('\n')
+            if err != nil {
+                return
+            }
+            line = strings.TrimSuffix(line, "\n")
+            switch {
+            case line == "":
+                if event.Event != "" {
+                    events <- event
+                }
+                event = testServerSentEvent{}
+            case strings.HasPrefix(line, "id: "):
+                event.Id, _ = strconv.Atoi(strings.TrimPrefix(line, "id: "))
+            case strings.HasPrefix(line, "event: "):
+                event.Event = strings.TrimPrefix(line, "event: ")
+            case strings.HasPrefix(line, "data: "):
+                json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.Data)
+            }
+        }
+    }()
+    return events
+}
+
+func TestEventStream(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{
+        Id:         1000,
+        Uid:        "1000",
+        Name:       "Tony Abbott",
+        FirstName:  "Tony",
+        LastName:   "Abbott",
+        Email:      "xXx_0n10n_fan_xXx@hotmail.com",
+        Picture:    "tone.jpg",
+    }
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:         1001,
+        Uid:        "1001",
+        Name:       "Malcolm Turnbull",
+        FirstName:  "Malcolm",
+        LastName:   "Turnbull",
+        Email:      "pm@gmail.com",
+        Picture:    "hehe",
+    }
+    testStore.createUser(&user2)
+
+    testStore.addFriend(user1, user2)
+
+    timeout := 500 * time.Millisecond
+    sendWait := 100 * time.Millisecond
+
+    req := SendMessageRequest{
+        Content:        "soz",
+        ContentType:    ContentTypeText,
+    }
+
+    msg1 := testAPI.sendMessageEndpoint(user2, user1.Id, req)
+    msg2 := testAPI.sendMessageEndpoint(user2, user1.Id, req)
+    msg3 := testAPI.sendMessageEndpoint(user2, user1.Id, req)
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        afterId, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+        testAPI.serveEventStream(w, user1, afterId)
+    }))
+    defer server.Close()
+
+    log.Println("** Testing Last-Event-ID replays missed messages")
+
+    httpReq, _ := http.NewRequest("GET", server.URL, nil)
+    httpReq.Header.Set("Last-Event-ID", strconv.Itoa(msg1.Id))
+    res, err := http.DefaultClient.Do(httpReq)
+    if err != nil {
+        t.Fatalf("Request failed: %v", err)
+    }
+    defer res.Body.Close()
+
+    if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+        t.Errorf("Wrong content type: %v", contentType)
+    }
+
+    events := readServerSentEvents(bufio.NewReader(res.Body))
+
+    expectEvent := func(id int) {
+        select {
+        case event := <-events:
+            if event.Event != "message" || event.Id != id || event.Data.Payload.Id != id {
+                t.Errorf("Expected message %v, got %v", id, event)
+            }
+        case <-time.After(timeout):
+            t.Errorf("Didn't receive message %v in time", id)
+        }
+    }
+
+    expectEvent(msg2.Id)
+    expectEvent(msg3.Id)
+
+    log.Println("** Testing live delivery after replay")
+
+    select {
+    case event := <-events:
+        t.Errorf("Shouldn't have received an event yet, got %v", event)
+    case <-time.After(sendWait):
+    }
+
+    msg4 := testAPI.sendMessageEndpoint(user2, user1.Id, req)
+    expectEvent(msg4.Id)
+}
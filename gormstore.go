@@ -0,0 +1,587 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    "github.com/jinzhu/gorm"
+)
+
+// Databases gormStore supports
+const (
+    DialectPostgres = "postgres"
+    // connection strings are file names, or ":memory:"
+    DialectSQLite   = "sqlite3"
+)
+
+// gormStore is a Store backed by a SQL database, through gorm.
+type gormStore struct {
+    db          *gorm.DB
+    dialect     string
+}
+
+// openGormStore connects to the database. Call migrate before using it.
+func openGormStore(dialect string, connectionString string) (*gormStore, error) {
+    if dialect != DialectPostgres && dialect != DialectSQLite {
+        return nil, fmt.Errorf("openGormStore: unsupported database %q", dialect)
+    }
+
+    db, err := gorm.Open(dialect, connectionString)
+    if err != nil {
+        return nil, err
+    }
+
+    if dialect == DialectSQLite {
+        // SQLite locks the whole database to write, so connections would
+        // just fail with "database is locked" waiting on each other, and an
+        // in-memory database only exists for the connection that made it
+        db.DB().SetMaxOpenConns(1)
+    }
+
+    return &gormStore{db: &db, dialect: dialect}, nil
+}
+
+// Applies any migrations the database doesn't have yet.
+func (s *gormStore) migrate() error {
+    return s.migrateUp(latestMigration())
+}
+
+func (s *gormStore) close() error {
+    return s.db.Close()
+}
+
+// Gets the error from a lookup, as errNotFound if there wasn't anything.
+func lookupError(result *gorm.DB) error {
+    if result.RecordNotFound() {
+        return errNotFound
+    }
+    return result.Error
+}
+
+/*
+ * Users
+ */
+
+func (s *gormStore) getUser(id int) (user User, err error) {
+    err = lookupError(s.db.Where(&User{Id: id}).First(&user))
+    return user, err
+}
+
+func (s *gormStore) getUserByUid(uid string) (user User, err error) {
+    err = lookupError(s.db.Where(&User{Uid: uid}).First(&user))
+    return user, err
+}
+
+func (s *gormStore) createUser(user *User) error {
+    return s.db.Create(user).Error
+}
+
+func (s *gormStore) saveUser(user *User) error {
+    return s.db.Save(user).Error
+}
+
+func (s *gormStore) deleteUser(user User) error {
+    tx := s.db.Begin()
+
+    if err := tx.Where(&APIKey{BotId: user.Id}).Delete(APIKey{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where("user_id = ? or friend_id = ?", user.Id, user.Id).Delete(UserFriend{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where("user_id = ? or requestor_id = ?", user.Id, user.Id).Delete(FriendRequest{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where(&GroupMember{UserId: user.Id}).Delete(GroupMember{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where("user_id = ? or friend_id = ?", user.Id, user.Id).Delete(Conversation{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where("user_id = ? or friend_id = ?", user.Id, user.Id).Delete(ReadMarker{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Delete(&user).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit().Error
+}
+
+func (s *gormStore) searchUsersByEmail(email string, exceptId int) (users Users) {
+    s.db.Where("upper(email) = ? and id != ?", strings.ToUpper(email), exceptId).Find(&users)
+    return users
+}
+
+func (s *gormStore) searchUsersByName(name string, exceptId int) (users Users) {
+    s.db.Where(s.likeInsensitive("name")+" and id != ?", "%"+likeEscaper.Replace(name)+"%", exceptId).Find(&users)
+    return users
+}
+
+// Escapes LIKE's wildcards, so they're matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Gets a condition matching column against a LIKE pattern ignoring case,
+// with wildcards escaped by likeEscaper
+func (s *gormStore) likeInsensitive(column string) string {
+    if s.dialect == DialectSQLite {
+        // LIKE already ignores case (for ASCII at least), but there's no
+        // escape character unless it's given one
+        return column + ` LIKE ? ESCAPE '\'`
+    }
+    return column + " ILIKE ?"
+}
+
+func (s *gormStore) getBots(owner User) (bots Users) {
+    s.db.Where(&User{OwnerId: owner.Id, IsBot: true}).Order("id").Find(&bots)
+    return bots
+}
+
+/*
+ * Friends
+ */
+
+func (s *gormStore) getFriends(user User) Users {
+    friends := Users{}
+    s.db.Joins("inner join user_friends on user_friends.friend_id = users.id left join conversations on conversations.user_id = user_friends.user_id and conversations.friend_id = user_friends.friend_id").Where("user_friends.user_id = ?", user.Id).Order("coalesce(conversations.last_message_id, 0) desc, users.name").Find(&friends)
+    return friends
+}
+
+func (s *gormStore) addFriend(user User, friend User) error {
+    if user.Id == friend.Id {
+        return errors.New("Cannot add yourself as a friend")
+    }
+
+    tx := s.db.Begin()
+
+    userFriend := UserFriend{UserId: user.Id, FriendId: friend.Id}
+    if err := tx.Create(&userFriend).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    userFriend = UserFriend{UserId: friend.Id, FriendId: user.Id}
+    if err := tx.Create(&userFriend).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    tx.Commit()
+    return nil
+}
+
+func (s *gormStore) deleteFriend(user User, friend User) error {
+    var uf1, uf2 UserFriend
+
+    // check two-way friendship exists
+    if err := lookupError(s.db.Where(&UserFriend{UserId: user.Id, FriendId: friend.Id}).First(&uf1)); err != nil {
+        return err
+    }
+    if err := lookupError(s.db.Where(&UserFriend{UserId: friend.Id, FriendId: user.Id}).First(&uf2)); err != nil {
+        return err
+    }
+
+    tx := s.db.Begin()
+
+    // do actual deleting
+    if err := tx.Where("user_id = ? and friend_id = ?", user.Id, friend.Id).Delete(UserFriend{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := tx.Where("friend_id = ? and user_id = ?", user.Id, friend.Id).Delete(UserFriend{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    tx.Commit()
+    return nil
+}
+
+func (s *gormStore) isFriend(user User, friend User) bool {
+    var uf UserFriend
+    return s.db.Where(&UserFriend{UserId: user.Id, FriendId: friend.Id}).Find(&uf).Error == nil
+}
+
+/*
+ * Friend requests
+ */
+
+func (s *gormStore) getFriendRequests(user User) Users {
+    requestors := Users{}
+    s.db.Joins("inner join friend_requests on requestor_id = id").Where(&UserFriend{UserId: user.Id}).Find(&requestors)
+    return requestors
+}
+
+func (s *gormStore) addFriendRequest(user User, requestor User) error {
+    if user.Id == requestor.Id {
+        return errors.New("Cannot request to be your own friend")
+    }
+
+    return s.db.Create(&FriendRequest{UserId: user.Id, RequestorId: requestor.Id}).Error
+}
+
+func (s *gormStore) hasFriendRequest(user User, requestor User) bool {
+    var friendRequest FriendRequest
+    return s.db.Where(&FriendRequest{UserId: user.Id, RequestorId: requestor.Id}).Find(&friendRequest).Error == nil
+}
+
+func (s *gormStore) deleteFriendRequest(user User, requestor User) error {
+    return s.db.Where("user_id = ? and requestor_id = ?", user.Id, requestor.Id).Delete(FriendRequest{}).Error
+}
+
+/*
+ * Messages
+ */
+
+func (s *gormStore) addMessage(msg *Message) error {
+    msg.ConversationKey = msg.conversationKey()
+
+    tx := s.db.Begin()
+
+    if err := tx.Create(msg).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    if msg.RecipientType == RecipientTypeUser {
+        // the lower id's conversation first, whoever sent it, so messages
+        // going both ways at once don't deadlock on each other's rows
+        userId, friendId := msg.SenderId, msg.RecipientId
+        if friendId < userId {
+            userId, friendId = friendId, userId
+        }
+        if err := updateConversation(tx, userId, friendId, *msg); err != nil {
+            tx.Rollback()
+            return err
+        }
+        if err := updateConversation(tx, friendId, userId, *msg); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    return tx.Commit().Error
+}
+
+// Records msg as the latest message in userId's conversation with friendId,
+// creating the conversation if it's their first.
+// It's one statement, so concurrent first messages can't both try to create
+// it, and the condition stops a concurrent older message from winning.
+func updateConversation(tx *gorm.DB, userId int, friendId int, msg Message) error {
+    return tx.Exec(`insert into conversations (user_id, friend_id, last_message_id, last_message_time) values (?, ?, ?, ?)
+        on conflict (user_id, friend_id) do update
+        set last_message_id = excluded.last_message_id, last_message_time = excluded.last_message_time
+        where conversations.last_message_id < excluded.last_message_id`,
+        userId, friendId, msg.Id, msg.Timestamp).Error
+}
+
+func (s *gormStore) getMessage(id int) (msg Message, err error) {
+    err = lookupError(s.db.Where(&Message{Id: id}).First(&msg))
+    return msg, err
+}
+
+func (s *gormStore) saveMessage(msg *Message) error {
+    return s.db.Save(msg).Error
+}
+
+func (s *gormStore) getMessagesWithUser(user User, otherUser User, last int, amount int) Messages {
+    return s.messagesBefore(userConversationKey(user.Id, otherUser.Id), last, amount)
+}
+
+func (s *gormStore) getGroupMessages(group Group, last int, amount int) Messages {
+    return s.messagesBefore(groupConversationKey(group.Id), last, amount)
+}
+
+func (s *gormStore) getMessagesWithUserAfter(user User, otherUser User, after int, amount int) Messages {
+    return s.messagesAfter(userConversationKey(user.Id, otherUser.Id), after, amount)
+}
+
+func (s *gormStore) getGroupMessagesAfter(group Group, after int, amount int) Messages {
+    return s.messagesAfter(groupConversationKey(group.Id), after, amount)
+}
+
+// Gets the amount messages in the conversation before last (or the latest, if
+// last is -1), oldest first
+func (s *gormStore) messagesBefore(conversationKey string, last int, amount int) Messages {
+    msgs := Messages{}
+    query := s.db.Where("conversation_key = ?", conversationKey)
+    if last != -1 {
+        query = query.Where("id < ?", last)
+    }
+    query.Order("id desc").Limit(amount).Find(&msgs)
+    msgs.reverse()
+
+    return msgs
+}
+
+// Gets the amount messages in the conversation after after, oldest first
+func (s *gormStore) messagesAfter(conversationKey string, after int, amount int) Messages {
+    msgs := Messages{}
+    s.db.Where("conversation_key = ? and id > ?", conversationKey, after).Order("id").Limit(amount).Find(&msgs)
+    return msgs
+}
+
+func (s *gormStore) getNextMessageAfterId(user User, afterId int) (msg Message, ok bool) {
+    if err := s.db.Where("((recipient_type = ? and recipient_id = ?) or (recipient_type = ? and sender_id != ? and recipient_id in (select group_id from group_members where user_id = ?))) and id > ?", RecipientTypeUser, user.Id, RecipientTypeGroup, user.Id, user.Id, afterId).First(&msg).Error; err == nil {
+        return msg, true
+    }
+    return Message{}, false
+}
+
+func (s *gormStore) lastMessageIdFromUser(user User, otherUser User) int {
+    var msg Message
+    if err := s.db.Where("sender_id = ? and recipient_id = ? and recipient_type = ?", otherUser.Id, user.Id, RecipientTypeUser).Order("id desc").First(&msg).Error; err != nil {
+        return 0
+    }
+    return msg.Id
+}
+
+func (s *gormStore) getConversation(user User, otherUser User) (conversation Conversation, err error) {
+    err = lookupError(s.db.Where(&Conversation{UserId: user.Id, FriendId: otherUser.Id}).First(&conversation))
+    return conversation, err
+}
+
+// Does it in one query.
+func (s *gormStore) getConversationSummaries(user User) (summaries map[int]ConversationSummary) {
+    summaries = make(map[int]ConversationSummary)
+
+    rows, err := s.db.Raw(`
+        select f.friend_id,
+            (select count(*) from messages u
+                where u.sender_id = f.friend_id and u.recipient_id = f.user_id and u.recipient_type = ?
+                and u.id > coalesce(r.last_read_id, 0) and not u.deleted),
+            m.id, m.content, m.content_type, m.sender_id, m.recipient_id, m.recipient_type, m.timestamp, m.edited_at, m.deleted
+        from user_friends f
+        left join read_markers r on r.user_id = f.user_id and r.friend_id = f.friend_id
+        left join conversations c on c.user_id = f.user_id and c.friend_id = f.friend_id
+        left join messages m on m.id = c.last_message_id
+        where f.user_id = ?`, RecipientTypeUser, user.Id).Rows()
+    if err != nil {
+        log.Printf("Failed to get conversation summaries: %v\n", err)
+        return summaries
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var summary ConversationSummary
+        var id, contentType, senderId, recipientId, recipientType sql.NullInt64
+        var content sql.NullString
+        var timestamp, editedAt *time.Time
+        var deleted sql.NullBool
+
+        if err := rows.Scan(&summary.FriendId, &summary.UnreadCount, &id, &content, &contentType, &senderId, &recipientId, &recipientType, &timestamp, &editedAt, &deleted); err != nil {
+            log.Printf("Failed to scan conversation summary: %v\n", err)
+            continue
+        }
+
+        if id.Valid {
+            summary.LastMessage = &Message{
+                Id:             int(id.Int64),
+                Content:        content.String,
+                ContentType:    ContentType(contentType.Int64),
+                SenderId:       int(senderId.Int64),
+                RecipientId:    int(recipientId.Int64),
+                RecipientType:  RecipientType(recipientType.Int64),
+                Timestamp:      *timestamp,
+                EditedAt:       editedAt,
+                Deleted:        deleted.Bool,
+            }
+        }
+
+        summaries[summary.FriendId] = summary
+    }
+
+    return summaries
+}
+
+/*
+ * Read markers
+ */
+
+func (s *gormStore) getReadMarker(user User, otherUser User) (marker ReadMarker) {
+    if err := s.db.Where(&ReadMarker{UserId: user.Id, FriendId: otherUser.Id}).First(&marker).Error; err != nil {
+        return ReadMarker{UserId: user.Id, FriendId: otherUser.Id}
+    }
+    return marker
+}
+
+func (s *gormStore) advanceReadMarker(marker ReadMarker) error {
+    var existing ReadMarker
+    if s.db.Where(&ReadMarker{UserId: marker.UserId, FriendId: marker.FriendId}).First(&existing).RecordNotFound() {
+        if err := s.db.Create(&marker).Error; err == nil {
+            return nil
+        }
+        // another device got there first, so update theirs instead
+    }
+
+    // the condition stops a concurrent older mark from winning
+    return s.db.Model(ReadMarker{}).Where("user_id = ? and friend_id = ? and last_read_id < ?", marker.UserId, marker.FriendId, marker.LastReadId).Update("last_read_id", marker.LastReadId).Error
+}
+
+/*
+ * Groups
+ */
+
+func (s *gormStore) getGroup(id int) (group Group, err error) {
+    err = lookupError(s.db.Where(&Group{Id: id}).First(&group))
+    return group, err
+}
+
+func (s *gormStore) getGroups(user User) Groups {
+    groups := Groups{}
+    s.db.Joins("inner join group_members on group_id = id").Where(&GroupMember{UserId: user.Id}).Order("id").Find(&groups)
+    return groups
+}
+
+func (s *gormStore) createGroup(group *Group, members Users) error {
+    tx := s.db.Begin()
+
+    if err := tx.Create(group).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    for _, userId := range groupMemberIds(*group, members) {
+        if err := tx.Create(&GroupMember{GroupId: group.Id, UserId: userId}).Error; err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    return tx.Commit().Error
+}
+
+func (s *gormStore) getGroupMembers(group Group) Users {
+    members := Users{}
+    s.db.Joins("inner join group_members on user_id = id").Where(&GroupMember{GroupId: group.Id}).Order("id").Find(&members)
+    return members
+}
+
+func (s *gormStore) isGroupMember(group Group, user User) bool {
+    var gm GroupMember
+    return s.db.Where(&GroupMember{GroupId: group.Id, UserId: user.Id}).First(&gm).Error == nil
+}
+
+func (s *gormStore) addGroupMember(group Group, user User) error {
+    return s.db.Create(&GroupMember{GroupId: group.Id, UserId: user.Id}).Error
+}
+
+func (s *gormStore) removeGroupMember(group Group, user User) error {
+    return s.db.Where("group_id = ? and user_id = ?", group.Id, user.Id).Delete(GroupMember{}).Error
+}
+
+/*
+ * Sessions and revoked tokens
+ */
+
+func (s *gormStore) createSession(session *Session) error {
+    // clean up while we're here
+    s.db.Where("user_id = ? and expires_at <= ?", session.UserId, time.Now()).Delete(Session{})
+
+    return s.db.Create(session).Error
+}
+
+func (s *gormStore) getSessionByHash(tokenHash string) (session Session, err error) {
+    err = lookupError(s.db.Where(&Session{TokenHash: tokenHash}).First(&session))
+    return session, err
+}
+
+func (s *gormStore) getSessions(user User) (sessions []Session) {
+    s.db.Where(&Session{UserId: user.Id}).Order("id desc").Find(&sessions)
+    return sessions
+}
+
+func (s *gormStore) saveSession(session *Session) error {
+    return s.db.Save(session).Error
+}
+
+func (s *gormStore) deleteSession(session Session) error {
+    return s.db.Delete(&session).Error
+}
+
+func (s *gormStore) revokeToken(revoked RevokedToken) error {
+    // nobody needs the expired ones any more
+    s.db.Where("expires_at <= ?", time.Now()).Delete(RevokedToken{})
+
+    if err := s.db.Create(&revoked).Error; err != nil {
+        // already revoked is fine
+        if s.isTokenRevoked(revoked.TokenHash) {
+            return nil
+        }
+        return err
+    }
+    return nil
+}
+
+func (s *gormStore) isTokenRevoked(tokenHash string) bool {
+    var revoked RevokedToken
+    return s.db.Where(&RevokedToken{TokenHash: tokenHash}).First(&revoked).Error == nil
+}
+
+func (s *gormStore) getUserRevocation(uid string) (revocation UserRevocation, err error) {
+    err = lookupError(s.db.Joins("inner join users on users.id = user_revocations.user_id").Where("users.uid = ?", uid).First(&revocation))
+    return revocation, err
+}
+
+func (s *gormStore) revokeAllSessions(revocation UserRevocation) error {
+    tx := s.db.Begin()
+
+    if err := tx.Where(&Session{UserId: revocation.UserId}).Delete(Session{}).Error; err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    // Save only updates rows that are already there, and the user may never
+    // have been revoked before
+    err := tx.Exec(`insert into user_revocations (user_id, revoked_before) values (?, ?)
+        on conflict (user_id) do update set revoked_before = excluded.revoked_before`,
+        revocation.UserId, revocation.RevokedBefore).Error
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit().Error
+}
+
+/*
+ * API keys
+ */
+
+func (s *gormStore) createAPIKey(key *APIKey) error {
+    return s.db.Create(key).Error
+}
+
+func (s *gormStore) getAPIKeyByHash(keyHash string) (key APIKey, err error) {
+    err = lookupError(s.db.Where(&APIKey{KeyHash: keyHash}).First(&key))
+    return key, err
+}
+
+func (s *gormStore) getAPIKeys(bot User) (keys []APIKey) {
+    s.db.Where(&APIKey{BotId: bot.Id}).Order("id").Find(&keys)
+    return keys
+}
+
+func (s *gormStore) getAPIKey(bot User, keyId int) (key APIKey, err error) {
+    err = lookupError(s.db.Where(&APIKey{Id: keyId, BotId: bot.Id}).First(&key))
+    return key, err
+}
+
+func (s *gormStore) saveAPIKey(key *APIKey) error {
+    return s.db.Save(key).Error
+}
+
+func (s *gormStore) deleteAPIKey(key APIKey) error {
+    return s.db.Delete(&key).Error
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+/*
+ * DB data types
+ */
+// Represents a group conversation in the database
+type Group struct {
+    Id          int         `json:"id" gorm:"primary_key" sql:"auto_increment"`
+    Name        string      `json:"name" sql:"type:varchar(256)"`
+    CreatorId   int         `json:"creatorId" sql:"not null"`
+    Timestamp   time.Time   `json:"timestamp" sql:"not null"`
+}
+
+// Represents a user's membership of a group in the database
+type GroupMember struct {
+    GroupId     int `gorm:"primary_key"`
+    UserId      int `gorm:"primary_key"`
+}
+
+type Groups []Group
+
+// creates a group with the user as its creator and first member, along with
+// the other members
+func (api *API) createGroup(user User, name string, members Users) (group Group, err error) {
+    if name == "" {
+        return group, errors.New("Group name cannot be empty")
+    }
+
+    group = Group{
+        Name:       name,
+        CreatorId:  user.Id,
+        Timestamp:  time.Now(),
+    }
+
+    err = api.store.createGroup(&group, members)
+    return group, err
+}
+
+// Gets the ids of a new group's members, creator first, without any
+// duplicates
+func groupMemberIds(group Group, members Users) []int {
+    ids := []int{group.CreatorId}
+    added := map[int]bool{group.CreatorId: true}
+    for _, member := range members {
+        if !added[member.Id] {
+            ids = append(ids, member.Id)
+            added[member.Id] = true
+        }
+    }
+    return ids
+}
+
+func (api *API) addGroupMember(group Group, user User) error {
+    if api.store.isGroupMember(group, user) {
+        return errors.New("User is already a member of the group")
+    }
+    return api.store.addGroupMember(group, user)
+}
+
+func (api *API) removeGroupMember(group Group, user User) error {
+    if !api.store.isGroupMember(group, user) {
+        return errors.New("User is not a member of the group")
+    }
+    return api.store.removeGroupMember(group, user)
+}
+
+func (api *API) addMessageToGroup(user User, group Group, content string, contentType ContentType) (msg Message, err error) {
+    if !contentType.valid() {
+        return msg, errors.New("Invalid content type")
+    }
+    if err := checkMessageLength(content); err != nil {
+        return msg, err
+    }
+
+    msg = Message{
+        Content:        content,
+        ContentType:    contentType,
+        SenderId:       user.Id,
+        RecipientId:    group.Id,
+        RecipientType:  RecipientTypeGroup,
+        Timestamp:      time.Now(),
+    }
+
+    err = api.store.addMessage(&msg)
+    return msg, err
+}
+
+// gets a group by id, as long as the user is a member of it
+func (api *API) getGroup(user User, groupId int) (group Group, err error) {
+    if group, err = api.store.getGroup(groupId); err != nil {
+        return group, errors.New("Group not found")
+    }
+    if !api.store.isGroupMember(group, user) {
+        return group, errors.New("You are not a member of the group")
+    }
+    return group, nil
+}
+
+/*
+ * API endpoints
+ */
+
+/*
+ * /groups endpoint
+ */
+
+func (api *API) groupsHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /groups")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "GET":
+        resp = api.listGroupsEndpoint(user)
+    case "POST":
+        decoder := json.NewDecoder(r.Body)
+        var req CreateGroupRequest
+        err := decoder.Decode(&req)
+        if err != nil {
+            log.Println("JSON decoding failed")
+            return http.StatusBadRequest
+        }
+        resp = api.createGroupEndpoint(user, req)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * GET /groups
+ * Gets a list of the groups the current user is a member of.
+ */
+type ListGroupsResponse struct {
+    Success bool    `json:"success"`
+    Groups  Groups  `json:"groups"`
+}
+
+func (api *API) listGroupsEndpoint(user User) ListGroupsResponse {
+    return ListGroupsResponse{
+        Success:    true,
+        Groups:     api.store.getGroups(user),
+    }
+}
+
+/*
+ * POST /groups
+ * Creates a group containing the current user and the given friends.
+ */
+type CreateGroupRequest struct {
+    Name        string  `json:"name"`
+    MemberIds   []int   `json:"memberIds"`
+}
+
+type CreateGroupResponse struct {
+    Success bool    `json:"success"`
+    Error   string  `json:"error"`
+    Id      int     `json:"id"`
+}
+
+func (api *API) createGroupEndpoint(user User, req CreateGroupRequest) CreateGroupResponse {
+    // check all the members exist and are friends before creating anything
+    var members Users
+    for _, memberId := range req.MemberIds {
+        if memberId == user.Id {
+            continue
+        }
+
+        member, err := api.store.getUser(memberId)
+        if err != nil {
+            return CreateGroupResponse{
+                Success:    false,
+                Error:      "User not found",
+            }
+        }
+
+        if !api.store.isFriend(user, member) {
+            return CreateGroupResponse{
+                Success:    false,
+                Error:      "User is not your friend",
+            }
+        }
+
+        members = append(members, member)
+    }
+
+    group, err := api.createGroup(user, req.Name, members)
+    if err != nil {
+        return CreateGroupResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    return CreateGroupResponse{
+        Success:    true,
+        Id:         group.Id,
+    }
+}
+
+/*
+ * /groups/{groupId} endpoint
+ */
+
+func (api *API) groupHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /groups/{groupId}")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    vars := mux.Vars(r)
+    groupId, err := strconv.Atoi(vars["groupId"])
+    if err != nil || groupId <= 0 {
+        log.Println("Group ID not positive integer")
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "GET":
+        resp = api.getGroupEndpoint(user, groupId)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * GET /groups/{groupId}
+ * Gets a group the current user is a member of, along with its members.
+ */
+type GetGroupResponse struct {
+    Success bool            `json:"success"`
+    Error   string          `json:"error"`
+    Group   Group           `json:"group"`
+    Members []PublicUser    `json:"members"`
+}
+
+func (api *API) getGroupEndpoint(user User, groupId int) GetGroupResponse {
+    group, err := api.getGroup(user, groupId)
+    if err != nil {
+        return GetGroupResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    members := api.store.getGroupMembers(group)
+
+    return GetGroupResponse{
+        Success:    true,
+        Group:      group,
+        Members:    members.toPublic(),
+    }
+}
+
+/*
+ * /groups/{groupId}/members/{userId} endpoint
+ */
+
+func (api *API) groupMemberHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /groups/{groupId}/members/{userId}")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    vars := mux.Vars(r)
+    groupId, err := strconv.Atoi(vars["groupId"])
+    if err != nil || groupId <= 0 {
+        log.Println("Group ID not positive integer")
+        return http.StatusBadRequest
+    }
+    memberId, err := strconv.Atoi(vars["userId"])
+    if err != nil || memberId <= 0 {
+        log.Println("User ID not positive integer")
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "PUT":
+        resp = api.addGroupMemberEndpoint(user, groupId, memberId)
+    case "DELETE":
+        resp = api.removeGroupMemberEndpoint(user, groupId, memberId)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * PUT /groups/{groupId}/members/{userId}
+ * Adds one of the current user's friends to a group the current user is in.
+ */
+
+/*
+ * DELETE /groups/{groupId}/members/{userId}
+ * Removes a user from a group. Members can remove themselves; only the
+ * group's creator can remove other members.
+ */
+type ModifyGroupMemberResponse struct {
+    Success bool    `json:"success"`
+    Error   string  `json:"error"`
+}
+
+func (api *API) addGroupMemberEndpoint(user User, groupId int, memberId int) ModifyGroupMemberResponse {
+    group, err := api.getGroup(user, groupId)
+    if err != nil {
+        return ModifyGroupMemberResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    member, err := api.store.getUser(memberId)
+    if err != nil {
+        return ModifyGroupMemberResponse{
+            Success:    false,
+            Error:      "User not found",
+        }
+    }
+
+    if !api.store.isFriend(user, member) {
+        return ModifyGroupMemberResponse{
+            Success:    false,
+            Error:      "User is not your friend",
+        }
+    }
+
+    if err := api.addGroupMember(group, member); err != nil {
+        return ModifyGroupMemberResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    return ModifyGroupMemberResponse{
+        Success:    true,
+    }
+}
+
+func (api *API) removeGroupMemberEndpoint(user User, groupId int, memberId int) ModifyGroupMemberResponse {
+    group, err := api.getGroup(user, groupId)
+    if err != nil {
+        return ModifyGroupMemberResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    if memberId != user.Id && group.CreatorId != user.Id {
+        return ModifyGroupMemberResponse{
+            Success:    false,
+            Error:      "Only the group's creator can remove other members",
+        }
+    }
+
+    member, err := api.store.getUser(memberId)
+    if err != nil {
+        return ModifyGroupMemberResponse{
+            Success:    false,
+            Error:      "User not found",
+        }
+    }
+
+    if err := api.removeGroupMember(group, member); err != nil {
+        return ModifyGroupMemberResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    return ModifyGroupMemberResponse{
+        Success:    true,
+    }
+}
+
+/*
+ * /groups/{groupId}/messages endpoint
+ */
+
+func (api *API) groupMessagesHandler(w http.ResponseWriter, r *http.Request, user User, ok bool) int {
+    log.Println("Handling /groups/{groupId}/messages")
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    vars := mux.Vars(r)
+    groupId, err := strconv.Atoi(vars["groupId"])
+    if err != nil || groupId <= 0 {
+        log.Println("Group ID not positive integer")
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "GET":
+        page, amount, ok := parseMessagePageParams(r)
+        if !ok {
+            return http.StatusBadRequest
+        }
+        resp = api.listGroupMessagesEndpoint(user, groupId, page, amount)
+    case "POST":
+        decoder := json.NewDecoder(r.Body)
+        var req SendMessageRequest
+        err := decoder.Decode(&req)
+        if err != nil {
+            log.Println("JSON decoding failed")
+            return http.StatusBadRequest
+        }
+        resp = api.sendGroupMessageEndpoint(user, groupId, req)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * GET /groups/{groupId}/messages
+ * Gets a list of the messages sent to a group the current user is in.
+ * last, after, cursor and amount behave the same as for
+ * /friends/{friendId}/messages.
+ */
+func (api *API) listGroupMessagesEndpoint(user User, groupId int, page messagePage, amount int) ListMessagesResponse {
+    group, err := api.getGroup(user, groupId)
+    if err != nil {
+        return ListMessagesResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    messages, nextCursor := pageMessages(page, amount,
+        func(last int, amount int) Messages {
+            return api.store.getGroupMessages(group, last, amount)
+        },
+        func(after int, amount int) Messages {
+            return api.store.getGroupMessagesAfter(group, after, amount)
+        })
+
+    return ListMessagesResponse{
+        Success:    true,
+        Messages:   messages,
+        NextCursor: nextCursor,
+    }
+}
+
+/*
+ * POST /groups/{groupId}/messages
+ * Sends a message from the current user to every member of a group.
+ */
+func (api *API) sendGroupMessageEndpoint(user User, groupId int, req SendMessageRequest) SendMessageResponse {
+    group, err := api.getGroup(user, groupId)
+    if err != nil {
+        return SendMessageResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    msg, sendErr := api.addMessageToGroup(user, group, req.Content, req.ContentType)
+
+    if sendErr != nil {
+        return SendMessageResponse{
+            Success:    false,
+            Error:      sendErr.Error(),
+        }
+    }
+
+    // send events to everyone else in the group, in case they're long-polling
+    for _, member := range api.store.getGroupMembers(group) {
+        if member.Id != user.Id {
+            sendMessageEvent(member.Id, msg)
+        }
+    }
+
+    return SendMessageResponse{
+        Success:    true,
+        Id:         msg.Id,
+    }
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+    "testing"
+    "log"
+    "time"
+)
+
+func TestGroups(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{
+        Id:         1,
+        Uid:        "1",
+        Name:       "Snoop Doge",
+        FirstName:  "Snoop",
+        LastName:   "Doge",
+        Email:      "poop@gmail.com",
+        Picture:    "blah",
+    }
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:         2,
+        Uid:        "2",
+        Name:       "Malcolm Turnbull",
+        FirstName:  "Malcolm",
+        LastName:   "Turnbull",
+        Email:      "pm@gmail.com",
+        Picture:    "hehe",
+    }
+    testStore.createUser(&user2)
+
+    user3 := User{
+        Id:         3,
+        Uid:        "3",
+        Name:       "Shrek",
+        FirstName:  "Shrek",
+        LastName:   "The Ogre",
+        Email:      "swamp@gmail.com",
+        Picture:    "40keks",
+    }
+    testStore.createUser(&user3)
+
+    testStore.addFriend(user1, user2)
+
+    log.Println("Create a group with a user who isn't a friend")
+    createResp := testAPI.createGroupEndpoint(user1, CreateGroupRequest{Name: "swamp", MemberIds: []int{user3.Id}})
+    if createResp.Success {
+        t.Error("Creating a group with a non-friend should fail")
+    }
+    if groups := testStore.getGroups(user1); len(groups) != 0 {
+        t.Errorf("0 groups expected, found %v\n", len(groups))
+    }
+
+    log.Println("Create a group with no name")
+    createResp = testAPI.createGroupEndpoint(user1, CreateGroupRequest{Name: "", MemberIds: []int{user2.Id}})
+    if createResp.Success {
+        t.Error("Creating a group with no name should fail")
+    }
+
+    log.Println("Create a group with user1 and user2")
+    createResp = testAPI.createGroupEndpoint(user1, CreateGroupRequest{Name: "politics", MemberIds: []int{user2.Id}})
+    if !createResp.Success {
+        t.Fatalf("Creating group failed: %v", createResp.Error)
+    }
+    groupId := createResp.Id
+
+    for _, user := range []User{user1, user2} {
+        listResp := testAPI.listGroupsEndpoint(user)
+        if len(listResp.Groups) != 1 || listResp.Groups[0].Id != groupId {
+            t.Errorf("User %v should be in exactly the new group, got %v\n", user.Id, listResp.Groups)
+        }
+    }
+    if groups := testStore.getGroups(user3); len(groups) != 0 {
+        t.Errorf("user3 shouldn't be in any groups, found %v\n", len(groups))
+    }
+
+    log.Println("Get the group as a non-member")
+    if getResp := testAPI.getGroupEndpoint(user3, groupId); getResp.Success {
+        t.Error("Getting a group as a non-member should fail")
+    }
+
+    log.Println("Get the group as a member")
+    getResp := testAPI.getGroupEndpoint(user2, groupId)
+    if !getResp.Success {
+        t.Errorf("Getting group failed: %v", getResp.Error)
+    }
+    if getResp.Group.CreatorId != user1.Id {
+        t.Errorf("Wrong creator: %v\n", getResp.Group.CreatorId)
+    }
+    if len(getResp.Members) != 2 {
+        t.Errorf("2 members expected, found %v\n", len(getResp.Members))
+    }
+
+    log.Println("Add user3 to the group via someone who isn't their friend")
+    if resp := testAPI.addGroupMemberEndpoint(user1, groupId, user3.Id); resp.Success {
+        t.Error("Adding a non-friend to a group should fail")
+    }
+
+    log.Println("Add user3 to the group via their friend")
+    testStore.addFriend(user2, user3)
+    if resp := testAPI.addGroupMemberEndpoint(user2, groupId, user3.Id); !resp.Success {
+        t.Errorf("Adding member failed: %v", resp.Error)
+    }
+    if resp := testAPI.addGroupMemberEndpoint(user2, groupId, user3.Id); resp.Success {
+        t.Error("Adding an existing member should fail")
+    }
+
+    log.Println("Send messages to the group")
+    if resp := testAPI.sendGroupMessageEndpoint(user2, groupId, SendMessageRequest{Content: "hello all", ContentType: ContentTypeText}); !resp.Success {
+        t.Errorf("Sending group message failed: %v", resp.Error)
+    }
+    if resp := testAPI.sendGroupMessageEndpoint(user3, groupId, SendMessageRequest{Content: "get out of my swamp", ContentType: ContentTypeText}); !resp.Success {
+        t.Errorf("Sending group message failed: %v", resp.Error)
+    }
+
+    listResp := testAPI.listGroupMessagesEndpoint(user1, groupId, latestMessages, 100)
+    if !listResp.Success {
+        t.Errorf("Listing group messages failed: %v", listResp.Error)
+    }
+    if len(listResp.Messages) != 2 {
+        t.Errorf("2 messages expected, found %v\n", len(listResp.Messages))
+    } else {
+        if listResp.Messages[0].Content != "hello all" || listResp.Messages[1].Content != "get out of my swamp" {
+            t.Errorf("Messages returned in the wrong order: %v\n", listResp.Messages)
+        }
+        if listResp.Messages[0].RecipientType != RecipientTypeGroup {
+            t.Errorf("Message had the wrong recipient type: %v\n", listResp.Messages[0].RecipientType)
+        }
+        if group, _ := testAPI.getRecipientGroup(listResp.Messages[0]); group.Id != groupId {
+            t.Errorf("Message had the wrong recipient group: %v\n", group.Id)
+        }
+        if _, err := testAPI.getRecipientUser(listResp.Messages[0]); err == nil {
+            t.Error("getRecipientUser should fail for group messages")
+        }
+    }
+
+    log.Println("Group messages shouldn't show up in one-to-one conversations")
+    if msgs := testStore.getMessagesWithUser(user1, user2, -1, 100); len(msgs) != 0 {
+        t.Errorf("0 messages expected, found %v\n", len(msgs))
+    }
+
+    log.Println("Only the creator can remove other members")
+    if resp := testAPI.removeGroupMemberEndpoint(user2, groupId, user3.Id); resp.Success {
+        t.Error("Non-creator removing another member should fail")
+    }
+    if resp := testAPI.removeGroupMemberEndpoint(user1, groupId, user3.Id); !resp.Success {
+        t.Errorf("Creator removing member failed: %v", resp.Error)
+    }
+    if resp := testAPI.sendGroupMessageEndpoint(user3, groupId, SendMessageRequest{Content: "wait", ContentType: ContentTypeText}); resp.Success {
+        t.Error("Removed member shouldn't be able to send to the group")
+    }
+
+    log.Println("Members can leave")
+    if resp := testAPI.removeGroupMemberEndpoint(user2, groupId, user2.Id); !resp.Success {
+        t.Errorf("Leaving group failed: %v", resp.Error)
+    }
+    if groups := testStore.getGroups(user2); len(groups) != 0 {
+        t.Errorf("user2 shouldn't be in any groups, found %v\n", len(groups))
+    }
+}
+
+func TestGroupMessageEvents(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{
+        Id:         1000,
+        Uid:        "1000",
+        Name:       "Tony Abbott",
+        FirstName:  "Tony",
+        LastName:   "Abbott",
+        Email:      "xXx_0n10n_fan_xXx@hotmail.com",
+        Picture:    "tone.jpg",
+    }
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:         1001,
+        Uid:        "1001",
+        Name:       "Malcolm Turnbull",
+        FirstName:  "Malcolm",
+        LastName:   "Turnbull",
+        Email:      "pm@gmail.com",
+        Picture:    "hehe",
+    }
+    testStore.createUser(&user2)
+
+    user3 := User{
+        Id:         1002,
+        Uid:        "1002",
+        Name:       "Julie Bishop",
+        FirstName:  "Julie",
+        LastName:   "Bishop",
+        Email:      "julie@gmail.com",
+        Picture:    "stare.jpg",
+    }
+    testStore.createUser(&user3)
+
+    testStore.addFriend(user1, user2)
+    testStore.addFriend(user1, user3)
+
+    group, _ := testAPI.createGroup(user1, "cabinet", nil)
+    testStore.addGroupMember(group, user2)
+    testStore.addGroupMember(group, user3)
+
+    timeout := 100 * time.Millisecond
+    sendWait := 100 * time.Millisecond
+
+    log.Println("** Testing group message events reach every other member")
+
+    // buffered, since the sender's long-poll is expected to time out after we stop listening
+    done1 := make(chan GetNextMessageResponse, 1)
+    done2 := make(chan GetNextMessageResponse)
+    done3 := make(chan GetNextMessageResponse)
+
+    go func() {
+        resp := testAPI.getNextMessageEndpoint(user1, 0)
+        log.Printf("[1] A: success %v, error %v, msg %v\n", resp.Success, resp.Error, resp.Message.Id)
+        done1 <- resp
+    }()
+    go func() {
+        resp := testAPI.getNextMessageEndpoint(user2, 0)
+        log.Printf("[2] A: success %v, error %v, msg %v\n", resp.Success, resp.Error, resp.Message.Id)
+        done2 <- resp
+    }()
+    go func() {
+        resp := testAPI.getNextMessageEndpoint(user3, 0)
+        log.Printf("[3] A: success %v, error %v, msg %v\n", resp.Success, resp.Error, resp.Message.Id)
+        done3 <- resp
+    }()
+
+    time.Sleep(sendWait)
+    resp := testAPI.sendGroupMessageEndpoint(user1, group.Id, SendMessageRequest{Content: "leadership spill", ContentType: ContentTypeText})
+    if !resp.Success {
+        t.Fatalf("Send group message failed: %v", resp.Error)
+    }
+    msgId := resp.Id
+
+    for i, done := range []chan GetNextMessageResponse{done2, done3} {
+        select {
+        case nextResp := <-done:
+            if !nextResp.Success || nextResp.Message.Id != msgId || nextResp.Message.RecipientType != RecipientTypeGroup {
+                t.Errorf("Group message event wasn't received correctly for member %v", i+2)
+            }
+        case <-time.After(timeout):
+            t.Errorf("Group message event wasn't received in time for member %v", i+2)
+        }
+    }
+
+    log.Println("Sender shouldn't receive their own group message")
+    select {
+    case <-done1:
+        t.Errorf("Sender shouldn't have received an event")
+    case <-time.After(timeout):
+        log.Println("Timed out successfully for sender")
+    }
+
+    log.Println("** Testing getNextMessageAfterId finds group messages")
+
+    msg, ok := testStore.getNextMessageAfterId(user2, msgId - 1)
+    if !ok || msg.Id != msgId {
+        t.Errorf("Expected group message %v, got %v (ok %v)", msgId, msg.Id, ok)
+    }
+    if _, ok := testStore.getNextMessageAfterId(user1, msgId - 1); ok {
+        t.Errorf("Sender shouldn't see their own group message as received")
+    }
+}
+
+func TestCreateGroupWithMembers(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{Uid: "1", Name: "Tony Abbott"}
+    user2 := User{Uid: "2", Name: "Malcolm Turnbull"}
+    user3 := User{Uid: "3", Name: "Shrek"}
+    testStore.createUser(&user1)
+    testStore.createUser(&user2)
+    testStore.createUser(&user3)
+
+    log.Println("Create a group with repeated members")
+    group := Group{Name: "politics", CreatorId: user1.Id, Timestamp: time.Now()}
+    if err := testStore.createGroup(&group, Users{user2, user1, user2}); err != nil {
+        t.Fatalf("Creating group failed: %v", err)
+    }
+    if members := testStore.getGroupMembers(group); len(members) != 2 {
+        t.Errorf("2 members expected, found %v\n", members)
+    }
+
+    log.Println("Create a group that can't be created")
+    taken := Group{Id: group.Id, Name: "swamp", CreatorId: user3.Id, Timestamp: time.Now()}
+    if err := testStore.createGroup(&taken, Users{user3}); err == nil {
+        t.Error("Creating a group with a taken id should fail")
+    }
+    if testStore.isGroupMember(group, user3) {
+        t.Error("Members were added to a group that wasn't created")
+    }
+    if groups := testStore.getGroups(user3); len(groups) != 0 {
+        t.Errorf("user3 shouldn't be in any groups, found %v\n", groups)
+    }
+}
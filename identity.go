@@ -0,0 +1,177 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+    "time"
+
+    "golang.org/x/net/context"
+)
+
+const IdentityProviderGoogle = "google"
+
+// Where Google publishes the keys it signs ID tokens with, as JWKS
+const GoogleCertURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// identityProviders is the list used by the program, initialized by main().
+var identityProviders []identityProvider
+
+// Stores info obtained from an identity provider's ID token
+type IdentityInfo struct {
+    // name of the identityProvider the info came from
+    Provider    string
+    ID          string
+    DisplayName string
+    FirstName   string
+    LastName    string
+    Email       string
+    Picture     string
+    // when the token the info came from was issued, and when it expires
+    IssuedAt    time.Time
+    ExpiresAt   time.Time
+}
+
+// Gets the User.Uid for the identity.
+// Google ids are stored as-is, since they were around before any other
+// provider; everyone else's are prefixed with the provider's name, so ids
+// from different providers can't collide.
+func (info IdentityInfo) uid() string {
+    if info.Provider == "" || info.Provider == IdentityProviderGoogle {
+        return info.ID
+    }
+    return info.Provider + ":" + info.ID
+}
+
+// identityProvider is somewhere users can sign in with, which vouches for
+// them with ID tokens.
+type identityProvider interface {
+    // name identifies the provider, and namespaces its users' ids.
+    name() string
+    // issuers lists the iss values of the provider's tokens.
+    issuers() []string
+    // verifyIDToken checks the token was issued by the provider for us, and
+    // gets info about the user from it.
+    verifyIDToken(c context.Context, token string) (IdentityInfo, error)
+}
+
+// Creates the identity providers set up in the config.
+// Google's is always there, configured by the [auth] section; others come
+// from [provider "name"] sections in order of name, plus the dev provider in
+// dev mode. Each issuer can only belong to one provider, so it's always clear
+// which one verifies a token.
+func setupIdentityProviders(cfg Config) ([]identityProvider, error) {
+    clockSkew := time.Duration(cfg.Auth.ClockSkew) * time.Second
+
+    providers := []identityProvider{
+        &oidcProvider{
+            providerName:   IdentityProviderGoogle,
+            issuerList:     cfg.Auth.Issuer,
+            keysURL:        GoogleCertURL,
+            clientIds:      cfg.Auth.ClientId,
+            clockSkew:      clockSkew,
+            claims:         defaultClaimMapping,
+        },
+    }
+
+    names := make([]string, 0, len(cfg.Provider))
+    for name := range cfg.Provider {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        providerCfg := cfg.Provider[name]
+        if name == IdentityProviderGoogle || name == IdentityProviderDev || name == BotUidPrefix || strings.Contains(name, ":") {
+            return nil, fmt.Errorf("setupIdentityProviders: invalid provider name %q", name)
+        }
+        if len(providerCfg.Issuer) == 0 || providerCfg.KeysURL == "" || len(providerCfg.ClientId) == 0 {
+            return nil, fmt.Errorf("setupIdentityProviders: provider %q needs issuer, keysurl and clientid", name)
+        }
+
+        claims := defaultClaimMapping
+        setClaim := func(claim *string, configured string) {
+            if configured != "" {
+                *claim = configured
+            }
+        }
+        setClaim(&claims.ID, providerCfg.IdClaim)
+        setClaim(&claims.DisplayName, providerCfg.NameClaim)
+        setClaim(&claims.FirstName, providerCfg.FirstNameClaim)
+        setClaim(&claims.LastName, providerCfg.LastNameClaim)
+        setClaim(&claims.Email, providerCfg.EmailClaim)
+        setClaim(&claims.Picture, providerCfg.PictureClaim)
+
+        providers = append(providers, &oidcProvider{
+            providerName:   name,
+            issuerList:     providerCfg.Issuer,
+            keysURL:        providerCfg.KeysURL,
+            clientIds:      providerCfg.ClientId,
+            clockSkew:      clockSkew,
+            claims:         claims,
+        })
+    }
+
+    if cfg.Auth.DevMode {
+        log.Println("WARNING: dev auth mode is on; anyone with the dev key can sign in as anyone")
+        key, err := loadDevKey(cfg.Auth.DevKeyFile)
+        if err != nil {
+            return nil, err
+        }
+        provider, err := newDevProvider(key, clockSkew)
+        if err != nil {
+            return nil, err
+        }
+        providers = append(providers, provider)
+    }
+
+    issuerProviders := make(map[string]string)
+    for _, provider := range providers {
+        for _, iss := range provider.issuers() {
+            if other, ok := issuerProviders[iss]; ok && other != provider.name() {
+                return nil, fmt.Errorf("setupIdentityProviders: providers %q and %q both have issuer %q", other, provider.name(), iss)
+            }
+            issuerProviders[iss] = provider.name()
+        }
+    }
+
+    return providers, nil
+}
+
+// Verifies an ID token with whichever provider issued it.
+func verifyIDToken(c context.Context, token string) (IdentityInfo, error) {
+    iss, err := unverifiedIssuer(token)
+    if err != nil {
+        return IdentityInfo{}, newIDTokenError(IDTokenMalformed, "%v", err)
+    }
+
+    for _, provider := range identityProviders {
+        if containsString(provider.issuers(), iss) {
+            return provider.verifyIDToken(c, token)
+        }
+    }
+    return IdentityInfo{}, newIDTokenError(IDTokenWrongIssuer, "no provider for %q", iss)
+}
+
+// Gets the iss claim of a JWT without verifying it, to find out which
+// provider should verify it.
+func unverifiedIssuer(token string) (string, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return "", fmt.Errorf("token has %d parts", len(parts))
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+    if err != nil {
+        return "", err
+    }
+    var claims struct {
+        Iss string  `json:"iss"`
+    }
+    if err := json.Unmarshal(payload, &claims); err != nil {
+        return "", err
+    }
+    return claims.Iss, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "encoding/base64"
+    "testing"
+    "log"
+)
+
+func TestIdentityUids(t *testing.T) {
+    defer resetTables()
+
+    googleInfo := IdentityInfo{
+        Provider:       IdentityProviderGoogle,
+        ID:             "1000",
+        DisplayName:    "Tony Abbott",
+        FirstName:      "Tony",
+        LastName:       "Abbott",
+        Email:          "xXx_0n10n_fan_xXx@hotmail.com",
+    }
+    corpInfo := googleInfo
+    corpInfo.Provider = "corp"
+
+    log.Println("Testing Google uids aren't namespaced")
+    if uid := googleInfo.uid(); uid != "1000" {
+        t.Errorf("Google uid was not correct: expected %v, got %v", "1000", uid)
+    }
+
+    log.Println("Testing other providers' uids are namespaced")
+    if uid := corpInfo.uid(); uid != "corp:1000" {
+        t.Errorf("Provider uid was not correct: expected %v, got %v", "corp:1000", uid)
+    }
+
+    log.Println("Testing the same id from different providers gets different users")
+    googleUser := testAPI.getUserFromInfo(googleInfo)
+    corpUser := testAPI.getUserFromInfo(corpInfo)
+    if googleUser.Id == corpUser.Id {
+        t.Errorf("Users from different providers collided: %v", googleUser.Id)
+    }
+    if corpUser.Uid != "corp:1000" {
+        t.Errorf("Uid is not correct: expected %v, got %v", "corp:1000", corpUser.Uid)
+    }
+}
+
+func TestSetupIdentityProviders(t *testing.T) {
+    var testCfg Config
+    testCfg.Auth.ClientId = []string{"web.apps.googleusercontent.com"}
+    testCfg.Auth.Issuer = DefaultIssuers
+    testCfg.Auth.ClockSkew = 60
+
+    log.Println("Testing Google is always set up")
+    providers, err := setupIdentityProviders(testCfg)
+    if err != nil {
+        t.Fatalf("Setting up providers failed: %v", err)
+    }
+    if len(providers) != 1 || providers[0].name() != IdentityProviderGoogle {
+        t.Errorf("Expected just Google, got %v", providers)
+    }
+
+    log.Println("Testing a configured provider with its own claims")
+    testCfg.Provider = map[string]*ProviderConfig{
+        "corp": {
+            Issuer:     []string{"https://login.example.com"},
+            KeysURL:    "https://login.example.com/keys",
+            ClientId:   []string{"wobchat"},
+            IdClaim:    "employee_id",
+        },
+    }
+    providers, err = setupIdentityProviders(testCfg)
+    if err != nil {
+        t.Fatalf("Setting up providers failed: %v", err)
+    }
+    if len(providers) != 2 {
+        t.Fatalf("2 providers expected, found %v", len(providers))
+    }
+    corp, ok := providers[1].(*oidcProvider)
+    if !ok || corp.name() != "corp" {
+        t.Fatalf("Expected the corp provider, got %v", providers[1])
+    }
+    if corp.claims.ID != "employee_id" || corp.claims.Email != "email" {
+        t.Errorf("Claims weren't mapped right: %v", corp.claims)
+    }
+
+    log.Println("Testing providers can't pretend to be Google")
+    testCfg.Provider[IdentityProviderGoogle] = testCfg.Provider["corp"]
+    if _, err := setupIdentityProviders(testCfg); err == nil {
+        t.Error("Provider named google was accepted")
+    }
+    delete(testCfg.Provider, IdentityProviderGoogle)
+
+    log.Println("Testing providers can't share an issuer")
+    testCfg.Provider["other"] = &ProviderConfig{
+        Issuer:     []string{"https://accounts.example.com", "https://login.example.com"},
+        KeysURL:    "https://accounts.example.com/keys",
+        ClientId:   []string{"wobchat"},
+    }
+    if _, err := setupIdentityProviders(testCfg); err == nil {
+        t.Error("Providers with the same issuer were accepted")
+    }
+    testCfg.Provider["other"].Issuer = []string{"https://accounts.example.com"}
+    providers, err = setupIdentityProviders(testCfg)
+    if err != nil {
+        t.Fatalf("Setting up providers failed: %v", err)
+    }
+    if len(providers) != 3 || providers[1].name() != "corp" || providers[2].name() != "other" {
+        t.Errorf("Expected Google then providers in order of name, got %v", providers)
+    }
+    testCfg.Provider["other"].Issuer = []string{DefaultIssuers[0]}
+    if _, err := setupIdentityProviders(testCfg); err == nil {
+        t.Error("Provider with Google's issuer was accepted")
+    }
+    delete(testCfg.Provider, "other")
+
+    log.Println("Testing providers need an issuer")
+    testCfg.Provider["corp"].Issuer = nil
+    if _, err := setupIdentityProviders(testCfg); err == nil {
+        t.Error("Provider without an issuer was accepted")
+    }
+}
+
+func TestUnverifiedIssuer(t *testing.T) {
+    encode := func(s string) string {
+        return base64.RawURLEncoding.EncodeToString([]byte(s))
+    }
+
+    log.Println("Testing getting the issuer of a token")
+    token := encode(`{"alg":"RS256"}`) + "." + encode(`{"iss":"https://login.example.com","sub":"1"}`) + ".sig"
+    if iss, err := unverifiedIssuer(token); err != nil || iss != "https://login.example.com" {
+        t.Errorf("Issuer was not correct: got %v, %v", iss, err)
+    }
+
+    log.Println("Testing malformed tokens")
+    for _, bad := range []string{"", "a.b", "a.!!!.c", "a." + encode("not json") + ".c"} {
+        if _, err := unverifiedIssuer(bad); err == nil {
+            t.Errorf("Malformed token %q was accepted", bad)
+        }
+    }
+}
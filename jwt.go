@@ -16,9 +16,17 @@ package main
 
 import (
     "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
     "encoding/gob"
     "encoding/json"
+    "encoding/pem"
     "fmt"
+    "log"
+    "math/big"
     "net/http"
     "strconv"
     "strings"
@@ -28,16 +36,6 @@ import (
     "golang.org/x/net/context"
 )
 
-// Stores info obtained from a Google JWT token
-type GoogleInfo struct {
-    ID          string
-    DisplayName string
-    FirstName   string
-    LastName    string
-    Email       string
-    Picture     string
-}
-
 /*
     idinfo looks like this when it's returned
 
@@ -57,50 +55,229 @@ type GoogleInfo struct {
     "sub": "<user id>"}
 */
 
-// verifyIDToken verifies Google ID token, which heavily based on JWT.
-// It returns user ID of the pricipal who granted an authorization.
-func verifyIDToken(c context.Context, t string) (GoogleInfo, error) {
+// Why an ID token was rejected
+type IDTokenErrorReason string
+
+const (
+    IDTokenMalformed            IDTokenErrorReason = "malformed"
+    IDTokenUnverifiable         IDTokenErrorReason = "unverifiable"
+    IDTokenSignatureInvalid     IDTokenErrorReason = "signature invalid"
+    IDTokenExpired              IDTokenErrorReason = "expired"
+    IDTokenNotValidYet          IDTokenErrorReason = "not valid yet"
+    IDTokenWrongAudience        IDTokenErrorReason = "wrong audience"
+    IDTokenWrongIssuer          IDTokenErrorReason = "wrong issuer"
+    IDTokenEmailNotVerified     IDTokenErrorReason = "email not verified"
+    IDTokenMissingClaim         IDTokenErrorReason = "missing claim"
+)
+
+// IDTokenError is returned by verifyIDToken when it rejects a token.
+type IDTokenError struct {
+    Reason  IDTokenErrorReason
+    Message string
+}
+
+func (e *IDTokenError) Error() string {
+    return fmt.Sprintf("verifyIDToken: %s: %s", e.Reason, e.Message)
+}
+
+func newIDTokenError(reason IDTokenErrorReason, format string, args ...interface{}) error {
+    return &IDTokenError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// oidcProvider is an OpenID Connect identity provider, like Google or a
+// company's own IdP.
+type oidcProvider struct {
+    providerName    string
+    // accepted values of iss
+    issuerList      []string
+    // where the provider publishes its signing keys
+    keysURL         string
+    // keys to use instead of fetching them from keysURL
+    staticKeys      map[string][]byte
+    // our OAuth client IDs, accepted as aud/azp
+    clientIds       []string
+    clockSkew       time.Duration
+    // names of the claims holding each piece of IdentityInfo
+    claims          claimMapping
+}
+
+// Which claims of an ID token hold the fields of IdentityInfo
+type claimMapping struct {
+    ID          string
+    DisplayName string
+    FirstName   string
+    LastName    string
+    Email       string
+    Picture     string
+}
+
+// The standard OpenID Connect claims, which Google uses
+var defaultClaimMapping = claimMapping{
+    ID:             "sub",
+    DisplayName:    "name",
+    FirstName:      "given_name",
+    LastName:       "family_name",
+    Email:          "email",
+    Picture:        "picture",
+}
+
+func (p *oidcProvider) name() string {
+    return p.providerName
+}
+
+func (p *oidcProvider) issuers() []string {
+    return p.issuerList
+}
+
+// verifyIDToken verifies ID token, which heavily based on JWT.
+// It returns info about the pricipal who granted an authorization.
+// Errors are *IDTokenError if the token itself was rejected.
+func (p *oidcProvider) verifyIDToken(c context.Context, t string) (IdentityInfo, error) {
+    info := IdentityInfo{Provider: p.providerName}
+
     token, err := jwt.Parse(t, func(j *jwt.Token) (interface{}, error) {
         kid, _ := j.Header["kid"].(string)
-        keys, err := idTokenCerts(c)
+        keys, err := p.publicKeys(c)
         if err != nil {
             return nil, err
         }
-        cert, ok := keys[kid]
+        data, ok := keys[kid]
         if !ok {
             return nil, fmt.Errorf("verifyIDToken: keys[%q] = nil", kid)
         }
-        return cert, nil
+        return publicKeyForMethod(data, j.Method)
     })
 
-    info := GoogleInfo{}
-
     if err != nil {
+        ve, ok := err.(*jwt.ValidationError)
+        switch {
+        case !ok:
+            return info, newIDTokenError(IDTokenMalformed, "%v", err)
+        case ve.Errors&jwt.ValidationErrorMalformed != 0:
+            return info, newIDTokenError(IDTokenMalformed, "%v", err)
+        case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+            return info, newIDTokenError(IDTokenUnverifiable, "%v", err)
+        case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+            return info, newIDTokenError(IDTokenSignatureInvalid, "%v", err)
+        case ve.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0:
+            return info, newIDTokenError(IDTokenMalformed, "%v", err)
+        }
+        // jwt-go checks exp and nbf without any allowance for clock skew,
+        // so we check them again ourselves below
+    }
+
+    if err := p.validateClaims(token.Claims, time.Now()); err != nil {
         return info, err
     }
 
-    info.ID = token.Claims["sub"].(string)
-    info.DisplayName = token.Claims["name"].(string)
-    info.FirstName = token.Claims["given_name"].(string)
-    info.LastName = token.Claims["family_name"].(string)
-    info.Email = token.Claims["email"].(string)
+    info.ID, _ = token.Claims[p.claims.ID].(string)
+    info.DisplayName, _ = token.Claims[p.claims.DisplayName].(string)
+    info.FirstName, _ = token.Claims[p.claims.FirstName].(string)
+    info.LastName, _ = token.Claims[p.claims.LastName].(string)
+    info.Email, _ = token.Claims[p.claims.Email].(string)
     // some users may not have a picture
-    picUrl, ok := token.Claims["picture"].(string)
-    if !ok {
-        info.Picture = ""
-    } else {
-        info.Picture = picUrl
+    info.Picture, _ = token.Claims[p.claims.Picture].(string)
+
+    // validateClaims made sure exp is there
+    exp, _ := token.Claims["exp"].(float64)
+    info.ExpiresAt = time.Unix(int64(exp), 0)
+    if iat, ok := token.Claims["iat"].(float64); ok {
+        info.IssuedAt = time.Unix(int64(iat), 0)
     }
 
     return info, nil
 }
 
+// publicKeys gets the keys the provider signs tokens with, keyed by kid.
+func (p *oidcProvider) publicKeys(c context.Context) (map[string][]byte, error) {
+    if p.staticKeys != nil {
+        return p.staticKeys, nil
+    }
+    return idTokenCerts(c, p.keysURL)
+}
+
+// validateClaims checks an ID token was issued for us by the provider, and
+// that it's still current (allowing for clock skew).
+func (p *oidcProvider) validateClaims(claims map[string]interface{}, now time.Time) error {
+    if id, _ := claims[p.claims.ID].(string); id == "" {
+        return newIDTokenError(IDTokenMissingClaim, "no %v", p.claims.ID)
+    }
+
+    iss, _ := claims["iss"].(string)
+    if !containsString(p.issuerList, iss) {
+        return newIDTokenError(IDTokenWrongIssuer, "%q not allowed", iss)
+    }
+
+    // aud can be a single string or a list
+    var audiences []string
+    switch aud := claims["aud"].(type) {
+    case string:
+        audiences = []string{aud}
+    case []interface{}:
+        for _, a := range aud {
+            if s, ok := a.(string); ok {
+                audiences = append(audiences, s)
+            }
+        }
+    }
+    audienceOk := false
+    for _, aud := range audiences {
+        if containsString(p.clientIds, aud) {
+            audienceOk = true
+            break
+        }
+    }
+    if !audienceOk {
+        return newIDTokenError(IDTokenWrongAudience, "%q not allowed", audiences)
+    }
+    // azp is the client that asked for the token, which has to be ours too
+    if azp, ok := claims["azp"].(string); ok && !containsString(p.clientIds, azp) {
+        return newIDTokenError(IDTokenWrongAudience, "azp %q not allowed", azp)
+    }
+
+    exp, ok := claims["exp"].(float64)
+    if !ok {
+        return newIDTokenError(IDTokenMissingClaim, "no exp")
+    }
+    if now.Add(-p.clockSkew).After(time.Unix(int64(exp), 0)) {
+        return newIDTokenError(IDTokenExpired, "expired at %v", time.Unix(int64(exp), 0))
+    }
+    for _, claim := range []string{"nbf", "iat"} {
+        if t, ok := claims[claim].(float64); ok && now.Add(p.clockSkew).Before(time.Unix(int64(t), 0)) {
+            return newIDTokenError(IDTokenNotValidYet, "%v is %v", claim, time.Unix(int64(t), 0))
+        }
+    }
+
+    // Google sends email_verified as a string in some tokens
+    if email, _ := claims[p.claims.Email].(string); email != "" {
+        verified := false
+        switch v := claims["email_verified"].(type) {
+        case bool:
+            verified = v
+        case string:
+            verified = v == "true"
+        }
+        if !verified {
+            return newIDTokenError(IDTokenEmailNotVerified, "%v", email)
+        }
+    }
+
+    return nil
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
 // idTokenCerts returns public certificates used to encrypt ID tokens.
-// It returns a cached copy, if available, or fetches from a known URL otherwise.
+// It returns a cached copy, if available, or fetches from certURL otherwise.
 // The returnd map is keyed after the cert IDs.
-func idTokenCerts(c context.Context) (map[string][]byte, error) {
-    //certURL := config.Google.CertURL
-    certURL := "https://www.googleapis.com/oauth2/v1/certs"
+func idTokenCerts(c context.Context, certURL string) (map[string][]byte, error) {
     // try cache first
     keys, err := certsFromCache(c, certURL)
     if err == nil {
@@ -118,9 +295,9 @@ func idTokenCerts(c context.Context) (map[string][]byte, error) {
     // cache the result for duration exp
     var data bytes.Buffer
     if err := gob.NewEncoder(&data).Encode(keys); err != nil {
-        fmt.Errorf("idTokenCerts: %v", err)
+        log.Printf("idTokenCerts: %v\n", err)
     } else if err := cache.set(c, certURL, data.Bytes(), exp); err != nil {
-        fmt.Errorf("idTokenCerts: cache.set(%q): %v", certURL, err)
+        log.Printf("idTokenCerts: cache.set(%q): %v\n", certURL, err)
     }
     // return the result anyway, even on cache errors
     return keys, nil
@@ -158,7 +335,10 @@ func httpClient(c context.Context) *http.Client {
     return cl
 }
 
-// certsFromCache fetches public keys from the network.
+// fetchPublicKeys fetches public keys from the network.
+// It understands both JWKS documents ({"keys": [...]}) and Google's legacy
+// map of key IDs to PEM certificates. The returned map holds each key's PEM
+// certificate or JWK JSON, for publicKeyForMethod to parse.
 // See idTokenCerts func.
 func fetchPublicKeys(c context.Context, url string) (map[string][]byte, time.Duration, error) {
     res, err := httpClient(c).Get(url)
@@ -169,17 +349,159 @@ func fetchPublicKeys(c context.Context, url string) (map[string][]byte, time.Dur
     if res.StatusCode != http.StatusOK {
         return nil, 0, fmt.Errorf("fetchPublicKeys: %s: %v", url, res.Status)
     }
-    var body map[string]string
+    var body map[string]json.RawMessage
     if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
         return nil, 0, err
     }
     keys := make(map[string][]byte)
-    for k, v := range body {
-        keys[k] = []byte(v)
+    if jwks, ok := body["keys"]; ok {
+        var jwkList []json.RawMessage
+        if err := json.Unmarshal(jwks, &jwkList); err != nil {
+            return nil, 0, fmt.Errorf("fetchPublicKeys: %s: %v", url, err)
+        }
+        for _, raw := range jwkList {
+            var key jsonWebKey
+            if err := json.Unmarshal(raw, &key); err != nil {
+                return nil, 0, fmt.Errorf("fetchPublicKeys: %s: %v", url, err)
+            }
+            // keys for encryption are no use to us
+            if key.Kid == "" || (key.Use != "" && key.Use != "sig") {
+                continue
+            }
+            keys[key.Kid] = []byte(raw)
+        }
+    } else {
+        for k, v := range body {
+            var cert string
+            if err := json.Unmarshal(v, &cert); err != nil {
+                return nil, 0, fmt.Errorf("fetchPublicKeys: %s: %v", url, err)
+            }
+            keys[k] = []byte(cert)
+        }
     }
     return keys, resourceExpiry(res.Header), nil
 }
 
+// A key from a JWKS document; only the fields we need for RSA and EC keys
+type jsonWebKey struct {
+    Kid     string  `json:"kid"`
+    Kty     string  `json:"kty"`
+    Alg     string  `json:"alg"`
+    Use     string  `json:"use"`
+    // RSA
+    N       string  `json:"n"`
+    E       string  `json:"e"`
+    // EC
+    Crv     string  `json:"crv"`
+    X       string  `json:"x"`
+    Y       string  `json:"y"`
+}
+
+// publicKeyForMethod parses a key returned by fetchPublicKeys, making sure
+// it's the right kind of key for the token's signing method.
+// This stops a token signed with HMAC from being checked using the public
+// key as the secret.
+func publicKeyForMethod(data []byte, method jwt.SigningMethod) (interface{}, error) {
+    var key interface{}
+    if block, _ := pem.Decode(data); block != nil {
+        var err error
+        if key, err = parsePEMPublicKey(block); err != nil {
+            return nil, err
+        }
+    } else {
+        var jwk jsonWebKey
+        if err := json.Unmarshal(data, &jwk); err != nil {
+            return nil, fmt.Errorf("publicKeyForMethod: %v", err)
+        }
+        if jwk.Alg != "" && jwk.Alg != method.Alg() {
+            return nil, fmt.Errorf("publicKeyForMethod: key is for %v, token uses %v", jwk.Alg, method.Alg())
+        }
+        var err error
+        if key, err = jwk.publicKey(); err != nil {
+            return nil, err
+        }
+    }
+
+    switch method.(type) {
+    case *jwt.SigningMethodRSA:
+        if _, ok := key.(*rsa.PublicKey); ok {
+            return key, nil
+        }
+    case *jwt.SigningMethodECDSA:
+        if _, ok := key.(*ecdsa.PublicKey); ok {
+            return key, nil
+        }
+    }
+    return nil, fmt.Errorf("publicKeyForMethod: %T can't be used with %v", key, method.Alg())
+}
+
+// parsePEMPublicKey parses a PEM certificate or public key.
+func parsePEMPublicKey(block *pem.Block) (interface{}, error) {
+    switch block.Type {
+    case "CERTIFICATE":
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        return cert.PublicKey, nil
+    case "PUBLIC KEY":
+        return x509.ParsePKIXPublicKey(block.Bytes)
+    }
+    return nil, fmt.Errorf("parsePEMPublicKey: unknown block type %q", block.Type)
+}
+
+// publicKey gets the RSA or EC public key described by the JWK.
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+    decode := func(s string) (*big.Int, error) {
+        b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+        if err != nil {
+            return nil, fmt.Errorf("publicKey: %v", err)
+        }
+        return new(big.Int).SetBytes(b), nil
+    }
+
+    switch jwk.Kty {
+    case "RSA":
+        n, err := decode(jwk.N)
+        if err != nil {
+            return nil, err
+        }
+        e, err := decode(jwk.E)
+        if err != nil {
+            return nil, err
+        }
+        if n.Sign() <= 0 || e.BitLen() > 31 || e.Int64() < 3 {
+            return nil, fmt.Errorf("publicKey: bad RSA key %q", jwk.Kid)
+        }
+        return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+    case "EC":
+        var curve elliptic.Curve
+        switch jwk.Crv {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        case "P-521":
+            curve = elliptic.P521()
+        default:
+            return nil, fmt.Errorf("publicKey: unknown curve %q", jwk.Crv)
+        }
+        x, err := decode(jwk.X)
+        if err != nil {
+            return nil, err
+        }
+        y, err := decode(jwk.Y)
+        if err != nil {
+            return nil, err
+        }
+        if !curve.IsOnCurve(x, y) {
+            return nil, fmt.Errorf("publicKey: EC key %q isn't on %v", jwk.Kid, jwk.Crv)
+        }
+        return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+    }
+    return nil, fmt.Errorf("publicKey: unsupported key type %q", jwk.Kty)
+}
+
 // resourceExpiry returns the remaining life of a resource
 // based on Cache-Control and Age headers.
 func resourceExpiry(h http.Header) time.Duration {
@@ -0,0 +1,225 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "math/big"
+    "testing"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "time"
+
+    jwt "github.com/dgrijalva/jwt-go"
+    "golang.org/x/net/context"
+)
+
+func TestValidateClaims(t *testing.T) {
+    provider := &oidcProvider{
+        providerName:   IdentityProviderGoogle,
+        issuerList:     DefaultIssuers,
+        keysURL:        GoogleCertURL,
+        clientIds:      []string{"web.apps.googleusercontent.com", "android.apps.googleusercontent.com"},
+        clockSkew:      60 * time.Second,
+        claims:         defaultClaimMapping,
+    }
+
+    now := time.Now()
+
+    // a valid token's claims, changed by each case below
+    validClaims := func() map[string]interface{} {
+        return map[string]interface{}{
+            "sub":              "1234",
+            "iss":              "accounts.google.com",
+            "aud":              "web.apps.googleusercontent.com",
+            "azp":              "android.apps.googleusercontent.com",
+            "email":            "jaydensmith@gmail.com",
+            "email_verified":   true,
+            "iat":              float64(now.Add(-time.Minute).Unix()),
+            "exp":              float64(now.Add(time.Hour).Unix()),
+        }
+    }
+
+    cases := []struct {
+        name    string
+        change  func(claims map[string]interface{})
+        reason  IDTokenErrorReason
+    }{
+        {"valid token", func(c map[string]interface{}) {}, ""},
+        {"https issuer", func(c map[string]interface{}) { c["iss"] = "https://accounts.google.com" }, ""},
+        {"audience list", func(c map[string]interface{}) { c["aud"] = []interface{}{"someone.else", "web.apps.googleusercontent.com"} }, ""},
+        {"no azp", func(c map[string]interface{}) { delete(c, "azp") }, ""},
+        {"email_verified string", func(c map[string]interface{}) { c["email_verified"] = "true" }, ""},
+        {"no email", func(c map[string]interface{}) { delete(c, "email"); delete(c, "email_verified") }, ""},
+        {"expired within skew", func(c map[string]interface{}) { c["exp"] = float64(now.Add(-30 * time.Second).Unix()) }, ""},
+        {"issued within skew", func(c map[string]interface{}) { c["iat"] = float64(now.Add(30 * time.Second).Unix()) }, ""},
+        {"no sub", func(c map[string]interface{}) { delete(c, "sub") }, IDTokenMissingClaim},
+        {"other issuer", func(c map[string]interface{}) { c["iss"] = "evil.example.com" }, IDTokenWrongIssuer},
+        {"other audience", func(c map[string]interface{}) { c["aud"] = "someone.else" }, IDTokenWrongAudience},
+        {"no audience", func(c map[string]interface{}) { delete(c, "aud") }, IDTokenWrongAudience},
+        {"other azp", func(c map[string]interface{}) { c["azp"] = "someone.else" }, IDTokenWrongAudience},
+        {"no exp", func(c map[string]interface{}) { delete(c, "exp") }, IDTokenMissingClaim},
+        {"expired", func(c map[string]interface{}) { c["exp"] = float64(now.Add(-2 * time.Minute).Unix()) }, IDTokenExpired},
+        {"not valid yet", func(c map[string]interface{}) { c["nbf"] = float64(now.Add(2 * time.Minute).Unix()) }, IDTokenNotValidYet},
+        {"issued in the future", func(c map[string]interface{}) { c["iat"] = float64(now.Add(2 * time.Minute).Unix()) }, IDTokenNotValidYet},
+        {"email not verified", func(c map[string]interface{}) { c["email_verified"] = false }, IDTokenEmailNotVerified},
+        {"email_verified missing", func(c map[string]interface{}) { delete(c, "email_verified") }, IDTokenEmailNotVerified},
+    }
+
+    for _, tc := range cases {
+        log.Printf("Testing validating claims: %v\n", tc.name)
+        claims := validClaims()
+        tc.change(claims)
+
+        err := provider.validateClaims(claims, now)
+        if tc.reason == "" {
+            if err != nil {
+                t.Errorf("%v: expected no error, got %v", tc.name, err)
+            }
+            continue
+        }
+        tokenErr, ok := err.(*IDTokenError)
+        if !ok {
+            t.Errorf("%v: expected %v IDTokenError, got %v", tc.name, tc.reason, err)
+        } else if tokenErr.Reason != tc.reason {
+            t.Errorf("%v: expected %v, got %v", tc.name, tc.reason, tokenErr.Reason)
+        }
+    }
+
+    log.Println("Testing no client IDs configured")
+    provider.clientIds = nil
+    if err := provider.validateClaims(validClaims(), now); err == nil {
+        t.Error("Token accepted with no client IDs configured")
+    }
+}
+
+func TestFetchPublicKeys(t *testing.T) {
+    if cache == nil {
+        cache = newMemoryCache(0, 0, 0)
+    }
+
+    rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+    ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    encode := func(b []byte) string {
+        return base64.RawURLEncoding.EncodeToString(b)
+    }
+
+    jwks := map[string]interface{}{
+        "keys": []map[string]string{
+            {
+                "kid":  "rsa1",
+                "kty":  "RSA",
+                "alg":  "RS256",
+                "use":  "sig",
+                "n":    encode(rsaKey.N.Bytes()),
+                "e":    encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+            },
+            {
+                "kid":  "ec1",
+                "kty":  "EC",
+                "crv":  "P-256",
+                "x":    encode(ecKey.X.Bytes()),
+                "y":    encode(ecKey.Y.Bytes()),
+            },
+            {
+                "kid":  "enc1",
+                "kty":  "RSA",
+                "use":  "enc",
+                "n":    encode(rsaKey.N.Bytes()),
+                "e":    encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+            },
+        },
+    }
+
+    requests := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+        w.Header().Set("Cache-Control", "public, max-age=3600")
+        w.Header().Set("Age", "600")
+        json.NewEncoder(w).Encode(jwks)
+    }))
+    defer server.Close()
+
+    log.Println("Testing fetching a JWKS document")
+    keys, exp, err := fetchPublicKeys(context.Background(), server.URL)
+    if err != nil {
+        t.Fatalf("Fetching keys failed: %v", err)
+    }
+    if exp != 3000*time.Second {
+        t.Errorf("Expiry was not correct: expected %v, got %v", 3000*time.Second, exp)
+    }
+    if len(keys) != 2 {
+        t.Errorf("2 signing keys expected, found %v", len(keys))
+    }
+
+    log.Println("Testing parsing an RSA key")
+    key, err := publicKeyForMethod(keys["rsa1"], jwt.SigningMethodRS256)
+    if err != nil {
+        t.Errorf("Parsing RSA key failed: %v", err)
+    } else if rsaPub, ok := key.(*rsa.PublicKey); !ok || rsaPub.N.Cmp(rsaKey.N) != 0 || rsaPub.E != rsaKey.E {
+        t.Errorf("RSA key was not correct: %v", key)
+    }
+
+    log.Println("Testing parsing an EC key")
+    key, err = publicKeyForMethod(keys["ec1"], jwt.SigningMethodES256)
+    if err != nil {
+        t.Errorf("Parsing EC key failed: %v", err)
+    } else if ecPub, ok := key.(*ecdsa.PublicKey); !ok || ecPub.X.Cmp(ecKey.X) != 0 || ecPub.Y.Cmp(ecKey.Y) != 0 {
+        t.Errorf("EC key was not correct: %v", key)
+    }
+
+    log.Println("Testing keys can't be used with other algorithms")
+    if _, err := publicKeyForMethod(keys["rsa1"], jwt.SigningMethodHS256); err == nil {
+        t.Error("RSA key accepted for HS256")
+    }
+    if _, err := publicKeyForMethod(keys["rsa1"], jwt.SigningMethodRS512); err == nil {
+        t.Error("RS256 key accepted for RS512")
+    }
+    if _, err := publicKeyForMethod(keys["ec1"], jwt.SigningMethodRS256); err == nil {
+        t.Error("EC key accepted for RS256")
+    }
+
+    log.Println("Testing keys are cached for their lifetime")
+    if _, err := idTokenCerts(context.Background(), server.URL); err != nil {
+        t.Fatalf("Getting keys failed: %v", err)
+    }
+    if _, err := idTokenCerts(context.Background(), server.URL); err != nil {
+        t.Fatalf("Getting keys failed: %v", err)
+    }
+    if requests != 2 {
+        t.Errorf("Keys weren't cached: %v requests made", requests)
+    }
+
+    log.Println("Testing fetching legacy PEM certificates")
+    template := &x509.Certificate{
+        SerialNumber:   big.NewInt(1),
+        NotBefore:      time.Now().Add(-time.Hour),
+        NotAfter:       time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &rsaKey.PublicKey, rsaKey)
+    if err != nil {
+        t.Fatalf("Creating certificate failed: %v", err)
+    }
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    legacyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]string{"cert1": string(certPEM)})
+    }))
+    defer legacyServer.Close()
+
+    keys, _, err = fetchPublicKeys(context.Background(), legacyServer.URL)
+    if err != nil {
+        t.Fatalf("Fetching keys failed: %v", err)
+    }
+    key, err = publicKeyForMethod(keys["cert1"], jwt.SigningMethodRS256)
+    if err != nil {
+        t.Errorf("Parsing certificate failed: %v", err)
+    } else if rsaPub, ok := key.(*rsa.PublicKey); !ok || rsaPub.N.Cmp(rsaKey.N) != 0 {
+        t.Errorf("Certificate key was not correct: %v", key)
+    }
+}
@@ -1,47 +1,81 @@
 package main
 
 import (
+    "flag"
     "fmt"
     "log"
     "net/http"
 
-    "github.com/jinzhu/gorm"
     _ "github.com/lib/pq"
+    _ "github.com/mattn/go-sqlite3"
 )
 
-// store DB in a global :(
-var db gorm.DB
-
 var cfg Config
 
 func main() {
     cfg = setupConfig()
 
-    log.Println("Creating certificate cache")
-    cache = newMemoryCache()
-
-    log.Println("Opening DB connection")
+    if args := flag.Args(); len(args) > 0 {
+        switch args[0] {
+        case "mint-token":
+            if err := mintTokenCommand(cfg, args[1:]); err != nil {
+                log.Println("Failed to mint token")
+                log.Fatal(err)
+            }
+        case "migrate":
+            if err := migrateCommand(cfg, args[1:]); err != nil {
+                log.Println("Failed to migrate")
+                log.Fatal(err)
+            }
+        default:
+            log.Fatalf("Unknown command %q\n", args[0])
+        }
+        return
+    }
 
+    log.Printf("Creating certificate cache (%v)\n", cfg.Cache.Type)
     var err error
-    db, err = gorm.Open(cfg.Database.Type, cfg.Database.ConnectionString)
+    cache, err = newCache(cfg)
+    if err != nil {
+        log.Println("Failed to create cache")
+        panic(err)
+    }
 
+    log.Println("Setting up rate limits")
+    rateLimits, err = setupRateLimits(cfg)
     if err != nil {
-        log.Println("Failed to open DB connection")
+        log.Println("Failed to set up rate limits")
         panic(err)
     }
-    defer db.Close()
+    trustForwardedFor = cfg.Server.TrustForwardedFor
 
-    // Create tables and automigrate
-    log.Println("Creating/migrating tables")
-    db.AutoMigrate(&User{})
-    db.AutoMigrate(&UserFriend{})
-    db.AutoMigrate(&FriendRequest{})
-    db.AutoMigrate(&Message{})
+    log.Println("Setting up identity providers")
+    identityProviders, err = setupIdentityProviders(cfg)
+    if err != nil {
+        log.Println("Failed to set up identity providers")
+        panic(err)
+    }
+
+    log.Printf("Opening store (%v)\n", cfg.Database.Type)
+    store, err := openStore(cfg.Database.Type, cfg.Database.ConnectionString)
+    if err != nil {
+        log.Println("Failed to open store")
+        panic(err)
+    }
+    defer store.close()
+
+    log.Printf("Creating event bus (%v)\n", cfg.Events.Bus)
+    eventBus, err = newEventBus(cfg, store)
+    if err != nil {
+        log.Println("Failed to create event bus")
+        panic(err)
+    }
+    defer eventBus.close()
 
     // Set up HTTP handlers
     log.Println("Starting HTTP server")
     address := fmt.Sprintf("127.0.0.1:%d", cfg.Server.HTTPPort)
-    router := setupAPIHandlers()
+    router := setupAPIHandlers(newAPI(store))
 
     log.Printf("Listening on %v\n", address)
     http.ListenAndServe(address, router)
@@ -0,0 +1,992 @@
+package main
+
+import (
+    "errors"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Returned by memoryStore when something would break a primary key or unique
+// constraint, as the database would
+var errDuplicateKey = errors.New("Duplicate key")
+
+// memoryStore is a Store that keeps everything in memory, for running the
+// server or its tests without a database. Everything is lost when it's closed.
+//
+// Tables with their own ids are kept as slices sorted by id, so results come
+// out in the same order as the database's; the rest are sets keyed by their
+// primary key. Like database sequences, ids aren't reused after deleting.
+type memoryStore struct {
+    mu              sync.Mutex
+
+    users           []User
+    friends         map[UserFriend]bool
+    friendRequests  map[FriendRequest]bool
+    messages        []Message
+    // keyed by user and friend, like the tables
+    conversations   map[UserFriend]Conversation
+    readMarkers     map[UserFriend]ReadMarker
+    groups          []Group
+    groupMembers    map[GroupMember]bool
+    sessions        []Session
+    revokedTokens   map[string]RevokedToken
+    userRevocations map[int]UserRevocation
+    apiKeys         []APIKey
+
+    // the last ids handed out
+    lastUserId      int
+    lastMessageId   int
+    lastGroupId     int
+    lastSessionId   int
+    lastAPIKeyId    int
+}
+
+func newMemoryStore() *memoryStore {
+    s := &memoryStore{}
+    s.clear()
+    return s
+}
+
+// Deletes everything, but carries on from the same ids.
+func (s *memoryStore) clear() {
+    s.users = nil
+    s.friends = make(map[UserFriend]bool)
+    s.friendRequests = make(map[FriendRequest]bool)
+    s.messages = nil
+    s.conversations = make(map[UserFriend]Conversation)
+    s.readMarkers = make(map[UserFriend]ReadMarker)
+    s.groups = nil
+    s.groupMembers = make(map[GroupMember]bool)
+    s.sessions = nil
+    s.revokedTokens = make(map[string]RevokedToken)
+    s.userRevocations = make(map[int]UserRevocation)
+    s.apiKeys = nil
+}
+
+func (s *memoryStore) close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.clear()
+    return nil
+}
+
+// Picks the id for a new row, given the ids already used (in order) and the
+// one it asked for, if any. Returns false if the one it asked for is taken.
+func nextId(id int, last *int, ids []int) (int, bool) {
+    if id != 0 {
+        if i := sort.SearchInts(ids, id); i < len(ids) && ids[i] == id {
+            return 0, false
+        }
+        return id, true
+    }
+
+    // skip past ones that were asked for
+    for {
+        *last++
+        if i := sort.SearchInts(ids, *last); i == len(ids) || ids[i] != *last {
+            return *last, true
+        }
+    }
+}
+
+// Gets the position of the row with the given id in a table sorted by id, or
+// where it would go if there isn't one.
+func searchIds(n int, id int, idAt func(i int) int) int {
+    return sort.Search(n, func(i int) bool {
+        return idAt(i) >= id
+    })
+}
+
+/*
+ * Users
+ */
+
+func (s *memoryStore) userIds() []int {
+    ids := make([]int, len(s.users))
+    for i, user := range s.users {
+        ids[i] = user.Id
+    }
+    return ids
+}
+
+func (s *memoryStore) findUser(id int) (int, bool) {
+    i := searchIds(len(s.users), id, func(i int) int { return s.users[i].Id })
+    return i, i < len(s.users) && s.users[i].Id == id
+}
+
+func (s *memoryStore) getUser(id int) (User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if i, ok := s.findUser(id); ok {
+        return s.users[i], nil
+    }
+    return User{}, errNotFound
+}
+
+func (s *memoryStore) getUserByUid(uid string) (User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.userByUid(uid)
+}
+
+func (s *memoryStore) userByUid(uid string) (User, error) {
+    for _, user := range s.users {
+        if user.Uid == uid {
+            return user, nil
+        }
+    }
+    return User{}, errNotFound
+}
+
+func (s *memoryStore) createUser(user *User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // uids are unique
+    if _, err := s.userByUid(user.Uid); err == nil {
+        return errDuplicateKey
+    }
+
+    id, ok := nextId(user.Id, &s.lastUserId, s.userIds())
+    if !ok {
+        return errDuplicateKey
+    }
+    user.Id = id
+
+    i, _ := s.findUser(id)
+    s.users = append(s.users, User{})
+    copy(s.users[i+1:], s.users[i:])
+    s.users[i] = *user
+    return nil
+}
+
+func (s *memoryStore) saveUser(user *User) error {
+    s.mu.Lock()
+    i, ok := s.findUser(user.Id)
+    if !ok {
+        s.mu.Unlock()
+        return s.createUser(user)
+    }
+    defer s.mu.Unlock()
+
+    if other, err := s.userByUid(user.Uid); err == nil && other.Id != user.Id {
+        return errDuplicateKey
+    }
+    s.users[i] = *user
+    return nil
+}
+
+func (s *memoryStore) deleteUser(user User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    keys := s.apiKeys[:0]
+    for _, key := range s.apiKeys {
+        if key.BotId != user.Id {
+            keys = append(keys, key)
+        }
+    }
+    s.apiKeys = keys
+
+    for uf := range s.friends {
+        if uf.UserId == user.Id || uf.FriendId == user.Id {
+            delete(s.friends, uf)
+        }
+    }
+    for fr := range s.friendRequests {
+        if fr.UserId == user.Id || fr.RequestorId == user.Id {
+            delete(s.friendRequests, fr)
+        }
+    }
+    for gm := range s.groupMembers {
+        if gm.UserId == user.Id {
+            delete(s.groupMembers, gm)
+        }
+    }
+    for uf := range s.conversations {
+        if uf.UserId == user.Id || uf.FriendId == user.Id {
+            delete(s.conversations, uf)
+        }
+    }
+    for uf := range s.readMarkers {
+        if uf.UserId == user.Id || uf.FriendId == user.Id {
+            delete(s.readMarkers, uf)
+        }
+    }
+
+    if i, ok := s.findUser(user.Id); ok {
+        s.users = append(s.users[:i], s.users[i+1:]...)
+    }
+    return nil
+}
+
+func (s *memoryStore) searchUsersByEmail(email string, exceptId int) Users {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    users := Users{}
+    for _, user := range s.users {
+        if strings.ToUpper(user.Email) == strings.ToUpper(email) && user.Id != exceptId {
+            users = append(users, user)
+        }
+    }
+    return users
+}
+
+func (s *memoryStore) searchUsersByName(name string, exceptId int) Users {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    users := Users{}
+    for _, user := range s.users {
+        if strings.Contains(strings.ToUpper(user.Name), strings.ToUpper(name)) && user.Id != exceptId {
+            users = append(users, user)
+        }
+    }
+    return users
+}
+
+func (s *memoryStore) getBots(owner User) Users {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    bots := Users{}
+    for _, user := range s.users {
+        if user.IsBot && user.OwnerId == owner.Id {
+            bots = append(bots, user)
+        }
+    }
+    return bots
+}
+
+/*
+ * Friends
+ */
+
+// Sorts friends by their last message with the user, then by name
+type friendsByLastMessage struct {
+    friends         Users
+    lastMessageIds  map[int]int
+}
+
+func (f friendsByLastMessage) Len() int {
+    return len(f.friends)
+}
+
+func (f friendsByLastMessage) Less(i, j int) bool {
+    a, b := f.friends[i], f.friends[j]
+    if f.lastMessageIds[a.Id] != f.lastMessageIds[b.Id] {
+        return f.lastMessageIds[a.Id] > f.lastMessageIds[b.Id]
+    }
+    return a.Name < b.Name
+}
+
+func (f friendsByLastMessage) Swap(i, j int) {
+    f.friends[i], f.friends[j] = f.friends[j], f.friends[i]
+}
+
+func (s *memoryStore) getFriends(user User) Users {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    sorter := friendsByLastMessage{friends: Users{}, lastMessageIds: make(map[int]int)}
+    for _, friend := range s.users {
+        uf := UserFriend{UserId: user.Id, FriendId: friend.Id}
+        if s.friends[uf] {
+            sorter.friends = append(sorter.friends, friend)
+            sorter.lastMessageIds[friend.Id] = s.conversations[uf].LastMessageId
+        }
+    }
+    sort.Stable(sorter)
+
+    return sorter.friends
+}
+
+func (s *memoryStore) addFriend(user User, friend User) error {
+    if user.Id == friend.Id {
+        return errors.New("Cannot add yourself as a friend")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    uf1 := UserFriend{UserId: user.Id, FriendId: friend.Id}
+    uf2 := UserFriend{UserId: friend.Id, FriendId: user.Id}
+    if s.friends[uf1] || s.friends[uf2] {
+        return errDuplicateKey
+    }
+    s.friends[uf1] = true
+    s.friends[uf2] = true
+    return nil
+}
+
+func (s *memoryStore) deleteFriend(user User, friend User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // check two-way friendship exists
+    uf1 := UserFriend{UserId: user.Id, FriendId: friend.Id}
+    uf2 := UserFriend{UserId: friend.Id, FriendId: user.Id}
+    if !s.friends[uf1] || !s.friends[uf2] {
+        return errNotFound
+    }
+
+    delete(s.friends, uf1)
+    delete(s.friends, uf2)
+    return nil
+}
+
+func (s *memoryStore) isFriend(user User, friend User) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.friends[UserFriend{UserId: user.Id, FriendId: friend.Id}]
+}
+
+/*
+ * Friend requests
+ */
+
+func (s *memoryStore) getFriendRequests(user User) Users {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    requestors := Users{}
+    for _, requestor := range s.users {
+        if s.friendRequests[FriendRequest{UserId: user.Id, RequestorId: requestor.Id}] {
+            requestors = append(requestors, requestor)
+        }
+    }
+    return requestors
+}
+
+func (s *memoryStore) addFriendRequest(user User, requestor User) error {
+    if user.Id == requestor.Id {
+        return errors.New("Cannot request to be your own friend")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    fr := FriendRequest{UserId: user.Id, RequestorId: requestor.Id}
+    if s.friendRequests[fr] {
+        return errDuplicateKey
+    }
+    s.friendRequests[fr] = true
+    return nil
+}
+
+func (s *memoryStore) hasFriendRequest(user User, requestor User) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.friendRequests[FriendRequest{UserId: user.Id, RequestorId: requestor.Id}]
+}
+
+func (s *memoryStore) deleteFriendRequest(user User, requestor User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.friendRequests, FriendRequest{UserId: user.Id, RequestorId: requestor.Id})
+    return nil
+}
+
+/*
+ * Messages
+ */
+
+// Copies a message, so the caller can't change the stored one through its
+// EditedAt
+func copyMessage(msg Message) Message {
+    if msg.EditedAt != nil {
+        editedAt := *msg.EditedAt
+        msg.EditedAt = &editedAt
+    }
+    return msg
+}
+
+func (s *memoryStore) findMessage(id int) (int, bool) {
+    i := searchIds(len(s.messages), id, func(i int) int { return s.messages[i].Id })
+    return i, i < len(s.messages) && s.messages[i].Id == id
+}
+
+func (s *memoryStore) addMessage(msg *Message) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]int, len(s.messages))
+    for i, m := range s.messages {
+        ids[i] = m.Id
+    }
+    id, ok := nextId(msg.Id, &s.lastMessageId, ids)
+    if !ok {
+        return errDuplicateKey
+    }
+    msg.Id = id
+    msg.ConversationKey = msg.conversationKey()
+
+    i, _ := s.findMessage(id)
+    s.messages = append(s.messages, Message{})
+    copy(s.messages[i+1:], s.messages[i:])
+    s.messages[i] = copyMessage(*msg)
+
+    if msg.RecipientType == RecipientTypeUser {
+        s.updateConversation(msg.SenderId, msg.RecipientId, *msg)
+        s.updateConversation(msg.RecipientId, msg.SenderId, *msg)
+    }
+    return nil
+}
+
+// Records msg as the latest message in userId's conversation with friendId,
+// unless a later one already is
+func (s *memoryStore) updateConversation(userId int, friendId int, msg Message) {
+    key := UserFriend{UserId: userId, FriendId: friendId}
+    if conversation, ok := s.conversations[key]; ok && conversation.LastMessageId > msg.Id {
+        return
+    }
+    s.conversations[key] = Conversation{
+        UserId:             userId,
+        FriendId:           friendId,
+        LastMessageId:      msg.Id,
+        LastMessageTime:    msg.Timestamp,
+    }
+}
+
+func (s *memoryStore) getMessage(id int) (Message, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if i, ok := s.findMessage(id); ok {
+        return copyMessage(s.messages[i]), nil
+    }
+    return Message{}, errNotFound
+}
+
+func (s *memoryStore) saveMessage(msg *Message) error {
+    s.mu.Lock()
+    i, ok := s.findMessage(msg.Id)
+    if !ok {
+        s.mu.Unlock()
+        return s.addMessage(msg)
+    }
+    defer s.mu.Unlock()
+
+    s.messages[i] = copyMessage(*msg)
+    return nil
+}
+
+// Gets the amount messages in the conversation before last (or the latest, if
+// last is -1), oldest first
+func (s *memoryStore) messagesBefore(conversationKey string, last int, amount int) Messages {
+    msgs := Messages{}
+    for i := len(s.messages) - 1; i >= 0 && len(msgs) != amount; i-- {
+        msg := s.messages[i]
+        if (last == -1 || msg.Id < last) && msg.ConversationKey == conversationKey {
+            msgs = append(msgs, copyMessage(msg))
+        }
+    }
+    msgs.reverse()
+
+    return msgs
+}
+
+// Gets the amount messages in the conversation after after, oldest first
+func (s *memoryStore) messagesAfter(conversationKey string, after int, amount int) Messages {
+    msgs := Messages{}
+    i, _ := s.findMessage(after + 1)
+    for ; i < len(s.messages) && len(msgs) != amount; i++ {
+        if s.messages[i].ConversationKey == conversationKey {
+            msgs = append(msgs, copyMessage(s.messages[i]))
+        }
+    }
+    return msgs
+}
+
+func (s *memoryStore) getMessagesWithUser(user User, otherUser User, last int, amount int) Messages {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.messagesBefore(userConversationKey(user.Id, otherUser.Id), last, amount)
+}
+
+func (s *memoryStore) getGroupMessages(group Group, last int, amount int) Messages {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.messagesBefore(groupConversationKey(group.Id), last, amount)
+}
+
+func (s *memoryStore) getMessagesWithUserAfter(user User, otherUser User, after int, amount int) Messages {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.messagesAfter(userConversationKey(user.Id, otherUser.Id), after, amount)
+}
+
+func (s *memoryStore) getGroupMessagesAfter(group Group, after int, amount int) Messages {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.messagesAfter(groupConversationKey(group.Id), after, amount)
+}
+
+func (s *memoryStore) getNextMessageAfterId(user User, afterId int) (Message, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    i, _ := s.findMessage(afterId + 1)
+    for _, msg := range s.messages[i:] {
+        switch msg.RecipientType {
+        case RecipientTypeUser:
+            if msg.RecipientId == user.Id {
+                return copyMessage(msg), true
+            }
+        case RecipientTypeGroup:
+            // not the user's own messages to their groups
+            if msg.SenderId != user.Id && s.groupMembers[GroupMember{GroupId: msg.RecipientId, UserId: user.Id}] {
+                return copyMessage(msg), true
+            }
+        }
+    }
+    return Message{}, false
+}
+
+func (s *memoryStore) lastMessageIdFromUser(user User, otherUser User) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for i := len(s.messages) - 1; i >= 0; i-- {
+        msg := s.messages[i]
+        if msg.RecipientType == RecipientTypeUser && msg.SenderId == otherUser.Id && msg.RecipientId == user.Id {
+            return msg.Id
+        }
+    }
+    return 0
+}
+
+func (s *memoryStore) getConversation(user User, otherUser User) (Conversation, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if conversation, ok := s.conversations[UserFriend{UserId: user.Id, FriendId: otherUser.Id}]; ok {
+        return conversation, nil
+    }
+    return Conversation{}, errNotFound
+}
+
+func (s *memoryStore) getConversationSummaries(user User) map[int]ConversationSummary {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    summaries := make(map[int]ConversationSummary)
+    for uf := range s.friends {
+        if uf.UserId == user.Id {
+            summaries[uf.FriendId] = ConversationSummary{FriendId: uf.FriendId}
+        }
+    }
+
+    // newest first, so the first message with each friend is the last one
+    for i := len(s.messages) - 1; i >= 0; i-- {
+        msg := s.messages[i]
+        if msg.RecipientType != RecipientTypeUser {
+            continue
+        }
+
+        var friendId int
+        switch user.Id {
+        case msg.RecipientId:
+            friendId = msg.SenderId
+        case msg.SenderId:
+            friendId = msg.RecipientId
+        default:
+            continue
+        }
+        summary, ok := summaries[friendId]
+        if !ok {
+            continue
+        }
+
+        if summary.LastMessage == nil {
+            lastMessage := copyMessage(msg)
+            summary.LastMessage = &lastMessage
+        }
+        lastReadId := s.readMarkers[UserFriend{UserId: user.Id, FriendId: friendId}].LastReadId
+        if msg.SenderId == friendId && msg.RecipientId == user.Id && msg.Id > lastReadId && !msg.Deleted {
+            summary.UnreadCount++
+        }
+        summaries[friendId] = summary
+    }
+
+    return summaries
+}
+
+/*
+ * Read markers
+ */
+
+func (s *memoryStore) getReadMarker(user User, otherUser User) ReadMarker {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if marker, ok := s.readMarkers[UserFriend{UserId: user.Id, FriendId: otherUser.Id}]; ok {
+        return marker
+    }
+    return ReadMarker{UserId: user.Id, FriendId: otherUser.Id}
+}
+
+func (s *memoryStore) advanceReadMarker(marker ReadMarker) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    key := UserFriend{UserId: marker.UserId, FriendId: marker.FriendId}
+    if existing, ok := s.readMarkers[key]; !ok || existing.LastReadId < marker.LastReadId {
+        s.readMarkers[key] = marker
+    }
+    return nil
+}
+
+/*
+ * Groups
+ */
+
+func (s *memoryStore) findGroup(id int) (int, bool) {
+    i := searchIds(len(s.groups), id, func(i int) int { return s.groups[i].Id })
+    return i, i < len(s.groups) && s.groups[i].Id == id
+}
+
+func (s *memoryStore) getGroup(id int) (Group, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if i, ok := s.findGroup(id); ok {
+        return s.groups[i], nil
+    }
+    return Group{}, errNotFound
+}
+
+func (s *memoryStore) getGroups(user User) Groups {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    groups := Groups{}
+    for _, group := range s.groups {
+        if s.groupMembers[GroupMember{GroupId: group.Id, UserId: user.Id}] {
+            groups = append(groups, group)
+        }
+    }
+    return groups
+}
+
+func (s *memoryStore) createGroup(group *Group, members Users) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]int, len(s.groups))
+    for i, g := range s.groups {
+        ids[i] = g.Id
+    }
+    id, ok := nextId(group.Id, &s.lastGroupId, ids)
+    if !ok {
+        return errDuplicateKey
+    }
+    group.Id = id
+
+    i, _ := s.findGroup(id)
+    s.groups = append(s.groups, Group{})
+    copy(s.groups[i+1:], s.groups[i:])
+    s.groups[i] = *group
+
+    for _, userId := range groupMemberIds(*group, members) {
+        s.groupMembers[GroupMember{GroupId: group.Id, UserId: userId}] = true
+    }
+    return nil
+}
+
+func (s *memoryStore) getGroupMembers(group Group) Users {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    members := Users{}
+    for _, user := range s.users {
+        if s.groupMembers[GroupMember{GroupId: group.Id, UserId: user.Id}] {
+            members = append(members, user)
+        }
+    }
+    return members
+}
+
+func (s *memoryStore) isGroupMember(group Group, user User) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.groupMembers[GroupMember{GroupId: group.Id, UserId: user.Id}]
+}
+
+func (s *memoryStore) addGroupMember(group Group, user User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    gm := GroupMember{GroupId: group.Id, UserId: user.Id}
+    if s.groupMembers[gm] {
+        return errDuplicateKey
+    }
+    s.groupMembers[gm] = true
+    return nil
+}
+
+func (s *memoryStore) removeGroupMember(group Group, user User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.groupMembers, GroupMember{GroupId: group.Id, UserId: user.Id})
+    return nil
+}
+
+/*
+ * Sessions and revoked tokens
+ */
+
+func (s *memoryStore) findSession(id int) (int, bool) {
+    i := searchIds(len(s.sessions), id, func(i int) int { return s.sessions[i].Id })
+    return i, i < len(s.sessions) && s.sessions[i].Id == id
+}
+
+func (s *memoryStore) createSession(session *Session) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // clean up while we're here
+    now := time.Now()
+    sessions := s.sessions[:0]
+    for _, other := range s.sessions {
+        if other.UserId != session.UserId || other.ExpiresAt.After(now) {
+            sessions = append(sessions, other)
+        }
+    }
+    s.sessions = sessions
+
+    ids := make([]int, len(s.sessions))
+    for i, other := range s.sessions {
+        if other.TokenHash == session.TokenHash {
+            return errDuplicateKey
+        }
+        ids[i] = other.Id
+    }
+    id, ok := nextId(session.Id, &s.lastSessionId, ids)
+    if !ok {
+        return errDuplicateKey
+    }
+    session.Id = id
+
+    i, _ := s.findSession(id)
+    s.sessions = append(s.sessions, Session{})
+    copy(s.sessions[i+1:], s.sessions[i:])
+    s.sessions[i] = *session
+    return nil
+}
+
+func (s *memoryStore) getSessionByHash(tokenHash string) (Session, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for _, session := range s.sessions {
+        if session.TokenHash == tokenHash {
+            return session, nil
+        }
+    }
+    return Session{}, errNotFound
+}
+
+func (s *memoryStore) getSessions(user User) []Session {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    sessions := []Session{}
+    for i := len(s.sessions) - 1; i >= 0; i-- {
+        if s.sessions[i].UserId == user.Id {
+            sessions = append(sessions, s.sessions[i])
+        }
+    }
+    return sessions
+}
+
+func (s *memoryStore) saveSession(session *Session) error {
+    s.mu.Lock()
+    i, ok := s.findSession(session.Id)
+    if !ok {
+        s.mu.Unlock()
+        return s.createSession(session)
+    }
+    defer s.mu.Unlock()
+
+    s.sessions[i] = *session
+    return nil
+}
+
+func (s *memoryStore) deleteSession(session Session) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if i, ok := s.findSession(session.Id); ok {
+        s.sessions = append(s.sessions[:i], s.sessions[i+1:]...)
+    }
+    return nil
+}
+
+func (s *memoryStore) revokeToken(revoked RevokedToken) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // nobody needs the expired ones any more
+    now := time.Now()
+    for tokenHash, other := range s.revokedTokens {
+        if !other.ExpiresAt.After(now) {
+            delete(s.revokedTokens, tokenHash)
+        }
+    }
+
+    // already revoked is fine
+    if _, ok := s.revokedTokens[revoked.TokenHash]; !ok {
+        s.revokedTokens[revoked.TokenHash] = revoked
+    }
+    return nil
+}
+
+func (s *memoryStore) isTokenRevoked(tokenHash string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    _, ok := s.revokedTokens[tokenHash]
+    return ok
+}
+
+func (s *memoryStore) getUserRevocation(uid string) (UserRevocation, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, err := s.userByUid(uid)
+    if err != nil {
+        return UserRevocation{}, err
+    }
+    if revocation, ok := s.userRevocations[user.Id]; ok {
+        return revocation, nil
+    }
+    return UserRevocation{}, errNotFound
+}
+
+func (s *memoryStore) revokeAllSessions(revocation UserRevocation) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    sessions := s.sessions[:0]
+    for _, session := range s.sessions {
+        if session.UserId != revocation.UserId {
+            sessions = append(sessions, session)
+        }
+    }
+    s.sessions = sessions
+
+    s.userRevocations[revocation.UserId] = revocation
+    return nil
+}
+
+/*
+ * API keys
+ */
+
+func (s *memoryStore) findAPIKey(id int) (int, bool) {
+    i := searchIds(len(s.apiKeys), id, func(i int) int { return s.apiKeys[i].Id })
+    return i, i < len(s.apiKeys) && s.apiKeys[i].Id == id
+}
+
+func (s *memoryStore) createAPIKey(key *APIKey) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]int, len(s.apiKeys))
+    for i, other := range s.apiKeys {
+        if other.KeyHash == key.KeyHash {
+            return errDuplicateKey
+        }
+        ids[i] = other.Id
+    }
+    id, ok := nextId(key.Id, &s.lastAPIKeyId, ids)
+    if !ok {
+        return errDuplicateKey
+    }
+    key.Id = id
+
+    i, _ := s.findAPIKey(id)
+    s.apiKeys = append(s.apiKeys, APIKey{})
+    copy(s.apiKeys[i+1:], s.apiKeys[i:])
+    s.apiKeys[i] = *key
+    return nil
+}
+
+func (s *memoryStore) getAPIKeyByHash(keyHash string) (APIKey, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for _, key := range s.apiKeys {
+        if key.KeyHash == keyHash {
+            return key, nil
+        }
+    }
+    return APIKey{}, errNotFound
+}
+
+func (s *memoryStore) getAPIKeys(bot User) []APIKey {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    keys := []APIKey{}
+    for _, key := range s.apiKeys {
+        if key.BotId == bot.Id {
+            keys = append(keys, key)
+        }
+    }
+    return keys
+}
+
+func (s *memoryStore) getAPIKey(bot User, keyId int) (APIKey, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if i, ok := s.findAPIKey(keyId); ok && s.apiKeys[i].BotId == bot.Id {
+        return s.apiKeys[i], nil
+    }
+    return APIKey{}, errNotFound
+}
+
+func (s *memoryStore) saveAPIKey(key *APIKey) error {
+    s.mu.Lock()
+    i, ok := s.findAPIKey(key.Id)
+    if !ok {
+        s.mu.Unlock()
+        return s.createAPIKey(key)
+    }
+    defer s.mu.Unlock()
+
+    for _, other := range s.apiKeys {
+        if other.KeyHash == key.KeyHash && other.Id != key.Id {
+            return errDuplicateKey
+        }
+    }
+    s.apiKeys[i] = *key
+    return nil
+}
+
+func (s *memoryStore) deleteAPIKey(key APIKey) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if i, ok := s.findAPIKey(key.Id); ok {
+        s.apiKeys = append(s.apiKeys[:i], s.apiKeys[i+1:]...)
+    }
+    return nil
+}
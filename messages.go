@@ -1,12 +1,17 @@
 package main
 
 import (
+    "encoding/base64"
     "encoding/json"
     "errors"
+    "fmt"
+    "io"
     "log"
     "net/http"
     "strconv"
+    "strings"
     "time"
+    "unicode/utf8"
     
     "github.com/gorilla/mux"
 )
@@ -25,10 +30,31 @@ func (ct *ContentType) valid() bool {
 type RecipientType int
 const (
     RecipientTypeUser = 1
+    RecipientTypeGroup = 2
 )
 
 func (rt *RecipientType) valid() bool {
-    return rt != nil && *rt >= 1 && *rt <= 1
+    return rt != nil && *rt >= 1 && *rt <= 2
+}
+
+// The most characters a message's content can have
+const MaxMessageLength = 1024
+
+// Checks content fits in a message
+func checkMessageLength(content string) error {
+    if utf8.RuneCountInString(content) > MaxMessageLength {
+        return fmt.Errorf("Messages can't be longer than %d characters", MaxMessageLength)
+    }
+    return nil
+}
+
+// Checks content can replace a message's.
+// Unlike sending, editing a message to nothing isn't allowed; delete it instead.
+func checkEditedContent(content string) error {
+    if content == "" {
+        return errors.New("Message content cannot be empty")
+    }
+    return checkMessageLength(content)
 }
 
 type Message struct {
@@ -39,22 +65,240 @@ type Message struct {
     RecipientId         int             `json:"recipientId" sql:"not null"`
     RecipientType       RecipientType   `json:"recipientType" sql:"not null"`
     Timestamp           time.Time       `json:"timestamp" sql:"not null"`
+    EditedAt            *time.Time      `json:"editedAt"`
+    // deleted messages are kept as tombstones, with their content cleared
+    Deleted             bool            `json:"deleted" sql:"not null"`
+    // the same for every message in a conversation, so its history is one
+    // range of an index; filled in by the store
+    ConversationKey     string          `json:"-" sql:"type:varchar(64)"`
 }
 
 type Messages []Message
 
-func (msg *Message) getSender() (sender User, err error) {
-    err = db.Where(&User{Id: msg.SenderId}).First(&sender).Error
-    return
+// Gets the conversation key of messages between two users, whichever of them
+// sent them
+func userConversationKey(userId int, otherUserId int) string {
+    if otherUserId < userId {
+        userId, otherUserId = otherUserId, userId
+    }
+    return fmt.Sprintf("u:%d:%d", userId, otherUserId)
+}
+
+// Gets the conversation key of messages sent to a group
+func groupConversationKey(groupId int) string {
+    return fmt.Sprintf("g:%d", groupId)
+}
+
+func (msg *Message) conversationKey() string {
+    if msg.RecipientType == RecipientTypeGroup {
+        return groupConversationKey(msg.RecipientId)
+    }
+    return userConversationKey(msg.SenderId, msg.RecipientId)
+}
+
+// Changes the content of a message.
+// Only text messages can be edited, and deleted messages stay deleted.
+func (api *API) editMessage(msg *Message, content string) error {
+    if msg.Deleted {
+        return errors.New("Message has been deleted")
+    }
+    if msg.ContentType != ContentTypeText {
+        return errors.New("Only text messages can be edited")
+    }
+    if err := checkEditedContent(content); err != nil {
+        return err
+    }
+
+    now := time.Now()
+    edited := *msg
+    edited.Content = content
+    edited.EditedAt = &now
+    if err := api.store.saveMessage(&edited); err != nil {
+        return err
+    }
+
+    *msg = edited
+    return nil
 }
 
-func (msg *Message) getRecipientUser() (recipient User, err error) {
+// Deletes a message, leaving a tombstone in its place so the conversation
+// shows where it was.
+func (api *API) deleteMessage(msg *Message) error {
+    if msg.Deleted {
+        return errors.New("Message has already been deleted")
+    }
+
+    deleted := *msg
+    deleted.Content = ""
+    deleted.Deleted = true
+    if err := api.store.saveMessage(&deleted); err != nil {
+        return err
+    }
+
+    *msg = deleted
+    return nil
+}
+
+// Represents how far a user has read in their conversation with a friend
+type ReadMarker struct {
+    UserId      int     `json:"userId" gorm:"primary_key"`
+    FriendId    int     `json:"friendId" gorm:"primary_key"`
+    LastReadId  int     `json:"lastReadId" sql:"not null"`
+}
+
+func (api *API) getSender(msg Message) (User, error) {
+    return api.store.getUser(msg.SenderId)
+}
+
+func (api *API) getRecipientUser(msg Message) (recipient User, err error) {
     if msg.RecipientType != RecipientTypeUser {
-        err = errors.New("Invalid recipient type")
+        return recipient, errors.New("Invalid recipient type")
+    }
+    return api.store.getUser(msg.RecipientId)
+}
+
+func (api *API) getRecipientGroup(msg Message) (recipient Group, err error) {
+    if msg.RecipientType != RecipientTypeGroup {
+        return recipient, errors.New("Invalid recipient type")
+    }
+    return api.store.getGroup(msg.RecipientId)
+}
+
+// Marks every message up to and including messageId from otherUser as read.
+// Markers only ever move forwards; marking an older message does nothing.
+func (api *API) markMessagesRead(user User, otherUser User, messageId int) (marker ReadMarker, err error) {
+    msg, err := api.store.getMessage(messageId)
+    if err != nil || msg.SenderId != otherUser.Id || msg.RecipientId != user.Id || msg.RecipientType != RecipientTypeUser {
+        return marker, errors.New("Message not found")
+    }
+
+    marker = api.store.getReadMarker(user, otherUser)
+    if messageId <= marker.LastReadId {
+        return marker, nil
+    }
+
+    marker.LastReadId = messageId
+    err = api.store.advanceReadMarker(marker)
+    return marker, err
+}
+
+// The state of a user's conversation with one of their friends
+type ConversationSummary struct {
+    FriendId    int
+    UnreadCount int
+    LastMessage *Message
+}
+
+// Which page of a conversation's history to list: the messages before a
+// message (or the latest, if from is -1), going backwards, or those after
+// one, going forwards. Clients get them as opaque cursors.
+type messagePage struct {
+    forward     bool
+    from        int
+}
+
+// The latest messages, going backwards
+var latestMessages = messagePage{from: -1}
+
+func (page messagePage) cursor() string {
+    direction := "before"
+    if page.forward {
+        direction = "after"
+    }
+    return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%v:%d", direction, page.from)))
+}
+
+func parseMessageCursor(cursor string) (page messagePage, err error) {
+    decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+        return page, errors.New("Invalid cursor")
+    }
+
+    parts := strings.SplitN(string(decoded), ":", 2)
+    if len(parts) != 2 || (parts[0] != "before" && parts[0] != "after") {
+        return page, errors.New("Invalid cursor")
+    }
+    page.forward = parts[0] == "after"
+    if page.from, err = strconv.Atoi(parts[1]); err != nil || page.from < 0 {
+        return page, errors.New("Invalid cursor")
+    }
+    return page, nil
+}
+
+// Gets the page of messages asked for by a request's cursor, last or after
+// parameter (only one of them), and how many messages to get.
+func parseMessagePageParams(r *http.Request) (page messagePage, amount int, ok bool) {
+    cursorParam, lastParam, afterParam := r.FormValue("cursor"), r.FormValue("last"), r.FormValue("after")
+    page = latestMessages
+
+    given := 0
+    for _, param := range []string{cursorParam, lastParam, afterParam} {
+        if param != "" {
+            given++
+        }
+    }
+    if given > 1 {
+        log.Println("More than one of cursor, last and after")
+        return page, 0, false
+    }
+
+    var err error
+    switch {
+    case cursorParam != "":
+        if page, err = parseMessageCursor(cursorParam); err != nil {
+            log.Println("Cursor not valid")
+            return page, 0, false
+        }
+    case lastParam != "":
+        page.from, err = strconv.Atoi(lastParam)
+        if err != nil || page.from < 0 {
+            log.Println("Last not positive integer")
+            return page, 0, false
+        }
+    case afterParam != "":
+        page.forward = true
+        page.from, err = strconv.Atoi(afterParam)
+        if err != nil || page.from < 0 {
+            log.Println("After not positive integer")
+            return page, 0, false
+        }
+    }
+
+    if amountParam := r.FormValue("amount"); amountParam != "" {
+        amount, err = strconv.Atoi(amountParam)
+        if err != nil || amount <= 0 {
+            log.Println("Amount not positive integer")
+            return page, 0, false
+        }
     } else {
-        err = db.Where(&User{Id: msg.RecipientId}).First(&recipient).Error
+        // default to 100
+        amount = 100
     }
-    return
+
+    return page, amount, true
+}
+
+// Gets a page of messages, oldest first, using before and after to get them
+// from the store, along with the cursor for the next page in the same
+// direction. Going backwards there's no next page once the first message
+// has been reached; going forwards there always is, for messages sent later.
+func pageMessages(page messagePage, amount int, before func(last int, amount int) Messages, after func(after int, amount int) Messages) (msgs Messages, nextCursor string) {
+    if page.forward {
+        msgs = after(page.from, amount)
+        next := page
+        if len(msgs) > 0 {
+            next.from = msgs[len(msgs)-1].Id
+        }
+        return msgs, next.cursor()
+    }
+
+    // one more than asked for, to see if there are any before them
+    msgs = before(page.from, amount+1)
+    if len(msgs) <= amount {
+        return msgs, ""
+    }
+    msgs = msgs[1:]
+    return msgs, messagePage{from: msgs[0].Id}.cursor()
 }
 
 /*
@@ -65,9 +309,8 @@ func (msg *Message) getRecipientUser() (recipient User, err error) {
  * /friends/{friendId}/messages endpoint
  */
 
-func messagesHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) messagesHandler(w http.ResponseWriter, r *http.Request, user User, ok bool) int {
     log.Println("Handling /friends/{friendId}/messages")
-    user, ok := getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -83,30 +326,11 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) int {
 
     switch r.Method {
     case "GET":
-        var last, amount int;
-        var err error;
-
-        if last_param := r.FormValue("last"); last_param != ""{
-            last, err = strconv.Atoi(last_param)
-            if err != nil || last < 0 {
-                log.Println("Last not positive integer")
-                return http.StatusBadRequest
-            }
-        } else {
-            last = -1;
-        }
-
-        if amount_param := r.FormValue("amount"); amount_param != ""{
-            amount, err = strconv.Atoi(amount_param)
-            if err != nil || amount <= 0 {
-                log.Println("Amount not positive integer")
-                return http.StatusBadRequest
-            }
-        } else {
-            // default to 100
-            amount = 100;
+        page, amount, ok := parseMessagePageParams(r)
+        if !ok {
+            return http.StatusBadRequest
         }
-        resp = listMessagesEndpoint(user, friendId, last, amount)
+        resp = api.listMessagesEndpoint(user, friendId, page, amount)
     case "POST":
         decoder := json.NewDecoder(r.Body)
         var req SendMessageRequest
@@ -115,7 +339,7 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) int {
             log.Println("JSON decoding failed")
             return http.StatusBadRequest
         }
-        resp = sendMessageEndpoint(user, friendId, req)
+        resp = api.sendMessageEndpoint(user, friendId, req)
     default:
         return http.StatusMethodNotAllowed
     }
@@ -129,15 +353,20 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) int {
  * Gets a list of the messages between the current user and their friend specified
  * by the Id.
  * last specifies the messageId of the message that would come right after the last returned message.
+ * after specifies the messageId of the message that would come right before the first returned message.
+ * cursor is a nextCursor from an earlier response, to get the next page.
  * amount specifies the number of messages returned.
  */
 type ListMessagesResponse struct {
-    Success     bool        `json:"success"`
-    Error       string      `json:"error"`
-    Messages    Messages    `json:"messages"`
+    Success     bool            `json:"success"`
+    Error       string          `json:"error"`
+    Messages    Messages        `json:"messages"`
+    ReadMarkers []ReadMarker    `json:"readMarkers"`
+    // for the next page, in the same direction; empty if there isn't one
+    NextCursor  string          `json:"nextCursor"`
 }
 
-func listMessagesEndpoint(user User, friendId int, last int, amount int) ListMessagesResponse {
+func (api *API) listMessagesEndpoint(user User, friendId int, page messagePage, amount int) ListMessagesResponse {
     if friendId == user.Id {
         return ListMessagesResponse{
             Success:    false,
@@ -145,8 +374,7 @@ func listMessagesEndpoint(user User, friendId int, last int, amount int) ListMes
         }
     }
 
-    var friend User
-    dbErr := db.Where(&User{Id: friendId}).First(&friend).Error
+    friend, dbErr := api.store.getUser(friendId)
 
     if dbErr != nil {
         // friend they are trying to list messages between not found
@@ -156,19 +384,26 @@ func listMessagesEndpoint(user User, friendId int, last int, amount int) ListMes
         }
     }
 
-    if !user.isFriend(friend) {
+    if !api.store.isFriend(user, friend) {
         return ListMessagesResponse{
             Success:    false,
             Error:      "User is not your friend",
         }
     }
 
-    var messages Messages
-    messages = user.getMessagesWithUser(friend, last, amount)
+    messages, nextCursor := pageMessages(page, amount,
+        func(last int, amount int) Messages {
+            return api.store.getMessagesWithUser(user, friend, last, amount)
+        },
+        func(after int, amount int) Messages {
+            return api.store.getMessagesWithUserAfter(user, friend, after, amount)
+        })
 
     return ListMessagesResponse{
-        Success:    true,
-        Messages:   messages,
+        Success:        true,
+        Messages:       messages,
+        ReadMarkers:    []ReadMarker{api.store.getReadMarker(user, friend), api.store.getReadMarker(friend, user)},
+        NextCursor:     nextCursor,
     }
 }
 
@@ -187,7 +422,7 @@ type SendMessageResponse struct {
     Id      int         `json:"id"`
 }
 
-func sendMessageEndpoint(user User, friendId int, req SendMessageRequest) SendMessageResponse {
+func (api *API) sendMessageEndpoint(user User, friendId int, req SendMessageRequest) SendMessageResponse {
     if friendId == user.Id {
         return SendMessageResponse{
             Success:    false,
@@ -195,8 +430,7 @@ func sendMessageEndpoint(user User, friendId int, req SendMessageRequest) SendMe
         }
     }
 
-    var friend User
-    dbErr := db.Where(&User{Id: friendId}).First(&friend).Error
+    friend, dbErr := api.store.getUser(friendId)
 
     if dbErr != nil {
         // friend they are trying to send message to not found
@@ -206,7 +440,7 @@ func sendMessageEndpoint(user User, friendId int, req SendMessageRequest) SendMe
         }
     }
 
-    if !user.isFriend(friend) {
+    if !api.store.isFriend(user, friend) {
         // users are not friends
         return SendMessageResponse{
             Success:    false,
@@ -214,7 +448,7 @@ func sendMessageEndpoint(user User, friendId int, req SendMessageRequest) SendMe
         }
     }
 
-    msg, sendErr := user.addMessageToUser(friend, req.Content, req.ContentType)
+    msg, sendErr := api.addMessageToUser(user, friend, req.Content, req.ContentType)
 
     if sendErr != nil {
         return SendMessageResponse{
@@ -231,3 +465,256 @@ func sendMessageEndpoint(user User, friendId int, req SendMessageRequest) SendMe
         Id:         msg.Id,
     }
 }
+
+/*
+ * /friends/{friendId}/messages/read endpoint
+ */
+
+func (api *API) readMessagesHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /friends/{friendId}/messages/read")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    vars := mux.Vars(r)
+    friendId, err := strconv.Atoi(vars["friendId"])
+    if err != nil || friendId <= 0 {
+        log.Println("Friend ID not positive integer")
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "PUT":
+        var req ReadMessagesRequest
+        // an empty body means everything has been read
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+            log.Println("JSON decoding failed")
+            return http.StatusBadRequest
+        }
+        if req.MessageId < 0 {
+            log.Println("Message ID negative")
+            return http.StatusBadRequest
+        }
+        resp = api.readMessagesEndpoint(user, friendId, req)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * PUT /friends/{friendId}/messages/read
+ * Marks the messages from the friend specified by the Id as read, up to and
+ * including messageId (or all of them, if it isn't given).
+ */
+type ReadMessagesRequest struct {
+    MessageId   int     `json:"messageId"`
+}
+
+type ReadMessagesResponse struct {
+    Success     bool        `json:"success"`
+    Error       string      `json:"error"`
+    ReadMarker  ReadMarker  `json:"readMarker"`
+}
+
+func (api *API) readMessagesEndpoint(user User, friendId int, req ReadMessagesRequest) ReadMessagesResponse {
+    if friendId == user.Id {
+        return ReadMessagesResponse{
+            Success:    false,
+            Error:      "You can't read messages from yourself",
+        }
+    }
+
+    friend, dbErr := api.store.getUser(friendId)
+
+    if dbErr != nil {
+        return ReadMessagesResponse{
+            Success:    false,
+            Error:      "Friend not found",
+        }
+    }
+
+    if !api.store.isFriend(user, friend) {
+        return ReadMessagesResponse{
+            Success:    false,
+            Error:      "User is not your friend",
+        }
+    }
+
+    messageId := req.MessageId
+    if messageId == 0 {
+        messageId = api.store.lastMessageIdFromUser(user, friend)
+        if messageId == 0 {
+            // nothing to read
+            return ReadMessagesResponse{
+                Success:    true,
+                ReadMarker: api.store.getReadMarker(user, friend),
+            }
+        }
+    }
+
+    oldMarker := api.store.getReadMarker(user, friend)
+
+    marker, err := api.markMessagesRead(user, friend, messageId)
+    if err != nil {
+        return ReadMessagesResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    if marker.LastReadId != oldMarker.LastReadId {
+        // let the sender know their messages were seen, and the user's other
+        // devices that they don't need to show them as unread any more
+        event := newEvent(EventTypeMessagesRead, marker)
+        sendEvent(friend.Id, event)
+        sendEvent(user.Id, event)
+    }
+
+    return ReadMessagesResponse{
+        Success:    true,
+        ReadMarker: marker,
+    }
+}
+
+/*
+ * /friends/{friendId}/messages/{messageId} endpoint
+ */
+
+func (api *API) messageHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /friends/{friendId}/messages/{messageId}")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    vars := mux.Vars(r)
+    friendId, err := strconv.Atoi(vars["friendId"])
+    if err != nil || friendId <= 0 {
+        log.Println("Friend ID not positive integer")
+        return http.StatusBadRequest
+    }
+    messageId, err := strconv.Atoi(vars["messageId"])
+    if err != nil || messageId <= 0 {
+        log.Println("Message ID not positive integer")
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "PATCH":
+        decoder := json.NewDecoder(r.Body)
+        var req EditMessageRequest
+        err := decoder.Decode(&req)
+        if err != nil {
+            log.Println("JSON decoding failed")
+            return http.StatusBadRequest
+        }
+        if err := checkEditedContent(req.Content); err != nil {
+            log.Println(err)
+            return http.StatusBadRequest
+        }
+        resp = api.editMessageEndpoint(user, friendId, messageId, req)
+    case "DELETE":
+        resp = api.deleteMessageEndpoint(user, friendId, messageId)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+// Gets a message the user sent to their friend, for changing it.
+func (api *API) getSentMessage(user User, friendId int, messageId int) (msg Message, friend User, err error) {
+    if friend, err = api.store.getUser(friendId); err != nil {
+        return msg, friend, errors.New("Friend not found")
+    }
+
+    if !api.store.isFriend(user, friend) {
+        return msg, friend, errors.New("User is not your friend")
+    }
+
+    msg, err = api.store.getMessage(messageId)
+    if err != nil || msg.SenderId != user.Id || msg.RecipientId != friend.Id || msg.RecipientType != RecipientTypeUser {
+        return msg, friend, errors.New("Message not found")
+    }
+
+    return msg, friend, nil
+}
+
+/*
+ * PATCH /friends/{friendId}/messages/{messageId}
+ * Edits the content of a text message the current user sent to their friend.
+ */
+type EditMessageRequest struct {
+    Content     string      `json:"content"`
+}
+
+type ModifyMessageResponse struct {
+    Success     bool        `json:"success"`
+    Error       string      `json:"error"`
+    Message     Message     `json:"message"`
+}
+
+func (api *API) editMessageEndpoint(user User, friendId int, messageId int, req EditMessageRequest) ModifyMessageResponse {
+    msg, friend, err := api.getSentMessage(user, friendId, messageId)
+    if err != nil {
+        return ModifyMessageResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    if err = api.editMessage(&msg, req.Content); err != nil {
+        return ModifyMessageResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    event := newEvent(EventTypeMessageEdited, msg)
+    sendEvent(friend.Id, event)
+    sendEvent(user.Id, event)
+
+    return ModifyMessageResponse{
+        Success:    true,
+        Message:    msg,
+    }
+}
+
+/*
+ * DELETE /friends/{friendId}/messages/{messageId}
+ * Deletes a message the current user sent to their friend.
+ */
+func (api *API) deleteMessageEndpoint(user User, friendId int, messageId int) ModifyMessageResponse {
+    msg, friend, err := api.getSentMessage(user, friendId, messageId)
+    if err != nil {
+        return ModifyMessageResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    if err = api.deleteMessage(&msg); err != nil {
+        return ModifyMessageResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+
+    event := newEvent(EventTypeMessageDeleted, msg)
+    sendEvent(friend.Id, event)
+    sendEvent(user.Id, event)
+
+    return ModifyMessageResponse{
+        Success:    true,
+        Message:    msg,
+    }
+}
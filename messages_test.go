@@ -1,8 +1,12 @@
 package main
 
 import (
+    "fmt"
+    "strings"
     "testing"
     "log"
+    "net/http"
+    "time"
 )
 
 func TestGetSender(t *testing.T) {
@@ -16,7 +20,7 @@ func TestGetSender(t *testing.T) {
         Email:      "poop@gmail.com",
         Picture:    "blah",
     }
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:         2,
@@ -27,16 +31,16 @@ func TestGetSender(t *testing.T) {
         Email:      "pm@gmail.com",
         Picture:    "hehe",
     }
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Add a message from user1 to user2")
-    user1.addMessageToUser(user2, "this is a message from user1 to user2", 1)
+    testAPI.addMessageToUser(user1, user2, "this is a message from user1 to user2", 1)
     
     log.Println("Get messages between user1 and user2")
-    messages := user1.getMessagesWithUser(user2, -1, 100)
+    messages := testStore.getMessagesWithUser(user1, user2, -1, 100)
 
     log.Println("Check sender")
-    if sender, _ := messages[0].getSender(); sender.Id != user1.Id {
+    if sender, _ := testAPI.getSender(messages[0]); sender.Id != user1.Id {
         t.Error("Wrong sender returned")
     }
 }
@@ -52,7 +56,7 @@ func TestGetRecipientUser(t *testing.T) {
         Email:      "poop@gmail.com",
         Picture:    "blah",
     }
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:         2,
@@ -63,16 +67,16 @@ func TestGetRecipientUser(t *testing.T) {
         Email:      "pm@gmail.com",
         Picture:    "hehe",
     }
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Add a message from user1 to user2")
-    user1.addMessageToUser(user2, "this is a message from user1 to user2", 1)
+    testAPI.addMessageToUser(user1, user2, "this is a message from user1 to user2", 1)
     
     log.Println("Get messages between user1 and user2")
-    messages := user1.getMessagesWithUser(user2, -1, 100)
+    messages := testStore.getMessagesWithUser(user1, user2, -1, 100)
 
     log.Println("Check recipient")
-    if recipient, _ := messages[0].getRecipientUser(); recipient.Id != user2.Id {
+    if recipient, _ := testAPI.getRecipientUser(messages[0]); recipient.Id != user2.Id {
         t.Error("Wrong recipient returned")
     }
 }
@@ -89,7 +93,7 @@ func TestListMessagesEndpoint(t *testing.T) {
         Email:      "poop@gmail.com",
         Picture:    "blah",
     }
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:         2,
@@ -100,7 +104,7 @@ func TestListMessagesEndpoint(t *testing.T) {
         Email:      "pm@gmail.com",
         Picture:    "hehe",
     }
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     user3 := User{
         Id:         3,
@@ -111,30 +115,30 @@ func TestListMessagesEndpoint(t *testing.T) {
         Email:      "swamp@gmail.com",
         Picture:    "40keks",
     }
-    db.Create(&user3)
+    testStore.createUser(&user3)
 
     log.Println("List the messages between user2 and user1 (not friends)")
-    response := listMessagesEndpoint(user2, 1, -1, 100)
+    response := testAPI.listMessagesEndpoint(user2, 1, latestMessages, 100)
     if response.Error == "" {
         t.Error("Listing messages should fail when users aren't friends")
     }
 
     log.Println("List the messages between user1 and user1 (same user)")
-    response = listMessagesEndpoint(user2, 2, -1, 100)
+    response = testAPI.listMessagesEndpoint(user2, 2, latestMessages, 100)
     if response.Error == "" {
         t.Error("Listing messages should fail when users are the same")
     }
 
     log.Println("Adding users as friends")
-    user1.addFriend(user2)
-    user1.addFriend(user3)
-    user2.addFriend(user3)
+    testStore.addFriend(user1, user2)
+    testStore.addFriend(user1, user3)
+    testStore.addFriend(user2, user3)
 
     log.Println("Add a message from user1 to user2")
-    user1.addMessageToUser(user2, "this is a message from user1 to user2", 1)
+    testAPI.addMessageToUser(user1, user2, "this is a message from user1 to user2", 1)
 
     log.Println("List the messages between user2 and user1")
-    response = listMessagesEndpoint(user2, 1, -1, 100)
+    response = testAPI.listMessagesEndpoint(user2, 1, latestMessages, 100)
 
     if response.Error != "" {
         t.Error("Response had error when it shouldn't have")
@@ -146,16 +150,16 @@ func TestListMessagesEndpoint(t *testing.T) {
         if response.Messages[0].Content != "this is a message from user1 to user2" {
             t.Errorf("Message returned had the wrong content: %v\n", response.Messages[0].Content)
         }
-        if sender, _ := response.Messages[0].getSender(); sender.Id != 1 {
+        if sender, _ := testAPI.getSender(response.Messages[0]); sender.Id != 1 {
             t.Errorf("Message returned had the wrong senderid: %v\n", response.Messages[0].SenderId)
         }
-        if recipient, _ := response.Messages[0].getRecipientUser(); recipient.Id != 2 {
+        if recipient, _ := testAPI.getRecipientUser(response.Messages[0]); recipient.Id != 2 {
             t.Errorf("Message returned had the wrong recipientid: %v\n", response.Messages[0].RecipientId)
         }
     }
 
     log.Println("List the messages between user1 and user2")
-    response = listMessagesEndpoint(user1, 2, -1, 100)
+    response = testAPI.listMessagesEndpoint(user1, 2, latestMessages, 100)
 
     if response.Error != "" {
         t.Error("Response had error when it shouldn't have")
@@ -167,19 +171,19 @@ func TestListMessagesEndpoint(t *testing.T) {
         if response.Messages[0].Content != "this is a message from user1 to user2" {
             t.Errorf("Message returned had the wrong content: %v\n", response.Messages[0].Content)
         }
-        if sender, _ := response.Messages[0].getSender(); sender.Id != 1 {
+        if sender, _ := testAPI.getSender(response.Messages[0]); sender.Id != 1 {
             t.Errorf("Message returned had the wrong senderid: %v\n", response.Messages[0].SenderId)
         }
-        if recipient, _ := response.Messages[0].getRecipientUser(); recipient.Id != 2 {
+        if recipient, _ := testAPI.getRecipientUser(response.Messages[0]); recipient.Id != 2 {
             t.Errorf("Message returned had the wrong recipientid: %v\n", response.Messages[0].RecipientId)
         }
     }
 
     log.Println("Add a message from user2 to user3")
-    user2.addMessageToUser(user3, "this is a message from user2 to user3", 1)
+    testAPI.addMessageToUser(user2, user3, "this is a message from user2 to user3", 1)
 
     log.Println("List the messages between user3 and user2")
-    response = listMessagesEndpoint(user3, 2, -1, 100)
+    response = testAPI.listMessagesEndpoint(user3, 2, latestMessages, 100)
 
     if response.Error != "" {
         t.Error("Response had error when it shouldn't have")
@@ -191,19 +195,19 @@ func TestListMessagesEndpoint(t *testing.T) {
         if response.Messages[0].Content != "this is a message from user2 to user3" {
             t.Errorf("Message returned had the wrong content: %v\n", response.Messages[0].Content)
         }
-        if sender, _ := response.Messages[0].getSender(); sender.Id != 2 {
+        if sender, _ := testAPI.getSender(response.Messages[0]); sender.Id != 2 {
             t.Errorf("Message returned had the wrong senderid: %v\n", response.Messages[0].SenderId)
         }
-        if recipient, _ := response.Messages[0].getRecipientUser(); recipient.Id != 3 {
+        if recipient, _ := testAPI.getRecipientUser(response.Messages[0]); recipient.Id != 3 {
             t.Errorf("Message returned had the wrong recipientid: %v\n", response.Messages[0].RecipientId)
         }
     }
 
     log.Println("Add a message from user1 to user2")
-    user1.addMessageToUser(user2, "this is another message from user1 to user2", 1)
+    testAPI.addMessageToUser(user1, user2, "this is another message from user1 to user2", 1)
 
     log.Println("List the messages between user2 and user1")
-    response = listMessagesEndpoint(user2, 1, -1, 100)
+    response = testAPI.listMessagesEndpoint(user2, 1, latestMessages, 100)
 
     if response.Error != "" {
         t.Error("Response had error when it shouldn't have")
@@ -221,10 +225,10 @@ func TestListMessagesEndpoint(t *testing.T) {
     }
 
     log.Println("Add a message from user2 to user1")
-    user1.addMessageToUser(user2, "this is a message from user2 to user1", 1)
+    testAPI.addMessageToUser(user1, user2, "this is a message from user2 to user1", 1)
 
     log.Println("List the messages between user1 and user2")
-    response = listMessagesEndpoint(user1, 2, -1, 100)
+    response = testAPI.listMessagesEndpoint(user1, 2, latestMessages, 100)
 
     if response.Error != "" {
         t.Error("Response had error when it shouldn't have")
@@ -245,7 +249,7 @@ func TestListMessagesEndpoint(t *testing.T) {
     }
 
     log.Println("List the last message between user1 and user2")
-    response = listMessagesEndpoint(user1, 2, -1, 1)
+    response = testAPI.listMessagesEndpoint(user1, 2, latestMessages, 1)
 
     if response.Error != "" {
         t.Error("Response had error when it shouldn't have")
@@ -260,12 +264,132 @@ func TestListMessagesEndpoint(t *testing.T) {
     }
 
     log.Println("List the messages between user1 and a non existent user")
-    response = listMessagesEndpoint(user1, 123, -1, 100)
+    response = testAPI.listMessagesEndpoint(user1, 123, latestMessages, 100)
     if response.Error != "Friend not found" {
         t.Errorf("Response returned the wrong error. Got error %v\n", response.Error)
     }
 }
 
+func TestListMessagesPaging(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{Uid: "1", Name: "Snoop Doge"}
+    user2 := User{Uid: "2", Name: "Malcolm Turnbull"}
+    user3 := User{Uid: "3", Name: "Shrek"}
+    testStore.createUser(&user1)
+    testStore.createUser(&user2)
+    testStore.createUser(&user3)
+    testStore.addFriend(user1, user2)
+    testStore.addFriend(user1, user3)
+
+    var ids []int
+    for i := 0; i < 5; i++ {
+        msg, _ := testAPI.addMessageToUser(user1, user2, fmt.Sprintf("message %v", i+1), ContentTypeText)
+        ids = append(ids, msg.Id)
+        // another conversation in between, which shouldn't show up
+        testAPI.addMessageToUser(user3, user1, "interruption", ContentTypeText)
+    }
+
+    checkPage := func(resp ListMessagesResponse, expected []int) {
+        if !resp.Success {
+            t.Fatalf("Listing messages failed: %v", resp.Error)
+        }
+        if len(resp.Messages) != len(expected) {
+            t.Fatalf("Expected %v messages, got %v", len(expected), len(resp.Messages))
+        }
+        for i, msg := range resp.Messages {
+            if msg.Id != expected[i] {
+                t.Errorf("Message %v: expected %v, got %v", i, expected[i], msg.Id)
+            }
+        }
+    }
+
+    log.Println("Paging backwards from the latest")
+    resp := testAPI.listMessagesEndpoint(user2, user1.Id, latestMessages, 2)
+    checkPage(resp, ids[3:5])
+    if resp.NextCursor == "" {
+        t.Fatal("Expected a cursor for older messages")
+    }
+
+    page, err := parseMessageCursor(resp.NextCursor)
+    if err != nil {
+        t.Fatalf("Parsing cursor failed: %v", err)
+    }
+    resp = testAPI.listMessagesEndpoint(user2, user1.Id, page, 2)
+    checkPage(resp, ids[1:3])
+
+    page, _ = parseMessageCursor(resp.NextCursor)
+    resp = testAPI.listMessagesEndpoint(user2, user1.Id, page, 2)
+    checkPage(resp, ids[0:1])
+    if resp.NextCursor != "" {
+        t.Errorf("Expected no cursor after the first message, got %q", resp.NextCursor)
+    }
+
+    log.Println("Paging forwards")
+    resp = testAPI.listMessagesEndpoint(user1, user2.Id, messagePage{forward: true, from: ids[0]}, 3)
+    checkPage(resp, ids[1:4])
+
+    page, _ = parseMessageCursor(resp.NextCursor)
+    resp = testAPI.listMessagesEndpoint(user1, user2.Id, page, 3)
+    checkPage(resp, ids[4:5])
+
+    log.Println("Paging forwards past the latest, then picking up new messages")
+    page, _ = parseMessageCursor(resp.NextCursor)
+    resp = testAPI.listMessagesEndpoint(user1, user2.Id, page, 3)
+    checkPage(resp, []int{})
+    msg, _ := testAPI.addMessageToUser(user2, user1, "message 6", ContentTypeText)
+    page, _ = parseMessageCursor(resp.NextCursor)
+    resp = testAPI.listMessagesEndpoint(user1, user2.Id, page, 3)
+    checkPage(resp, []int{msg.Id})
+
+    log.Println("Paging a group's messages")
+    group, _ := testAPI.createGroup(user1, "Swamp", nil)
+    testStore.addGroupMember(group, user3)
+    var groupIds []int
+    for i := 0; i < 3; i++ {
+        msg, _ := testAPI.addMessageToGroup(user3, group, "ogres are like onions", ContentTypeText)
+        groupIds = append(groupIds, msg.Id)
+    }
+    resp = testAPI.listGroupMessagesEndpoint(user1, group.Id, latestMessages, 2)
+    checkPage(resp, groupIds[1:3])
+    page, _ = parseMessageCursor(resp.NextCursor)
+    resp = testAPI.listGroupMessagesEndpoint(user1, group.Id, page, 2)
+    checkPage(resp, groupIds[0:1])
+    resp = testAPI.listGroupMessagesEndpoint(user1, group.Id, messagePage{forward: true, from: 0}, 2)
+    checkPage(resp, groupIds[0:2])
+}
+
+func TestMessagePageParams(t *testing.T) {
+    forward := messagePage{forward: true, from: 12}
+    tests := []struct {
+        query   string
+        page    messagePage
+        amount  int
+        ok      bool
+    }{
+        {"", latestMessages, 100, true},
+        {"?last=7&amount=5", messagePage{from: 7}, 5, true},
+        {"?after=12", forward, 100, true},
+        {"?cursor=" + forward.cursor() + "&amount=3", forward, 3, true},
+        {"?cursor=" + messagePage{from: 7}.cursor(), messagePage{from: 7}, 100, true},
+        {"?last=7&after=12", messagePage{}, 0, false},
+        {"?cursor=" + forward.cursor() + "&last=7", messagePage{}, 0, false},
+        {"?cursor=bogus", messagePage{}, 0, false},
+        {"?after=-1", messagePage{}, 0, false},
+        {"?amount=0", messagePage{}, 0, false},
+    }
+
+    for _, test := range tests {
+        r, _ := http.NewRequest("GET", "/friends/1/messages"+test.query, nil)
+        page, amount, ok := parseMessagePageParams(r)
+        if ok != test.ok {
+            t.Errorf("%q: expected ok to be %v", test.query, test.ok)
+        } else if ok && (page != test.page || amount != test.amount) {
+            t.Errorf("%q: expected %+v and %v, got %+v and %v", test.query, test.page, test.amount, page, amount)
+        }
+    }
+}
+
 func TestSendMessageEndpoint(t *testing.T) {
     defer resetTables()
 
@@ -278,7 +402,7 @@ func TestSendMessageEndpoint(t *testing.T) {
         Email:      "poop@gmail.com",
         Picture:    "blah",
     }
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:         2,
@@ -289,14 +413,14 @@ func TestSendMessageEndpoint(t *testing.T) {
         Email:      "pm@gmail.com",
         Picture:    "hehe",
     }
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Send a message from user1 to user2 (not friends)")
     req := SendMessageRequest{
         Content:        "asept frend request plz",
         ContentType:    ContentTypeText,
     }
-    resp := sendMessageEndpoint(user1, 2, req)
+    resp := testAPI.sendMessageEndpoint(user1, 2, req)
 
     if resp.Success {
         t.Error("Users shouldn't be able to send messages to users they aren't friends with")
@@ -307,21 +431,21 @@ func TestSendMessageEndpoint(t *testing.T) {
         Content:        "i'm so lonely",
         ContentType:    ContentTypeText,
     }
-    resp = sendMessageEndpoint(user1, 1, req)
+    resp = testAPI.sendMessageEndpoint(user1, 1, req)
 
     if resp.Success {
         t.Error("Users shouldn't be able to send messages to themselves")
     }
 
     log.Println("Adding users as friends")
-    user1.addFriend(user2)
+    testStore.addFriend(user1, user2)
 
     log.Println("Send a message from user1 to user2")
     req = SendMessageRequest{
         Content:     "You are a nice person",
         ContentType: ContentTypeText,
     }
-    resp = sendMessageEndpoint(user1, 2, req)
+    resp = testAPI.sendMessageEndpoint(user1, 2, req)
 
     if !resp.Success {
         t.Error("Response returned not success when it should have been successful")
@@ -331,7 +455,7 @@ func TestSendMessageEndpoint(t *testing.T) {
         t.Error("Response returned an error when it shouldn't have")
     }
 
-    messages := user1.getMessagesWithUser(user2, -1, 100)
+    messages := testStore.getMessagesWithUser(user1, user2, -1, 100)
 
     if len(messages) != 1 {
         t.Errorf("1 message expected, found %v\n", len(messages))
@@ -339,10 +463,10 @@ func TestSendMessageEndpoint(t *testing.T) {
         if messages[0].Content != "You are a nice person" {
             t.Errorf("Message returned had the wrong content: %v\n", messages[0].Content)
         }
-        if sender, _ := messages[0].getSender(); sender.Id != 1 {
+        if sender, _ := testAPI.getSender(messages[0]); sender.Id != 1 {
             t.Errorf("Message returned had the wrong senderid: %v\n", messages[0].SenderId)
         }
-        if recipient, _ := messages[0].getRecipientUser(); recipient.Id != 2 {
+        if recipient, _ := testAPI.getRecipientUser(messages[0]); recipient.Id != 2 {
             t.Errorf("Message returned had the wrong recipientid: %v\n", messages[0].RecipientId)
         }
     }
@@ -352,7 +476,7 @@ func TestSendMessageEndpoint(t *testing.T) {
         Content:     "You are a nice person",
         ContentType: ContentTypeText,
     }
-    resp = sendMessageEndpoint(user1, 1234, req)
+    resp = testAPI.sendMessageEndpoint(user1, 1234, req)
 
     if resp.Success {
         t.Error("Response returned success when it should have been unsuccessful")
@@ -367,7 +491,7 @@ func TestSendMessageEndpoint(t *testing.T) {
         Content:        "justdoit",
         ContentType:    ContentTypeVideo,
     }
-    resp = sendMessageEndpoint(user1, 2, req)
+    resp = testAPI.sendMessageEndpoint(user1, 2, req)
 
     if !resp.Success {
         t.Errorf("Response returned failure when it should have succeeded: %v", resp.Error)
@@ -378,7 +502,7 @@ func TestSendMessageEndpoint(t *testing.T) {
         Content:        "",
         ContentType:    ContentTypeShake,
     }
-    resp = sendMessageEndpoint(user1, 2, req)
+    resp = testAPI.sendMessageEndpoint(user1, 2, req)
 
     if !resp.Success {
         t.Errorf("Response returned failure when it should have succeeded: %v", resp.Error)
@@ -389,7 +513,7 @@ func TestSendMessageEndpoint(t *testing.T) {
         Content:     "You are a nice person",
         ContentType: 4,
     }
-    resp = sendMessageEndpoint(user1, 2, req)
+    resp = testAPI.sendMessageEndpoint(user1, 2, req)
 
     if resp.Success {
         t.Error("Response returned success when it should have been unsuccessful")
@@ -399,3 +523,212 @@ func TestSendMessageEndpoint(t *testing.T) {
         t.Errorf("Response returned the wrong error. Got error %v\n", resp.Error)
     }
 }
+
+func TestReadMessagesEndpoint(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{
+        Id:         1,
+        Uid:        "1",
+        Name:       "Snoop Doge",
+        FirstName:  "Snoop",
+        LastName:   "Doge",
+        Email:      "poop@gmail.com",
+        Picture:    "blah",
+    }
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:         2,
+        Uid:        "2",
+        Name:       "Malcolm Turnbull",
+        FirstName:  "Malcolm",
+        LastName:   "Turnbull",
+        Email:      "pm@gmail.com",
+        Picture:    "hehe",
+    }
+    testStore.createUser(&user2)
+
+    log.Println("Mark messages read from a non-friend")
+    if resp := testAPI.readMessagesEndpoint(user2, 1, ReadMessagesRequest{}); resp.Success {
+        t.Error("Marking messages read should fail when users aren't friends")
+    }
+
+    testStore.addFriend(user1, user2)
+
+    log.Println("Mark messages read with no messages")
+    if resp := testAPI.readMessagesEndpoint(user2, 1, ReadMessagesRequest{}); !resp.Success || resp.ReadMarker.LastReadId != 0 {
+        t.Errorf("Marking an empty conversation read should succeed with no marker, got %v", resp)
+    }
+
+    msg1, _ := testAPI.addMessageToUser(user1, user2, "first", ContentTypeText)
+    msg2, _ := testAPI.addMessageToUser(user1, user2, "second", ContentTypeText)
+    msg3, _ := testAPI.addMessageToUser(user2, user1, "reply", ContentTypeText)
+
+    sub := subscribeEvents(user1.Id)
+    defer sub.unsubscribe()
+
+    log.Println("Mark the first message read")
+    resp := testAPI.readMessagesEndpoint(user2, 1, ReadMessagesRequest{MessageId: msg1.Id})
+    if !resp.Success || resp.ReadMarker.LastReadId != msg1.Id {
+        t.Errorf("Marking message read failed: %v", resp)
+    }
+
+    log.Println("Check the sender got a read receipt")
+    select {
+    case event := <-sub.Events:
+        marker, ok := event.Payload.(ReadMarker)
+        if event.Type != EventTypeMessagesRead || !ok || marker.UserId != user2.Id || marker.LastReadId != msg1.Id {
+            t.Errorf("Wrong read receipt event: %v", event)
+        }
+    case <-time.After(100 * time.Millisecond):
+        t.Error("No read receipt event received")
+    }
+
+    log.Println("Mark your own message read")
+    if resp := testAPI.readMessagesEndpoint(user2, 1, ReadMessagesRequest{MessageId: msg3.Id}); resp.Success {
+        t.Error("Marking your own message read should fail")
+    }
+
+    log.Println("Mark everything read")
+    resp = testAPI.readMessagesEndpoint(user2, 1, ReadMessagesRequest{})
+    if !resp.Success || resp.ReadMarker.LastReadId != msg2.Id {
+        t.Errorf("Marking everything read failed: %v", resp)
+    }
+
+    log.Println("Markers don't move backwards")
+    resp = testAPI.readMessagesEndpoint(user2, 1, ReadMessagesRequest{MessageId: msg1.Id})
+    if !resp.Success || resp.ReadMarker.LastReadId != msg2.Id {
+        t.Errorf("Read marker moved backwards: %v", resp)
+    }
+
+    log.Println("Check read markers are listed with messages")
+    listResp := testAPI.listMessagesEndpoint(user1, 2, latestMessages, 100)
+    if len(listResp.ReadMarkers) != 2 {
+        t.Fatalf("2 read markers expected, found %v", len(listResp.ReadMarkers))
+    }
+    for _, marker := range listResp.ReadMarkers {
+        if marker.UserId == user2.Id && marker.LastReadId != msg2.Id {
+            t.Errorf("user2's marker should be at %v, got %v", msg2.Id, marker.LastReadId)
+        }
+        if marker.UserId == user1.Id && marker.LastReadId != 0 {
+            t.Errorf("user1 hasn't read anything, got %v", marker.LastReadId)
+        }
+    }
+}
+
+func TestEditAndDeleteMessageEndpoints(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{
+        Id:         1,
+        Uid:        "1",
+        Name:       "Snoop Doge",
+        FirstName:  "Snoop",
+        LastName:   "Doge",
+        Email:      "poop@gmail.com",
+        Picture:    "blah",
+    }
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:         2,
+        Uid:        "2",
+        Name:       "Malcolm Turnbull",
+        FirstName:  "Malcolm",
+        LastName:   "Turnbull",
+        Email:      "pm@gmail.com",
+        Picture:    "hehe",
+    }
+    testStore.createUser(&user2)
+
+    testStore.addFriend(user1, user2)
+
+    msg1, _ := testAPI.addMessageToUser(user1, user2, "teh typo", ContentTypeText)
+    msg2, _ := testAPI.addMessageToUser(user1, user2, "oops", ContentTypeText)
+    shake, _ := testAPI.addMessageToUser(user1, user2, "", ContentTypeShake)
+
+    sub := subscribeEvents(user2.Id)
+    defer sub.unsubscribe()
+
+    expectEvent := func(eventType string, id int) {
+        select {
+        case event := <-sub.Events:
+            msg, ok := event.Payload.(Message)
+            if event.Type != eventType || !ok || msg.Id != id {
+                t.Errorf("Expected %v event for message %v, got %v", eventType, id, event)
+            }
+        case <-time.After(100 * time.Millisecond):
+            t.Errorf("No %v event received", eventType)
+        }
+    }
+
+    log.Println("Edit someone else's message")
+    if resp := testAPI.editMessageEndpoint(user2, 1, msg1.Id, EditMessageRequest{Content: "hacked"}); resp.Success {
+        t.Error("Editing someone else's message should fail")
+    }
+
+    log.Println("Edit a message")
+    resp := testAPI.editMessageEndpoint(user1, 2, msg1.Id, EditMessageRequest{Content: "the typo"})
+    if !resp.Success || resp.Message.Content != "the typo" || resp.Message.EditedAt == nil {
+        t.Errorf("Editing message failed: %v", resp)
+    }
+    expectEvent(EventTypeMessageEdited, msg1.Id)
+
+    log.Println("Edit a message to nothing or too much")
+    if resp := testAPI.editMessageEndpoint(user1, 2, msg1.Id, EditMessageRequest{Content: ""}); resp.Success {
+        t.Error("Editing a message to nothing should fail")
+    }
+    tooLong := strings.Repeat("é", MaxMessageLength+1)
+    if resp := testAPI.editMessageEndpoint(user1, 2, msg1.Id, EditMessageRequest{Content: tooLong}); resp.Success {
+        t.Error("Editing a message to more than the maximum length should fail")
+    }
+    if _, err := testAPI.addMessageToUser(user1, user2, tooLong, ContentTypeText); err == nil {
+        t.Error("Sending a message over the maximum length should fail")
+    }
+    // é is two bytes, but one character
+    longest, err := testAPI.addMessageToUser(user1, user2, tooLong[:2*MaxMessageLength], ContentTypeText)
+    if err != nil {
+        t.Errorf("Sending a message of the maximum length failed: %v", err)
+    }
+
+    log.Println("Edit a non-text message")
+    if resp := testAPI.editMessageEndpoint(user1, 2, shake.Id, EditMessageRequest{Content: "text"}); resp.Success {
+        t.Error("Editing a non-text message should fail")
+    }
+
+    log.Println("Delete someone else's message")
+    if resp := testAPI.deleteMessageEndpoint(user2, 1, msg2.Id); resp.Success {
+        t.Error("Deleting someone else's message should fail")
+    }
+
+    log.Println("Delete a message")
+    resp = testAPI.deleteMessageEndpoint(user1, 2, msg2.Id)
+    if !resp.Success || !resp.Message.Deleted || resp.Message.Content != "" {
+        t.Errorf("Deleting message failed: %v", resp)
+    }
+    expectEvent(EventTypeMessageDeleted, msg2.Id)
+
+    log.Println("Edit and delete a deleted message")
+    if resp := testAPI.editMessageEndpoint(user1, 2, msg2.Id, EditMessageRequest{Content: "back"}); resp.Success {
+        t.Error("Editing a deleted message should fail")
+    }
+    if resp := testAPI.deleteMessageEndpoint(user1, 2, msg2.Id); resp.Success {
+        t.Error("Deleting a deleted message twice should fail")
+    }
+
+    log.Println("Check the conversation has the edit and the tombstone")
+    messages := testStore.getMessagesWithUser(user2, user1, longest.Id, 100)
+    if len(messages) != 3 {
+        t.Fatalf("3 messages expected, found %v", len(messages))
+    }
+    if messages[0].Content != "the typo" || messages[0].EditedAt == nil {
+        t.Errorf("Edited message wasn't stored: %v", messages[0])
+    }
+    if !messages[1].Deleted || messages[1].Content != "" {
+        t.Errorf("Deleted message wasn't left as a tombstone: %v", messages[1])
+    }
+    if messages[2].Deleted || messages[2].EditedAt != nil {
+        t.Errorf("Untouched message was changed: %v", messages[2])
+    }
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "flag"
+    "fmt"
+    "log"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/jinzhu/gorm"
+)
+
+// A numbered change to the database's schema, with how to undo it.
+// Never change a migration once it's been released; add another one.
+type migration struct {
+    version     int
+    name        string
+    // SQL statements, run in order in a transaction. {id}, {timestamp} and
+    // {bool} are replaced with the database's own column types, {least} and
+    // {greatest} with its functions for them, and {add column} with how to
+    // add a column that might already be there; statements using it must
+    // start "alter table <table> {add column} <column>".
+    up          []string
+    down        []string
+}
+
+// Records which migrations have been applied to the database
+type SchemaMigration struct {
+    Version     int         `gorm:"primary_key"`
+    AppliedAt   time.Time   `sql:"not null"`
+}
+
+// Column types and functions that differ between databases
+var migrationTypes = map[string]*strings.Replacer{
+    DialectPostgres:    strings.NewReplacer(
+        "{id}",         "id serial primary key",
+        "{timestamp}",  "timestamp with time zone",
+        "{bool}",       "boolean",
+        "{least}",      "least",
+        "{greatest}",   "greatest",
+        "{add column}", "add column if not exists",
+    ),
+    DialectSQLite:      strings.NewReplacer(
+        "{id}",         "id integer primary key autoincrement",
+        "{timestamp}",  "datetime",
+        "{bool}",       "bool",
+        "{least}",      "min",
+        "{greatest}",   "max",
+        // SQLite has no add column if not exists, so runMigration checks
+        // for the column itself
+        "{add column}", "add column",
+    ),
+}
+
+// Matches statements adding a column that might already be there, with the
+// table and column names
+var addColumnPattern = regexp.MustCompile(`^alter table (\w+) \{add column\} (\w+)`)
+
+// Fills in conversations from the messages, for the ones that are missing
+var populateConversationsSQL = fmt.Sprintf(`
+    insert into conversations (user_id, friend_id, last_message_id, last_message_time)
+    select p.user_id, p.friend_id, m.id, m.timestamp
+    from (
+        select user_id, friend_id, max(id) as last_id from (
+            select sender_id as user_id, recipient_id as friend_id, id from messages where recipient_type = %d
+            union all
+            select recipient_id as user_id, sender_id as friend_id, id from messages where recipient_type = %d
+        ) directed
+        group by user_id, friend_id
+    ) p
+    inner join messages m on m.id = p.last_id
+    where not exists (select 1 from conversations c where c.user_id = p.user_id and c.friend_id = p.friend_id)`,
+    RecipientTypeUser, RecipientTypeUser)
+
+// Every migration, in order.
+// Databases from before there were migrations already have the tables and
+// columns from some of them, so those only create what isn't there. The
+// first is the schema as it was then.
+var migrations = []migration{
+    {
+        version:    1,
+        name:       "Users, friends, friend requests and messages",
+        up:         []string{
+            `create table if not exists users (
+                {id},
+                uid varchar(255) unique,
+                name varchar(255),
+                first_name varchar(255),
+                last_name varchar(255),
+                email varchar(255),
+                picture varchar(255)
+            )`,
+            `create table if not exists user_friends (
+                user_id integer,
+                friend_id integer,
+                primary key (user_id, friend_id)
+            )`,
+            `create table if not exists friend_requests (
+                user_id integer,
+                requestor_id integer,
+                primary key (user_id, requestor_id)
+            )`,
+            `create table if not exists messages (
+                {id},
+                content varchar(1024),
+                content_type integer not null,
+                sender_id integer not null,
+                recipient_id integer not null,
+                recipient_type integer not null,
+                timestamp {timestamp} not null
+            )`,
+        },
+        down:       []string{
+            `drop table messages`,
+            `drop table friend_requests`,
+            `drop table user_friends`,
+            `drop table users`,
+        },
+    },
+    {
+        version:    2,
+        name:       "Groups",
+        up:         []string{
+            `create table if not exists groups (
+                {id},
+                name varchar(256),
+                creator_id integer not null,
+                timestamp {timestamp} not null
+            )`,
+            `create table if not exists group_members (
+                group_id integer,
+                user_id integer,
+                primary key (group_id, user_id)
+            )`,
+        },
+        down:       []string{
+            `drop table group_members`,
+            `drop table groups`,
+        },
+    },
+    {
+        version:    3,
+        name:       "Read markers",
+        up:         []string{
+            `create table if not exists read_markers (
+                user_id integer,
+                friend_id integer,
+                last_read_id integer not null,
+                primary key (user_id, friend_id)
+            )`,
+        },
+        down:       []string{
+            `drop table read_markers`,
+        },
+    },
+    {
+        version:    4,
+        name:       "Conversations",
+        up:         []string{
+            `create table if not exists conversations (
+                user_id integer,
+                friend_id integer,
+                last_message_id integer not null,
+                last_message_time {timestamp} not null,
+                primary key (user_id, friend_id)
+            )`,
+            `create index if not exists idx_conversations_user_id_last_message_id on conversations (user_id, last_message_id)`,
+            populateConversationsSQL,
+        },
+        down:       []string{
+            `drop table conversations`,
+        },
+    },
+    {
+        version:    5,
+        name:       "Sessions and revoked tokens",
+        up:         []string{
+            `create table if not exists sessions (
+                {id},
+                user_id integer not null,
+                token_hash varchar(255) not null unique,
+                device varchar(255) not null,
+                timestamp {timestamp} not null,
+                last_used_at {timestamp} not null,
+                expires_at {timestamp} not null
+            )`,
+            `create index if not exists idx_sessions_user_id on sessions (user_id)`,
+            `create table if not exists revoked_tokens (
+                token_hash varchar(255) primary key,
+                expires_at {timestamp} not null
+            )`,
+            `create table if not exists user_revocations (
+                user_id integer primary key,
+                revoked_before {timestamp} not null
+            )`,
+        },
+        down:       []string{
+            `drop table user_revocations`,
+            `drop table revoked_tokens`,
+            `drop table sessions`,
+        },
+    },
+    {
+        version:    6,
+        name:       "Bot API keys",
+        up:         []string{
+            `create table if not exists api_keys (
+                {id},
+                bot_id integer not null,
+                key_hash varchar(255) not null unique,
+                prefix varchar(255) not null,
+                scopes varchar(255) not null,
+                timestamp {timestamp} not null,
+                last_used_at {timestamp} not null
+            )`,
+            `create index if not exists idx_api_keys_bot_id on api_keys (bot_id)`,
+        },
+        down:       []string{
+            `drop table api_keys`,
+        },
+    },
+    {
+        version:    7,
+        name:       "Message history indexes",
+        up:         []string{
+            `alter table messages add column conversation_key varchar(64)`,
+            // the same as Message.conversationKey
+            fmt.Sprintf(`update messages set conversation_key = case
+                when recipient_type = %d then 'g:' || recipient_id
+                else 'u:' || {least}(sender_id, recipient_id) || ':' || {greatest}(sender_id, recipient_id)
+            end`, RecipientTypeGroup),
+            // for reading a conversation's history
+            `create index idx_messages_conversation_key_id on messages (conversation_key, id)`,
+            // for finding the next message someone received
+            `create index idx_messages_recipient_type_recipient_id_id on messages (recipient_type, recipient_id, id)`,
+            `create index idx_group_members_user_id on group_members (user_id)`,
+        },
+        down:       []string{
+            `drop index idx_group_members_user_id`,
+            `drop index idx_messages_recipient_type_recipient_id_id`,
+            `drop index idx_messages_conversation_key_id`,
+            `alter table messages drop column conversation_key`,
+        },
+    },
+    {
+        version:    8,
+        name:       "Message edits and deletes",
+        up:         []string{
+            `alter table messages {add column} edited_at {timestamp}`,
+            `alter table messages {add column} deleted {bool} not null default false`,
+        },
+        down:       []string{
+            `alter table messages drop column deleted`,
+            `alter table messages drop column edited_at`,
+        },
+    },
+    {
+        version:    9,
+        name:       "Bot accounts",
+        up:         []string{
+            `alter table users {add column} is_bot {bool} not null default false`,
+            `alter table users {add column} owner_id integer`,
+            `create index if not exists idx_users_owner_id on users (owner_id)`,
+        },
+        down:       []string{
+            `drop index idx_users_owner_id`,
+            `alter table users drop column owner_id`,
+            `alter table users drop column is_bot`,
+        },
+    },
+}
+
+// Gets the version of the last migration
+func latestMigration() int {
+    return migrations[len(migrations)-1].version
+}
+
+// Gets the migrations applied to the database, by version, creating the
+// table that records them if it isn't there yet.
+func (s *gormStore) appliedMigrations() (map[int]SchemaMigration, error) {
+    create := `create table if not exists schema_migrations (version integer primary key, applied_at {timestamp} not null)`
+    if err := s.db.Exec(migrationTypes[s.dialect].Replace(create)).Error; err != nil {
+        return nil, err
+    }
+
+    var rows []SchemaMigration
+    if err := s.db.Order("version").Find(&rows).Error; err != nil {
+        return nil, err
+    }
+
+    applied := make(map[int]SchemaMigration)
+    for _, row := range rows {
+        applied[row.Version] = row
+    }
+    return applied, nil
+}
+
+// Applies the migrations up to and including version to that haven't been.
+func (s *gormStore) migrateUp(to int) error {
+    applied, err := s.appliedMigrations()
+    if err != nil {
+        return err
+    }
+    for version := range applied {
+        if version > latestMigration() {
+            return fmt.Errorf("migrateUp: the database has migration %d, which is newer than this version of the server", version)
+        }
+    }
+
+    for _, m := range migrations {
+        if m.version > to {
+            break
+        }
+        if _, ok := applied[m.version]; ok {
+            continue
+        }
+
+        log.Printf("Applying migration %d (%v)\n", m.version, m.name)
+        err := s.runMigration(m.up, func(tx *gorm.DB) error {
+            return tx.Create(&SchemaMigration{Version: m.version, AppliedAt: time.Now()}).Error
+        })
+        if err != nil {
+            return fmt.Errorf("migrateUp: migration %d: %v", m.version, err)
+        }
+    }
+    return nil
+}
+
+// Undoes the applied migrations after version to, latest first.
+func (s *gormStore) migrateDown(to int) error {
+    applied, err := s.appliedMigrations()
+    if err != nil {
+        return err
+    }
+
+    for i := len(migrations) - 1; i >= 0; i-- {
+        m := migrations[i]
+        if m.version <= to {
+            break
+        }
+        if _, ok := applied[m.version]; !ok {
+            continue
+        }
+
+        log.Printf("Undoing migration %d (%v)\n", m.version, m.name)
+        err := s.runMigration(m.down, func(tx *gorm.DB) error {
+            return tx.Where("version = ?", m.version).Delete(SchemaMigration{}).Error
+        })
+        if err != nil {
+            return fmt.Errorf("migrateDown: migration %d: %v", m.version, err)
+        }
+    }
+    return nil
+}
+
+// Runs a migration's statements and records it, all or nothing
+func (s *gormStore) runMigration(statements []string, record func(tx *gorm.DB) error) error {
+    types, ok := migrationTypes[s.dialect]
+    if !ok {
+        return fmt.Errorf("no migrations for %q databases", s.dialect)
+    }
+
+    tx := s.db.Begin()
+
+    for _, statement := range statements {
+        // databases AutoMigrate made before there were migrations can
+        // already have the columns later ones add
+        if match := addColumnPattern.FindStringSubmatch(statement); match != nil && s.dialect == DialectSQLite {
+            exists, err := sqliteHasColumn(tx, match[1], match[2])
+            if err != nil {
+                tx.Rollback()
+                return err
+            }
+            if exists {
+                continue
+            }
+        }
+
+        if err := tx.Exec(types.Replace(statement)).Error; err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    if err := record(tx); err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit().Error
+}
+
+// Whether a SQLite table has the column
+func sqliteHasColumn(tx *gorm.DB, table string, column string) (bool, error) {
+    rows, err := tx.Raw("pragma table_info(" + table + ")").Rows()
+    if err != nil {
+        return false, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var cid, notNull, pk int
+        var name, columnType string
+        var defaultValue sql.NullString
+        if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+            return false, err
+        }
+        if name == column {
+            return true, nil
+        }
+    }
+    return false, rows.Err()
+}
+
+// migrate subcommand: migrates the database up or down, or shows which
+// migrations have been applied.
+func migrateCommand(cfg Config, args []string) error {
+    if len(args) == 0 {
+        return errors.New("Usage: migrate up|down|status [-to version]")
+    }
+    action := args[0]
+
+    var to int
+    flags := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+    flags.IntVar(&to, "to", -1, "Version to migrate to (default: the latest for up, the one before the current one for down)")
+    if err := flags.Parse(args[1:]); err != nil {
+        return err
+    }
+
+    store, err := openGormStore(cfg.Database.Type, cfg.Database.ConnectionString)
+    if err != nil {
+        return err
+    }
+    defer store.close()
+
+    switch action {
+    case "up":
+        if to == -1 {
+            to = latestMigration()
+        }
+        return store.migrateUp(to)
+
+    case "down":
+        if to == -1 {
+            applied, err := store.appliedMigrations()
+            if err != nil {
+                return err
+            }
+            // just the last one
+            for version := range applied {
+                if version > to {
+                    to = version
+                }
+            }
+            to--
+        }
+        if to < 0 {
+            return errors.New("No migrations to undo")
+        }
+        return store.migrateDown(to)
+
+    case "status":
+        applied, err := store.appliedMigrations()
+        if err != nil {
+            return err
+        }
+        for _, m := range migrations {
+            status := "pending"
+            if row, ok := applied[m.version]; ok {
+                status = "applied " + row.AppliedAt.Format(time.RFC3339)
+            }
+            fmt.Printf("%4d  %-33v  %v\n", m.version, status, m.name)
+        }
+        return nil
+
+    default:
+        return fmt.Errorf("Unknown migrate action %q", action)
+    }
+}
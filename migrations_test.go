@@ -0,0 +1,291 @@
+package main
+
+import (
+    "log"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestMigrationList(t *testing.T) {
+    for i, m := range migrations {
+        if m.version != i+1 {
+            t.Errorf("Migration %d should be version %d", m.version, i+1)
+        }
+        if m.name == "" || len(m.up) == 0 || len(m.down) == 0 {
+            t.Errorf("Migration %d needs a name, up and down", m.version)
+        }
+        for dialect, types := range migrationTypes {
+            for _, statement := range append(m.up, m.down...) {
+                if strings.Contains(types.Replace(statement), "{") {
+                    t.Errorf("Migration %d has an unknown column type for %v: %v", m.version, dialect, statement)
+                }
+            }
+        }
+    }
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+    gs, ok := testStore.(*gormStore)
+    if !ok {
+        t.Skip("Only databases have migrations")
+    }
+    defer resetTables()
+    // leave it how the other tests expect
+    defer gs.migrateUp(latestMigration())
+
+    checkTables := func(version int) {
+        applied, err := gs.appliedMigrations()
+        if err != nil {
+            t.Fatalf("Getting applied migrations failed: %v", err)
+        }
+        if len(applied) != version {
+            t.Errorf("Expected %v migrations applied, got %v", version, len(applied))
+        }
+        for _, m := range migrations {
+            if _, ok := applied[m.version]; ok != (m.version <= version) {
+                t.Errorf("Migration %v applied: %v", m.version, ok)
+            }
+        }
+
+        if gs.db.HasTable(&User{}) != (version >= 1) {
+            t.Errorf("users table is wrong at version %v", version)
+        }
+        if gs.db.HasTable(&ReadMarker{}) != (version >= 3) {
+            t.Errorf("read_markers table is wrong at version %v", version)
+        }
+        if gs.db.HasTable(&Conversation{}) != (version >= 4) {
+            t.Errorf("conversations table is wrong at version %v", version)
+        }
+        if gs.db.HasTable(&APIKey{}) != (version >= 6) {
+            t.Errorf("api_keys table is wrong at version %v", version)
+        }
+    }
+
+    log.Println("Testing migrating all the way down")
+    if err := gs.migrateDown(0); err != nil {
+        t.Fatalf("Migrating down failed: %v", err)
+    }
+    checkTables(0)
+
+    log.Println("Testing migrating up part of the way")
+    if err := gs.migrateUp(3); err != nil {
+        t.Fatalf("Migrating up failed: %v", err)
+    }
+    checkTables(3)
+
+    user1 := User{Uid: "9001", Name: "Tony Abbott"}
+    user2 := User{Uid: "9002", Name: "Malcolm Turnbull"}
+    testStore.createUser(&user1)
+    testStore.createUser(&user2)
+    // straight into the table, as it was then
+    gs.db.Exec("insert into messages (content, content_type, sender_id, recipient_id, recipient_type, timestamp) values (?, ?, ?, ?, ?, ?)",
+        "onion", ContentTypeText, user2.Id, user1.Id, RecipientTypeUser, time.Now())
+
+    log.Println("Testing migrating the rest of the way up")
+    if err := gs.migrateUp(latestMigration()); err != nil {
+        t.Fatalf("Migrating up failed: %v", err)
+    }
+    checkTables(latestMigration())
+    if _, err := testStore.getConversation(user1, user2); err != nil {
+        t.Errorf("Conversation wasn't filled in from existing messages: %v", err)
+    }
+    if msgs := testStore.getMessagesWithUser(user1, user2, -1, 10); len(msgs) != 1 {
+        t.Errorf("Existing message's conversation key wasn't filled in")
+    }
+
+    log.Println("Testing migrating down one")
+    if err := gs.migrateDown(latestMigration() - 1); err != nil {
+        t.Fatalf("Migrating down failed: %v", err)
+    }
+    checkTables(latestMigration() - 1)
+    if _, err := testStore.getUser(user1.Id); err != nil {
+        t.Errorf("Migrating down one lost earlier tables' rows: %v", err)
+    }
+
+    log.Println("Testing migrations from a newer server are refused")
+    gs.migrateUp(latestMigration())
+    gs.db.Create(&SchemaMigration{Version: latestMigration() + 1})
+    if err := gs.migrateUp(latestMigration()); err == nil {
+        t.Error("Migrating up a database from a newer server should fail")
+    }
+    gs.db.Where("version = ?", latestMigration()+1).Delete(SchemaMigration{})
+}
+
+// Users and messages as they were before there were migrations, for making
+// the tables the way AutoMigrate did then
+type baselineUser struct {
+    Id        int       `gorm:"primary_key" sql:"auto_increment"`
+    Uid       string    `sql:"unique"`
+    Name      string
+    FirstName string
+    LastName  string
+    Email     string
+    Picture   string
+}
+
+func (baselineUser) TableName() string {
+    return "users"
+}
+
+type baselineMessage struct {
+    Id                  int             `gorm:"primary_key" sql:"auto_increment"`
+    Content             string          `sql:"type:varchar(1024)"`
+    ContentType         ContentType     `sql:"not null"`
+    SenderId            int             `sql:"not null"`
+    RecipientId         int             `sql:"not null"`
+    RecipientType       RecipientType   `sql:"not null"`
+    Timestamp           time.Time       `sql:"not null"`
+}
+
+func (baselineMessage) TableName() string {
+    return "messages"
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+    gs, ok := testStore.(*gormStore)
+    if !ok {
+        t.Skip("Only databases have migrations")
+    }
+    defer resetTables()
+    // leave it how the other tests expect
+    defer gs.migrateUp(latestMigration())
+
+    log.Println("Making the tables the way the server did before migrations")
+    if err := gs.migrateDown(0); err != nil {
+        t.Fatalf("Migrating down failed: %v", err)
+    }
+    gs.db.DropTable(&SchemaMigration{})
+    gs.db.AutoMigrate(&baselineUser{})
+    gs.db.AutoMigrate(&UserFriend{})
+    gs.db.AutoMigrate(&FriendRequest{})
+    gs.db.AutoMigrate(&baselineMessage{})
+
+    oldUser1 := baselineUser{Uid: "9001", Name: "Tony Abbott"}
+    oldUser2 := baselineUser{Uid: "9002", Name: "Malcolm Turnbull"}
+    gs.db.Create(&oldUser1)
+    gs.db.Create(&oldUser2)
+    oldMsg := baselineMessage{Content: "onion", ContentType: ContentTypeText, SenderId: oldUser2.Id, RecipientId: oldUser1.Id, RecipientType: RecipientTypeUser, Timestamp: time.Now()}
+    gs.db.Create(&oldMsg)
+
+    log.Println("Migrating it up")
+    if err := gs.migrateUp(latestMigration()); err != nil {
+        t.Fatalf("Migrating up failed: %v", err)
+    }
+
+    log.Println("Checking existing users and messages work")
+    user1, err := testStore.getUser(oldUser1.Id)
+    if err != nil || user1.Uid != oldUser1.Uid || user1.IsBot {
+        t.Fatalf("Existing user wasn't kept: %v %v", user1, err)
+    }
+    user2, _ := testStore.getUser(oldUser2.Id)
+    if err := testStore.saveUser(&user1); err != nil {
+        t.Errorf("Saving existing user failed: %v", err)
+    }
+
+    msg, err := testStore.getMessage(oldMsg.Id)
+    if err != nil || msg.Deleted || msg.EditedAt != nil {
+        t.Fatalf("Existing message wasn't kept: %v %v", msg, err)
+    }
+    if err := testAPI.editMessage(&msg, "onions"); err != nil {
+        t.Errorf("Editing existing message failed: %v", err)
+    }
+    if msgs := testStore.getMessagesWithUser(user1, user2, -1, 10); len(msgs) != 1 || msgs[0].Content != "onions" {
+        t.Errorf("Expected the edited message, got %v", msgs)
+    }
+    if _, err := testStore.getConversation(user1, user2); err != nil {
+        t.Errorf("Conversation wasn't filled in from existing messages: %v", err)
+    }
+
+    log.Println("Checking new users and messages work")
+    bot := User{Uid: "bot:9003", Name: "Onion Bot", IsBot: true, OwnerId: user1.Id}
+    if err := testStore.createUser(&bot); err != nil {
+        t.Errorf("Creating bot failed: %v", err)
+    }
+    if bots := testStore.getBots(user1); len(bots) != 1 || bots[0].Id != bot.Id {
+        t.Errorf("Expected the bot, got %v", bots)
+    }
+    reply, err := testAPI.addMessageToUser(user1, user2, "leave it", ContentTypeText)
+    if err != nil {
+        t.Fatalf("Sending message failed: %v", err)
+    }
+    if err := testAPI.deleteMessage(&reply); err != nil {
+        t.Errorf("Deleting message failed: %v", err)
+    }
+}
+
+// Messages as AutoMigrate made them just before there were migrations, when
+// they could already be edited and deleted
+type autoMigratedMessage struct {
+    Id                  int             `gorm:"primary_key" sql:"auto_increment"`
+    Content             string          `sql:"type:varchar(1024)"`
+    ContentType         ContentType     `sql:"not null"`
+    SenderId            int             `sql:"not null"`
+    RecipientId         int             `sql:"not null"`
+    RecipientType       RecipientType   `sql:"not null"`
+    Timestamp           time.Time       `sql:"not null"`
+    EditedAt            *time.Time
+    Deleted             bool            `sql:"not null"`
+}
+
+func (autoMigratedMessage) TableName() string {
+    return "messages"
+}
+
+func TestMigrateAutoMigratedDatabase(t *testing.T) {
+    gs, ok := testStore.(*gormStore)
+    if !ok {
+        t.Skip("Only databases have migrations")
+    }
+    defer resetTables()
+    // leave it how the other tests expect
+    defer gs.migrateUp(latestMigration())
+
+    log.Println("Making the tables the way AutoMigrate did just before migrations")
+    if err := gs.migrateDown(0); err != nil {
+        t.Fatalf("Migrating down failed: %v", err)
+    }
+    gs.db.DropTable(&SchemaMigration{})
+    gs.db.AutoMigrate(&User{})
+    gs.db.AutoMigrate(&UserFriend{})
+    gs.db.AutoMigrate(&FriendRequest{})
+    gs.db.AutoMigrate(&autoMigratedMessage{})
+    gs.db.AutoMigrate(&Group{})
+    gs.db.AutoMigrate(&GroupMember{})
+    gs.db.AutoMigrate(&ReadMarker{})
+    gs.db.AutoMigrate(&Conversation{})
+    gs.db.AutoMigrate(&Session{})
+    gs.db.AutoMigrate(&RevokedToken{})
+    gs.db.AutoMigrate(&UserRevocation{})
+    gs.db.AutoMigrate(&APIKey{})
+    gs.db.Model(&Conversation{}).AddIndex("idx_conversations_user_id_last_message_id", "user_id", "last_message_id")
+
+    user1 := User{Uid: "9001", Name: "Tony Abbott"}
+    gs.db.Create(&user1)
+    bot := User{Uid: "bot:9002", Name: "Onion Bot", IsBot: true, OwnerId: user1.Id}
+    gs.db.Create(&bot)
+    editedAt := time.Now()
+    oldMsg := autoMigratedMessage{Content: "onions", ContentType: ContentTypeText, SenderId: bot.Id, RecipientId: user1.Id, RecipientType: RecipientTypeUser, Timestamp: time.Now(), EditedAt: &editedAt}
+    gs.db.Create(&oldMsg)
+
+    log.Println("Migrating it up")
+    if err := gs.migrateUp(latestMigration()); err != nil {
+        t.Fatalf("Migrating up failed: %v", err)
+    }
+    applied, _ := gs.appliedMigrations()
+    if len(applied) != latestMigration() {
+        t.Errorf("Expected %v migrations applied, got %v", latestMigration(), len(applied))
+    }
+
+    log.Println("Checking existing users and messages were kept")
+    if bots := testStore.getBots(user1); len(bots) != 1 || bots[0].Id != bot.Id {
+        t.Errorf("Expected the bot, got %v", bots)
+    }
+    msgs := testStore.getMessagesWithUser(user1, bot, -1, 10)
+    if len(msgs) != 1 || msgs[0].Id != oldMsg.Id || msgs[0].EditedAt == nil {
+        t.Errorf("Expected the edited message, got %v", msgs)
+    }
+    if _, err := testStore.getConversation(user1, bot); err != nil {
+        t.Errorf("Conversation wasn't filled in from existing messages: %v", err)
+    }
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/net/context"
+)
+
+// Names of rate limits, for [ratelimit "name"] sections.
+// Messages can also be limited per content type, as "messages:<type>",
+// e.g. "messages:shake".
+const (
+    // sending messages, to friends and groups
+    RateLimitMessages       = "messages"
+    // sending friend requests
+    RateLimitFriendRequests = "friendrequests"
+    // signing in, per client address
+    RateLimitSessions       = "sessions"
+)
+
+// The most a request to send a message can be, which is plenty for a message
+// of MaxMessageLength characters, even with every one of them escaped
+const MaxMessageRequestSize = 16 * 1024
+
+// Content type names, for per content type limits
+var contentTypeNames = map[ContentType]string{
+    ContentTypeText:    "text",
+    ContentTypeVideo:   "video",
+    ContentTypeShake:   "shake",
+}
+
+// A limit on how many requests someone can make in a window of time
+type rateLimit struct {
+    requests    int
+    window      time.Duration
+    // whether the last window's requests count too, weighted by how much of
+    // it the sliding window still covers; otherwise windows are fixed, and
+    // start afresh
+    sliding     bool
+}
+
+var defaultRateLimits = map[string]rateLimit{
+    RateLimitMessages:              {60, time.Minute, true},
+    RateLimitMessages + ":video":   {20, time.Minute, true},
+    RateLimitMessages + ":shake":   {10, time.Minute, true},
+    RateLimitFriendRequests:        {20, time.Hour, false},
+    RateLimitSessions:              {30, time.Minute, false},
+}
+
+// rateLimits is the limits used by the program, set up by main().
+var rateLimits = defaultRateLimits
+
+// Whether clients' addresses come from X-Forwarded-For, set up by main()
+var trustForwardedFor = false
+
+// Creates the rate limits, with the defaults overridden by the config.
+func setupRateLimits(cfg Config) (map[string]rateLimit, error) {
+    limits := make(map[string]rateLimit)
+    for name, limit := range defaultRateLimits {
+        limits[name] = limit
+    }
+
+    for name, limitCfg := range cfg.RateLimit {
+        if !validRateLimitName(name) {
+            return nil, fmt.Errorf("setupRateLimits: unknown rate limit %q", name)
+        }
+        limit := rateLimit{
+            requests:   limitCfg.Requests,
+            window:     time.Duration(limitCfg.Window) * time.Second,
+            sliding:    limitCfg.Sliding,
+        }
+        if limit.window <= 0 {
+            limit.window = limits[name].window
+        }
+        if limit.requests > 0 && limit.window <= 0 {
+            return nil, fmt.Errorf("setupRateLimits: rate limit %q needs a window", name)
+        }
+        limits[name] = limit
+    }
+    return limits, nil
+}
+
+func validRateLimitName(name string) bool {
+    switch name {
+    case RateLimitMessages, RateLimitFriendRequests, RateLimitSessions:
+        return true
+    }
+    for _, typeName := range contentTypeNames {
+        if name == RateLimitMessages+":"+typeName {
+            return true
+        }
+    }
+    return false
+}
+
+// Wraps handler so its requests with the given method count towards the
+// named limit, and are rejected with 429 Too Many Requests once it's
+// reached. Users are limited separately; requests without one (like
+// signing in) are limited by client address.
+// The user is only authenticated once, here, and passed on to the handler.
+func (api *API) limitRate(name string, method string, handler UserHandler) APIHandler {
+    return func(w http.ResponseWriter, r *http.Request) int {
+        user, authenticated := api.getCurrentUser(r)
+        if r.Method != method {
+            return handler(w, r, user, authenticated)
+        }
+
+        client := "addr:" + clientAddress(r)
+        if authenticated {
+            client = "user:" + strconv.Itoa(user.Id)
+        }
+
+        // the more specific limit first, so it doesn't use up the other
+        names := []string{name}
+        if name == RateLimitMessages {
+            contentType, ok, err := peekContentType(r)
+            if err != nil {
+                log.Printf("Couldn't read message: %v\n", err)
+                return http.StatusRequestEntityTooLarge
+            }
+            if ok {
+                names = []string{name + ":" + contentTypeNames[contentType], name}
+            }
+        }
+
+        if limitName, retryAfter, ok := checkRateLimits(newContext(r), names, client); !ok {
+            log.Printf("Rate limited %v (%v)\n", client, limitName)
+            seconds := int((retryAfter + time.Second - 1) / time.Second)
+            if seconds < 1 {
+                seconds = 1
+            }
+            w.Header().Set("Retry-After", strconv.Itoa(seconds))
+            return http.StatusTooManyRequests
+        }
+
+        return handler(w, r, user, authenticated)
+    }
+}
+
+// Counts a request from client towards each of the named limits in turn,
+// stopping at the first one that rejects it, and returning which one that
+// was. Rejected requests don't count towards any of them.
+func checkRateLimits(c context.Context, names []string, client string) (limitName string, retryAfter time.Duration, ok bool) {
+    now := time.Now()
+    var counted []string
+    for _, name := range names {
+        key, retryAfter, ok := countRequest(c, name, client, now)
+        if !ok {
+            for _, key := range counted {
+                uncountRequest(c, key)
+            }
+            return name, retryAfter, false
+        }
+        if key != "" {
+            counted = append(counted, key)
+        }
+    }
+    return "", 0, true
+}
+
+// Counts a request from client towards the named limit, returning whether
+// it's allowed and, if it's not, how long until it would be.
+// Requests are allowed if the cache fails, rather than locking everyone out.
+func checkRateLimit(c context.Context, name string, client string) (retryAfter time.Duration, ok bool) {
+    _, retryAfter, ok = countRequest(c, name, client, time.Now())
+    return retryAfter, ok
+}
+
+// Does the work of checkRateLimit, also returning the key the request was
+// counted under, or "" if it wasn't.
+func countRequest(c context.Context, name string, client string, now time.Time) (key string, retryAfter time.Duration, ok bool) {
+    limit, ok := rateLimits[name]
+    if !ok || limit.requests <= 0 {
+        return "", 0, true
+    }
+
+    window := now.UnixNano() / int64(limit.window)
+    windowStart := time.Unix(0, window*int64(limit.window))
+    key = fmt.Sprintf("ratelimit:%v:%v:%d", name, client, window)
+
+    count, err := cache.inc(c, key, 1, 0)
+    if err != nil {
+        log.Printf("checkRateLimit: cache.inc(%q): %v\n", key, err)
+        return "", 0, true
+    }
+    if count == 1 {
+        // long enough to be the last window of a sliding limit
+        if err := cache.touch(c, key, 2*limit.window); err != nil {
+            log.Printf("checkRateLimit: cache.touch(%q): %v\n", key, err)
+        }
+    }
+
+    total := float64(count)
+    if limit.sliding {
+        lastKey := fmt.Sprintf("ratelimit:%v:%v:%d", name, client, window-1)
+        if data, err := cache.get(c, lastKey); err == nil {
+            if last, err := strconv.ParseUint(string(data), 10, 64); err == nil {
+                covered := 1 - float64(now.Sub(windowStart))/float64(limit.window)
+                total += float64(last) * covered
+            }
+        }
+    }
+    if total <= float64(limit.requests) {
+        return key, 0, true
+    }
+
+    // rejected requests don't count, so clients that back off get back in
+    uncountRequest(c, key)
+    return "", windowStart.Add(limit.window).Sub(now), false
+}
+
+// Takes back a request counted under key
+func uncountRequest(c context.Context, key string) {
+    if _, err := cache.inc(c, key, -1, 0); err != nil {
+        log.Printf("checkRateLimit: cache.inc(%q): %v\n", key, err)
+    }
+}
+
+// Gets the address of the client that made the request. Behind a trusted
+// proxy, that's the last address the proxy added to X-Forwarded-For, since
+// the client can send its own; otherwise it's whoever connected.
+func clientAddress(r *http.Request) string {
+    if forwarded := r.Header.Get("X-Forwarded-For"); trustForwardedFor && forwarded != "" {
+        addresses := strings.Split(forwarded, ",")
+        return strings.TrimSpace(addresses[len(addresses)-1])
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// Gets the content type of the message being sent, leaving the body for the
+// handler to read. Fails if the body is larger than MaxMessageRequestSize,
+// rather than reading however much the client sends.
+func peekContentType(r *http.Request) (contentType ContentType, ok bool, err error) {
+    body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxMessageRequestSize+1))
+    r.Body.Close()
+    r.Body = ioutil.NopCloser(bytes.NewReader(body))
+    if err != nil {
+        return 0, false, err
+    }
+    if len(body) > MaxMessageRequestSize {
+        return 0, false, fmt.Errorf("body is larger than %d bytes", MaxMessageRequestSize)
+    }
+
+    var req struct {
+        ContentType ContentType `json:"contentType"`
+    }
+    if err := json.Unmarshal(body, &req); err != nil {
+        return 0, false, nil
+    }
+    _, ok = contentTypeNames[req.ContentType]
+    return req.ContentType, ok, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "golang.org/x/net/context"
+)
+
+// Swaps in limits for a test, returning a function that puts the old ones back
+func setTestRateLimits(limits map[string]rateLimit) func() {
+    oldLimits := rateLimits
+    rateLimits = limits
+    return func() {
+        rateLimits = oldLimits
+    }
+}
+
+func TestCheckRateLimit(t *testing.T) {
+    c := context.Background()
+    cache.flush(c)
+
+    log.Println("Testing fixed windows")
+    defer setTestRateLimits(map[string]rateLimit{
+        "fixed":    {3, time.Hour, false},
+        // so long that we're still in its first window, most of the way
+        // through; the window before is -1
+        "sliding":  {10, 200 * 365 * 24 * time.Hour, true},
+    })()
+
+    for i := 0; i < 3; i++ {
+        if _, ok := checkRateLimit(c, "fixed", "user:1"); !ok {
+            t.Errorf("Request %v was limited", i+1)
+        }
+    }
+    for i := 0; i < 2; i++ {
+        retryAfter, ok := checkRateLimit(c, "fixed", "user:1")
+        if ok {
+            t.Errorf("Request over the limit was allowed")
+        }
+        if retryAfter <= 0 || retryAfter > time.Hour {
+            t.Errorf("Expected a retry within an hour, got %v", retryAfter)
+        }
+    }
+    if _, ok := checkRateLimit(c, "fixed", "user:2"); !ok {
+        t.Errorf("Another user was limited")
+    }
+    if _, ok := checkRateLimit(c, "unlimited", "user:1"); !ok {
+        t.Errorf("A request without a limit was limited")
+    }
+
+    log.Println("Testing rejected requests don't count")
+    window := time.Now().UnixNano() / int64(time.Hour)
+    if data, _ := cache.get(c, fmt.Sprintf("ratelimit:fixed:user:1:%d", window)); string(data) != "3" {
+        t.Errorf("Expected a count of 3, got %q", data)
+    }
+
+    log.Println("Testing sliding windows count the last window")
+    if _, ok := checkRateLimit(c, "sliding", "user:1"); !ok {
+        t.Errorf("First request was limited")
+    }
+    cache.set(c, "ratelimit:sliding:user:2:-1", []byte("100"), 0)
+    if _, ok := checkRateLimit(c, "sliding", "user:2"); ok {
+        t.Errorf("Request was allowed despite the last window's requests")
+    }
+}
+
+func TestCheckRateLimits(t *testing.T) {
+    c := context.Background()
+    cache.flush(c)
+
+    defer setTestRateLimits(map[string]rateLimit{
+        "specific": {5, time.Hour, false},
+        "general":  {2, time.Hour, false},
+    })()
+    names := []string{"specific", "general"}
+
+    for i := 0; i < 2; i++ {
+        if _, _, ok := checkRateLimits(c, names, "user:1"); !ok {
+            t.Errorf("Request %v was limited", i+1)
+        }
+    }
+
+    log.Println("Testing the limit that rejects a request is given")
+    limitName, retryAfter, ok := checkRateLimits(c, names, "user:1")
+    if ok || limitName != "general" || retryAfter <= 0 {
+        t.Errorf("Expected to be limited by general, got %v %v %v", ok, limitName, retryAfter)
+    }
+
+    log.Println("Testing a request rejected by a later limit doesn't count towards earlier ones")
+    window := time.Now().UnixNano() / int64(time.Hour)
+    if data, _ := cache.get(c, fmt.Sprintf("ratelimit:specific:user:1:%d", window)); string(data) != "2" {
+        t.Errorf("Expected a count of 2, got %q", data)
+    }
+}
+
+func TestClientAddress(t *testing.T) {
+    defer func() { trustForwardedFor = false }()
+
+    r, _ := http.NewRequest("POST", "/sessions", nil)
+    r.RemoteAddr = "10.0.0.1:4321"
+    r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+
+    log.Println("Testing X-Forwarded-For is ignored without a trusted proxy")
+    if addr := clientAddress(r); addr != "10.0.0.1" {
+        t.Errorf("Expected 10.0.0.1, got %v", addr)
+    }
+
+    log.Println("Testing the proxy's X-Forwarded-For entry is used behind one")
+    trustForwardedFor = true
+    if addr := clientAddress(r); addr != "5.6.7.8" {
+        t.Errorf("Expected 5.6.7.8, got %v", addr)
+    }
+    r.Header.Del("X-Forwarded-For")
+    if addr := clientAddress(r); addr != "10.0.0.1" {
+        t.Errorf("Expected 10.0.0.1, got %v", addr)
+    }
+}
+
+func TestPeekContentType(t *testing.T) {
+    log.Println("Testing peeking leaves the body for the handler")
+    body := `{"content":"wobble","contentType":3}`
+    r, _ := http.NewRequest("POST", "/friends/1/messages", strings.NewReader(body))
+    contentType, ok, err := peekContentType(r)
+    if err != nil || !ok || contentType != ContentTypeShake {
+        t.Errorf("Expected a shake, got %v %v %v", contentType, ok, err)
+    }
+    if b, _ := ioutil.ReadAll(r.Body); string(b) != body {
+        t.Errorf("Body wasn't left for the handler: %q", b)
+    }
+
+    log.Println("Testing bodies that aren't messages")
+    r, _ = http.NewRequest("POST", "/friends/1/messages", strings.NewReader("nope"))
+    if _, ok, err := peekContentType(r); ok || err != nil {
+        t.Errorf("Expected no content type, got %v %v", ok, err)
+    }
+
+    log.Println("Testing huge bodies aren't read")
+    r, _ = http.NewRequest("POST", "/friends/1/messages", bytes.NewReader(make([]byte, 10*MaxMessageRequestSize)))
+    if _, _, err := peekContentType(r); err == nil {
+        t.Error("Huge body was accepted")
+    }
+}
+
+func TestLimitRateAuthenticatesOnce(t *testing.T) {
+    defer resetTables()
+    cache.flush(context.Background())
+
+    session := testAPI.createSessionEndpoint(IdentityInfo{ID: "3000", DisplayName: "Kevin Rudd"}, "phone")
+    user, _ := testAPI.getSessionUser(session.Token)
+
+    handler := testAPI.limitRate(RateLimitMessages, "POST", func(w http.ResponseWriter, r *http.Request, current User, ok bool) int {
+        if !ok || current.Id != user.Id {
+            t.Errorf("Handler didn't get the user the rate limit authenticated: %v %v", current, ok)
+        }
+        return http.StatusOK
+    })
+
+    r, _ := http.NewRequest("POST", "/friends/1/messages", strings.NewReader(`{"contentType":1}`))
+    r.Header.Set("X-Session-Token", session.Token)
+    if status := handler(httptest.NewRecorder(), r); status != http.StatusOK {
+        t.Errorf("Expected %v, got %v", http.StatusOK, status)
+    }
+
+
+    log.Println("Testing huge messages are rejected")
+    r, _ = http.NewRequest("POST", "/friends/1/messages", bytes.NewReader(make([]byte, 10*MaxMessageRequestSize)))
+    if status := handler(httptest.NewRecorder(), r); status != http.StatusRequestEntityTooLarge {
+        t.Errorf("Expected %v, got %v", http.StatusRequestEntityTooLarge, status)
+    }
+}
+
+func TestSetupRateLimits(t *testing.T) {
+    var config Config
+    config.RateLimit = map[string]*RateLimitConfig{
+        "messages:shake":   {Requests: 1, Window: 5},
+        "friendrequests":   {Requests: 0},
+    }
+    limits, err := setupRateLimits(config)
+    if err != nil {
+        t.Fatalf("Setting up rate limits failed: %v", err)
+    }
+    if limit := limits["messages:shake"]; limit.requests != 1 || limit.window != 5*time.Second || limit.sliding {
+        t.Errorf("Wrong shake limit: %+v", limit)
+    }
+    if limits["friendrequests"].requests != 0 {
+        t.Errorf("Expected friend requests not to be limited")
+    }
+    if limits["messages"] != defaultRateLimits["messages"] {
+        t.Errorf("Expected the default messages limit, got %+v", limits["messages"])
+    }
+
+    config.RateLimit = map[string]*RateLimitConfig{"messages:smoke": {Requests: 1, Window: 5}}
+    if _, err := setupRateLimits(config); err == nil {
+        t.Error("Unknown rate limit should fail")
+    }
+}
+
+func TestRateLimitingAPI(t *testing.T) {
+    defer resetTables()
+    cache.flush(context.Background())
+
+    server := newTestAPIServer(t)
+    defer server.Close()
+
+    defer setTestRateLimits(map[string]rateLimit{
+        RateLimitMessages:              {5, time.Hour, false},
+        RateLimitMessages + ":shake":   {2, time.Hour, false},
+        RateLimitSessions:              {3, time.Hour, false},
+    })()
+
+    session1 := server.signIn(IdentityInfo{ID: "3000", DisplayName: "Kevin Rudd"})
+    session2 := server.signIn(IdentityInfo{ID: "3001", DisplayName: "Julia Gillard"})
+    server.request("POST", fmt.Sprintf("/users/%d/friendrequests", session2.User.Id), session1.Token, nil, nil)
+    server.request("PUT", fmt.Sprintf("/friendrequests/%d", session1.User.Id), session2.Token, nil, nil)
+
+    log.Println("** Testing wobbles are limited separately")
+    path := fmt.Sprintf("/friends/%d/messages", session2.User.Id)
+    shake := SendMessageRequest{ContentType: ContentTypeShake}
+    for i := 0; i < 2; i++ {
+        var resp SendMessageResponse
+        if status := server.request("POST", path, session1.Token, shake, &resp); status != http.StatusOK || !resp.Success {
+            t.Errorf("Wobble %v failed: %v %v", i+1, status, resp.Error)
+        }
+    }
+
+    header := http.Header{}
+    header.Set("X-Session-Token", session1.Token)
+    status := server.requestWithHeader("POST", path, header, shake, nil)
+    if status != http.StatusTooManyRequests {
+        t.Errorf("Expected %v, got %v", http.StatusTooManyRequests, status)
+    }
+
+    text := SendMessageRequest{Content: "wobble wobble", ContentType: ContentTypeText}
+    if status := server.request("POST", path, session1.Token, text, nil); status != http.StatusOK {
+        t.Errorf("Text message after wobbles: expected %v, got %v", http.StatusOK, status)
+    }
+
+    log.Println("** Testing all messages count towards the messages limit")
+    server.request("POST", path, session1.Token, text, nil)
+    server.request("POST", path, session1.Token, text, nil)
+    if status := server.request("POST", path, session1.Token, text, nil); status != http.StatusTooManyRequests {
+        t.Errorf("Expected %v, got %v", http.StatusTooManyRequests, status)
+    }
+    if status := server.request("GET", path, session1.Token, nil, nil); status != http.StatusOK {
+        t.Errorf("Listing messages: expected %v, got %v", http.StatusOK, status)
+    }
+    if status := server.request("POST", fmt.Sprintf("/friends/%d/messages", session1.User.Id), session2.Token, text, nil); status != http.StatusOK {
+        t.Errorf("Other user's message: expected %v, got %v", http.StatusOK, status)
+    }
+
+    log.Println("** Testing 429 responses have Retry-After")
+    req, _ := http.NewRequest("POST", server.URL+path, nil)
+    req.Header.Set("X-Session-Token", session1.Token)
+    res, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatalf("Request failed: %v", err)
+    }
+    res.Body.Close()
+    retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+    if res.StatusCode != http.StatusTooManyRequests || err != nil || retryAfter < 1 || retryAfter > 3600 {
+        t.Errorf("Expected 429 with Retry-After, got %v %q", res.StatusCode, res.Header.Get("Retry-After"))
+    }
+
+    log.Println("** Testing signing in is limited by address")
+    if status := server.request("POST", "/sessions", "", CreateSessionRequest{IdToken: "bogus"}, nil); status != http.StatusUnauthorized {
+        t.Errorf("Expected %v, got %v", http.StatusUnauthorized, status)
+    }
+    if status := server.request("POST", "/sessions", "", CreateSessionRequest{IdToken: "bogus"}, nil); status != http.StatusTooManyRequests {
+        t.Errorf("Expected %v, got %v", http.StatusTooManyRequests, status)
+    }
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/net/context"
+)
+
+// How long to wait for Redis if the context doesn't say
+const RedisDefaultTimeout = 5 * time.Second
+
+// How many idle connections to keep around for the next request
+const RedisMaxIdleConns = 8
+
+// How many times inc retries when someone else changes the value under it
+const RedisMaxIncAttempts = 10
+
+// An error reply from Redis. The connection's still fine after one of these.
+type redisError string
+
+func (e redisError) Error() string {
+    return "redis: " + string(e)
+}
+
+// redisCache is a cacheInterface backed by a Redis server (or anything else
+// that speaks RESP), so every instance shares the same cache.
+type redisCache struct {
+    address     string
+    password    string
+    database    int
+    // prepended to every key
+    prefix      string
+    timeout     time.Duration
+
+    mu          sync.Mutex
+    idle        []*redisConn
+}
+
+// newRedisCache creates a redisCache, checking the server is reachable.
+func newRedisCache(address string, password string, database int, prefix string) (cacheInterface, error) {
+    rc := &redisCache{
+        address:    address,
+        password:   password,
+        database:   database,
+        prefix:     prefix,
+        timeout:    RedisDefaultTimeout,
+    }
+    if _, err := rc.do(context.Background(), "PING"); err != nil {
+        return nil, fmt.Errorf("newRedisCache: %v", err)
+    }
+    return rc, nil
+}
+
+// A connection to the server
+type redisConn struct {
+    net.Conn
+    r   *bufio.Reader
+    w   *bufio.Writer
+}
+
+// Sends a command and reads its reply, which is a string, int64, []byte,
+// []interface{} or nil.
+func (conn *redisConn) do(args ...string) (interface{}, error) {
+    fmt.Fprintf(conn.w, "*%d\r\n", len(args))
+    for _, arg := range args {
+        fmt.Fprintf(conn.w, "$%d\r\n%s\r\n", len(arg), arg)
+    }
+    if err := conn.w.Flush(); err != nil {
+        return nil, err
+    }
+    return conn.readReply()
+}
+
+func (conn *redisConn) readReply() (interface{}, error) {
+    line, err := conn.r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+        return nil, fmt.Errorf("redis: bad reply %q", line)
+    }
+    line = line[:len(line)-2]
+
+    switch line[0] {
+    case '+':
+        return line[1:], nil
+    case '-':
+        return nil, redisError(line[1:])
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '$':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil || n < 0 {
+            // $-1 is nil
+            return nil, err
+        }
+        data := make([]byte, n+2)
+        if _, err := io.ReadFull(conn.r, data); err != nil {
+            return nil, err
+        }
+        return data[:n], nil
+    case '*':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil || n < 0 {
+            return nil, err
+        }
+        items := make([]interface{}, n)
+        for i := range items {
+            // errors inside arrays (e.g. from EXEC) are items, not failures
+            items[i], err = conn.readReply()
+            if _, ok := err.(redisError); err != nil && !ok {
+                return nil, err
+            }
+        }
+        return items, nil
+    default:
+        return nil, fmt.Errorf("redis: bad reply %q", line)
+    }
+}
+
+// Gets an idle connection or makes a new one, with its deadline set from
+// the context.
+func (rc *redisCache) getConn(c context.Context) (*redisConn, error) {
+    deadline := time.Now().Add(rc.timeout)
+    if d, ok := c.Deadline(); ok && d.Before(deadline) {
+        deadline = d
+    }
+
+    var conn *redisConn
+    rc.mu.Lock()
+    if n := len(rc.idle); n > 0 {
+        conn = rc.idle[n-1]
+        rc.idle = rc.idle[:n-1]
+    }
+    rc.mu.Unlock()
+
+    if conn == nil {
+        netConn, err := net.DialTimeout("tcp", rc.address, deadline.Sub(time.Now()))
+        if err != nil {
+            return nil, err
+        }
+        conn = &redisConn{netConn, bufio.NewReader(netConn), bufio.NewWriter(netConn)}
+        conn.SetDeadline(deadline)
+
+        if rc.password != "" {
+            if _, err := conn.do("AUTH", rc.password); err != nil {
+                conn.Close()
+                return nil, err
+            }
+        }
+        if rc.database != 0 {
+            if _, err := conn.do("SELECT", strconv.Itoa(rc.database)); err != nil {
+                conn.Close()
+                return nil, err
+            }
+        }
+        return conn, nil
+    }
+
+    conn.SetDeadline(deadline)
+    return conn, nil
+}
+
+// Returns a connection to the pool, unless err means it's broken.
+func (rc *redisCache) putConn(conn *redisConn, err error) {
+    if _, ok := err.(redisError); err != nil && !ok {
+        conn.Close()
+        return
+    }
+
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    if len(rc.idle) >= RedisMaxIdleConns {
+        conn.Close()
+        return
+    }
+    rc.idle = append(rc.idle, conn)
+}
+
+// Sends a single command
+func (rc *redisCache) do(c context.Context, args ...string) (interface{}, error) {
+    conn, err := rc.getConn(c)
+    if err != nil {
+        return nil, err
+    }
+    reply, err := conn.do(args...)
+    rc.putConn(conn, err)
+    return reply, err
+}
+
+func (rc *redisCache) set(c context.Context, key string, data []byte, exp time.Duration) error {
+    args := []string{"SET", rc.prefix + key, string(data)}
+    // like memcache, no expiry means the item's kept until it's evicted
+    if ms := int64(exp / time.Millisecond); ms > 0 {
+        args = append(args, "PX", strconv.FormatInt(ms, 10))
+    }
+    _, err := rc.do(c, args...)
+    return err
+}
+
+func (rc *redisCache) inc(c context.Context, key string, delta int64, initialValue uint64) (v uint64, err error) {
+    key = rc.prefix + key
+
+    conn, err := rc.getConn(c)
+    if err != nil {
+        return 0, err
+    }
+    defer func() {
+        rc.putConn(conn, err)
+    }()
+
+    if _, err = conn.do("SET", key, strconv.FormatUint(initialValue, 10), "NX"); err != nil {
+        return 0, err
+    }
+
+    // INCRBY is atomic, so use it when we can
+    if delta >= 0 {
+        var reply interface{}
+        reply, err = conn.do("INCRBY", key, strconv.FormatInt(delta, 10))
+        if n, ok := reply.(int64); err == nil && ok && n >= 0 {
+            return uint64(n), nil
+        }
+        // it fails for values past an int64
+        if _, ok := err.(redisError); err != nil && !ok {
+            return 0, err
+        }
+    }
+
+    // INCRBY can't cap at zero or wrap around, so do it ourselves, starting
+    // again if the value changes before we've set it
+    for i := 0; i < RedisMaxIncAttempts; i++ {
+        if _, err = conn.do("WATCH", key); err != nil {
+            return 0, err
+        }
+
+        var reply interface{}
+        if reply, err = conn.do("GET", key); err != nil {
+            return 0, err
+        }
+        v = initialValue
+        if data, ok := reply.([]byte); ok {
+            if v, err = strconv.ParseUint(string(data), 10, 64); err != nil {
+                conn.do("UNWATCH")
+                return 0, fmt.Errorf("inc: %q isn't a number", key)
+            }
+        }
+        v = incValue(v, delta)
+
+        // keep the key's expiry, if it has one
+        if reply, err = conn.do("PTTL", key); err != nil {
+            return 0, err
+        }
+        args := []string{"SET", key, strconv.FormatUint(v, 10)}
+        if ttl, ok := reply.(int64); ok && ttl > 0 {
+            args = append(args, "PX", strconv.FormatInt(ttl, 10))
+        }
+
+        if _, err = conn.do("MULTI"); err != nil {
+            return 0, err
+        }
+        if _, err = conn.do(args...); err != nil {
+            conn.do("DISCARD")
+            return 0, err
+        }
+        if reply, err = conn.do("EXEC"); err != nil {
+            return 0, err
+        }
+        // EXEC gives nil if the value changed
+        if reply != nil {
+            return v, nil
+        }
+    }
+    return 0, errors.New("inc: value kept changing")
+}
+
+func (rc *redisCache) get(c context.Context, key string) ([]byte, error) {
+    reply, err := rc.do(c, "GET", rc.prefix+key)
+    if err != nil {
+        return nil, err
+    }
+    data, ok := reply.([]byte)
+    if !ok {
+        return nil, errCacheMiss
+    }
+    return data, nil
+}
+
+func (rc *redisCache) touch(c context.Context, key string, exp time.Duration) error {
+    key = rc.prefix + key
+    args := []string{"PEXPIRE", key, strconv.FormatInt(int64(exp/time.Millisecond), 10)}
+    if exp < time.Millisecond {
+        args = []string{"PERSIST", key}
+    }
+    reply, err := rc.do(c, args...)
+    if err != nil {
+        return err
+    }
+    if n, _ := reply.(int64); n == 1 {
+        return nil
+    }
+
+    // PERSIST also gives 0 if the key has no expiry anyway
+    if args[0] == "PERSIST" {
+        if reply, err = rc.do(c, "EXISTS", key); err != nil {
+            return err
+        }
+        if n, _ := reply.(int64); n == 1 {
+            return nil
+        }
+    }
+    return errCacheMiss
+}
+
+func (rc *redisCache) deleleMulti(c context.Context, keys []string) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    args := []string{"DEL"}
+    for _, key := range keys {
+        args = append(args, rc.prefix+key)
+    }
+    _, err := rc.do(c, args...)
+    return err
+}
+
+// Deletes everything in the database, or, with a prefix, just the keys
+// with that prefix, since something else might be using the database too.
+func (rc *redisCache) flush(c context.Context) error {
+    if rc.prefix == "" {
+        _, err := rc.do(c, "FLUSHDB")
+        return err
+    }
+
+    pattern := redisEscapePattern(rc.prefix) + "*"
+    cursor := "0"
+    for {
+        reply, err := rc.do(c, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+        if err != nil {
+            return err
+        }
+        items, ok := reply.([]interface{})
+        if !ok || len(items) != 2 {
+            return fmt.Errorf("flush: bad SCAN reply %v", reply)
+        }
+        next, _ := items[0].([]byte)
+        keys, _ := items[1].([]interface{})
+
+        if len(keys) > 0 {
+            args := []string{"DEL"}
+            for _, key := range keys {
+                if b, ok := key.([]byte); ok {
+                    args = append(args, string(b))
+                }
+            }
+            if _, err := rc.do(c, args...); err != nil {
+                return err
+            }
+        }
+
+        cursor = string(next)
+        if cursor == "0" || cursor == "" {
+            return nil
+        }
+    }
+}
+
+// Escapes the special characters of a glob-style pattern for SCAN MATCH
+func redisEscapePattern(s string) string {
+    var escaped []byte
+    for i := 0; i < len(s); i++ {
+        switch s[i] {
+        case '*', '?', '[', ']', '\\':
+            escaped = append(escaped, '\\')
+        }
+        escaped = append(escaped, s[i])
+    }
+    return string(escaped)
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "golang.org/x/net/context"
+)
+
+// An in-process server speaking enough RESP to test redisCache with
+type fakeRedisServer struct {
+    listener    net.Listener
+    password    string
+
+    mu          sync.Mutex
+    // one keyspace per database
+    databases   map[int]map[string]*fakeRedisItem
+    // bumped whenever a key changes, for WATCH
+    versions    map[string]int
+    conns       int
+}
+
+type fakeRedisItem struct {
+    data    string
+    exp     time.Time
+}
+
+func newFakeRedisServer(t *testing.T, password string) *fakeRedisServer {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Listening failed: %v", err)
+    }
+    server := &fakeRedisServer{
+        listener:   listener,
+        password:   password,
+        databases:  make(map[int]map[string]*fakeRedisItem),
+        versions:   make(map[string]int),
+    }
+    go server.serve()
+    return server
+}
+
+func (server *fakeRedisServer) address() string {
+    return server.listener.Addr().String()
+}
+
+func (server *fakeRedisServer) close() {
+    server.listener.Close()
+}
+
+func (server *fakeRedisServer) serve() {
+    for {
+        conn, err := server.listener.Accept()
+        if err != nil {
+            return
+        }
+        server.mu.Lock()
+        server.conns++
+        server.mu.Unlock()
+        go server.handle(conn)
+    }
+}
+
+// State of one client connection
+type fakeRedisConn struct {
+    authed      bool
+    database    int
+    // queued by MULTI, or nil
+    queued      [][]string
+    multi       bool
+    watched     map[string]int
+}
+
+func (server *fakeRedisServer) handle(netConn net.Conn) {
+    defer netConn.Close()
+    r := bufio.NewReader(netConn)
+    w := bufio.NewWriter(netConn)
+    conn := &fakeRedisConn{authed: server.password == ""}
+
+    for {
+        args, err := readFakeRedisCommand(r)
+        if err != nil {
+            return
+        }
+
+        var reply interface{}
+        switch {
+        case conn.multi && args[0] != "EXEC" && args[0] != "DISCARD":
+            conn.queued = append(conn.queued, args)
+            reply = "QUEUED"
+        default:
+            server.mu.Lock()
+            reply = server.exec(conn, args)
+            server.mu.Unlock()
+        }
+
+        writeFakeRedisReply(w, reply)
+        if err := w.Flush(); err != nil {
+            return
+        }
+    }
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    if !strings.HasPrefix(line, "*") {
+        return nil, fmt.Errorf("expected array, got %q", line)
+    }
+    n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+    args := make([]string, n)
+    for i := range args {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+        data := make([]byte, size+2)
+        if _, err := io.ReadFull(r, data); err != nil {
+            return nil, err
+        }
+        args[i] = string(data[:size])
+    }
+    args[0] = strings.ToUpper(args[0])
+    return args, nil
+}
+
+func writeFakeRedisReply(w *bufio.Writer, reply interface{}) {
+    switch reply := reply.(type) {
+    case nil:
+        w.WriteString("$-1\r\n")
+    case string:
+        fmt.Fprintf(w, "+%s\r\n", reply)
+    case redisError:
+        fmt.Fprintf(w, "-%s\r\n", string(reply))
+    case int:
+        fmt.Fprintf(w, ":%d\r\n", reply)
+    case []byte:
+        fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+    case []interface{}:
+        if reply == nil {
+            w.WriteString("*-1\r\n")
+            return
+        }
+        fmt.Fprintf(w, "*%d\r\n", len(reply))
+        for _, item := range reply {
+            writeFakeRedisReply(w, item)
+        }
+    }
+}
+
+// Gets a live item, deleting it if it's expired
+func (server *fakeRedisServer) item(database int, key string) *fakeRedisItem {
+    items := server.databases[database]
+    item, ok := items[key]
+    if !ok {
+        return nil
+    }
+    if !item.exp.IsZero() && time.Now().After(item.exp) {
+        delete(items, key)
+        return nil
+    }
+    return item
+}
+
+func (server *fakeRedisServer) changed(database int, key string) {
+    server.versions[fmt.Sprintf("%d:%s", database, key)]++
+}
+
+// Runs a command, with server.mu held
+func (server *fakeRedisServer) exec(conn *fakeRedisConn, args []string) interface{} {
+    if args[0] == "AUTH" {
+        if len(args) != 2 || args[1] != server.password {
+            return redisError("WRONGPASS invalid password")
+        }
+        conn.authed = true
+        return "OK"
+    }
+    if !conn.authed {
+        return redisError("NOAUTH Authentication required.")
+    }
+
+    if server.databases[conn.database] == nil {
+        server.databases[conn.database] = make(map[string]*fakeRedisItem)
+    }
+    items := server.databases[conn.database]
+
+    switch args[0] {
+    case "PING":
+        return "PONG"
+    case "SELECT":
+        conn.database, _ = strconv.Atoi(args[1])
+        return "OK"
+    case "INCRBY":
+        item := server.item(conn.database, args[1])
+        if item == nil {
+            item = &fakeRedisItem{data: "0"}
+            items[args[1]] = item
+        }
+        v, err := strconv.ParseInt(item.data, 10, 64)
+        if err != nil {
+            return redisError("ERR value is not an integer or out of range")
+        }
+        delta, _ := strconv.ParseInt(args[2], 10, 64)
+        if (delta > 0 && v+delta < v) || (delta < 0 && v+delta > v) {
+            return redisError("ERR increment or decrement would overflow")
+        }
+        item.data = strconv.FormatInt(v+delta, 10)
+        server.changed(conn.database, args[1])
+        return int(v + delta)
+    case "GET":
+        if item := server.item(conn.database, args[1]); item != nil {
+            return []byte(item.data)
+        }
+        return nil
+    case "SET":
+        item := &fakeRedisItem{data: args[2]}
+        for i := 3; i < len(args); i++ {
+            switch strings.ToUpper(args[i]) {
+            case "NX":
+                if server.item(conn.database, args[1]) != nil {
+                    return nil
+                }
+            case "PX":
+                i++
+                ms, _ := strconv.Atoi(args[i])
+                item.exp = time.Now().Add(time.Duration(ms) * time.Millisecond)
+            }
+        }
+        items[args[1]] = item
+        server.changed(conn.database, args[1])
+        return "OK"
+    case "PTTL":
+        item := server.item(conn.database, args[1])
+        switch {
+        case item == nil:
+            return -2
+        case item.exp.IsZero():
+            return -1
+        default:
+            return int(item.exp.Sub(time.Now()) / time.Millisecond)
+        }
+    case "PEXPIRE", "PERSIST":
+        item := server.item(conn.database, args[1])
+        if item == nil || (args[0] == "PERSIST" && item.exp.IsZero()) {
+            return 0
+        }
+        item.exp = time.Time{}
+        if args[0] == "PEXPIRE" {
+            ms, _ := strconv.Atoi(args[2])
+            item.exp = time.Now().Add(time.Duration(ms) * time.Millisecond)
+        }
+        return 1
+    case "EXISTS":
+        if server.item(conn.database, args[1]) != nil {
+            return 1
+        }
+        return 0
+    case "DEL":
+        deleted := 0
+        for _, key := range args[1:] {
+            if server.item(conn.database, key) != nil {
+                delete(items, key)
+                server.changed(conn.database, key)
+                deleted++
+            }
+        }
+        return deleted
+    case "FLUSHDB":
+        for key := range items {
+            server.changed(conn.database, key)
+        }
+        server.databases[conn.database] = nil
+        return "OK"
+    case "SCAN":
+        // everything in one go; only trailing * patterns are supported
+        prefix := strings.Replace(strings.TrimSuffix(args[3], "*"), "\\", "", -1)
+        keys := []interface{}{}
+        for key := range items {
+            if strings.HasPrefix(key, prefix) {
+                keys = append(keys, []byte(key))
+            }
+        }
+        return []interface{}{[]byte("0"), keys}
+    case "WATCH":
+        if conn.watched == nil {
+            conn.watched = make(map[string]int)
+        }
+        for _, key := range args[1:] {
+            id := fmt.Sprintf("%d:%s", conn.database, key)
+            conn.watched[id] = server.versions[id]
+        }
+        return "OK"
+    case "UNWATCH":
+        conn.watched = nil
+        return "OK"
+    case "MULTI":
+        conn.multi = true
+        conn.queued = nil
+        return "OK"
+    case "DISCARD":
+        conn.multi = false
+        conn.queued = nil
+        conn.watched = nil
+        return "OK"
+    case "EXEC":
+        queued := conn.queued
+        conn.multi = false
+        conn.queued = nil
+        watched := conn.watched
+        conn.watched = nil
+        for id, version := range watched {
+            if server.versions[id] != version {
+                return []interface{}(nil)
+            }
+        }
+        replies := []interface{}{}
+        for _, queuedArgs := range queued {
+            replies = append(replies, server.exec(conn, queuedArgs))
+        }
+        return replies
+    default:
+        return redisError("ERR unknown command '" + args[0] + "'")
+    }
+}
+
+func TestRedisCache(t *testing.T) {
+    server := newFakeRedisServer(t, "hunter2")
+    defer server.close()
+    c := context.Background()
+
+    log.Println("Testing connecting with the wrong password fails")
+    if _, err := newRedisCache(server.address(), "hunter3", 0, ""); err == nil {
+        t.Error("Connecting with the wrong password should fail")
+    }
+
+    rc, err := newRedisCache(server.address(), "hunter2", 2, "test:")
+    if err != nil {
+        t.Fatalf("Connecting failed: %v", err)
+    }
+
+    log.Println("Testing set and get")
+    if _, err := rc.get(c, "a"); err != errCacheMiss {
+        t.Errorf("Expected a miss, got %v", err)
+    }
+    if err := rc.set(c, "a", []byte("hello\r\nworld"), time.Minute); err != nil {
+        t.Fatalf("set failed: %v", err)
+    }
+    if data, err := rc.get(c, "a"); err != nil || string(data) != "hello\r\nworld" {
+        t.Errorf("Expected hello world, got %q (%v)", data, err)
+    }
+    if server.item(2, "test:a") == nil {
+        t.Error("Key wasn't prefixed or database wasn't selected")
+    }
+
+    log.Println("Testing items expire")
+    rc.set(c, "short", []byte("x"), 20*time.Millisecond)
+    time.Sleep(40 * time.Millisecond)
+    if _, err := rc.get(c, "short"); err != errCacheMiss {
+        t.Errorf("Expected an expired item to miss, got %v", err)
+    }
+
+    log.Println("Testing touch")
+    if err := rc.touch(c, "missing", time.Minute); err != errCacheMiss {
+        t.Errorf("Expected touching a missing key to miss, got %v", err)
+    }
+    rc.set(c, "touched", []byte("x"), 20*time.Millisecond)
+    if err := rc.touch(c, "touched", 0); err != nil {
+        t.Errorf("touch failed: %v", err)
+    }
+    if err := rc.touch(c, "touched", 0); err != nil {
+        t.Errorf("touching a key without expiry failed: %v", err)
+    }
+    time.Sleep(40 * time.Millisecond)
+    if _, err := rc.get(c, "touched"); err != nil {
+        t.Errorf("Expected touch to remove the expiry, got %v", err)
+    }
+    rc.touch(c, "touched", 20*time.Millisecond)
+    time.Sleep(40 * time.Millisecond)
+    if _, err := rc.get(c, "touched"); err != errCacheMiss {
+        t.Errorf("Expected touch to set the expiry, got %v", err)
+    }
+
+    log.Println("Testing inc")
+    if v, err := rc.inc(c, "n", 5, 10); err != nil || v != 15 {
+        t.Errorf("Expected 15, got %v (%v)", v, err)
+    }
+    if v, err := rc.inc(c, "n", -3, 10); err != nil || v != 12 {
+        t.Errorf("Expected 12, got %v (%v)", v, err)
+    }
+    if v, err := rc.inc(c, "n", -100, 10); err != nil || v != 0 {
+        t.Errorf("Expected underflow to cap at 0, got %v (%v)", v, err)
+    }
+    rc.set(c, "big", []byte(strconv.FormatUint(1<<64-1, 10)), time.Minute)
+    if v, err := rc.inc(c, "big", 2, 0); err != nil || v != 1 {
+        t.Errorf("Expected overflow to wrap to 1, got %v (%v)", v, err)
+    }
+    if item := server.item(2, "test:big"); item == nil || item.exp.IsZero() {
+        t.Error("inc lost the key's expiry")
+    }
+    rc.set(c, "word", []byte("wob"), time.Minute)
+    if _, err := rc.inc(c, "word", 1, 0); err == nil {
+        t.Error("inc on a non-number should fail")
+    }
+
+    log.Println("Testing concurrent incs all count")
+    var wg sync.WaitGroup
+    for i := 0; i < 5; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 10; j++ {
+                if _, err := rc.inc(c, "counter", 1, 0); err != nil {
+                    t.Errorf("inc failed: %v", err)
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    if data, _ := rc.get(c, "counter"); string(data) != "50" {
+        t.Errorf("Expected 50, got %q", data)
+    }
+
+    log.Println("Testing deleleMulti")
+    rc.set(c, "b", []byte("b"), time.Minute)
+    if err := rc.deleleMulti(c, []string{"a", "b", "missing"}); err != nil {
+        t.Errorf("deleleMulti failed: %v", err)
+    }
+    if _, err := rc.get(c, "a"); err != errCacheMiss {
+        t.Errorf("Expected a to be deleted, got %v", err)
+    }
+
+    log.Println("Testing flush only deletes prefixed keys")
+    other, _ := newRedisCache(server.address(), "hunter2", 2, "other:")
+    other.set(c, "a", []byte("keep"), time.Minute)
+    rc.set(c, "a", []byte("a"), time.Minute)
+    if err := rc.flush(c); err != nil {
+        t.Errorf("flush failed: %v", err)
+    }
+    if _, err := rc.get(c, "a"); err != errCacheMiss {
+        t.Errorf("Expected a to be flushed, got %v", err)
+    }
+    if data, err := other.get(c, "a"); err != nil || string(data) != "keep" {
+        t.Errorf("flush deleted another prefix's key: %q (%v)", data, err)
+    }
+
+    log.Println("Testing connections are reused")
+    server.mu.Lock()
+    conns := server.conns
+    server.mu.Unlock()
+    for i := 0; i < 10; i++ {
+        rc.get(c, "a")
+    }
+    server.mu.Lock()
+    if server.conns != conns {
+        t.Errorf("Expected no new connections, got %v", server.conns-conns)
+    }
+    server.mu.Unlock()
+}
+
+func TestNewCache(t *testing.T) {
+    server := newFakeRedisServer(t, "")
+    defer server.close()
+
+    var config Config
+    if c, err := newCache(config); err != nil {
+        t.Errorf("Creating default cache failed: %v", err)
+    } else if _, ok := c.(*memoryCache); !ok {
+        t.Errorf("Expected memoryCache by default, got %T", c)
+    }
+
+    config.Cache.Type = CacheRedis
+    config.Cache.Address = server.address()
+    if c, err := newCache(config); err != nil {
+        t.Errorf("Creating redis cache failed: %v", err)
+    } else if _, ok := c.(*redisCache); !ok {
+        t.Errorf("Expected redisCache, got %T", c)
+    }
+
+    config.Cache.Type = "memcache"
+    if _, err := newCache(config); err == nil {
+        t.Error("Unknown cache type should fail")
+    }
+}
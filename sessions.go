@@ -0,0 +1,456 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+    "golang.org/x/net/context"
+)
+
+// How long a session lasts before the user has to sign in again
+const SessionLifetime = 30 * 24 * time.Hour
+
+// Number of random bytes in a session token
+const SessionTokenSize = 32
+
+// How out of date Session.LastUsedAt can get, so we don't write to the
+// database on every request
+const SessionLastUsedResolution = 5 * time.Minute
+
+/*
+ * Data types
+ */
+
+// A signed-in device.
+// Only a hash of the token is stored, so the table leaking doesn't let anyone
+// sign in.
+type Session struct {
+    Id          int
+    UserId      int         `sql:"not null;index"`
+    TokenHash   string      `sql:"not null;unique"`
+    // what the client said it was, or its User-Agent
+    Device      string      `sql:"not null"`
+    Timestamp   time.Time   `sql:"not null"`
+    LastUsedAt  time.Time   `sql:"not null"`
+    ExpiresAt   time.Time   `sql:"not null"`
+}
+
+// What the user gets to see about their sessions
+type PublicSession struct {
+    Id          int         `json:"id"`
+    Device      string      `json:"device"`
+    Timestamp   time.Time   `json:"timestamp"`
+    LastUsedAt  time.Time   `json:"lastUsedAt"`
+    ExpiresAt   time.Time   `json:"expiresAt"`
+    // whether it's the session making the request
+    Current     bool        `json:"current"`
+}
+
+// An ID token that's been logged out, so it can't be used again before it
+// expires.
+type RevokedToken struct {
+    TokenHash   string      `gorm:"primary_key"`
+    ExpiresAt   time.Time   `sql:"not null"`
+}
+
+// ID tokens issued to the user before RevokedBefore can't be used, since
+// they logged out everywhere then. It's a whole second, like tokens' iat.
+type UserRevocation struct {
+    UserId          int         `gorm:"primary_key"`
+    RevokedBefore   time.Time   `sql:"not null"`
+}
+
+/*
+ * Helper functions
+ */
+
+func hashSessionToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// Creates a new session for the user, returning the token the client should
+// send in X-Session-Token.
+func (api *API) createSession(user User, device string) (token string, session Session, err error) {
+    b := make([]byte, SessionTokenSize)
+    if _, err = rand.Read(b); err != nil {
+        return token, session, err
+    }
+    token = base64.RawURLEncoding.EncodeToString(b)
+
+    now := time.Now()
+    session = Session{
+        UserId:     user.Id,
+        TokenHash:  hashSessionToken(token),
+        Device:     device,
+        Timestamp:  now,
+        LastUsedAt: now,
+        ExpiresAt:  now.Add(SessionLifetime),
+    }
+
+    if err = api.store.createSession(&session); err != nil {
+        return "", session, err
+    }
+    return token, session, nil
+}
+
+// Gets a session from its token, if it's valid and hasn't expired
+func (api *API) getSession(token string) (session Session, ok bool) {
+    session, err := api.store.getSessionByHash(hashSessionToken(token))
+    return session, err == nil && session.ExpiresAt.After(time.Now())
+}
+
+// Gets the user a session token belongs to, if it's valid and hasn't expired
+func (api *API) getSessionUser(token string) (user User, ok bool) {
+    session, ok := api.getSession(token)
+    if !ok {
+        return user, false
+    }
+    user, err := api.store.getUser(session.UserId)
+    if err != nil {
+        return user, false
+    }
+
+    if time.Since(session.LastUsedAt) > SessionLastUsedResolution {
+        session.LastUsedAt = time.Now()
+        api.store.saveSession(&session)
+    }
+    return user, true
+}
+
+// Gets the user's sessions that haven't expired, newest first
+func (api *API) getSessions(user User) (sessions []Session) {
+    now := time.Now()
+    for _, session := range api.store.getSessions(user) {
+        if session.ExpiresAt.After(now) {
+            sessions = append(sessions, session)
+        }
+    }
+    return sessions
+}
+
+// Ends one of the user's sessions.
+func (api *API) deleteSession(user User, sessionId int) error {
+    for _, session := range api.store.getSessions(user) {
+        if session.Id == sessionId {
+            return api.store.deleteSession(session)
+        }
+    }
+    return errors.New("Session not found")
+}
+
+func (session *Session) toPublic(currentId int) PublicSession {
+    return PublicSession{
+        Id:         session.Id,
+        Device:     session.Device,
+        Timestamp:  session.Timestamp,
+        LastUsedAt: session.LastUsedAt,
+        ExpiresAt:  session.ExpiresAt,
+        Current:    session.Id == currentId,
+    }
+}
+
+// Stops an ID token from being used again.
+func (api *API) revokeIDToken(token string, info IdentityInfo) error {
+    return api.store.revokeToken(RevokedToken{
+        TokenHash:  hashSessionToken(token),
+        ExpiresAt:  info.ExpiresAt,
+    })
+}
+
+// Gets whether an ID token has been logged out, either by itself or by its
+// user logging out everywhere after it was issued.
+func (api *API) isIDTokenRevoked(token string, info IdentityInfo) bool {
+    if api.store.isTokenRevoked(hashSessionToken(token)) {
+        return true
+    }
+
+    // iat only has whole seconds, so a token issued in the same second as
+    // logging out everywhere is taken to be from after it
+    revocation, err := api.store.getUserRevocation(info.uid())
+    return err == nil && info.IssuedAt.Before(revocation.RevokedBefore.Truncate(time.Second))
+}
+
+// Logs the user out of every session, and stops every ID token they've been
+// issued so far from working.
+func (api *API) revokeAllSessions(user User) error {
+    return api.store.revokeAllSessions(UserRevocation{UserId: user.Id, RevokedBefore: time.Now().Truncate(time.Second)})
+}
+
+/*
+ * API endpoints
+ */
+
+/*
+ * /sessions endpoint
+ */
+
+func (api *API) sessionsHandler(w http.ResponseWriter, r *http.Request, user User, ok bool) int {
+    log.Println("Handling /sessions")
+
+    var resp interface{}
+
+    switch r.Method {
+    case "POST":
+        decoder := json.NewDecoder(r.Body)
+        var req CreateSessionRequest
+        err := decoder.Decode(&req)
+        if err != nil {
+            log.Println("JSON decoding failed")
+            return http.StatusBadRequest
+        }
+
+        info, err := verifyIDToken(newContext(r), req.IdToken)
+        if err != nil {
+            log.Printf("ID token not valid: %v\n", err)
+            return http.StatusUnauthorized
+        }
+        if api.isIDTokenRevoked(req.IdToken, info) {
+            log.Println("ID token has been revoked")
+            return http.StatusUnauthorized
+        }
+
+        if req.Device == "" {
+            req.Device = r.UserAgent()
+        }
+        resp = api.createSessionEndpoint(info, req.Device)
+    case "DELETE":
+        if !ok {
+            return http.StatusUnauthorized
+        }
+        resp = api.logoutEverywhereEndpoint(user)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * POST /sessions
+ * Signs in with an ID token from Google (or another configured identity
+ * provider), creating the user if they're new.
+ * The returned token goes in the X-Session-Token header of later requests,
+ * until expiresAt.
+ */
+type CreateSessionRequest struct {
+    IdToken     string      `json:"idToken"`
+    // shown in /me/sessions; defaults to the User-Agent
+    Device      string      `json:"device"`
+}
+
+type CreateSessionResponse struct {
+    Success     bool        `json:"success"`
+    Error       string      `json:"error"`
+    Token       string      `json:"token"`
+    ExpiresAt   time.Time   `json:"expiresAt"`
+    User        PublicUser  `json:"user"`
+}
+
+func (api *API) createSessionEndpoint(info IdentityInfo, device string) CreateSessionResponse {
+    // the profile only gets synced from the identity provider here now, not
+    // on every request
+    user := api.getUserFromInfo(info)
+
+    token, session, err := api.createSession(user, device)
+    if err != nil {
+        log.Printf("Creating session failed: %v\n", err)
+        return CreateSessionResponse{
+            Success:    false,
+            Error:      "Could not create session",
+        }
+    }
+
+    return CreateSessionResponse{
+        Success:    true,
+        Token:      token,
+        ExpiresAt:  session.ExpiresAt,
+        User:       user.toPublic(),
+    }
+}
+
+/*
+ * DELETE /sessions
+ * Logs the current user out everywhere: every session ends, and ID tokens
+ * issued before now stop working.
+ */
+type LogoutResponse struct {
+    Success     bool        `json:"success"`
+    Error       string      `json:"error"`
+}
+
+func (api *API) logoutEverywhereEndpoint(user User) LogoutResponse {
+    if err := api.revokeAllSessions(user); err != nil {
+        log.Printf("Revoking sessions failed: %v\n", err)
+        return LogoutResponse{
+            Success:    false,
+            Error:      "Could not log out",
+        }
+    }
+    return LogoutResponse{
+        Success:    true,
+    }
+}
+
+/*
+ * /sessions/current endpoint
+ */
+
+func (api *API) currentSessionHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /sessions/current")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "DELETE":
+        resp = api.logoutEndpoint(newContext(r), user, r.Header.Get("X-Session-Token"))
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * DELETE /sessions/current
+ * Logs out the session (or ID token) making the request.
+ */
+func (api *API) logoutEndpoint(c context.Context, user User, token string) LogoutResponse {
+    if session, ok := api.getSession(token); ok && session.UserId == user.Id {
+        if err := api.store.deleteSession(session); err != nil {
+            log.Printf("Deleting session failed: %v\n", err)
+            return LogoutResponse{
+                Success:    false,
+                Error:      "Could not log out",
+            }
+        }
+        return LogoutResponse{
+            Success:    true,
+        }
+    }
+
+    // older clients use their ID token directly
+    info, err := verifyIDToken(c, token)
+    if err == nil {
+        err = api.revokeIDToken(token, info)
+    }
+    if err != nil {
+        log.Printf("Revoking ID token failed: %v\n", err)
+        return LogoutResponse{
+            Success:    false,
+            Error:      "Could not log out",
+        }
+    }
+    return LogoutResponse{
+        Success:    true,
+    }
+}
+
+/*
+ * /me/sessions endpoint
+ */
+
+func (api *API) mySessionsHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /me/sessions")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "GET":
+        resp = api.listMySessionsEndpoint(user, r.Header.Get("X-Session-Token"))
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * GET /me/sessions
+ * Gets the current user's active sessions, newest first.
+ */
+type ListMySessionsResponse struct {
+    Success     bool            `json:"success"`
+    Error       string          `json:"error"`
+    Sessions    []PublicSession `json:"sessions"`
+}
+
+func (api *API) listMySessionsEndpoint(user User, token string) ListMySessionsResponse {
+    current, _ := api.getSession(token)
+
+    resp := ListMySessionsResponse{
+        Success:    true,
+        Sessions:   []PublicSession{},
+    }
+    for _, session := range api.getSessions(user) {
+        resp.Sessions = append(resp.Sessions, session.toPublic(current.Id))
+    }
+    return resp
+}
+
+/*
+ * /me/sessions/{sessionId} endpoint
+ */
+
+func (api *API) mySessionHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /me/sessions/{sessionId}")
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    vars := mux.Vars(r)
+    sessionId, err := strconv.Atoi(vars["sessionId"])
+    if err != nil || sessionId <= 0 {
+        log.Println("Session ID not positive integer")
+        return http.StatusBadRequest
+    }
+
+    var resp interface{}
+
+    switch r.Method {
+    case "DELETE":
+        resp = api.deleteMySessionEndpoint(user, sessionId)
+    default:
+        return http.StatusMethodNotAllowed
+    }
+
+    sendJSONResponse(w, resp)
+    return http.StatusOK
+}
+
+/*
+ * DELETE /me/sessions/{sessionId}
+ * Logs out one of the current user's sessions, e.g. on a lost device.
+ */
+func (api *API) deleteMySessionEndpoint(user User, sessionId int) LogoutResponse {
+    if err := api.deleteSession(user, sessionId); err != nil {
+        return LogoutResponse{
+            Success:    false,
+            Error:      err.Error(),
+        }
+    }
+    return LogoutResponse{
+        Success:    true,
+    }
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+    "testing"
+    "log"
+    "net/http"
+    "time"
+
+    "golang.org/x/net/context"
+)
+
+func TestSessions(t *testing.T) {
+    defer resetTables()
+
+    info := IdentityInfo{
+        ID:             "1000",
+        DisplayName:    "Tony Abbott",
+        FirstName:      "Tony",
+        LastName:       "Abbott",
+        Email:          "xXx_0n10n_fan_xXx@hotmail.com",
+        Picture:        "tone.jpg",
+    }
+
+    log.Println("Testing creating a session")
+    resp := testAPI.createSessionEndpoint(info, "test")
+    if !resp.Success {
+        t.Fatalf("Creating session failed: %v", resp.Error)
+    }
+    if resp.Token == "" {
+        t.Error("No token returned")
+    }
+    if resp.User.Name != info.DisplayName {
+        t.Errorf("Wrong user returned: %v", resp.User)
+    }
+    if !resp.ExpiresAt.After(time.Now()) {
+        t.Errorf("Session already expired: %v", resp.ExpiresAt)
+    }
+
+    log.Println("Testing the token isn't stored")
+    user := User{Id: resp.User.Id}
+    if sessions := testStore.getSessions(user); len(sessions) != 1 || sessions[0].TokenHash == resp.Token {
+        t.Error("Token stored instead of its hash")
+    }
+
+    log.Println("Testing looking up the session")
+    user, ok := testAPI.getSessionUser(resp.Token)
+    if !ok {
+        t.Fatal("Session not found")
+    }
+    if user.Id != resp.User.Id || user.Uid != info.ID {
+        t.Errorf("Wrong user for session: %v", user)
+    }
+
+    log.Println("Testing getCurrentUser with a session token")
+    r, _ := http.NewRequest("GET", "/me", nil)
+    r.Header.Set("X-Session-Token", resp.Token)
+    if user, ok := testAPI.getCurrentUser(r); !ok || user.Id != resp.User.Id {
+        t.Errorf("getCurrentUser didn't use the session: %v, %v", user, ok)
+    }
+
+    log.Println("Testing unknown tokens")
+    if _, ok := testAPI.getSessionUser("bogus"); ok {
+        t.Error("Unknown token was accepted")
+    }
+    r.Header.Set("X-Session-Token", "bogus")
+    if _, ok := testAPI.getCurrentUser(r); ok {
+        t.Error("getCurrentUser accepted an unknown token")
+    }
+
+    log.Println("Testing a second session for the same user")
+    resp2 := testAPI.createSessionEndpoint(info, "test")
+    if resp2.Token == resp.Token {
+        t.Error("Same token issued twice")
+    }
+    if resp2.User.Id != resp.User.Id {
+        t.Errorf("Second sign in created a new user: %v", resp2.User)
+    }
+    if _, ok := testAPI.getSessionUser(resp.Token); !ok {
+        t.Error("First session stopped working")
+    }
+
+    log.Println("Testing expired sessions")
+    for _, session := range testStore.getSessions(user) {
+        session.ExpiresAt = time.Now().Add(-time.Minute)
+        testStore.saveSession(&session)
+    }
+    if _, ok := testAPI.getSessionUser(resp.Token); ok {
+        t.Error("Expired session was accepted")
+    }
+
+    log.Println("Testing expired sessions are cleaned up")
+    testAPI.createSessionEndpoint(info, "test")
+    if count := len(testStore.getSessions(user)); count != 1 {
+        t.Errorf("1 session expected, found %v", count)
+    }
+}
+
+func TestLogout(t *testing.T) {
+    defer resetTables()
+
+    info := IdentityInfo{
+        ID:             "1000",
+        DisplayName:    "Tony Abbott",
+        FirstName:      "Tony",
+        LastName:       "Abbott",
+        Email:          "xXx_0n10n_fan_xXx@hotmail.com",
+        Picture:        "tone.jpg",
+    }
+    otherInfo := IdentityInfo{
+        ID:             "1001",
+        DisplayName:    "Malcolm Turnbull",
+        FirstName:      "Malcolm",
+        LastName:       "Turnbull",
+        Email:          "pm@gmail.com",
+        Picture:        "hehe",
+    }
+
+    phone := testAPI.createSessionEndpoint(info, "phone")
+    laptop := testAPI.createSessionEndpoint(info, "laptop")
+    other := testAPI.createSessionEndpoint(otherInfo, "phone")
+    user, _ := testAPI.getSessionUser(phone.Token)
+    otherUser, _ := testAPI.getSessionUser(other.Token)
+
+    log.Println("Testing listing sessions")
+    list := testAPI.listMySessionsEndpoint(user, phone.Token)
+    if len(list.Sessions) != 2 {
+        t.Fatalf("2 sessions expected, found %v", len(list.Sessions))
+    }
+    if list.Sessions[0].Device != "laptop" || list.Sessions[1].Device != "phone" {
+        t.Errorf("Sessions weren't newest first: %v", list.Sessions)
+    }
+    if list.Sessions[0].Current || !list.Sessions[1].Current {
+        t.Errorf("Wrong session marked current: %v", list.Sessions)
+    }
+    laptopId := list.Sessions[0].Id
+
+    log.Println("Testing other users can't log out your sessions")
+    if resp := testAPI.deleteMySessionEndpoint(otherUser, laptopId); resp.Success {
+        t.Error("Another user logged out a session")
+    }
+    if _, ok := testAPI.getSessionUser(laptop.Token); !ok {
+        t.Error("Session stopped working after another user tried to log it out")
+    }
+
+    log.Println("Testing logging out another of your sessions")
+    if resp := testAPI.deleteMySessionEndpoint(user, laptopId); !resp.Success {
+        t.Errorf("Logging out session failed: %v", resp.Error)
+    }
+    if _, ok := testAPI.getSessionUser(laptop.Token); ok {
+        t.Error("Logged out session still works")
+    }
+
+    log.Println("Testing logging out the current session")
+    if resp := testAPI.logoutEndpoint(context.Background(), user, phone.Token); !resp.Success {
+        t.Errorf("Logging out failed: %v", resp.Error)
+    }
+    if _, ok := testAPI.getSessionUser(phone.Token); ok {
+        t.Error("Logged out session still works")
+    }
+    if _, ok := testAPI.getSessionUser(other.Token); !ok {
+        t.Error("Logging out affected another user")
+    }
+
+    log.Println("Testing revoking ID tokens")
+    idInfo := info
+    idInfo.IssuedAt = time.Now().Add(-time.Minute)
+    idInfo.ExpiresAt = time.Now().Add(time.Hour)
+    if testAPI.isIDTokenRevoked("some.id.token", idInfo) {
+        t.Error("ID token revoked before logging out")
+    }
+    if err := testAPI.revokeIDToken("some.id.token", idInfo); err != nil {
+        t.Errorf("Revoking ID token failed: %v", err)
+    }
+    if err := testAPI.revokeIDToken("some.id.token", idInfo); err != nil {
+        t.Errorf("Revoking ID token twice failed: %v", err)
+    }
+    if !testAPI.isIDTokenRevoked("some.id.token", idInfo) {
+        t.Error("Revoked ID token still works")
+    }
+    if testAPI.isIDTokenRevoked("another.id.token", idInfo) {
+        t.Error("Revoking an ID token affected another one")
+    }
+
+    log.Println("Testing logging out everywhere")
+    phone = testAPI.createSessionEndpoint(info, "phone")
+    laptop = testAPI.createSessionEndpoint(info, "laptop")
+    if resp := testAPI.logoutEverywhereEndpoint(user); !resp.Success {
+        t.Errorf("Logging out everywhere failed: %v", resp.Error)
+    }
+    if _, ok := testAPI.getSessionUser(phone.Token); ok {
+        t.Error("Session still works after logging out everywhere")
+    }
+    if _, ok := testAPI.getSessionUser(laptop.Token); ok {
+        t.Error("Session still works after logging out everywhere")
+    }
+    if _, ok := testAPI.getSessionUser(other.Token); !ok {
+        t.Error("Logging out everywhere affected another user")
+    }
+    if !testAPI.isIDTokenRevoked("old.id.token", idInfo) {
+        t.Error("ID token issued before logging out everywhere still works")
+    }
+    newInfo := idInfo
+    newInfo.IssuedAt = time.Now().Add(time.Second)
+    if testAPI.isIDTokenRevoked("new.id.token", newInfo) {
+        t.Error("ID token issued after logging out everywhere doesn't work")
+    }
+
+    log.Println("Testing ID tokens issued in the same second as logging out everywhere")
+    revocation, err := testStore.getUserRevocation(info.uid())
+    if err != nil {
+        t.Fatalf("Getting revocation failed: %v", err)
+    }
+    // signing straight back in gets a token with the same iat
+    newInfo.IssuedAt = time.Unix(revocation.RevokedBefore.Unix(), 0)
+    if testAPI.isIDTokenRevoked("same.second.id.token", newInfo) {
+        t.Error("ID token issued in the same second as logging out everywhere doesn't work")
+    }
+}
+
+func TestRevokeAllSessionsStore(t *testing.T) {
+    defer resetTables()
+
+    user := User{Uid: "1000", Name: "Tony Abbott"}
+    testStore.createUser(&user)
+
+    log.Println("Testing revoking a user who's never been revoked")
+    if _, err := testStore.getUserRevocation(user.Uid); err != errNotFound {
+        t.Errorf("Expected no revocation, got %v", err)
+    }
+    first := time.Now().Add(-time.Hour).Truncate(time.Second)
+    if err := testStore.revokeAllSessions(UserRevocation{UserId: user.Id, RevokedBefore: first}); err != nil {
+        t.Fatalf("Revoking failed: %v", err)
+    }
+    revocation, err := testStore.getUserRevocation(user.Uid)
+    if err != nil || !revocation.RevokedBefore.Equal(first) {
+        t.Errorf("Revocation wasn't saved: %v %v", revocation, err)
+    }
+
+    log.Println("Testing revoking them again")
+    second := first.Add(time.Minute)
+    if err := testStore.revokeAllSessions(UserRevocation{UserId: user.Id, RevokedBefore: second}); err != nil {
+        t.Fatalf("Revoking again failed: %v", err)
+    }
+    revocation, err = testStore.getUserRevocation(user.Uid)
+    if err != nil || !revocation.RevokedBefore.Equal(second) {
+        t.Errorf("Revocation wasn't updated: %v %v", revocation, err)
+    }
+}
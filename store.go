@@ -0,0 +1,145 @@
+package main
+
+import (
+    "errors"
+)
+
+// Returned by Store lookups when there's nothing there
+var errNotFound = errors.New("Not found")
+
+// Store is where everything the API keeps is stored.
+// Handlers get one through their API, rather than talking to a database
+// directly, so it can be swapped out.
+type Store interface {
+    /*
+     * Users
+     */
+    getUser(id int) (User, error)
+    getUserByUid(uid string) (User, error)
+    // fills in user.Id, unless it's already set
+    createUser(user *User) error
+    saveUser(user *User) error
+    // deletes the user along with their friendships, friend requests, API
+    // keys, group memberships, conversations and read markers; their
+    // messages stay
+    deleteUser(user User) error
+    // case insensitive, exact match
+    searchUsersByEmail(email string, exceptId int) Users
+    // case insensitive, matching anywhere in the name
+    searchUsersByName(name string, exceptId int) Users
+    // gets the bots owned by the user, in the order they were created
+    getBots(owner User) Users
+
+    /*
+     * Friends
+     */
+    // sorted by time of last message sent/received, then alphabetically by
+    // display name
+    getFriends(user User) Users
+    addFriend(user User, friend User) error
+    deleteFriend(user User, friend User) error
+    isFriend(user User, friend User) bool
+
+    /*
+     * Friend requests, to user from requestor
+     */
+    getFriendRequests(user User) Users
+    addFriendRequest(user User, requestor User) error
+    hasFriendRequest(user User, requestor User) bool
+    deleteFriendRequest(user User, requestor User) error
+
+    /*
+     * Messages
+     */
+    // fills in msg.Id and msg.ConversationKey, and keeps the conversations of
+    // messages between users up to date
+    addMessage(msg *Message) error
+    getMessage(id int) (Message, error)
+    saveMessage(msg *Message) error
+    // the amount messages before last (or the latest, if last is -1),
+    // oldest first
+    getMessagesWithUser(user User, otherUser User, last int, amount int) Messages
+    getGroupMessages(group Group, last int, amount int) Messages
+    // the amount messages after after, oldest first
+    getMessagesWithUserAfter(user User, otherUser User, after int, amount int) Messages
+    getGroupMessagesAfter(group Group, after int, amount int) Messages
+    // gets the first message the user received after afterId, either
+    // directly or through one of their groups
+    getNextMessageAfterId(user User, afterId int) (Message, bool)
+    // gets the id of the last message otherUser sent the user, or 0 if there
+    // isn't one
+    lastMessageIdFromUser(user User, otherUser User) int
+    getConversation(user User, otherUser User) (Conversation, error)
+    // gets the unread count and last message of each of the user's
+    // conversations with their friends, keyed by friend id
+    getConversationSummaries(user User) map[int]ConversationSummary
+
+    /*
+     * Read markers
+     */
+    // LastReadId is 0 if the user hasn't read anything
+    getReadMarker(user User, otherUser User) ReadMarker
+    // saves the marker, unless the stored one is already further along
+    advanceReadMarker(marker ReadMarker) error
+
+    /*
+     * Groups
+     */
+    getGroup(id int) (Group, error)
+    getGroups(user User) Groups
+    // fills in group.Id, and adds its creator as its first member, then the
+    // other members; all or nothing
+    createGroup(group *Group, members Users) error
+    getGroupMembers(group Group) Users
+    isGroupMember(group Group, user User) bool
+    addGroupMember(group Group, user User) error
+    removeGroupMember(group Group, user User) error
+
+    /*
+     * Sessions and revoked tokens
+     */
+    // also deletes the user's expired sessions
+    createSession(session *Session) error
+    getSessionByHash(tokenHash string) (Session, error)
+    // gets every one of the user's sessions, expired or not, newest first
+    getSessions(user User) []Session
+    saveSession(session *Session) error
+    deleteSession(session Session) error
+    // also deletes expired revoked tokens; revoking a token twice is fine
+    revokeToken(revoked RevokedToken) error
+    isTokenRevoked(tokenHash string) bool
+    getUserRevocation(uid string) (UserRevocation, error)
+    // deletes all the user's sessions along with saving the revocation
+    revokeAllSessions(revocation UserRevocation) error
+
+    /*
+     * API keys
+     */
+    createAPIKey(key *APIKey) error
+    getAPIKeyByHash(keyHash string) (APIKey, error)
+    getAPIKeys(bot User) []APIKey
+    getAPIKey(bot User, keyId int) (APIKey, error)
+    saveAPIKey(key *APIKey) error
+    deleteAPIKey(key APIKey) error
+
+    close() error
+}
+
+// Opens the store the config asks for: "memory" for one that keeps
+// everything in memory, or a database dialect for gorm. Database tables are
+// created/migrated.
+func openStore(storeType string, connectionString string) (Store, error) {
+    if storeType == "memory" {
+        return newMemoryStore(), nil
+    }
+
+    store, err := openGormStore(storeType, connectionString)
+    if err != nil {
+        return nil, err
+    }
+    if err := store.migrate(); err != nil {
+        store.close()
+        return nil, err
+    }
+    return store, nil
+}
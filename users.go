@@ -4,9 +4,7 @@ import (
     "errors"
     "log"
     "net/http"
-    "sort"
     "strconv"
-    "strings"
     "time"
     "regexp"
 
@@ -25,6 +23,9 @@ type User struct {
     LastName  string
     Email     string
     Picture   string
+    // bots are created by their owner and sign in with API keys
+    IsBot     bool      `sql:"not null"`
+    OwnerId   int       `sql:"index"`
 }
 
 // Represents one-way friendship in the database
@@ -51,133 +52,17 @@ type PublicUser struct {
     FirstName   string  `json:"firstName"`
     LastName    string  `json:"lastName"`
     Picture     string  `json:"picture"`
+    IsBot       bool    `json:"isBot"`
 }
 
-// types, just for getFriends sorting (go pls ;_;)
-type Friends struct {
-    User    User
-    Friend  User
-}
-type FriendsByTime []Friends
-func (a FriendsByTime) Len() int {
-    return len(a)
-}
-func (a FriendsByTime) Swap(i, j int) {
-    a[i], a[j] = a[j], a[i]
-}
-func (a FriendsByTime) Less(i, j int) bool {
-    // sort by time; if they're equal, then by display name, alphabetical
-    ts_i := a[i].User.timeOfLastMessageWithUser(a[i].Friend)
-    ts_j := a[j].User.timeOfLastMessageWithUser(a[j].Friend)
-    if ts_i.Equal(ts_j) {
-        return a[i].Friend.Name < a[j].Friend.Name
-    }
-    return ts_j.Before(ts_i)
-}
-
-// gets list of user's friends, sorted by time of last message sent/received
-func (user *User) getFriends() Users {
-    friends := []User{}
-    db.Joins("inner join user_friends on friend_id = id").Where(&UserFriend{UserId: user.Id}).Find(&friends)
-
-    // sort
-    var friendsByTime FriendsByTime
-    for _, friend := range friends {
-        friendsByTime = append(friendsByTime, Friends{User: *user, Friend: friend})
-    }
-    sort.Sort(friendsByTime)
-
-    sortedFriends := []User{}
-    for _, friendByTime := range friendsByTime {
-        sortedFriends = append(sortedFriends, friendByTime.Friend)
-    }
-
-    return sortedFriends
-}
-
-func (user *User) addFriend(friend User) error {
-    if user.Id == friend.Id {
-        return errors.New("Cannot add yourself as a friend")
-    }
-
-    tx := db.Begin()
-
-    userFriend := UserFriend{UserId: user.Id, FriendId: friend.Id}
-    if err := tx.Create(&userFriend).Error; err != nil {
-        tx.Rollback()
-        return err
-    }
-
-    userFriend = UserFriend{UserId: friend.Id, FriendId: user.Id}
-    if err := tx.Create(&userFriend).Error; err != nil {
-        tx.Rollback()
-        return err
-    }
-
-    tx.Commit()
-    return nil
-}
-
-func (user *User) deleteFriend(friend User) error {
-    var uf1, uf2 UserFriend
-
-    // check two-way friendship exists
-    if err := db.Where(&UserFriend{UserId: user.Id, FriendId: friend.Id}).First(&uf1).Error; err != nil {
-        return err
-    }
-    if err := db.Where(&UserFriend{UserId: friend.Id, FriendId: user.Id}).First(&uf2).Error; err != nil {
-        return err
-    }
-
-    tx := db.Begin()
-
-    // do actual deleting
-    if err := db.Where("user_id = ? and friend_id = ?", user.Id, friend.Id).Delete(UserFriend{}).Error; err != nil {
-        tx.Rollback()
-        return err
-    }
-    if err := db.Where("friend_id = ? and user_id = ?", user.Id, friend.Id).Delete(UserFriend{}).Error; err != nil {
-        tx.Rollback()
-        return err
-    }
-
-    tx.Commit()
-    return nil
-}
-
-func (user *User) isFriend(friend User) bool {
-    var uf UserFriend
-    if err := db.Where(&UserFriend{UserId: user.Id, FriendId: friend.Id}).Find(&uf).Error; err != nil {
-        return false
-    }
-    return true
-}
-
-// get friend requests sent to a user
-func (user *User) getFriendRequests() Users {
-    requestors := []User{}
-    db.Joins("inner join friend_requests on requestor_id = id").Where(&UserFriend{UserId: user.Id}).Find(&requestors)
-    return requestors
-}
-
-// add a friend request to user from requestor
-func (user *User) addFriendRequest(requestor User) error {
-    if user.Id == requestor.Id {
-        return errors.New("Cannot request to be your own friend")
-    }
-
-    err := db.Create(&FriendRequest{UserId: user.Id, RequestorId: requestor.Id}).Error
-
-    return err
-}
-
-// get whether a friend request has been sent from requestor to user
-func (user *User) hasFriendRequest(requestor User) bool {
-    var friendRequest FriendRequest
-    if err := db.Where(&FriendRequest{UserId: user.Id, RequestorId: requestor.Id}).Find(&friendRequest).Error; err != nil {
-        return false
-    }
-    return true
+// Represents the latest message between two users, for sorting friends
+// Like UserFriend, there's a row for each direction, kept up to date by
+// the store as messages are added
+type Conversation struct {
+    UserId          int         `gorm:"primary_key"`
+    FriendId        int         `gorm:"primary_key"`
+    LastMessageId   int         `sql:"not null"`
+    LastMessageTime time.Time   `sql:"not null"`
 }
 
 func (user *User) toPublic() PublicUser {
@@ -188,6 +73,7 @@ func (user *User) toPublic() PublicUser {
         FirstName:  user.FirstName,
         LastName:   user.LastName,
         Picture:    user.Picture,
+        IsBot:      user.IsBot,
     }
 }
 
@@ -204,37 +90,13 @@ func (m Messages) reverse() {
     }
 }
 
-func (user *User) timeOfLastMessageWithUser(otherUser User) (ts time.Time) {
-    msgs := user.getMessagesWithUser(otherUser, -1, 1)
-    if len(msgs) > 0 {
-        ts = msgs[0].Timestamp
-    }
-    return ts
-}
-
-func (user *User) getMessagesWithUser(otherUser User, last int, amount int) (msgs Messages) {
-    if last == -1 {
-        db.Where("((sender_id = ? and recipient_id = ?) or (sender_id = ? and recipient_id = ?))", user.Id, otherUser.Id, otherUser.Id, user.Id).Order("id desc").Limit(amount).Find(&msgs)
-    } else {
-        db.Where("((sender_id = ? and recipient_id = ?) or (sender_id = ? and recipient_id = ?)) and id < ?", user.Id, otherUser.Id, otherUser.Id, user.Id, last).Order("id desc").Limit(amount).Find(&msgs)
-    }
-    msgs.reverse()
-    
-    return msgs
-}
-
-// Gets next message (i.e. with a greater ID than afterId) that the user has received
-func (user *User) getNextMessageAfterId(afterId int) (msg Message, ok bool) {
-    if err := db.Where("recipient_id = ? and id > ?", user.Id, afterId).First(&msg).Error; err == nil {
-        return msg, true
-    }
-    return Message{}, false
-}
-
-func (user *User) addMessageToUser(otherUser User, content string, contentType ContentType) (msg Message, err error) {
+func (api *API) addMessageToUser(user User, otherUser User, content string, contentType ContentType) (msg Message, err error) {
     if !contentType.valid() {
         return msg, errors.New("Invalid content type")
     }
+    if err := checkMessageLength(content); err != nil {
+        return msg, err
+    }
 
     msg = Message{
         Content:        content,
@@ -245,7 +107,9 @@ func (user *User) addMessageToUser(otherUser User, content string, contentType C
         Timestamp:      time.Now(),
     }
 
-    db.Create(&msg)
+    if err := api.store.addMessage(&msg); err != nil {
+        return msg, err
+    }
 
     return msg, nil
 }
@@ -253,57 +117,86 @@ func (user *User) addMessageToUser(otherUser User, content string, contentType C
 /*
  * DB manipulation functions
  */
-func getUserFromInfo(info GoogleInfo) (user User) {
-    log.Printf("Getting user %v\n", info.ID)
+func (api *API) getUserFromInfo(info IdentityInfo) (user User) {
+    uid := info.uid()
+    log.Printf("Getting user %v\n", uid)
 
     // check if user already exists
-    if err := db.Where(&User{Uid: info.ID}).First(&user).Error; err != nil {
+    var err error
+    if user, err = api.store.getUserByUid(uid); err != nil {
         // create user
         log.Println("Creating new user in db")
         user = User{
-            Uid:        info.ID,
+            Uid:        uid,
             Name:       info.DisplayName,
             FirstName:  info.FirstName,
             LastName:   info.LastName,
             Email:      info.Email,
             Picture:    info.Picture,
         }
-        db.Create(&user)
+        api.store.createUser(&user)
     } else {
         log.Println("Updating existing user in db")
         // update things from the info, in case they've changed
-        user.Uid = info.ID
+        oldUser := user
+        user.Uid = uid
         user.Name = info.DisplayName
         user.FirstName = info.FirstName
         user.LastName = info.LastName
         user.Email = info.Email
         user.Picture = info.Picture
-        db.Save(&user)
+        api.store.saveUser(&user)
+
+        if user != oldUser {
+            // let their friends (and their other devices) know
+            event := newEvent(EventTypeProfileUpdated, user.toPublic())
+            for _, friend := range api.store.getFriends(user) {
+                sendEvent(friend.Id, event)
+            }
+            sendEvent(user.Id, event)
+        }
     }
 
     return user
 }
 
-func getCurrentUser(r *http.Request) (user User, ok bool) {
-    info, authenticated := getAuthInfo(r)
+func (api *API) getCurrentUser(r *http.Request) (user User, ok bool) {
+    // bots use API keys
+    if key := getBearerToken(r); key != "" {
+        user, ok = api.getAPIKeyUser(r, key)
+        if !ok {
+            log.Println("Not authenticated")
+        }
+        return user, ok
+    }
+
+    if token := r.Header.Get("X-Session-Token"); token != "" {
+        if user, ok = api.getSessionUser(token); ok {
+            return user, true
+        }
+    }
+
+    // older clients send an ID token with every request instead of
+    // getting a session from POST /sessions
+    info, authenticated := api.getAuthInfo(r)
     if !authenticated {
         log.Println("Not authenticated")
         return user, false
     }
 
-    user = getUserFromInfo(info)
+    user = api.getUserFromInfo(info)
     return user, true
 }
 
 // search for users by name or by email
-func searchUsernames(q string, userid int) (users Users) {
+func (api *API) searchUsernames(q string, userid int) (users Users) {
     // check if q looks like an email
     if match, _ := regexp.MatchString(".+@.+\\..+", q); match {
         // search by email
-        db.Where("upper(email) = ? and id != ?", strings.ToUpper(q), userid).Find(&users)
+        users = api.store.searchUsersByEmail(q, userid)
     } else {
         // search by name
-        db.Where("upper(name) LIKE ? and id != ?", "%%"+strings.ToUpper(q)+"%%", userid).Find(&users)
+        users = api.store.searchUsersByName(q, userid)
     }
     return users
 }
@@ -316,9 +209,9 @@ func searchUsernames(q string, userid int) (users Users) {
  * /friends endpoint
  */
 
-func friendsHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) friendsHandler(w http.ResponseWriter, r *http.Request) int {
     log.Println("Handling /friends")
-    user, ok := getCurrentUser(r)
+    user, ok := api.getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -327,7 +220,7 @@ func friendsHandler(w http.ResponseWriter, r *http.Request) int {
 
     switch r.Method {
     case "GET":
-        resp = listFriendsEndpoint(user)
+        resp = api.listFriendsEndpoint(user)
     default:
         return http.StatusMethodNotAllowed
     }
@@ -338,20 +231,38 @@ func friendsHandler(w http.ResponseWriter, r *http.Request) int {
 
 /*
  * GET /friends
- * Gets a list of the current user's friends.
+ * Gets a list of the current user's friends, with the number of messages
+ * from each that the user hasn't read and the last message between them.
  */
+type FriendWithConversation struct {
+    PublicUser
+    UnreadCount int         `json:"unreadCount"`
+    LastMessage *Message    `json:"lastMessage"`
+}
+
 type ListFriendsResponse struct {
-    Success bool            `json:"success"`
-    Friends []PublicUser    `json:"friends"`
+    Success bool                        `json:"success"`
+    Friends []FriendWithConversation    `json:"friends"`
 }
 
-func listFriendsEndpoint(user User) ListFriendsResponse {
+func (api *API) listFriendsEndpoint(user User) ListFriendsResponse {
     var friends Users
-    friends = user.getFriends()
+    friends = api.store.getFriends(user)
+
+    summaries := api.store.getConversationSummaries(user)
 
     resp := ListFriendsResponse{
         Success:    true,
-        Friends:    friends.toPublic(),
+        Friends:    []FriendWithConversation{},
+    }
+
+    for _, friend := range friends {
+        summary := summaries[friend.Id]
+        resp.Friends = append(resp.Friends, FriendWithConversation{
+            PublicUser:     friend.toPublic(),
+            UnreadCount:    summary.UnreadCount,
+            LastMessage:    summary.LastMessage,
+        })
     }
 
     return resp
@@ -361,9 +272,9 @@ func listFriendsEndpoint(user User) ListFriendsResponse {
  * /friends/{friendId} endpoint
  */
 
-func friendHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) friendHandler(w http.ResponseWriter, r *http.Request) int {
     log.Println("Handling /friend/{friendId}")
-    user, ok := getCurrentUser(r)
+    user, ok := api.getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -379,9 +290,9 @@ func friendHandler(w http.ResponseWriter, r *http.Request) int {
 
     switch r.Method {
     case "GET":
-        resp = getFriendEndpoint(user, friendId)
+        resp = api.getFriendEndpoint(user, friendId)
     case "DELETE":
-        resp = deleteFriendEndpoint(user, friendId)
+        resp = api.deleteFriendEndpoint(user, friendId)
     default:
         return http.StatusMethodNotAllowed
     }
@@ -400,7 +311,7 @@ type GetFriendResponse struct {
     Friend  PublicUser  `json:"friend"`
 }
 
-func getFriendEndpoint(user User, friendId int) GetFriendResponse {
+func (api *API) getFriendEndpoint(user User, friendId int) GetFriendResponse {
     if friendId == user.Id {
         return GetFriendResponse{
             Success:    false,
@@ -408,8 +319,7 @@ func getFriendEndpoint(user User, friendId int) GetFriendResponse {
         }
     }
 
-    var friend User
-    dbErr := db.Where(&User{Id: friendId}).First(&friend).Error
+    friend, dbErr := api.store.getUser(friendId)
 
     if dbErr != nil {
         // friend not found
@@ -419,7 +329,7 @@ func getFriendEndpoint(user User, friendId int) GetFriendResponse {
         }
     }
 
-    if !user.isFriend(friend) {
+    if !api.store.isFriend(user, friend) {
         return GetFriendResponse{
             Success:    false,
             Error:      "User is not your friend",
@@ -441,7 +351,7 @@ type DeleteFriendResponse struct {
     Error   string  `json:"error"`
 }
 
-func deleteFriendEndpoint(user User, friendId int) DeleteFriendResponse {
+func (api *API) deleteFriendEndpoint(user User, friendId int) DeleteFriendResponse {
     if friendId == user.Id {
         return DeleteFriendResponse{
             Success:    false,
@@ -449,8 +359,7 @@ func deleteFriendEndpoint(user User, friendId int) DeleteFriendResponse {
         }
     }
 
-    var friend User
-    dbErr := db.Where(&User{Id: friendId}).First(&friend).Error
+    friend, dbErr := api.store.getUser(friendId)
 
     if dbErr != nil {
         return DeleteFriendResponse{
@@ -459,7 +368,7 @@ func deleteFriendEndpoint(user User, friendId int) DeleteFriendResponse {
         }
     }
 
-    if !user.isFriend(friend) {
+    if !api.store.isFriend(user, friend) {
         return DeleteFriendResponse{
             Success:    false,
             Error:      "User is not your friend",
@@ -467,13 +376,15 @@ func deleteFriendEndpoint(user User, friendId int) DeleteFriendResponse {
     }
 
     // actually delete the friend
-    if err := user.deleteFriend(friend); err != nil {
+    if err := api.store.deleteFriend(user, friend); err != nil {
         return DeleteFriendResponse{
             Success:    false,
             Error:      err.Error(),
         }
     }
 
+    sendEvent(friend.Id, newEvent(EventTypeFriendRemoved, user.toPublic()))
+
     return DeleteFriendResponse{
         Success:    true,
     }
@@ -483,9 +394,9 @@ func deleteFriendEndpoint(user User, friendId int) DeleteFriendResponse {
  * /users endpoint
  */
 
-func usersHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) usersHandler(w http.ResponseWriter, r *http.Request) int {
     log.Println("Handling /users")
-    user, ok := getCurrentUser(r)
+    user, ok := api.getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -495,7 +406,7 @@ func usersHandler(w http.ResponseWriter, r *http.Request) int {
     switch r.Method {
     case "GET":
         q := r.FormValue("q")
-        resp = listUsersEndpoint(q, user.Id)
+        resp = api.listUsersEndpoint(q, user.Id)
     default:
         return http.StatusMethodNotAllowed
     }
@@ -508,9 +419,9 @@ func usersHandler(w http.ResponseWriter, r *http.Request) int {
  * /me endpoint
  */
 
-func meHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) meHandler(w http.ResponseWriter, r *http.Request) int {
     log.Println("Handling /me")
-    user, ok := getCurrentUser(r)
+    user, ok := api.getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -519,7 +430,7 @@ func meHandler(w http.ResponseWriter, r *http.Request) int {
 
     switch r.Method {
     case "GET":
-        resp = getMeEndpoint(user)
+        resp = api.getMeEndpoint(user)
     default:
         return http.StatusMethodNotAllowed
     }
@@ -537,9 +448,9 @@ type ListUsersResponse struct {
     Users []PublicUser      `json:"users"`
 }
 
-func listUsersEndpoint(q string, userid int) ListUsersResponse {
+func (api *API) listUsersEndpoint(q string, userid int) ListUsersResponse {
     var users Users
-    users = searchUsernames(q, userid)
+    users = api.searchUsernames(q, userid)
 
     resp := ListUsersResponse{
         Success:    true,
@@ -559,7 +470,7 @@ type GetMeResponse struct {
     User    PublicUser  `json:"user"`
 }
 
-func getMeEndpoint(currentUser User) GetMeResponse {
+func (api *API) getMeEndpoint(currentUser User) GetMeResponse {
     return GetMeResponse{
         Success:    true,
         Error:      "",
@@ -571,9 +482,9 @@ func getMeEndpoint(currentUser User) GetMeResponse {
  * /friendrequests endpoint
  */
 
-func myFriendRequestsHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) myFriendRequestsHandler(w http.ResponseWriter, r *http.Request) int {
     log.Println("Handling /friendrequests")
-    user, ok := getCurrentUser(r)
+    user, ok := api.getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -582,7 +493,7 @@ func myFriendRequestsHandler(w http.ResponseWriter, r *http.Request) int {
 
     switch r.Method {
     case "GET":
-        resp = listMyFriendRequestsEndpoint(user)
+        resp = api.listMyFriendRequestsEndpoint(user)
     default:
         return http.StatusMethodNotAllowed
     }
@@ -600,9 +511,9 @@ type ListMyFriendRequestsResponse struct {
     Requestors []PublicUser    `json:"requestors"`
 }
 
-func listMyFriendRequestsEndpoint(user User) ListMyFriendRequestsResponse {
+func (api *API) listMyFriendRequestsEndpoint(user User) ListMyFriendRequestsResponse {
     var requestors Users
-    requestors = user.getFriendRequests()
+    requestors = api.store.getFriendRequests(user)
 
     resp := ListMyFriendRequestsResponse{
         Success:    true,
@@ -616,9 +527,9 @@ func listMyFriendRequestsEndpoint(user User) ListMyFriendRequestsResponse {
  * /friendrequests/{requestorId} endpoint
  */
 
-func myFriendRequestHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) myFriendRequestHandler(w http.ResponseWriter, r *http.Request) int {
     log.Println("Handling /friendrequests/{requestorId}")
-    user, ok := getCurrentUser(r)
+    user, ok := api.getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -634,9 +545,9 @@ func myFriendRequestHandler(w http.ResponseWriter, r *http.Request) int {
 
     switch r.Method {
     case "DELETE":
-        resp = modifyMyFriendRequestEndpoint(user, requestorId, "decline")
+        resp = api.modifyMyFriendRequestEndpoint(user, requestorId, "decline")
     case "PUT":
-        resp = modifyMyFriendRequestEndpoint(user, requestorId, "accept")
+        resp = api.modifyMyFriendRequestEndpoint(user, requestorId, "accept")
     default:
         return http.StatusMethodNotAllowed
     }
@@ -659,7 +570,7 @@ type ModifyMyFriendRequestResponse struct {
     Error   string  `json:"error"`
 }
 
-func modifyMyFriendRequestEndpoint(user User, requestorId int, action string) ModifyMyFriendRequestResponse {
+func (api *API) modifyMyFriendRequestEndpoint(user User, requestorId int, action string) ModifyMyFriendRequestResponse {
     // check if the current user and the specified user are the same
     if requestorId == user.Id {
         return ModifyMyFriendRequestResponse{
@@ -669,8 +580,7 @@ func modifyMyFriendRequestEndpoint(user User, requestorId int, action string) Mo
     }
 
     // get the user from the ID
-    var requestor User
-    dbErr := db.Where(&User{Id: requestorId}).First(&requestor).Error
+    requestor, dbErr := api.store.getUser(requestorId)
 
     // check if the user exists
     if dbErr != nil {
@@ -681,7 +591,7 @@ func modifyMyFriendRequestEndpoint(user User, requestorId int, action string) Mo
     }
 
     // check if the request exists
-    if !user.hasFriendRequest(requestor) {
+    if !api.store.hasFriendRequest(user, requestor) {
         return ModifyMyFriendRequestResponse{
             Success:    false,
             Error:      "User has not requested to be your friend",
@@ -690,7 +600,7 @@ func modifyMyFriendRequestEndpoint(user User, requestorId int, action string) Mo
 
     if action == "accept" {
         // add the friend
-        if err := user.addFriend(requestor); err != nil {
+        if err := api.store.addFriend(user, requestor); err != nil {
             return ModifyMyFriendRequestResponse{
                 Success:    false,
                 Error:      err.Error(),
@@ -699,7 +609,14 @@ func modifyMyFriendRequestEndpoint(user User, requestorId int, action string) Mo
     }
 
     // delete the request
-    db.Where("user_id = ? and requestor_id = ?", user.Id, requestor.Id).Delete(FriendRequest{})
+    api.store.deleteFriendRequest(user, requestor)
+
+    // let the requestor know what happened to their request
+    eventType := EventTypeFriendRequestDeclined
+    if action == "accept" {
+        eventType = EventTypeFriendRequestAccepted
+    }
+    sendEvent(requestor.Id, newEvent(eventType, user.toPublic()))
 
     return ModifyMyFriendRequestResponse{
         Success:    true,
@@ -710,9 +627,8 @@ func modifyMyFriendRequestEndpoint(user User, requestorId int, action string) Mo
  * /users/{userId}/friendrequests endpoint
  */
 
-func othersFriendRequestHandler(w http.ResponseWriter, r *http.Request) int {
+func (api *API) othersFriendRequestHandler(w http.ResponseWriter, r *http.Request, user User, ok bool) int {
     log.Println("Handling /users/{userId}/friendrequests")
-    user, ok := getCurrentUser(r)
     if !ok {
         return http.StatusUnauthorized
     }
@@ -728,7 +644,7 @@ func othersFriendRequestHandler(w http.ResponseWriter, r *http.Request) int {
 
     switch r.Method {
     case "POST":
-        resp = addOthersFriendRequestEndpoint(user, userId)
+        resp = api.addOthersFriendRequestEndpoint(user, userId)
     default:
         return http.StatusMethodNotAllowed
     }
@@ -747,9 +663,8 @@ type AddOthersFriendRequestResponse struct {
     Error   string      `json:"error"`
 }
 
-func addOthersFriendRequestEndpoint(user User, requestedId int) AddOthersFriendRequestResponse {
-    var requestedFriend User
-    dbErr := db.Where(&User{Id: requestedId}).First(&requestedFriend).Error
+func (api *API) addOthersFriendRequestEndpoint(user User, requestedId int) AddOthersFriendRequestResponse {
+    requestedFriend, dbErr := api.store.getUser(requestedId)
 
     if dbErr != nil {
         // friend they are requesting not found
@@ -759,7 +674,7 @@ func addOthersFriendRequestEndpoint(user User, requestedId int) AddOthersFriendR
     }
 
     // check if they are already friends
-    if requestedFriend.isFriend(user) {
+    if api.store.isFriend(requestedFriend, user) {
         return AddOthersFriendRequestResponse{
             Success:    false,
             Error:      "User is already your friend",
@@ -767,7 +682,7 @@ func addOthersFriendRequestEndpoint(user User, requestedId int) AddOthersFriendR
     }
 
     // check if the request exists
-    if requestedFriend.hasFriendRequest(user) {
+    if api.store.hasFriendRequest(requestedFriend, user) {
         return AddOthersFriendRequestResponse{
             Success:    false,
             Error:      "User already has a friend request from you",
@@ -775,14 +690,31 @@ func addOthersFriendRequestEndpoint(user User, requestedId int) AddOthersFriendR
     }
 
     // check if the opposite request exists
-    if user.hasFriendRequest(requestedFriend) {
+    if api.store.hasFriendRequest(user, requestedFriend) {
         return AddOthersFriendRequestResponse{
             Success:    false,
             Error:      "You already have a friend request from that user",
         }
     }
+
+    // bots can't accept friend requests, so adding one is all it takes
+    if requestedFriend.IsBot {
+        if user.IsBot {
+            return AddOthersFriendRequestResponse{
+                Success:    false,
+                Error:      "Bots can't be friends with other bots",
+            }
+        }
+        if err := api.store.addFriend(user, requestedFriend); err != nil {
+            return AddOthersFriendRequestResponse{
+                Success: false,
+                Error:   err.Error()}
+        }
+        sendEvent(user.Id, newEvent(EventTypeFriendRequestAccepted, requestedFriend.toPublic()))
+        return AddOthersFriendRequestResponse{Success: true}
+    }
     
-    addErr := requestedFriend.addFriendRequest(user)
+    addErr := api.store.addFriendRequest(requestedFriend, user)
 
     if addErr != nil {
         return AddOthersFriendRequestResponse{
@@ -790,5 +722,7 @@ func addOthersFriendRequestEndpoint(user User, requestedId int) AddOthersFriendR
             Error:   addErr.Error()}
     }
 
+    sendEvent(requestedFriend.Id, newEvent(EventTypeFriendRequestReceived, user.toPublic()))
+
     return AddOthersFriendRequestResponse{Success: true}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
     "fmt"
+    "sync"
     "testing"
     "time"
     "log"
@@ -20,7 +21,7 @@ func TestCreatingUsers(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 1")
-    db.Create(&testUser1)
+    testStore.createUser(&testUser1)
 
     testUser2 := User{
         Id:        12346,
@@ -32,18 +33,16 @@ func TestCreatingUsers(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&testUser2)
+    testStore.createUser(&testUser2)
 
     log.Println("Accessing test user 1")
-    user1 := User{}
-    db.Where(&User{Id: 12345}).First(&user1)
+    user1, _ := testStore.getUser(12345)
     if user1 != testUser1 {
         t.Error("User accessed not the same as user inserted")
     }
 
     log.Println("Accessing test user 2")
-    user2 := User{}
-    db.Where(&User{Id: 12346}).First(&user2)
+    user2, _ := testStore.getUser(12346)
     if user2 != testUser2 {
         t.Error("User accessed not the same as user inserted")
     }
@@ -53,26 +52,69 @@ func TestDeletingUsers(t *testing.T) {
     defer resetTables()
 
     log.Println("Deleting test user 1")
-    db.Where(&User{Id: 12345}).Delete(User{})
+    testStore.deleteUser(User{Id: 12345})
 
     log.Println("Accessing test user 1")
-    user1 := User{}
-    db.Where(&User{Id: 12345}).First(&user1)
+    user1, _ := testStore.getUser(12345)
     if user1.Uid != "" {
         t.Error("Deleted user still exists")
     }
 
     log.Println("Deleting test user 2")
-    db.Where(&User{Id: 12345}).Delete(User{})
+    testStore.deleteUser(User{Id: 12345})
 
     log.Println("Accessing test user 2")
     user2 := User{}
-    db.Where(&User{Id: 12345}).First(&user1)
+    user1, _ = testStore.getUser(12345)
     if user2.Uid != "" {
         t.Error("Deleted user still exists")
     }
 }
 
+func TestDeletingUserCleansUp(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{Uid: "12345", Name: "Jayden Smith"}
+    user2 := User{Uid: "12346", Name: "Willow Smith"}
+    testStore.createUser(&user1)
+    testStore.createUser(&user2)
+    testStore.addFriend(user1, user2)
+    testStore.addFriend(user2, user1)
+
+    group := Group{Name: "smiths", CreatorId: user1.Id, Timestamp: time.Now()}
+    testStore.createGroup(&group, Users{user2})
+
+    msg, _ := testAPI.addMessageToUser(user2, user1, "whip my hair", ContentTypeText)
+    testAPI.markMessagesRead(user1, user2, msg.Id)
+
+    log.Println("Deleting user 2")
+    if err := testStore.deleteUser(user2); err != nil {
+        t.Fatalf("Deleting user failed: %v", err)
+    }
+
+    log.Println("Checking what they were part of is gone")
+    if testStore.isGroupMember(group, user2) {
+        t.Error("Deleted user is still a group member")
+    }
+    if members := testStore.getGroupMembers(group); len(members) != 1 || members[0].Id != user1.Id {
+        t.Errorf("Expected just user 1 in the group, got %v", members)
+    }
+    if _, err := testStore.getConversation(user1, user2); err == nil {
+        t.Error("Conversation with deleted user still exists")
+    }
+    if _, err := testStore.getConversation(user2, user1); err == nil {
+        t.Error("Deleted user's conversation still exists")
+    }
+    if marker := testStore.getReadMarker(user1, user2); marker.LastReadId != 0 {
+        t.Errorf("Read marker for deleted user still exists: %v", marker)
+    }
+
+    log.Println("Checking their messages stay")
+    if _, err := testStore.getMessage(msg.Id); err != nil {
+        t.Errorf("Deleted user's message is gone: %v", err)
+    }
+}
+
 func TestIsFriend(t *testing.T) {
     defer resetTables()
 
@@ -86,7 +128,7 @@ func TestIsFriend(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 1")
-    db.Create(&testUser1)
+    testStore.createUser(&testUser1)
 
     testUser2 := User{
         Id:        12346,
@@ -98,24 +140,24 @@ func TestIsFriend(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&testUser2)
+    testStore.createUser(&testUser2)
 
     log.Println("Check they are not friends")
-    if testUser1.isFriend(testUser2) {
+    if testStore.isFriend(testUser1, testUser2) {
         t.Error("User 1 is friends with user 2")
     }
-    if testUser2.isFriend(testUser1) {
+    if testStore.isFriend(testUser2, testUser1) {
         t.Error("User 2 is friends with user 1")
     }
 
     log.Println("Adding them as friends")
-    testUser1.addFriend(testUser2)
+    testStore.addFriend(testUser1, testUser2)
 
     log.Println("Checking they are friends")
-    if !testUser1.isFriend(testUser2) {
+    if !testStore.isFriend(testUser1, testUser2) {
         t.Error("User 1 is not friends with user 2")
     }
-    if !testUser2.isFriend(testUser1) {
+    if !testStore.isFriend(testUser2, testUser1) {
         t.Error("User 2 is not friends with user 1")
     }
 }
@@ -133,7 +175,7 @@ func TestAddingFriends(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 1")
-    db.Create(&testUser1)
+    testStore.createUser(&testUser1)
 
     testUser2 := User{
         Id:        12346,
@@ -145,25 +187,25 @@ func TestAddingFriends(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&testUser2)
+    testStore.createUser(&testUser2)
 
     log.Println("Get the friends of test user 1 - should be empty")
-    friends := testUser1.getFriends()
+    friends := testStore.getFriends(testUser1)
     if len(friends) != 0 {
         t.Error("Friends found for user with no friends")
     }
 
     log.Println("Get the friends of test user 2 - should be empty")
-    friends = testUser2.getFriends()
+    friends = testStore.getFriends(testUser2)
     if len(friends) != 0 {
         t.Error("Friends found for user with no friends")
     }
 
     log.Println("Make test user 2 and test user 1 friends")
-    testUser1.addFriend(testUser2)
+    testStore.addFriend(testUser1, testUser2)
 
     log.Println("Get friends of user 1")
-    friends = testUser1.getFriends()
+    friends = testStore.getFriends(testUser1)
     if len(friends) != 1 {
         t.Errorf("1 friend should have been found, found %v\n", len(friends))
     }
@@ -172,7 +214,7 @@ func TestAddingFriends(t *testing.T) {
     }
 
     log.Println("Get friends of user 2")
-    friends = testUser2.getFriends()
+    friends = testStore.getFriends(testUser2)
     if len(friends) != 1 {
         t.Errorf("1 friend should have been found, found %v\n", len(friends))
     }
@@ -181,10 +223,10 @@ func TestAddingFriends(t *testing.T) {
     }
 
     log.Println("Make test user 2 and test user 1 friends")
-    testUser2.addFriend(testUser1)
+    testStore.addFriend(testUser2, testUser1)
 
     log.Println("Get friends of user 1")
-    friends = testUser1.getFriends()
+    friends = testStore.getFriends(testUser1)
     if len(friends) != 1 {
         t.Errorf("1 friend should have been found, found %v\n", len(friends))
     }
@@ -193,7 +235,7 @@ func TestAddingFriends(t *testing.T) {
     }
 
     log.Println("Get friends of user 2")
-    friends = testUser2.getFriends()
+    friends = testStore.getFriends(testUser2)
     if len(friends) != 1 {
         t.Errorf("1 friend should have been found, found %v\n", len(friends))
     }
@@ -211,19 +253,19 @@ func TestAddingFriends(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 3")
-    db.Create(&testUser3)
+    testStore.createUser(&testUser3)
 
     log.Println("Get friends of user 3")
-    friends = testUser3.getFriends()
+    friends = testStore.getFriends(testUser3)
     if len(friends) != 0 {
         t.Error("Friends found for user with no friends")
     }
 
     log.Println("Make test user 3 and test user 1 friends")
-    testUser1.addFriend(testUser3)
+    testStore.addFriend(testUser1, testUser3)
 
     log.Println("Get friends of user 1")
-    friends = testUser1.getFriends()
+    friends = testStore.getFriends(testUser1)
     if len(friends) != 2 {
         t.Errorf("2 friends should have been found, found %v\n", len(friends))
     }
@@ -234,7 +276,7 @@ func TestAddingFriends(t *testing.T) {
         t.Errorf("test user 3 not found in friends")
     }
     log.Println("Get friends of user 2")
-    friends = testUser2.getFriends()
+    friends = testStore.getFriends(testUser2)
     if len(friends) != 1 {
         t.Errorf("1 friend should have been found, found %v\n", len(friends))
     }
@@ -242,7 +284,7 @@ func TestAddingFriends(t *testing.T) {
         t.Errorf("Friend not equal to test user 1")
     }
     log.Println("Get friends of user 3")
-    friends = testUser3.getFriends()
+    friends = testStore.getFriends(testUser3)
     if len(friends) != 1 {
         t.Errorf("1 friend should have been found, found %v\n", len(friends))
     }
@@ -251,10 +293,10 @@ func TestAddingFriends(t *testing.T) {
     }
 
     log.Println("Make test user 2 and test user 3 friends")
-    testUser3.addFriend(testUser2)
+    testStore.addFriend(testUser3, testUser2)
 
     log.Println("Get friends of user 1")
-    friends = testUser1.getFriends()
+    friends = testStore.getFriends(testUser1)
     if len(friends) != 2 {
         t.Errorf("2 friends should have been found, found %v\n", len(friends))
     }
@@ -265,7 +307,7 @@ func TestAddingFriends(t *testing.T) {
         t.Errorf("test user 3 not found in friends")
     }
     log.Println("Get friends of user 2")
-    friends = testUser2.getFriends()
+    friends = testStore.getFriends(testUser2)
     if len(friends) != 2 {
         t.Errorf("2 friends should have been found, found %v\n", len(friends))
     }
@@ -276,7 +318,7 @@ func TestAddingFriends(t *testing.T) {
         t.Errorf("test user 3 not found in friends")
     }
     log.Println("Get friends of user 3")
-    friends = testUser3.getFriends()
+    friends = testStore.getFriends(testUser3)
     if len(friends) != 2 {
         t.Errorf("2 friends should have been found, found %v\n", len(friends))
     }
@@ -301,7 +343,7 @@ func TestDeletingFriends(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:        12346,
@@ -313,7 +355,7 @@ func TestDeletingFriends(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     user3 := User{
         Id:        12347,
@@ -325,69 +367,69 @@ func TestDeletingFriends(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 3")
-    db.Create(&user3)
+    testStore.createUser(&user3)
 
     log.Println("Trying to delete non-existent friendship")
-    if err := user1.deleteFriend(user2); err == nil {
+    if err := testStore.deleteFriend(user1, user2); err == nil {
         t.Error("Succeeded in deleting non-existent friendship")
     }
-    if err := user2.deleteFriend(user1); err == nil {
+    if err := testStore.deleteFriend(user2, user1); err == nil {
         t.Error("Succeeded in deleting non-existent friendship")
     }
 
     log.Println("Adding friendship")
-    user1.addFriend(user2)
+    testStore.addFriend(user1, user2)
 
     log.Println("Trying to delete friendship (1)")
-    if err := user1.deleteFriend(user2); err != nil {
+    if err := testStore.deleteFriend(user1, user2); err != nil {
         t.Errorf("Failed to delete friendship: %v", err)
     }
-    if user1.isFriend(user2) {
+    if testStore.isFriend(user1, user2) {
         t.Error("Friendship wasn't actually deleted")
     }
    
     log.Println("Trying to delete friendship that's already deleted")
-    if err := user1.deleteFriend(user2); err == nil {
+    if err := testStore.deleteFriend(user1, user2); err == nil {
         t.Error("Succeeded in deleting non-existent friendship")
     }
-    if err := user2.deleteFriend(user1); err == nil {
+    if err := testStore.deleteFriend(user2, user1); err == nil {
         t.Error("Succeeded in deleting non-existent friendship")
     }
 
     log.Println("Adding friendship")
-    user1.addFriend(user2)
+    testStore.addFriend(user1, user2)
 
     log.Println("Trying to delete friendship (2)")
-    if err := user2.deleteFriend(user1); err != nil {
+    if err := testStore.deleteFriend(user2, user1); err != nil {
         t.Errorf("Failed to delete friendship: %v", err)
     }
-    if user2.isFriend(user1) {
+    if testStore.isFriend(user2, user1) {
         t.Error("Friendship wasn't actually deleted")
     }
 
     log.Println("Trying to delete friendship that's already deleted")
-    if err := user1.deleteFriend(user2); err == nil {
+    if err := testStore.deleteFriend(user1, user2); err == nil {
         t.Error("Succeeded in deleting non-existent friendship")
     }
-    if err := user2.deleteFriend(user1); err == nil {
+    if err := testStore.deleteFriend(user2, user1); err == nil {
         t.Error("Succeeded in deleting non-existent friendship")
     }
 
     log.Println("Trying to delete self as friend")
-    if err := user1.deleteFriend(user1); err == nil {
+    if err := testStore.deleteFriend(user1, user1); err == nil {
         t.Error("Succeeded in deleting self as friend")
     }
 
     log.Println("Ensuring deletion doesn't affect other friendships")
-    user1.addFriend(user2)
-    user1.addFriend(user3)
-    if err := user1.deleteFriend(user2); err != nil {
+    testStore.addFriend(user1, user2)
+    testStore.addFriend(user1, user3)
+    if err := testStore.deleteFriend(user1, user2); err != nil {
         t.Errorf("Failed to delete friendship: %v", err)
     }
-    if user1.isFriend(user2) {
+    if testStore.isFriend(user1, user2) {
         t.Error("Failed to delete friendship")
     }
-    if !user1.isFriend(user3) {
+    if !testStore.isFriend(user1, user3) {
         t.Error("Deletion affected the wrong friendship")
     }
 }
@@ -426,7 +468,7 @@ func TestPublicUser(t *testing.T) {
     }
 
     log.Println("Creating test user")
-    db.Create(&testUser)
+    testStore.createUser(&testUser)
 
     log.Println("Converting to public")
     publicUser := testUser.toPublic()
@@ -466,9 +508,9 @@ func TestPublicUsers(t *testing.T) {
     }
 
     log.Println("Creating test users")
-    db.Create(&testUser1)
-    db.Create(&testUser2)
-    db.Create(&testUser3)
+    testStore.createUser(&testUser1)
+    testStore.createUser(&testUser2)
+    testStore.createUser(&testUser3)
 
     log.Println("Creating slice of test users")
     var testUsers Users
@@ -502,9 +544,9 @@ func TestGetUserFromInfo(t *testing.T) {
     }
 
     log.Println("Creating test user")
-    db.Create(&testUser)
+    testStore.createUser(&testUser)
 
-    testInfoBefore := GoogleInfo{
+    testInfoBefore := IdentityInfo{
         ID:             testUser.Uid,
         DisplayName:    testUser.Name,
         FirstName:      testUser.FirstName,
@@ -514,7 +556,7 @@ func TestGetUserFromInfo(t *testing.T) {
     }
 
     log.Println("Getting user from before info")
-    gotUserBefore := getUserFromInfo(testInfoBefore)
+    gotUserBefore := testAPI.getUserFromInfo(testInfoBefore)
 
     if gotUserBefore != testUser {
         t.Errorf("User from before info is not the same")
@@ -524,36 +566,36 @@ func TestGetUserFromInfo(t *testing.T) {
     testInfoAfter.Picture = newPictureURL
 
     log.Println("Getting user from after info")
-    gotUserAfter := getUserFromInfo(testInfoAfter)
+    gotUserAfter := testAPI.getUserFromInfo(testInfoAfter)
 
     if gotUserAfter.Picture != newPictureURL {
-        t.Errorf("User was not updated from GoogleInfo")
+        t.Errorf("User was not updated from IdentityInfo")
     }
 
     // check user is still in the db, and has been updated
-    var testUserAfter User
-    if err := db.Where("id = ?", testUser.Id).Find(&testUserAfter).Error; err != nil {
+    testUserAfter, err := testStore.getUser(testUser.Id)
+    if err != nil {
         t.Errorf("User is no longer in the database")
     }
     if testUserAfter.Picture != newPictureURL {
-        t.Errorf("User was not updated from GoogleInfo in the database")
+        t.Errorf("User was not updated from IdentityInfo in the database")
     }
 
     // check everything else was the same
     gotUserAfter.Picture = oldPictureURL
     testUserAfter.Picture = oldPictureURL
     if gotUserAfter != testUser {
-        t.Errorf("Something wrong was changed after updating user from GoogleInfo")
+        t.Errorf("Something wrong was changed after updating user from IdentityInfo")
     }
     if testUserAfter != testUser {
-        t.Errorf("Something wrong was changed in the database after updating user from GoogleInfo")
+        t.Errorf("Something wrong was changed in the database after updating user from IdentityInfo")
     }
 }
 
 func TestGetUserFromInfoNew(t *testing.T) {
     defer resetTables()
 
-    testInfo := GoogleInfo{
+    testInfo := IdentityInfo{
         ID:             "10001",
         DisplayName:    "Wanye Test",
         FirstName:      "Wanye",
@@ -563,13 +605,12 @@ func TestGetUserFromInfoNew(t *testing.T) {
     }
 
     // ensure the user doesn't exist yet
-    var testUser User
-    if err := db.Where("uid = ?", testInfo.ID).Find(&testUser).Error; err == nil {
+    if _, err := testStore.getUserByUid(testInfo.ID); err == nil {
         t.Errorf("User already existed before signing in")
     }
 
     log.Println("Getting user from info")
-    gotUser := getUserFromInfo(testInfo)
+    gotUser := testAPI.getUserFromInfo(testInfo)
 
     // check all the fields are correct
     if testInfo.ID != gotUser.Uid {
@@ -592,7 +633,8 @@ func TestGetUserFromInfoNew(t *testing.T) {
     }
 
     // ensure the user exists now
-    if err := db.Where("uid = ?", testInfo.ID).Find(&testUser).Error; err != nil {
+    testUser, err := testStore.getUserByUid(testInfo.ID)
+    if err != nil {
         t.Errorf("User doesn't exist in the database after calling getUserFromInfo")
     }
 
@@ -615,7 +657,7 @@ func TestDeleteFriendEndpoint(t *testing.T) {
         Picture:   "40keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:        12345,
@@ -627,25 +669,25 @@ func TestDeleteFriendEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Trying to delete friends (not friends yet)")
-    resp := deleteFriendEndpoint(user1, user2.Id)
+    resp := testAPI.deleteFriendEndpoint(user1, user2.Id)
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in deleting friendship that didn't exist")
     }
 
     log.Println("Adding users as friends")
-    user1.addFriend(user2)
+    testStore.addFriend(user1, user2)
 
     log.Println("Trying to delete friends (users are friends)")
-    resp = deleteFriendEndpoint(user1, user2.Id)
+    resp = testAPI.deleteFriendEndpoint(user1, user2.Id)
     if !resp.Success || resp.Error != "" {
         t.Errorf("Failed to delete friendship that existed (%v)", resp.Error)
     }
 
     log.Println("Trying to delete friends again (users no longer friends)")
-    resp = deleteFriendEndpoint(user1, user2.Id)
+    resp = testAPI.deleteFriendEndpoint(user1, user2.Id)
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in deleting friendship that didn't exist")
     }
@@ -664,7 +706,7 @@ func TestGetFriendEndpoint(t *testing.T) {
         Picture:   "40keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&testUser1)
+    testStore.createUser(&testUser1)
 
     testUser2 := User{
         Id:        2,
@@ -676,25 +718,25 @@ func TestGetFriendEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&testUser2)
+    testStore.createUser(&testUser2)
 
     log.Println("User 1 get friend user 1 (same user)")
-    resp := getFriendEndpoint(testUser1, 1)
+    resp := testAPI.getFriendEndpoint(testUser1, 1)
     if resp.Error == "" {
         t.Error("Users shouldn't be able to do get friend on their own ID")
     }
 
     log.Println("User 1 get friend user 2 (not friends)")
-    resp = getFriendEndpoint(testUser1, 2)
+    resp = testAPI.getFriendEndpoint(testUser1, 2)
     if resp.Error == "" {
         t.Error("Users shouldn't be able to do get friend on users that aren't their friends")
     }
 
     log.Println("Adding users as friends")
-    testUser1.addFriend(testUser2)
+    testStore.addFriend(testUser1, testUser2)
 
     log.Println("User 1 get friend user 2")
-    resp = getFriendEndpoint(testUser1, 2)
+    resp = testAPI.getFriendEndpoint(testUser1, 2)
     if resp.Error != "" {
         t.Error("Users should be able to do get friend on users that are their friends")
     }
@@ -703,7 +745,7 @@ func TestGetFriendEndpoint(t *testing.T) {
     }
 
     log.Println("User 2 get friend user 1")
-    resp = getFriendEndpoint(testUser2, 1)
+    resp = testAPI.getFriendEndpoint(testUser2, 1)
     if resp.Error != "" {
         t.Error("Users should be able to do get friend on users that are their friends")
     }
@@ -725,7 +767,7 @@ func TestAddAndGetMessagesWithUser(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:        421,
@@ -737,11 +779,11 @@ func TestAddAndGetMessagesWithUser(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Getting messages (should be none)")
-    messages1 := user1.getMessagesWithUser(user2, -1, 100)
-    messages2 := user2.getMessagesWithUser(user1, -1, 100)
+    messages1 := testStore.getMessagesWithUser(user1, user2, -1, 100)
+    messages2 := testStore.getMessagesWithUser(user2, user1, -1, 100)
     if len(messages1) != 0 {
         t.Errorf("Should have found 0 messages, found %v\n", len(messages1))
     }
@@ -750,17 +792,17 @@ func TestAddAndGetMessagesWithUser(t *testing.T) {
     }
 
     log.Println("Adding invalid messages")
-    if _, err := user1.addMessageToUser(user2, "this is messed up", -1); err == nil {
+    if _, err := testAPI.addMessageToUser(user1, user2, "this is messed up", -1); err == nil {
         t.Errorf("Should have failed with an invalid content type")
     }
 
     log.Println("Adding empty message")
-    if _, err := user1.addMessageToUser(user2, "", ContentTypeText); err != nil {
+    if _, err := testAPI.addMessageToUser(user1, user2, "", ContentTypeText); err != nil {
         t.Errorf("Shouldn't have failed on empty message")
     }
 
-    messages1 = user1.getMessagesWithUser(user2, -1, 100)
-    messages2 = user2.getMessagesWithUser(user1, -1, 100)
+    messages1 = testStore.getMessagesWithUser(user1, user2, -1, 100)
+    messages2 = testStore.getMessagesWithUser(user2, user1, -1, 100)
     if len(messages1) != 1 {
         t.Errorf("Should have found 1 message, found %v\n", len(messages1))
     }
@@ -772,15 +814,15 @@ func TestAddAndGetMessagesWithUser(t *testing.T) {
     text2 := "top kek"
 
     log.Println("Adding normal messages")
-    if _, err := user2.addMessageToUser(user1, text1, ContentTypeText); err != nil {
+    if _, err := testAPI.addMessageToUser(user2, user1, text1, ContentTypeText); err != nil {
         t.Errorf("Shouldn't have failed on normal message")
     }
-    if _, err := user1.addMessageToUser(user2, text2, ContentTypeText); err != nil {
+    if _, err := testAPI.addMessageToUser(user1, user2, text2, ContentTypeText); err != nil {
         t.Errorf("Shouldn't have failed on normal message")
     }
 
-    messages1 = user1.getMessagesWithUser(user2, -1, 100)
-    messages2 = user2.getMessagesWithUser(user1, -1, 100)
+    messages1 = testStore.getMessagesWithUser(user1, user2, -1, 100)
+    messages2 = testStore.getMessagesWithUser(user2, user1, -1, 100)
     if len(messages1) != 3 {
         t.Errorf("Should have found 3 messages, found %v\n", len(messages1))
     }
@@ -807,10 +849,10 @@ func TestAddAndGetMessagesWithUser(t *testing.T) {
         t.Errorf("Invalid message content; wanted %v, found %v\n", text2, messages2[2].Content)
     }
 
-    if sender, err := messages1[0].getSender(); err != nil || sender.Id != messages1[0].SenderId {
+    if sender, err := testAPI.getSender(messages1[0]); err != nil || sender.Id != messages1[0].SenderId {
         t.Errorf("Invalid sender ID")
     }
-    if recipient, err := messages1[0].getRecipientUser(); err != nil || recipient.Id != messages1[0].RecipientId {
+    if recipient, err := testAPI.getRecipientUser(messages1[0]); err != nil || recipient.Id != messages1[0].RecipientId {
         t.Errorf("Invalid recipient ID")
     }
 }
@@ -828,7 +870,7 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:        421,
@@ -840,7 +882,7 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     user3 := User{
         Id:        422,
@@ -852,25 +894,25 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 3")
-    db.Create(&user3)
+    testStore.createUser(&user3)
 
     log.Println("Adding 100 messages from user1 to user2")
     for i := 0; i < 100; i++ {
-        user2.addMessageToUser(user1, fmt.Sprintf("Hello user2 from user1 %v", i), ContentTypeText)
+        testAPI.addMessageToUser(user2, user1, fmt.Sprintf("Hello user2 from user1 %v", i), ContentTypeText)
     }
 
     log.Println("Adding 5 messages from user1 to user3")
     for i := 0; i < 5; i++ {
-        user3.addMessageToUser(user1, fmt.Sprintf("Hello user3 from user1 %v", i), ContentTypeText)
+        testAPI.addMessageToUser(user3, user1, fmt.Sprintf("Hello user3 from user1 %v", i), ContentTypeText)
     }
 
     log.Println("Adding 100 messages from user2 to user1")
     for i := 0; i < 100; i++ {
-        user1.addMessageToUser(user2, fmt.Sprintf("Hello user1 from user2 %v", i), ContentTypeText)
+        testAPI.addMessageToUser(user1, user2, fmt.Sprintf("Hello user1 from user2 %v", i), ContentTypeText)
     }
 
     log.Println("Getting last 100 messages between user2 and user1")
-    messages := user1.getMessagesWithUser(user2, -1, 100)
+    messages := testStore.getMessagesWithUser(user1, user2, -1, 100)
     if len(messages) != 100 {
         t.Errorf("Should have returned only 100 messages, returned %v\n", len(messages))
     } else {
@@ -882,7 +924,7 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
     }
 
     log.Println("Getting last 100 messages between user1 and user2")
-    messages = user2.getMessagesWithUser(user1, -1, 100)
+    messages = testStore.getMessagesWithUser(user2, user1, -1, 100)
     if len(messages) != 100 {
         t.Errorf("Should have returned only 100 messages, returned %v\n", len(messages))
     } else {
@@ -896,7 +938,7 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
     last_message_id := messages[0].Id
 
     log.Println("Getting first 100 messages between user1 and user2")
-    messages = user2.getMessagesWithUser(user1, last_message_id, 100)
+    messages = testStore.getMessagesWithUser(user2, user1, last_message_id, 100)
     if len(messages) != 100 {
         t.Errorf("Should have returned only 100 messages, returned %v\n", len(messages))
     } else {
@@ -908,7 +950,7 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
     }
 
     log.Println("Getting first 10 messages between user1 and user2")
-    messages = user2.getMessagesWithUser(user1, -1, 10)
+    messages = testStore.getMessagesWithUser(user2, user1, -1, 10)
     if len(messages) != 10 {
         t.Errorf("Should have returned only 10 messages, returned %v\n", len(messages))
     } else {
@@ -922,7 +964,7 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
     last_message_id = messages[0].Id
 
     log.Println("Getting next 10 messages between user1 and user2")
-    messages = user2.getMessagesWithUser(user1, last_message_id, 10)
+    messages = testStore.getMessagesWithUser(user2, user1, last_message_id, 10)
     if len(messages) != 10 {
         t.Errorf("Should have returned only 10 messages, returned %v\n", len(messages))
     } else {
@@ -934,7 +976,7 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
     }
 
     log.Println("Getting first 10 messages between user1 and user3 but only 5 exist")
-    messages = user3.getMessagesWithUser(user1, -1, 10)
+    messages = testStore.getMessagesWithUser(user3, user1, -1, 10)
     if len(messages) != 5 {
         t.Errorf("Should have returned only 5 messages, returned %v\n", len(messages))
     } else {
@@ -948,7 +990,7 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
     third_message_id := messages[2].Id
 
     log.Println("Getting 10 messages before the third message between user1 and user3")
-    messages = user3.getMessagesWithUser(user1, third_message_id, 10)
+    messages = testStore.getMessagesWithUser(user3, user1, third_message_id, 10)
     if len(messages) != 2 {
         t.Errorf("Should have returned only 2 messages, returned %v\n", len(messages))
     } else {
@@ -961,13 +1003,13 @@ func TestGetMessagesWithUserWithLastAndAmount(t *testing.T) {
 
     first_message_id := messages[0].Id
     log.Println("Getting 10 messages before the first message between user1 and user3")
-    messages = user3.getMessagesWithUser(user1, first_message_id, 10)
+    messages = testStore.getMessagesWithUser(user3, user1, first_message_id, 10)
     if len(messages) != 0 {
         t.Errorf("Should have returned no messages, returned %v\n", len(messages))
     }
 
     log.Println("Getting 1 message before the first message between user1 and user3")
-    messages = user3.getMessagesWithUser(user1, first_message_id, 1)
+    messages = testStore.getMessagesWithUser(user3, user1, first_message_id, 1)
     if len(messages) != 0 {
         t.Errorf("Should have returned no messages, returned %v\n", len(messages))
     }
@@ -977,7 +1019,7 @@ func TestSearchUsernames(t *testing.T) {
     defer resetTables()
 
     log.Println("Listing all users - there should be none")
-    users := searchUsernames("", 101)
+    users := testAPI.searchUsernames("", 101)
     if len(users) != 0 {
         t.Errorf("0 users should have been found, found %v\n", len(users))
     }
@@ -992,10 +1034,10 @@ func TestSearchUsernames(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     log.Println("Listing all users as id 421")
-    users = searchUsernames("", 421)
+    users = testAPI.searchUsernames("", 421)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {   
@@ -1005,7 +1047,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing all users as id 420")
-    users = searchUsernames("", 420)
+    users = testAPI.searchUsernames("", 420)
     if len(users) != 0 {
         t.Errorf("0 users should have been found, found %v\n", len(users))
     }
@@ -1020,10 +1062,10 @@ func TestSearchUsernames(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Listing all users as id 422")
-    users = searchUsernames("", 422)
+    users = testAPI.searchUsernames("", 422)
     if len(users) != 2 {
         t.Errorf("2 users should have been found, found %v\n", len(users))
     } else {
@@ -1036,7 +1078,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing all users as id 420")
-    users = searchUsernames("", 420)
+    users = testAPI.searchUsernames("", 420)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1046,7 +1088,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'Peppa Pig'")
-    users = searchUsernames("Peppa Pig", 101)
+    users = testAPI.searchUsernames("Peppa Pig", 101)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1056,7 +1098,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'Snoop'")
-    users = searchUsernames("Snoop", 101)
+    users = testAPI.searchUsernames("Snoop", 101)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1066,7 +1108,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'p' as id 101")
-    users = searchUsernames("p", 101)
+    users = testAPI.searchUsernames("p", 101)
     if len(users) != 2 {
         t.Errorf("2 users should have been found, found %v\n", len(users))
     } else {
@@ -1079,7 +1121,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'p' as id 420")
-    users = searchUsernames("p", 420)
+    users = testAPI.searchUsernames("p", 420)
     if len(users) != 1{
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1089,7 +1131,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'sno'")
-    users = searchUsernames("sno", 101)
+    users = testAPI.searchUsernames("sno", 101)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1099,7 +1141,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'ig'")
-    users = searchUsernames("ig", 101)
+    users = testAPI.searchUsernames("ig", 101)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1109,13 +1151,21 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'Snooo'")
-    users = searchUsernames("Snooo", 101)
+    users = testAPI.searchUsernames("Snooo", 101)
     if len(users) != 0 {
         t.Errorf("0 users should have been found, found %v\n", len(users))
     }
 
+    log.Println("Listing users matching '%' and 'S_oop'")
+    for _, q := range []string{"%", "S_oop"} {
+        users = testAPI.searchUsernames(q, 101)
+        if len(users) != 0 {
+            t.Errorf("Wildcards should be matched literally, found %v users for %q\n", len(users), q)
+        }
+    }
+
     log.Println("Listing users matching 'higher@gmail.com'")
-    users = searchUsernames("higher@gmail.com", 101)
+    users = testAPI.searchUsernames("higher@gmail.com", 101)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1125,7 +1175,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'hIGHer@gmAIl.com'")
-    users = searchUsernames("hIGHer@gmAIl.com", 101)
+    users = testAPI.searchUsernames("hIGHer@gmAIl.com", 101)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1135,7 +1185,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'p.pig@gmail.com'")
-    users = searchUsernames("p.pig@gmail.com", 101)
+    users = testAPI.searchUsernames("p.pig@gmail.com", 101)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1145,7 +1195,7 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'p.pig@gmail.com' as user 420")
-    users = searchUsernames("p.pig@gmail.com", 420)
+    users = testAPI.searchUsernames("p.pig@gmail.com", 420)
     if len(users) != 1 {
         t.Errorf("1 user should have been found, found %v\n", len(users))
     } else {
@@ -1155,25 +1205,25 @@ func TestSearchUsernames(t *testing.T) {
     }
 
     log.Println("Listing users matching 'p.pig@gmail.com' as user 421")
-    users = searchUsernames("p.pig@gmail.com", 421)
+    users = testAPI.searchUsernames("p.pig@gmail.com", 421)
     if len(users) != 0 {
         t.Errorf("0 users should have been found, found %v\n", len(users))
     }
 
     log.Println("Listing users matching 'p.pig@gmail.co'")
-    users = searchUsernames("p.pig@gmail.co", 101)
+    users = testAPI.searchUsernames("p.pig@gmail.co", 101)
     if len(users) != 0 {
         t.Errorf("0 users should have been found, found %v\n", len(users))
     }
 
     log.Println("Listing users matching 'p.pig@gmail.com.'")
-    users = searchUsernames("p.pig@gmail.com.", 101)
+    users = testAPI.searchUsernames("p.pig@gmail.com.", 101)
     if len(users) != 0 {
         t.Errorf("0 users should have been found, found %v\n", len(users))
     }
 
     log.Println("Listing users matching 'a@b.c")
-    users = searchUsernames("a@b.c", 101)
+    users = testAPI.searchUsernames("a@b.c", 101)
     if len(users) != 0 {
         t.Errorf("0 users should have been found, found %v\n", len(users))
     }
@@ -1192,7 +1242,7 @@ func TestListUsersEndpoint(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:        421,
@@ -1204,10 +1254,10 @@ func TestListUsersEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Listing users matching 'DOG'")
-    resp := listUsersEndpoint("DOG", 421)
+    resp := testAPI.listUsersEndpoint("DOG", 421)
 
     if !resp.Success {
         t.Error("Listing users didn't succeed when it should have.")
@@ -1235,9 +1285,9 @@ func TestGetMeEndpoint(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
     
-    resp := getMeEndpoint(user1)
+    resp := testAPI.getMeEndpoint(user1)
 
     // this should always work...
     if !resp.Success || resp.Error != "" {
@@ -1260,10 +1310,10 @@ func TestFriendRequests(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     log.Println("Requesting a friend request to yourself")
-    err := user1.addFriendRequest(user1)
+    err := testStore.addFriendRequest(user1, user1)
     if err.Error() != "Cannot request to be your own friend" {
         t.Error("Friend requests to yourself should fail")
     }
@@ -1278,35 +1328,35 @@ func TestFriendRequests(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Getting user 1's friend requests - should be empty")
-    friendrequests := user1.getFriendRequests()
+    friendrequests := testStore.getFriendRequests(user1)
     if len(friendrequests) != 0 {
         t.Error("Friend requests found for user with no friend requests")
     }
 
     log.Println("Getting user 2's friend requests - should be empty")
-    friendrequests = user2.getFriendRequests()
+    friendrequests = testStore.getFriendRequests(user2)
     if len(friendrequests) != 0 {
         t.Error("Friend requests found for user with no friend requests")
     }
 
     log.Println("Testing if user 1 has a friend request from user 2")
-    if user1.hasFriendRequest(user2) {
+    if testStore.hasFriendRequest(user1, user2) {
         t.Error("User 1 shouldn't have a friend request from user 2")
     }
 
     log.Println("Testing if user 2 has a friend request from user 1")
-    if user2.hasFriendRequest(user1) {
+    if testStore.hasFriendRequest(user2, user1) {
         t.Error("User 2 shouldn't have a friend request from user 1")
     }
 
     log.Println("Add a friend request from user2 to user1")
-    user1.addFriendRequest(user2)
+    testStore.addFriendRequest(user1, user2)
 
     log.Println("Getting user 1's friend requests")
-    friendrequests = user1.getFriendRequests()
+    friendrequests = testStore.getFriendRequests(user1)
     if len(friendrequests) != 1 {
         t.Errorf("1 friend request should have been found, found %v\n", len(friendrequests))
     } else {
@@ -1316,26 +1366,26 @@ func TestFriendRequests(t *testing.T) {
     }
 
     log.Println("Getting user 2's friend requests - should be empty")
-    friendrequests = user2.getFriendRequests()
+    friendrequests = testStore.getFriendRequests(user2)
     if len(friendrequests) != 0 {
         t.Error("Friend requests found for user with no friend requests")
     }
 
     log.Println("Testing if user 1 has a friend request from user 2")
-    if !user1.hasFriendRequest(user2) {
+    if !testStore.hasFriendRequest(user1, user2) {
         t.Error("User 1 should have a friend request from user 2")
     }
 
     log.Println("Testing if user 2 has a friend request from user 1")
-    if user2.hasFriendRequest(user1) {
+    if testStore.hasFriendRequest(user2, user1) {
         t.Error("User 2 shouldn't have a friend request from user 1")
     }
 
     log.Println("Add a friend request from user1 to user2")
-    user2.addFriendRequest(user1)
+    testStore.addFriendRequest(user2, user1)
 
     log.Println("Getting user 1's friend requests")
-    friendrequests = user1.getFriendRequests()
+    friendrequests = testStore.getFriendRequests(user1)
     if len(friendrequests) != 1 {
         t.Errorf("1 friend request should have been found, found %v\n", len(friendrequests))
     } else {
@@ -1345,7 +1395,7 @@ func TestFriendRequests(t *testing.T) {
     }
 
     log.Println("Getting user 2's friend requests")
-    friendrequests = user2.getFriendRequests()
+    friendrequests = testStore.getFriendRequests(user2)
     if len(friendrequests) != 1 {
         t.Errorf("1 friend request should have been found, found %v\n", len(friendrequests))
     } else {
@@ -1355,12 +1405,12 @@ func TestFriendRequests(t *testing.T) {
     }
 
     log.Println("Testing if user 1 has a friend request from user 2")
-    if !user1.hasFriendRequest(user2) {
+    if !testStore.hasFriendRequest(user1, user2) {
         t.Error("User 1 should have a friend request from user 2")
     }
 
     log.Println("Testing if user 2 has a friend request from user 1")
-    if !user2.hasFriendRequest(user1) {
+    if !testStore.hasFriendRequest(user2, user1) {
         t.Error("User 2 should have a friend request from user 1")
     }
 
@@ -1374,18 +1424,18 @@ func TestFriendRequests(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 3")
-    db.Create(&user3)
+    testStore.createUser(&user3)
 
     log.Println("Testing if user 1 has a friend request from user 3")
-    if user1.hasFriendRequest(user3) {
+    if testStore.hasFriendRequest(user1, user3) {
         t.Error("User 1 shouldn't have a friend request from user 3")
     }
 
     log.Println("Add a friend request from user3 to user1")
-    user1.addFriendRequest(user3)
+    testStore.addFriendRequest(user1, user3)
 
     log.Println("Getting user 1's friend requests")
-    friendrequests = user1.getFriendRequests()
+    friendrequests = testStore.getFriendRequests(user1)
     if len(friendrequests) != 2 {
         t.Errorf("2 friend requests should have been found, found %v\n", len(friendrequests))
     } else {
@@ -1398,12 +1448,12 @@ func TestFriendRequests(t *testing.T) {
     }
 
     log.Println("Testing if user 1 has a friend request from user 3")
-    if !user1.hasFriendRequest(user3) {
+    if !testStore.hasFriendRequest(user1, user3) {
         t.Error("User 1 should have a friend request from user 3")
     }
 
     log.Println("Testing if user 3 has a friend request from user 1")
-    if user3.hasFriendRequest(user1) {
+    if testStore.hasFriendRequest(user3, user1) {
         t.Error("User 3 shouldn't have a friend request from user 1")
     }
 }
@@ -1420,7 +1470,7 @@ func TestListMyFriendRequestsEndpoint(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:        421,
@@ -1432,7 +1482,7 @@ func TestListMyFriendRequestsEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     user3 := User{
         Id:        422,
@@ -1444,16 +1494,16 @@ func TestListMyFriendRequestsEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 3")
-    db.Create(&user3)
+    testStore.createUser(&user3)
 
     log.Println("Add a friend request from user2 to user1")
-    user1.addFriendRequest(user2)
+    testStore.addFriendRequest(user1, user2)
 
     log.Println("Add a friend request from user3 to user1")
-    user1.addFriendRequest(user3)
+    testStore.addFriendRequest(user1, user3)
 
     log.Println("Listing friend requests")
-    resp := listMyFriendRequestsEndpoint(user1)
+    resp := testAPI.listMyFriendRequestsEndpoint(user1)
 
     if !resp.Success {
         t.Error("Listing failed when it should have succeeded")
@@ -1483,7 +1533,7 @@ func TestModifyMyFriendRequestEndpoint(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:        421,
@@ -1495,7 +1545,7 @@ func TestModifyMyFriendRequestEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     user3 := User{
         Id:        422,
@@ -1507,58 +1557,58 @@ func TestModifyMyFriendRequestEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 3")
-    db.Create(&user3)
+    testStore.createUser(&user3)
 
     log.Println("Add a friend request from user2 to user1")
-    user1.addFriendRequest(user2)
+    testStore.addFriendRequest(user1, user2)
 
     log.Println("Add a friend request from user3 to user1")
-    user1.addFriendRequest(user3)
+    testStore.addFriendRequest(user1, user3)
 
     log.Println("Trying to modify a request from yourself")
-    resp := modifyMyFriendRequestEndpoint(user1, 420, "accept")
+    resp := testAPI.modifyMyFriendRequestEndpoint(user1, 420, "accept")
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in modifying reflective friend request")
     }
 
     log.Println("Trying to modify a request from a user that doesn't exist")
-    resp = modifyMyFriendRequestEndpoint(user1, 1337, "accept")
+    resp = testAPI.modifyMyFriendRequestEndpoint(user1, 1337, "accept")
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in modifying friend request from non existent user")
     }
 
     log.Println("Trying to modify a request that doesn't exist")
-    resp = modifyMyFriendRequestEndpoint(user2, 420, "accept")
+    resp = testAPI.modifyMyFriendRequestEndpoint(user2, 420, "accept")
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in modifying friend request that doesn't exist")
     }
 
     log.Println("Accepting a friend request")
-    resp = modifyMyFriendRequestEndpoint(user1, 421, "accept")
+    resp = testAPI.modifyMyFriendRequestEndpoint(user1, 421, "accept")
     if !resp.Success || resp.Error != "" {
         t.Error("Didn't succeed in modifying a valid friend request")
     } else {
         log.Println("Testing the request was deleted")
-        if user1.hasFriendRequest(user2) {
+        if testStore.hasFriendRequest(user1, user2) {
             t.Error("Friend request wasn't deleted")
         }
         log.Println("Testing the users are now friends")
-        if !user1.isFriend(user2) {
+        if !testStore.isFriend(user1, user2) {
             t.Error("Users aren't now friends")
         }
     }
 
     log.Println("Declining a friend request")
-    resp = modifyMyFriendRequestEndpoint(user1, 422, "decline")
+    resp = testAPI.modifyMyFriendRequestEndpoint(user1, 422, "decline")
     if !resp.Success || resp.Error != "" {
         t.Error("Didn't succeed in modifying a valid friend request")
     } else {
         log.Println("Testing the request was deleted")
-        if user1.hasFriendRequest(user3) {
+        if testStore.hasFriendRequest(user1, user3) {
             t.Error("Friend request wasn't deleted")
         }
         log.Println("Testing the users are now not friends")
-        if user1.isFriend(user3) {
+        if testStore.isFriend(user1, user3) {
             t.Error("Users are now friends when they shouldn't be")
         }
     }
@@ -1576,7 +1626,7 @@ func TestAddOthersFriendRequestEndpoint(t *testing.T) {
         Picture:   "42keks"}
 
     log.Println("Creating test user 1")
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:        421,
@@ -1588,7 +1638,7 @@ func TestAddOthersFriendRequestEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 2")
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     user3 := User{
         Id:        422,
@@ -1600,50 +1650,50 @@ func TestAddOthersFriendRequestEndpoint(t *testing.T) {
         Picture:   "someurl"}
 
     log.Println("Creating test user 3")
-    db.Create(&user3)
+    testStore.createUser(&user3)
 
     log.Println("Add a friend request from user2 to user1")
-    user1.addFriendRequest(user2)
+    testStore.addFriendRequest(user1, user2)
 
     log.Println("Make user2 and user3 friends")
-    user2.addFriend(user3)
+    testStore.addFriend(user2, user3)
 
     log.Println("Adding a friend request to a non-existent user")
-    resp := addOthersFriendRequestEndpoint(user1, 24601)
+    resp := testAPI.addOthersFriendRequestEndpoint(user1, 24601)
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in adding a friend request to a non-existent user")
     }
 
     log.Println("Adding a friend request to a friend")
-    resp = addOthersFriendRequestEndpoint(user2, 422)
+    resp = testAPI.addOthersFriendRequestEndpoint(user2, 422)
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in adding a friend request to an existing friend")
     }
 
     log.Println("Adding a friend request that already exists")
-    resp = addOthersFriendRequestEndpoint(user2, 420)
+    resp = testAPI.addOthersFriendRequestEndpoint(user2, 420)
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in adding a friend request that already exists")
     }
 
     log.Println("Adding a friend request that already exists in the opposite direction")
-    resp = addOthersFriendRequestEndpoint(user1, 421)
+    resp = testAPI.addOthersFriendRequestEndpoint(user1, 421)
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in adding a friend request that already exists in the opposite direction")
     }
 
     log.Println("Adding a friend request to yourself")
-    resp = addOthersFriendRequestEndpoint(user1, 420)
+    resp = testAPI.addOthersFriendRequestEndpoint(user1, 420)
     if resp.Success || resp.Error == "" {
         t.Error("Succeeded in adding a friend request to yourself")
     }
 
     log.Println("Adding a valid friend request")
-    resp = addOthersFriendRequestEndpoint(user3, 420)
+    resp = testAPI.addOthersFriendRequestEndpoint(user3, 420)
     if !resp.Success || resp.Error != "" {
         t.Error("Didn't succeed in adding a valid friend request")
     }
-    friendrequests := user1.getFriendRequests()
+    friendrequests := testStore.getFriendRequests(user1)
     if len(friendrequests) != 2 {
         t.Errorf("2 friend requests should have been found, found %v\n", len(friendrequests))
     } else {
@@ -1667,7 +1717,7 @@ func TestGetNextMessageEndpoint(t *testing.T) {
         Email:      "xXx_0n10n_fan_xXx@hotmail.com",
         Picture:    "tone.jpg",
     }
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:         2,
@@ -1678,33 +1728,33 @@ func TestGetNextMessageEndpoint(t *testing.T) {
         Email:      "pm@gmail.com",
         Picture:    "hehe",
     }
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     log.Println("Adding messages")
-    msg1, _ := user1.addMessageToUser(user2, "malcom pls", ContentTypeText)
-    msg2, _ := user2.addMessageToUser(user1, "lel", ContentTypeText)
-    msg3, _ := user1.addMessageToUser(user2, "y u do dis", ContentTypeText)
-    msg4, _ := user2.addMessageToUser(user1, "get rekt", ContentTypeText)
+    msg1, _ := testAPI.addMessageToUser(user1, user2, "malcom pls", ContentTypeText)
+    msg2, _ := testAPI.addMessageToUser(user2, user1, "lel", ContentTypeText)
+    msg3, _ := testAPI.addMessageToUser(user1, user2, "y u do dis", ContentTypeText)
+    msg4, _ := testAPI.addMessageToUser(user2, user1, "get rekt", ContentTypeText)
 
     log.Println("Checking getNextMessageAfterId for user1")
-    if msg, ok := user1.getNextMessageAfterId(0); !ok || msg.Id != msg2.Id {
+    if msg, ok := testStore.getNextMessageAfterId(user1, 0); !ok || msg.Id != msg2.Id {
         t.Errorf("Message not found/wrong ID. Expected %v/%v, found %v/%v\n", true, msg2.Id, ok, msg.Id)
     }
-    if msg, ok := user1.getNextMessageAfterId(msg2.Id); !ok || msg.Id != msg4.Id {
+    if msg, ok := testStore.getNextMessageAfterId(user1, msg2.Id); !ok || msg.Id != msg4.Id {
         t.Errorf("Message not found/wrong ID. Expected %v/%v, found %v/%v\n", true, msg4.Id, ok, msg.Id)
     }
-    if msg, ok := user1.getNextMessageAfterId(msg4.Id); ok {
+    if msg, ok := testStore.getNextMessageAfterId(user1, msg4.Id); ok {
         t.Errorf("Message found when there shouldn't have been one. Found %v/%v\n", ok, msg.Id)
     }
 
     log.Println("Checking getNextMessageAfterId for user2")
-    if msg, ok := user2.getNextMessageAfterId(0); !ok || msg.Id != msg1.Id {
+    if msg, ok := testStore.getNextMessageAfterId(user2, 0); !ok || msg.Id != msg1.Id {
         t.Errorf("Message not found/wrong ID. Expected %v/%v, found %v/%v\n", true, msg1.Id, ok, msg.Id)
     }
-    if msg, ok := user2.getNextMessageAfterId(msg1.Id); !ok || msg.Id != msg3.Id {
+    if msg, ok := testStore.getNextMessageAfterId(user2, msg1.Id); !ok || msg.Id != msg3.Id {
         t.Errorf("Message not found/wrong ID. Expected %v/%v, found %v/%v\n", true, msg3.Id, ok, msg.Id)
     }
-    if msg, ok := user2.getNextMessageAfterId(msg3.Id); ok {
+    if msg, ok := testStore.getNextMessageAfterId(user2, msg3.Id); ok {
         t.Errorf("Message found when there shouldn't have been one. Found %v/%v\n", ok, msg.Id)
     }
 }
@@ -1720,7 +1770,7 @@ func TestTimeOfLastMessage(t *testing.T) {
         Email:      "xXx_0n10n_fan_xXx@hotmail.com",
         Picture:    "tone.jpg",
     }
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:         2,
@@ -1731,41 +1781,43 @@ func TestTimeOfLastMessage(t *testing.T) {
         Email:      "pm@gmail.com",
         Picture:    "hehe",
     }
-    db.Create(&user2)
-
-    defaultTimestamp := time.Time{}
+    testStore.createUser(&user2)
 
     log.Println("Testing time of last message with no messages")
-    if ts := user1.timeOfLastMessageWithUser(user2); !ts.Equal(defaultTimestamp) {
-        t.Errorf("Time of last message was not correct: expected %v, got %v", defaultTimestamp, ts)
+    if _, err := testStore.getConversation(user1, user2); err != errNotFound {
+        t.Errorf("Expected no conversation, got error %v", err)
     }
-    if ts := user2.timeOfLastMessageWithUser(user1); !ts.Equal(defaultTimestamp) {
-        t.Errorf("Time of last message was not correct: expected %v, got %v", defaultTimestamp, ts)
+    if _, err := testStore.getConversation(user2, user1); err != errNotFound {
+        t.Errorf("Expected no conversation, got error %v", err)
     }
 
     log.Println("Adding a message")
-    msg1, _ := user1.addMessageToUser(user2, "malcom pls", ContentTypeText)
+    msg1, _ := testAPI.addMessageToUser(user1, user2, "malcom pls", ContentTypeText)
     timestamp1 := msg1.Timestamp.Round(time.Millisecond)
 
     log.Println("Testing time of last message after adding 1 message")
-    if ts := user1.timeOfLastMessageWithUser(user2).Round(time.Millisecond); !ts.Equal(timestamp1) {
+    conversation, _ := testStore.getConversation(user1, user2)
+    if ts := conversation.LastMessageTime.Round(time.Millisecond); !ts.Equal(timestamp1) {
         t.Errorf("Time of last message was not correct: expected %v, got %v", timestamp1, ts)
     }
-    if ts := user2.timeOfLastMessageWithUser(user1).Round(time.Millisecond); !ts.Equal(timestamp1) {
+    conversation, _ = testStore.getConversation(user2, user1)
+    if ts := conversation.LastMessageTime.Round(time.Millisecond); !ts.Equal(timestamp1) {
         t.Errorf("Time of last message was not correct: expected %v, got %v", timestamp1, ts)
     }
 
     time.Sleep(10 * time.Millisecond)
 
     log.Println("Adding another message")
-    msg2, _ := user2.addMessageToUser(user1, "lel", ContentTypeText)
+    msg2, _ := testAPI.addMessageToUser(user2, user1, "lel", ContentTypeText)
     timestamp2 := msg2.Timestamp.Round(time.Millisecond)
 
     log.Println("Testing time of last message after adding 2 messages")
-    if ts := user1.timeOfLastMessageWithUser(user2).Round(time.Millisecond); !ts.Equal(timestamp2) {
+    conversation, _ = testStore.getConversation(user1, user2)
+    if ts := conversation.LastMessageTime.Round(time.Millisecond); !ts.Equal(timestamp2) {
         t.Errorf("Time of last message was not correct: expected %v, got %v", timestamp2, ts)
     }
-    if ts := user2.timeOfLastMessageWithUser(user1).Round(time.Millisecond); !ts.Equal(timestamp2) {
+    conversation, _ = testStore.getConversation(user2, user1)
+    if ts := conversation.LastMessageTime.Round(time.Millisecond); !ts.Equal(timestamp2) {
         t.Errorf("Time of last message was not correct: expected %v, got %v", timestamp2, ts)
     }
 }
@@ -1781,7 +1833,7 @@ func TestGetFriendsSorting(t *testing.T) {
         Email:      "xXx_0n10n_fan_xXx@hotmail.com",
         Picture:    "tone.jpg",
     }
-    db.Create(&user1)
+    testStore.createUser(&user1)
 
     user2 := User{
         Id:         2,
@@ -1792,7 +1844,7 @@ func TestGetFriendsSorting(t *testing.T) {
         Email:      "pm@gmail.com",
         Picture:    "hehe",
     }
-    db.Create(&user2)
+    testStore.createUser(&user2)
 
     user3 := User{
         Id:        3,
@@ -1803,7 +1855,7 @@ func TestGetFriendsSorting(t *testing.T) {
         Email:     "billyboy@gmail.com",
         Picture:   "someurl",
     }
-    db.Create(&user3)
+    testStore.createUser(&user3)
 
     user4 := User{
         Id:         4,
@@ -1814,15 +1866,15 @@ func TestGetFriendsSorting(t *testing.T) {
         Email:      "mining_is_gr8@gmail.com",
         Picture:    "coal.jpg",
     }
-    db.Create(&user4)
+    testStore.createUser(&user4)
 
     log.Println("Adding friends")
-    user1.addFriend(user2)
-    user1.addFriend(user3) // yeah right
-    user1.addFriend(user4)
+    testStore.addFriend(user1, user2)
+    testStore.addFriend(user1, user3) // yeah right
+    testStore.addFriend(user1, user4)
 
     log.Println("Testing ordering with no messages")
-    friends := user1.getFriends()
+    friends := testStore.getFriends(user1)
     // should be alphabetical: bill (3), clive (4), malcolm (2)
     if friends[0].Id != user3.Id {
         t.Errorf("Friends weren't in alphabetical order: expected %v, got %v", user3.FirstName, friends[0].FirstName)
@@ -1835,9 +1887,9 @@ func TestGetFriendsSorting(t *testing.T) {
     }
 
     // send message from tony to malcolm
-    user1.addMessageToUser(user2, "we're friends...right?", ContentTypeText)
+    testAPI.addMessageToUser(user1, user2, "we're friends...right?", ContentTypeText)
     log.Println("Testing ordering with message to 1 friend")
-    friends = user1.getFriends()
+    friends = testStore.getFriends(user1)
     // should be: malcolm (2), bill(3), clive(4)
     if friends[0].Id != user2.Id {
         t.Errorf("Friends weren't in order: expected %v, got %v", user2.FirstName, friends[0].FirstName)
@@ -1850,9 +1902,9 @@ func TestGetFriendsSorting(t *testing.T) {
     }
 
     // send message from clive to tony
-    user4.addMessageToUser(user1, "bye bye tony, bye bye", ContentTypeText)
+    testAPI.addMessageToUser(user4, user1, "bye bye tony, bye bye", ContentTypeText)
     log.Println("Testing ordering with message to 2 friends")
-    friends = user1.getFriends()
+    friends = testStore.getFriends(user1)
     // should be: clive(4), malcolm(2), bill(3)
     if friends[0].Id != user4.Id {
         t.Errorf("Friends weren't in order: expected %v, got %v", user4.FirstName, friends[0].FirstName)
@@ -1865,9 +1917,9 @@ func TestGetFriendsSorting(t *testing.T) {
     }
 
     // send message from bill to malcolm (shouldn't affect ordering)
-    user3.addMessageToUser(user2, "fuk", ContentTypeText)
+    testAPI.addMessageToUser(user3, user2, "fuk", ContentTypeText)
     log.Println("Testing ordering with message to 2 friends, with 1 irrelevant message")
-    friends = user1.getFriends()
+    friends = testStore.getFriends(user1)
     // should be: clive(4), malcolm(2), bill(3)
     if friends[0].Id != user4.Id {
         t.Errorf("Friends weren't in order: expected %v, got %v", user4.FirstName, friends[0].FirstName)
@@ -1880,9 +1932,9 @@ func TestGetFriendsSorting(t *testing.T) {
     }
 
     // send message from bill to tony (should affect ordering)
-    user3.addMessageToUser(user1, "rip", ContentTypeText)
+    testAPI.addMessageToUser(user3, user1, "rip", ContentTypeText)
     log.Println("Testing ordering with message to 3 friends, with 1 irrelevant message")
-    friends = user1.getFriends()
+    friends = testStore.getFriends(user1)
     // should be: bill(3), clive(4), malcolm(2)
     if friends[0].Id != user3.Id {
         t.Errorf("Friends weren't in order: expected %v, got %v", user3.FirstName, friends[0].FirstName)
@@ -1894,3 +1946,292 @@ func TestGetFriendsSorting(t *testing.T) {
         t.Errorf("Friends weren't in order: expected %v, got %v", user2.FirstName, friends[2].FirstName)
     }
 }
+
+func TestFriendEvents(t *testing.T) {
+    defer resetTables()
+    user1 := User{
+        Id:        420,
+        Uid:       "420",
+        Name:      "Snoop Doge",
+        FirstName: "Snoop",
+        LastName:  "Doge",
+        Email:     "higher@gmail.com",
+        Picture:   "42keks"}
+
+    log.Println("Creating test user 1")
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:        421,
+        Uid:       "421",
+        Name:      "Peppa Pig",
+        FirstName: "Peppa",
+        LastName:  "Pig",
+        Email:     "p.pig@gmail.com",
+        Picture:   "someurl"}
+
+    log.Println("Creating test user 2")
+    testStore.createUser(&user2)
+
+    sub1 := subscribeEvents(user1.Id)
+    defer sub1.unsubscribe()
+    sub2 := subscribeEvents(user2.Id)
+    defer sub2.unsubscribe()
+
+    expectEvent := func(sub *EventSubscriber, eventType string, about User) {
+        select {
+        case event := <-sub.Events:
+            if event.Type != eventType {
+                t.Errorf("Expected %v event, got %v\n", eventType, event.Type)
+            } else if publicUser, ok := event.Payload.(PublicUser); !ok || publicUser.Id != about.Id {
+                t.Errorf("%v event was about the wrong user: %v\n", eventType, event.Payload)
+            }
+        case <-time.After(100 * time.Millisecond):
+            t.Errorf("No %v event received\n", eventType)
+        }
+    }
+
+    log.Println("Sending a friend request from user2 to user1")
+    testAPI.addOthersFriendRequestEndpoint(user2, user1.Id)
+    expectEvent(sub1, EventTypeFriendRequestReceived, user2)
+
+    log.Println("Declining the friend request")
+    testAPI.modifyMyFriendRequestEndpoint(user1, user2.Id, "decline")
+    expectEvent(sub2, EventTypeFriendRequestDeclined, user1)
+
+    log.Println("Sending and accepting another friend request")
+    testAPI.addOthersFriendRequestEndpoint(user2, user1.Id)
+    expectEvent(sub1, EventTypeFriendRequestReceived, user2)
+    testAPI.modifyMyFriendRequestEndpoint(user1, user2.Id, "accept")
+    expectEvent(sub2, EventTypeFriendRequestAccepted, user1)
+
+    log.Println("Updating user2's profile")
+    testAPI.getUserFromInfo(IdentityInfo{
+        ID:             user2.Uid,
+        DisplayName:    "George Pig",
+        FirstName:      "George",
+        LastName:       user2.LastName,
+        Email:          user2.Email,
+        Picture:        user2.Picture,
+    })
+    expectEvent(sub1, EventTypeProfileUpdated, user2)
+    expectEvent(sub2, EventTypeProfileUpdated, user2)
+
+    log.Println("Removing user1 as user2's friend")
+    testAPI.deleteFriendEndpoint(user2, user1.Id)
+    expectEvent(sub1, EventTypeFriendRemoved, user2)
+}
+
+func TestListFriendsEndpoint(t *testing.T) {
+    defer resetTables()
+    user1 := User{
+        Id:        420,
+        Uid:       "420",
+        Name:      "Snoop Doge",
+        FirstName: "Snoop",
+        LastName:  "Doge",
+        Email:     "higher@gmail.com",
+        Picture:   "42keks"}
+
+    log.Println("Creating test user 1")
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:        421,
+        Uid:       "421",
+        Name:      "Peppa Pig",
+        FirstName: "Peppa",
+        LastName:  "Pig",
+        Email:     "p.pig@gmail.com",
+        Picture:   "someurl"}
+
+    log.Println("Creating test user 2")
+    testStore.createUser(&user2)
+
+    user3 := User{
+        Id:        422,
+        Uid:       "422",
+        Name:      "Yo Mum",
+        FirstName: "Yo",
+        LastName:  "Mum",
+        Email:     "top.kek@gmail.com",
+        Picture:   "someurl"}
+
+    log.Println("Creating test user 3")
+    testStore.createUser(&user3)
+
+    testStore.addFriend(user1, user2)
+    testStore.addFriend(user1, user3)
+
+    log.Println("List friends with no messages")
+    resp := testAPI.listFriendsEndpoint(user1)
+    if len(resp.Friends) != 2 {
+        t.Fatalf("2 friends expected, found %v\n", len(resp.Friends))
+    }
+    for _, friend := range resp.Friends {
+        if friend.UnreadCount != 0 || friend.LastMessage != nil {
+            t.Errorf("Friend %v shouldn't have any messages: %v\n", friend.Id, friend)
+        }
+    }
+
+    log.Println("Send some messages")
+    msg4, _ := testAPI.addMessageToUser(user1, user3, "hi", ContentTypeText)
+    msg1, _ := testAPI.addMessageToUser(user2, user1, "one", ContentTypeText)
+    testAPI.addMessageToUser(user2, user1, "two", ContentTypeText)
+    msg3, _ := testAPI.addMessageToUser(user2, user1, "three", ContentTypeText)
+
+    log.Println("Read the first message from user2")
+    testAPI.markMessagesRead(user1, user2, msg1.Id)
+
+    resp = testAPI.listFriendsEndpoint(user1)
+    if len(resp.Friends) != 2 {
+        t.Fatalf("2 friends expected, found %v\n", len(resp.Friends))
+    }
+
+    // user2 messaged last, so should come first
+    if resp.Friends[0].Id != user2.Id {
+        t.Errorf("Expected user2 first, got %v\n", resp.Friends[0].Id)
+    } else {
+        if resp.Friends[0].UnreadCount != 2 {
+            t.Errorf("2 unread messages expected from user2, found %v\n", resp.Friends[0].UnreadCount)
+        }
+        if resp.Friends[0].LastMessage == nil || resp.Friends[0].LastMessage.Id != msg3.Id {
+            t.Errorf("Last message from user2 should be %v, got %v\n", msg3.Id, resp.Friends[0].LastMessage)
+        }
+    }
+
+    if resp.Friends[1].Id != user3.Id {
+        t.Errorf("Expected user3 second, got %v\n", resp.Friends[1].Id)
+    } else {
+        if resp.Friends[1].UnreadCount != 0 {
+            t.Errorf("Messages you sent shouldn't be unread, found %v\n", resp.Friends[1].UnreadCount)
+        }
+        if resp.Friends[1].LastMessage == nil || resp.Friends[1].LastMessage.Content != msg4.Content {
+            t.Errorf("Last message with user3 should be %v, got %v\n", msg4.Id, resp.Friends[1].LastMessage)
+        }
+    }
+}
+
+func TestConversations(t *testing.T) {
+    defer resetTables()
+    user1 := User{
+        Id:         1,
+        Uid:        "1",
+        Name:       "Tony Abbott",
+        FirstName:  "Tony",
+        LastName:   "Abbott",
+        Email:      "xXx_0n10n_fan_xXx@hotmail.com",
+        Picture:    "tone.jpg",
+    }
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:         2,
+        Uid:        "2",
+        Name:       "Malcolm Turnbull",
+        FirstName:  "Malcolm",
+        LastName:   "Turnbull",
+        Email:      "pm@gmail.com",
+        Picture:    "hehe",
+    }
+    testStore.createUser(&user2)
+
+    user3 := User{
+        Id:         3,
+        Uid:        "3",
+        Name:       "Julie Bishop",
+        FirstName:  "Julie",
+        LastName:   "Bishop",
+        Email:      "jbish@gmail.com",
+        Picture:    "stare",
+    }
+
+    getConversation := func(user User, friend User) (Conversation, bool) {
+        conversation, err := testStore.getConversation(user, friend)
+        return conversation, err == nil
+    }
+
+    log.Println("Testing there are no conversations before any messages")
+    if _, ok := getConversation(user1, user2); ok {
+        t.Error("Conversation found with no messages")
+    }
+
+    log.Println("Testing the first message creates both conversations")
+    msg1, _ := testAPI.addMessageToUser(user1, user2, "malcom pls", ContentTypeText)
+    for _, pair := range [][2]User{{user1, user2}, {user2, user1}} {
+        conversation, ok := getConversation(pair[0], pair[1])
+        if !ok {
+            t.Errorf("Conversation for %v with %v wasn't created", pair[0].Id, pair[1].Id)
+        } else if conversation.LastMessageId != msg1.Id {
+            t.Errorf("Last message was not correct: expected %v, got %v", msg1.Id, conversation.LastMessageId)
+        }
+    }
+
+    log.Println("Testing a reply updates both conversations")
+    msg2, _ := testAPI.addMessageToUser(user2, user1, "lel", ContentTypeText)
+    for _, pair := range [][2]User{{user1, user2}, {user2, user1}} {
+        conversation, _ := getConversation(pair[0], pair[1])
+        if conversation.LastMessageId != msg2.Id {
+            t.Errorf("Last message was not correct: expected %v, got %v", msg2.Id, conversation.LastMessageId)
+        }
+    }
+
+    log.Println("Testing messages sent at the same time")
+    testStore.createUser(&user3)
+    var wg sync.WaitGroup
+    sent := make(chan Message, 20)
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            // half going each way, each pair's first ones included
+            from, to := user1, user3
+            if i%2 == 1 {
+                from, to = user3, user1
+            }
+            msg, err := testAPI.addMessageToUser(from, to, "race", ContentTypeText)
+            if err != nil {
+                t.Errorf("Sending message at the same time failed: %v", err)
+                return
+            }
+            sent <- msg
+        }(i)
+    }
+    wg.Wait()
+    close(sent)
+    lastId := 0
+    for msg := range sent {
+        if msg.Id > lastId {
+            lastId = msg.Id
+        }
+    }
+    for _, pair := range [][2]User{{user1, user3}, {user3, user1}} {
+        conversation, _ := getConversation(pair[0], pair[1])
+        if conversation.LastMessageId != lastId {
+            t.Errorf("Last message was not correct: expected %v, got %v", lastId, conversation.LastMessageId)
+        }
+    }
+
+    // only the database has existing messages to populate them from
+    gs, ok := testStore.(*gormStore)
+    if !ok {
+        return
+    }
+
+    log.Println("Testing migrating populates conversations from existing messages")
+    // back to before there was a conversations table
+    if err := gs.migrateDown(3); err != nil {
+        t.Fatalf("Migrating down failed: %v", err)
+    }
+    if err := gs.migrateUp(latestMigration()); err != nil {
+        t.Fatalf("Migrating up failed: %v", err)
+    }
+    for _, pair := range [][2]User{{user1, user2}, {user2, user1}} {
+        conversation, ok := getConversation(pair[0], pair[1])
+        if !ok {
+            t.Errorf("Conversation for %v with %v wasn't populated", pair[0].Id, pair[1].Id)
+        } else if conversation.LastMessageId != msg2.Id {
+            t.Errorf("Last message was not correct: expected %v, got %v", msg2.Id, conversation.LastMessageId)
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+const (
+    // time allowed to write a frame to the client
+    WebSocketWriteWait = 10 * time.Second
+    // time allowed between pongs from the client before we give up on it
+    WebSocketPongWait = 60 * time.Second
+    // how often we ping the client; must be less than WebSocketPongWait
+    WebSocketPingPeriod = (WebSocketPongWait * 9) / 10
+    // clients only ever send us control frames, so keep this small
+    WebSocketMaxMessageSize = 512
+)
+
+var upgrader = websocket.Upgrader{
+    ReadBufferSize:     1024,
+    WriteBufferSize:    1024,
+    // APIHandler already allows cross-domain requests from anywhere
+    CheckOrigin:        func(r *http.Request) bool { return true },
+}
+
+/*
+ * /ws endpoint
+ */
+
+func (api *API) webSocketHandler(w http.ResponseWriter, r *http.Request) int {
+    log.Println("Handling /ws")
+
+    // browsers can't set headers on websocket requests
+    useSessionTokenParam(r)
+
+    user, ok := api.getCurrentUser(r)
+    if !ok {
+        return http.StatusUnauthorized
+    }
+
+    if r.Method != "GET" {
+        return http.StatusMethodNotAllowed
+    }
+
+    // default to ID of 0
+    afterId := 0
+
+    afterIdStr := r.FormValue("after")
+    if afterIdStr != "" {
+        var err error
+        afterId, err = strconv.Atoi(afterIdStr)
+        if err != nil || afterId <= 0 {
+            log.Println("After ID not positive integer")
+            return http.StatusBadRequest
+        }
+    }
+
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // Upgrade has already replied to the client
+        log.Printf("Websocket upgrade failed: %v\n", err)
+        return http.StatusOK
+    }
+
+    api.serveWebSocket(conn, user, afterId)
+
+    // the connection has been hijacked, so there's nothing left to write
+    return http.StatusOK
+}
+
+// Streams events to the user over conn, one JSON Event per frame, until the
+// client goes away.
+// If afterId is given, any messages received after it are sent first.
+func (api *API) serveWebSocket(conn *websocket.Conn, user User, afterId int) {
+    defer conn.Close()
+
+    // read loop: we don't expect anything from the client besides control
+    // frames, but we have to read to process pongs and notice disconnects
+    closed := make(chan bool)
+    go func() {
+        conn.SetReadLimit(WebSocketMaxMessageSize)
+        conn.SetReadDeadline(time.Now().Add(WebSocketPongWait))
+        conn.SetPongHandler(func(string) error {
+            conn.SetReadDeadline(time.Now().Add(WebSocketPongWait))
+            return nil
+        })
+        for {
+            if _, _, err := conn.NextReader(); err != nil {
+                close(closed)
+                return
+            }
+        }
+    }()
+
+    api.streamEvents(user, afterId, WebSocketPingPeriod, closed,
+        func(event Event) error {
+            conn.SetWriteDeadline(time.Now().Add(WebSocketWriteWait))
+            return conn.WriteJSON(event)
+        },
+        func() error {
+            conn.SetWriteDeadline(time.Now().Add(WebSocketWriteWait))
+            return conn.WriteMessage(websocket.PingMessage, nil)
+        })
+}
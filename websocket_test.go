@@ -0,0 +1,140 @@
+package main
+
+import (
+    "testing"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// An Event whose payload is a message
+type testMessageEvent struct {
+    Id          int64       `json:"id"`
+    Type        string      `json:"type"`
+    Payload     Message     `json:"payload"`
+}
+
+// Starts a test server which streams events for the given user, skipping auth
+func newWebSocketTestServer(user User, afterId int) *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            log.Printf("Upgrade failed: %v\n", err)
+            return
+        }
+        testAPI.serveWebSocket(conn, user, afterId)
+    }))
+}
+
+func dialWebSocketTestServer(t *testing.T, server *httptest.Server) *websocket.Conn {
+    url := "ws" + strings.TrimPrefix(server.URL, "http")
+    conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+    if err != nil {
+        t.Fatalf("Dial failed: %v", err)
+    }
+    return conn
+}
+
+func readWebSocketEvent(conn *websocket.Conn, timeout time.Duration) (event testMessageEvent, ok bool) {
+    conn.SetReadDeadline(time.Now().Add(timeout))
+    if err := conn.ReadJSON(&event); err != nil {
+        return event, false
+    }
+    return event, true
+}
+
+func TestWebSocket(t *testing.T) {
+    defer resetTables()
+
+    user1 := User{
+        Id:         1000,
+        Uid:        "1000",
+        Name:       "Tony Abbott",
+        FirstName:  "Tony",
+        LastName:   "Abbott",
+        Email:      "xXx_0n10n_fan_xXx@hotmail.com",
+        Picture:    "tone.jpg",
+    }
+    testStore.createUser(&user1)
+
+    user2 := User{
+        Id:         1001,
+        Uid:        "1001",
+        Name:       "Malcolm Turnbull",
+        FirstName:  "Malcolm",
+        LastName:   "Turnbull",
+        Email:      "pm@gmail.com",
+        Picture:    "hehe",
+    }
+    testStore.createUser(&user2)
+
+    testStore.addFriend(user1, user2)
+
+    timeout := 500 * time.Millisecond
+    sendWait := 100 * time.Millisecond
+
+    log.Println("** Testing live messages are streamed")
+
+    server := newWebSocketTestServer(user1, 0)
+    conn := dialWebSocketTestServer(t, server)
+
+    if _, ok := readWebSocketEvent(conn, timeout); ok {
+        t.Errorf("Shouldn't have received an event before any messages were sent")
+    }
+    // a timed out read breaks the client connection, so reconnect
+    conn.Close()
+    conn = dialWebSocketTestServer(t, server)
+
+    time.Sleep(sendWait)
+    req := SendMessageRequest{
+        Content:        "soz",
+        ContentType:    ContentTypeText,
+    }
+    resp1 := testAPI.sendMessageEndpoint(user2, user1.Id, req)
+    resp2 := testAPI.sendMessageEndpoint(user2, user1.Id, req)
+
+    for _, id := range []int{resp1.Id, resp2.Id} {
+        event, ok := readWebSocketEvent(conn, timeout)
+        if !ok {
+            t.Errorf("Didn't receive message %v in time", id)
+        } else if event.Type != EventTypeMessage || event.Payload.Id != id {
+            t.Errorf("Expected message %v, got %v", id, event)
+        }
+    }
+
+    conn.Close()
+    server.Close()
+
+    log.Println("** Testing catching up from a message ID")
+
+    resp3 := testAPI.sendMessageEndpoint(user2, user1.Id, req)
+
+    server = newWebSocketTestServer(user1, resp1.Id)
+    conn = dialWebSocketTestServer(t, server)
+
+    for _, id := range []int{resp2.Id, resp3.Id} {
+        event, ok := readWebSocketEvent(conn, timeout)
+        if !ok {
+            t.Errorf("Didn't receive message %v in time", id)
+        } else if event.Payload.Id != id {
+            t.Errorf("Expected message %v, got %v", id, event)
+        }
+    }
+
+    log.Println("** Testing messages sent after catching up are streamed")
+
+    resp4 := testAPI.sendMessageEndpoint(user2, user1.Id, req)
+    event, ok := readWebSocketEvent(conn, timeout)
+    if !ok {
+        t.Errorf("Didn't receive message %v in time", resp4.Id)
+    } else if event.Payload.Id != resp4.Id {
+        t.Errorf("Expected message %v, got %v", resp4.Id, event)
+    }
+
+    conn.Close()
+    server.Close()
+}
@@ -5,53 +5,129 @@ import (
     "log"
     "github.com/jinzhu/gorm"
     "os"
+    "path/filepath"
+    "strings"
     "flag" // TW
 )
 
 var printQueries = flag.Bool("printqueries", false, "Print all queries run through the database")
+var testStores = flag.String("stores", "memory,sqlite3,postgres", "Comma separated stores to run the tests against; postgres is skipped unless it's the configured database")
 
+// What the tests use, set up by TestMain
+var testStore Store
+var testAPI *API
+
+// Runs the tests once for each store
 func TestMain(m *testing.M) {
     cfg = setupConfig()
+    cache = newMemoryCache(0, 0, 0)
+
+    result := 0
+    for _, name := range strings.Split(*testStores, ",") {
+        store, ok := openTestStore(name)
+        if !ok {
+            continue
+        }
+
+        log.Printf("Running tests against the %v store\n", name)
+        testStore = store
+        testAPI = newAPI(store)
+        if code := m.Run(); code != 0 {
+            result = code
+        }
+
+        if gs, ok := store.(*gormStore); ok {
+            dropTables(gs.db)
+        }
+        store.close()
+    }
+
+    os.Exit(result)
+}
+
+// Opens the named store with empty tables, or returns false if it can't be
+// tested here
+func openTestStore(name string) (Store, bool) {
+    var connectionString string
+    if cfg.Database.Type == name {
+        connectionString = cfg.Database.TestConnectionString
+    }
+
+    switch name {
+    case "memory":
+        return newMemoryStore(), true
+    case DialectSQLite:
+        if connectionString == "" {
+            connectionString = filepath.Join(os.TempDir(), "wobchat-backend-test.db")
+        }
+    case DialectPostgres:
+        if connectionString == "" {
+            log.Println("Postgres isn't the configured database, or has no testconnectionstring; skipping it")
+            return nil, false
+        }
+    default:
+        log.Fatalf("Unknown store %q\n", name)
+    }
 
     log.Println("Opening DB connection")
-    dbTmp, err := gorm.Open(cfg.Database.Type, cfg.Database.TestConnectionString)
+    store, err := openGormStore(name, connectionString)
     if err != nil {
         log.Println("Failed to open DB connection")
         panic(err)
     }
-    db = dbTmp
-    defer db.Close()
 
     if *printQueries {
-        db.LogMode(true)
+        store.db.LogMode(true)
     }
 
     // drop the tables in case the last test run didn't drop them
-    db.DropTable(&User{})
-    db.DropTable(&UserFriend{})
-    db.DropTable(&Message{})
-    db.DropTable(&FriendRequest{})
+    dropTables(store.db)
 
     log.Println("Creating/migrating tables")
-    db.AutoMigrate(&User{})
-    db.AutoMigrate(&UserFriend{})
-    db.AutoMigrate(&Message{})
-    db.AutoMigrate(&FriendRequest{})
+    if err := store.migrate(); err != nil {
+        log.Println("Failed to migrate tables")
+        panic(err)
+    }
 
-    result := m.Run()
+    return store, true
+}
 
+func dropTables(db *gorm.DB) {
     db.DropTable(&User{})
     db.DropTable(&UserFriend{})
     db.DropTable(&Message{})
     db.DropTable(&FriendRequest{})
-
-    os.Exit(result)
+    db.DropTable(&Group{})
+    db.DropTable(&GroupMember{})
+    db.DropTable(&ReadMarker{})
+    db.DropTable(&Conversation{})
+    db.DropTable(&Session{})
+    db.DropTable(&RevokedToken{})
+    db.DropTable(&UserRevocation{})
+    db.DropTable(&APIKey{})
+    db.DropTable(&SchemaMigration{})
 }
 
 func resetTables() {
     log.Println("Resetting tables")
+    if ms, ok := testStore.(*memoryStore); ok {
+        ms.mu.Lock()
+        ms.clear()
+        ms.mu.Unlock()
+        return
+    }
+
+    db := testStore.(*gormStore).db
     db.Exec("DELETE FROM users;")
     db.Exec("DELETE FROM user_friends;")
     db.Exec("DELETE FROM messages;")
     db.Exec("DELETE FROM friend_requests;")
+    db.Exec("DELETE FROM groups;")
+    db.Exec("DELETE FROM group_members;")
+    db.Exec("DELETE FROM read_markers;")
+    db.Exec("DELETE FROM conversations;")
+    db.Exec("DELETE FROM sessions;")
+    db.Exec("DELETE FROM revoked_tokens;")
+    db.Exec("DELETE FROM user_revocations;")
+    db.Exec("DELETE FROM api_keys;")
 }
\ No newline at end of file